@@ -3,6 +3,9 @@ package iavl
 
 import (
 	"bytes"
+	"fmt"
+	"math"
+	"math/big"
 	mrand "math/rand"
 	"sort"
 	"testing"
@@ -14,26 +17,26 @@ import (
 
 func TestBasic(t *testing.T) {
 	tree := NewMutableTree(db.NewMemDB(), 0)
-	up := tree.Set([]byte("1"), []byte("one"))
+	up, _ := tree.Set([]byte("1"), []byte("one"))
 	if up {
 		t.Error("Did not expect an update (should have been create)")
 	}
-	up = tree.Set([]byte("2"), []byte("two"))
+	up, _ = tree.Set([]byte("2"), []byte("two"))
 	if up {
 		t.Error("Did not expect an update (should have been create)")
 	}
-	up = tree.Set([]byte("2"), []byte("TWO"))
+	up, _ = tree.Set([]byte("2"), []byte("TWO"))
 	if !up {
 		t.Error("Expected an update")
 	}
-	up = tree.Set([]byte("5"), []byte("five"))
+	up, _ = tree.Set([]byte("5"), []byte("five"))
 	if up {
 		t.Error("Did not expect an update (should have been create)")
 	}
 
 	// Test 0x00
 	{
-		idx, val := tree.Get([]byte{0x00})
+		idx, val, _ := tree.Get([]byte{0x00})
 		if val != nil {
 			t.Errorf("Expected no value to exist")
 		}
@@ -47,7 +50,7 @@ func TestBasic(t *testing.T) {
 
 	// Test "1"
 	{
-		idx, val := tree.Get([]byte("1"))
+		idx, val, _ := tree.Get([]byte("1"))
 		if val == nil {
 			t.Errorf("Expected value to exist")
 		}
@@ -61,7 +64,7 @@ func TestBasic(t *testing.T) {
 
 	// Test "2"
 	{
-		idx, val := tree.Get([]byte("2"))
+		idx, val, _ := tree.Get([]byte("2"))
 		if val == nil {
 			t.Errorf("Expected value to exist")
 		}
@@ -75,7 +78,7 @@ func TestBasic(t *testing.T) {
 
 	// Test "4"
 	{
-		idx, val := tree.Get([]byte("4"))
+		idx, val, _ := tree.Get([]byte("4"))
 		if val != nil {
 			t.Errorf("Expected no value to exist")
 		}
@@ -89,7 +92,7 @@ func TestBasic(t *testing.T) {
 
 	// Test "6"
 	{
-		idx, val := tree.Get([]byte("6"))
+		idx, val, _ := tree.Get([]byte("6"))
 		if val != nil {
 			t.Errorf("Expected no value to exist")
 		}
@@ -106,7 +109,7 @@ func TestUnit(t *testing.T) {
 
 	expectHash := func(tree *ImmutableTree, hashCount int64) {
 		// ensure number of new hash calculations is as expected.
-		hash, count := tree.hashWithCount()
+		hash, count := tree.HashWithCount()
 		if count != hashCount {
 			t.Fatalf("Expected %v new hashes, got %v", hashCount, count)
 		}
@@ -116,7 +119,7 @@ func TestUnit(t *testing.T) {
 			return false
 		})
 		// ensure that the new hash after nuking is the same as the old.
-		newHash, _ := tree.hashWithCount()
+		newHash, _ := tree.HashWithCount()
 		if !bytes.Equal(hash, newHash) {
 			t.Fatalf("Expected hash %v but got %v after nuking", hash, newHash)
 		}
@@ -124,7 +127,7 @@ func TestUnit(t *testing.T) {
 
 	expectSet := func(tree *MutableTree, i int, repr string, hashCount int64) {
 		origNode := tree.root
-		updated := tree.Set(i2b(i), []byte{})
+		updated, _ := tree.Set(i2b(i), []byte{})
 		// ensure node was added & structure is as expected.
 		if updated || P(tree.root) != repr {
 			t.Fatalf("Adding %v to %v:\nExpected         %v\nUnexpectedly got %v updated:%v",
@@ -137,7 +140,7 @@ func TestUnit(t *testing.T) {
 
 	expectRemove := func(tree *MutableTree, i int, repr string, hashCount int64) {
 		origNode := tree.root
-		value, removed := tree.Remove(i2b(i))
+		value, removed, _ := tree.Remove(i2b(i))
 		// ensure node was added & structure is as expected.
 		if len(value) != 0 || !removed || P(tree.root) != repr {
 			t.Fatalf("Removing %v from %v:\nExpected         %v\nUnexpectedly got %v value:%v removed:%v",
@@ -185,6 +188,104 @@ func TestUnit(t *testing.T) {
 
 }
 
+func TestGetSafe(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte("key"), []byte("value"))
+	tree.Set([]byte("empty"), []byte{})
+
+	// Modifying the copy leaves the tree as is.
+	value, exists, err := tree.GetSafe([]byte("key"))
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, []byte("value"), value)
+	value[0] = 'X'
+	_, value, _ = tree.Get([]byte("key"))
+	require.Equal(t, []byte("value"), value)
+
+	// Modifying the value returned by Get changes the tree.
+	value[0] = 'X'
+	value, _, err = tree.GetSafe([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("Xalue"), value)
+
+	value, exists, err = tree.GetSafe([]byte("empty"))
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Empty(t, value)
+	value, exists, err = tree.GetSafe([]byte("missing"))
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Nil(t, value)
+}
+
+func TestGetMany(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	values, found, err := tree.GetMany([][]byte{[]byte("key")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil}, values)
+	require.Equal(t, []bool{false}, found)
+
+	for i := 0; i < 200; i += 2 {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 200; i < 300; i += 2 {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	// Unsorted keys, present and absent, with duplicates, in saved and unsaved
+	// nodes.
+	for n := 0; n < 100; n++ {
+		keys := make([][]byte, mrand.Intn(50))
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%03d", mrand.Intn(310)))
+		}
+		values, found, err := tree.GetMany(keys)
+		require.NoError(t, err)
+		require.Len(t, values, len(keys))
+		require.Len(t, found, len(keys))
+		for i, key := range keys {
+			_, value, err := tree.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, value, values[i], "key %s", key)
+			require.Equal(t, value != nil, found[i], "key %s", key)
+		}
+	}
+}
+
+func BenchmarkGetMany(b *testing.B) {
+	tree := NewMutableTree(db.NewMemDB(), 10000)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%06d", i)), randBytes(32))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+
+	// Clusters of 100 adjacent keys.
+	clusters := make([][][]byte, 1000)
+	for c := range clusters {
+		start := mrand.Intn(100000 - 100)
+		for i := 0; i < 100; i++ {
+			clusters[c] = append(clusters[c], []byte(fmt.Sprintf("key-%06d", start+i)))
+		}
+	}
+	b.Run("Get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range clusters[i%len(clusters)] {
+				_, _, err := tree.Get(key)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("GetMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, err := tree.GetMany(clusters[i%len(clusters)])
+			require.NoError(b, err)
+		}
+	})
+}
+
 func TestRemove(t *testing.T) {
 	size := 10000
 	keyLen, dataLen := 16, 40
@@ -230,11 +331,11 @@ func TestIntegration(t *testing.T) {
 	for i := range records {
 		r := randomRecord()
 		records[i] = r
-		updated := tree.Set([]byte(r.key), []byte{})
+		updated, _ := tree.Set([]byte(r.key), []byte{})
 		if updated {
 			t.Error("should have not been updated")
 		}
-		updated = tree.Set([]byte(r.key), []byte(r.value))
+		updated, _ = tree.Set([]byte(r.key), []byte(r.value))
 		if !updated {
 			t.Error("should have been updated")
 		}
@@ -244,31 +345,31 @@ func TestIntegration(t *testing.T) {
 	}
 
 	for _, r := range records {
-		if has := tree.Has([]byte(r.key)); !has {
+		if has, _ := tree.Has([]byte(r.key)); !has {
 			t.Error("Missing key", r.key)
 		}
-		if has := tree.Has([]byte(randstr(12))); has {
+		if has, _ := tree.Has([]byte(randstr(12))); has {
 			t.Error("Table has extra key")
 		}
-		if _, val := tree.Get([]byte(r.key)); string(val) != string(r.value) {
+		if _, val, _ := tree.Get([]byte(r.key)); string(val) != string(r.value) {
 			t.Error("wrong value")
 		}
 	}
 
 	for i, x := range records {
-		if val, removed := tree.Remove([]byte(x.key)); !removed {
+		if val, removed, _ := tree.Remove([]byte(x.key)); !removed {
 			t.Error("Wasn't removed")
 		} else if string(val) != string(x.value) {
 			t.Error("Wrong value")
 		}
 		for _, r := range records[i+1:] {
-			if has := tree.Has([]byte(r.key)); !has {
+			if has, _ := tree.Has([]byte(r.key)); !has {
 				t.Error("Missing key", r.key)
 			}
-			if has := tree.Has([]byte(randstr(12))); has {
+			if has, _ := tree.Has([]byte(randstr(12))); has {
 				t.Error("Table has extra key")
 			}
-			_, val := tree.Get([]byte(r.key))
+			_, val, _ := tree.Get([]byte(r.key))
 			if string(val) != string(r.value) {
 				t.Error("wrong value")
 			}
@@ -307,7 +408,7 @@ func TestIterateRange(t *testing.T) {
 
 	// insert all the data
 	for _, r := range records {
-		updated := tree.Set([]byte(r.key), []byte(r.value))
+		updated, _ := tree.Set([]byte(r.key), []byte(r.value))
 		if updated {
 			t.Error("should have not been updated")
 		}
@@ -363,6 +464,694 @@ func TestIterateRange(t *testing.T) {
 	expectTraverse(t, trav, "low", "good", 2)
 }
 
+func TestIterateRangeBounds(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"b", "c", "d", "e", "f"} {
+		tree.Set([]byte(k), []byte(k))
+	}
+
+	iterate := func(start, end []byte, startInclusive, endInclusive, ascending bool) (keys string) {
+		tree.IterateRangeBounds(start, end, startInclusive, endInclusive, ascending, func(key, _ []byte) bool {
+			keys += string(key)
+			return false
+		})
+		return keys
+	}
+	require.Equal(t, "cde", iterate([]byte("c"), []byte("e"), true, true, true))
+	require.Equal(t, "cd", iterate([]byte("c"), []byte("e"), true, false, true))
+	require.Equal(t, "de", iterate([]byte("c"), []byte("e"), false, true, true))
+	require.Equal(t, "d", iterate([]byte("c"), []byte("e"), false, false, true))
+	require.Equal(t, "edc", iterate([]byte("c"), []byte("e"), true, true, false))
+	require.Equal(t, "dc", iterate([]byte("c"), []byte("e"), true, false, false))
+	require.Equal(t, "ed", iterate([]byte("c"), []byte("e"), false, true, false))
+	require.Equal(t, "d", iterate([]byte("c"), []byte("e"), false, false, false))
+	require.Equal(t, "d", iterate([]byte("d"), []byte("d"), true, true, true))
+	require.Equal(t, "", iterate([]byte("d"), []byte("d"), false, true, true))
+
+	// Compare every combination of bounds, present or not, against filtering
+	// all keys.
+	bounds := [][]byte{nil, []byte("a"), []byte("b"), []byte("bb"), []byte("d"), []byte("f"), []byte("g")}
+	for _, start := range bounds {
+		for _, end := range bounds {
+			for _, startInclusive := range []bool{true, false} {
+				for _, endInclusive := range []bool{true, false} {
+					expected := ""
+					for _, k := range []string{"b", "c", "d", "e", "f"} {
+						key := []byte(k)
+						if start != nil && (bytes.Compare(key, start) < 0 || !startInclusive && bytes.Equal(key, start)) {
+							continue
+						}
+						if end != nil && (bytes.Compare(key, end) > 0 || !endInclusive && bytes.Equal(key, end)) {
+							continue
+						}
+						expected += k
+					}
+					require.Equal(t, expected, iterate(start, end, startInclusive, endInclusive, true),
+						"start %q end %q startInclusive %v endInclusive %v", start, end, startInclusive, endInclusive)
+				}
+			}
+		}
+	}
+}
+
+func TestMinMax(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	_, _, ok, _ := tree.Min()
+	require.False(t, ok)
+	_, _, ok, _ = tree.Max()
+	require.False(t, ok)
+
+	tree.Set([]byte("m"), []byte("1"))
+	key, value, ok, _ := tree.Min()
+	require.True(t, ok)
+	require.Equal(t, "m", string(key))
+	require.Equal(t, "1", string(value))
+	key, value, ok, _ = tree.Max()
+	require.True(t, ok)
+	require.Equal(t, "m", string(key))
+	require.Equal(t, "1", string(value))
+
+	for _, k := range []string{"c", "x", "a", "q", "z", "b"} {
+		tree.Set([]byte(k), []byte("v"+k))
+	}
+	key, value, ok, _ = tree.Min()
+	require.True(t, ok)
+	require.Equal(t, "a", string(key))
+	require.Equal(t, "va", string(value))
+	key, value, ok, _ = tree.Max()
+	require.True(t, ok)
+	require.Equal(t, "z", string(key))
+	require.Equal(t, "vz", string(value))
+
+	tree.Remove([]byte("a"))
+	tree.Remove([]byte("z"))
+	key, _, _, _ = tree.Min()
+	require.Equal(t, "b", string(key))
+	key, _, _, _ = tree.Max()
+	require.Equal(t, "x", string(key))
+}
+
+func TestNextPrev(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	_, _, ok, _ := tree.Next([]byte("a"))
+	require.False(t, ok)
+	_, _, ok, _ = tree.Prev([]byte("a"))
+	require.False(t, ok)
+
+	for _, k := range []string{"b", "d", "f", "h"} {
+		tree.Set([]byte(k), []byte("v"+k))
+	}
+
+	cases := []struct {
+		key, next, prev string
+	}{
+		{"", "b", ""},
+		{"a", "b", ""},
+		{"b", "d", ""},
+		{"c", "d", "b"},
+		{"d", "f", "b"},
+		{"e", "f", "d"},
+		{"h", "", "f"},
+		{"i", "", "h"},
+	}
+	for _, c := range cases {
+		k, v, ok, _ := tree.Next([]byte(c.key))
+		require.Equal(t, c.next != "", ok, "next of %q", c.key)
+		require.Equal(t, c.next, string(k), "next of %q", c.key)
+		if ok {
+			require.Equal(t, "v"+c.next, string(v))
+		}
+		k, v, ok, _ = tree.Prev([]byte(c.key))
+		require.Equal(t, c.prev != "", ok, "prev of %q", c.key)
+		require.Equal(t, c.prev, string(k), "prev of %q", c.key)
+		if ok {
+			require.Equal(t, "v"+c.prev, string(v))
+		}
+	}
+
+	// Compare against the sorted keys of a larger tree with gaps.
+	tree = NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 500; i += 2 {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte{})
+	}
+	for i := -1; i <= 500; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		k, _, ok, _ := tree.Next(key)
+		if next := i + 2 - (i+2)%2; next < 500 {
+			require.True(t, ok)
+			require.Equal(t, fmt.Sprintf("key-%03d", next), string(k))
+		} else {
+			require.False(t, ok)
+		}
+		k, _, ok, _ = tree.Prev(key)
+		if prev := i - 1 - (i+1)%2; prev >= 0 {
+			require.True(t, ok)
+			require.Equal(t, fmt.Sprintf("key-%03d", prev), string(k))
+		} else {
+			require.False(t, ok)
+		}
+	}
+}
+
+func TestEmptyValue(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	empty, absent := []byte("key-05a"), []byte("key-05b")
+	updated, err := tree.Set(empty, []byte{})
+	require.NoError(t, err)
+	require.False(t, updated)
+
+	// A key with an empty value is present with a non-nil empty value, both in
+	// the working tree and after a round trip through the database, while an
+	// absent key has a nil value.
+	requireEmpty := func(tree *ImmutableTree) {
+		_, value, err := tree.Get(empty)
+		require.NoError(t, err)
+		require.NotNil(t, value)
+		require.Empty(t, value)
+		has, err := tree.Has(empty)
+		require.NoError(t, err)
+		require.True(t, has)
+		value, exists, err := tree.GetSafe(empty)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.NotNil(t, value)
+		require.Empty(t, value)
+
+		_, value, err = tree.Get(absent)
+		require.NoError(t, err)
+		require.Nil(t, value)
+		_, exists, err = tree.GetSafe(absent)
+		require.NoError(t, err)
+		require.False(t, exists)
+
+		// Proofs tell the key with an empty value from an absent one.
+		rootHash := tree.Hash()
+		value, proof, err := tree.GetWithProof(empty)
+		require.NoError(t, err)
+		require.NotNil(t, value)
+		require.NoError(t, proof.Verify(rootHash))
+		require.NoError(t, proof.VerifyItem(empty, []byte{}))
+		require.Error(t, proof.VerifyAbsence(empty))
+		_, existence, err := tree.GetWithExistenceProof(empty)
+		require.NoError(t, err)
+		require.NoError(t, existence.Verify(rootHash))
+		_, err = tree.GetAbsenceProof(empty)
+		require.Error(t, err)
+
+		value, proof, err = tree.GetWithProof(absent)
+		require.NoError(t, err)
+		require.Nil(t, value)
+		require.NoError(t, proof.Verify(rootHash))
+		require.NoError(t, proof.VerifyAbsence(absent))
+		absence, err := tree.GetAbsenceProof(absent)
+		require.NoError(t, err)
+		require.NoError(t, absence.Verify(rootHash, absent))
+		require.Error(t, absence.Verify(rootHash, empty))
+	}
+	requireEmpty(tree.ImmutableTree)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	loaded, err := NewMutableTree(memDB, 0).GetImmutable(version)
+	require.NoError(t, err)
+	requireEmpty(loaded)
+
+	// Removing the key returns its empty value, and makes it absent.
+	value, removed, err := tree.Remove(empty)
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.NotNil(t, value)
+	require.Empty(t, value)
+	_, value, err = tree.Get(empty)
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestClosest(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []byte{10, 20, 40, 80} {
+		tree.Set([]byte{k}, []byte{k, k})
+	}
+
+	cases := []struct {
+		key     []byte
+		closest byte
+	}{
+		{[]byte{20}, 20},       // present
+		{[]byte{25}, 20},       // between, closer to the one before
+		{[]byte{35}, 40},       // between, closer to the one after
+		{[]byte{30}, 20},       // a tie, the smaller
+		{[]byte{20, 0xff}, 20}, // longer keys are padded
+		{[]byte{29, 0xff}, 20},
+		{[]byte{30, 0x01}, 40},
+		{[]byte{}, 10},    // below the smallest
+		{[]byte{0}, 10},   // below the smallest
+		{[]byte{200}, 80}, // above the largest
+	}
+	for _, c := range cases {
+		k, v, ok, err := tree.Closest(c.key, nil)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte{c.closest}, k, "closest to %X", c.key)
+		require.Equal(t, []byte{c.closest, c.closest}, v)
+	}
+
+	// A custom distance, by which all keys are as close, gives the key before
+	// the target if there is one.
+	same := func(a, b []byte) *big.Int { return big.NewInt(1) }
+	k, _, _, err := tree.Closest([]byte{39}, same)
+	require.NoError(t, err)
+	require.Equal(t, []byte{20}, k)
+	k, _, _, err = tree.Closest([]byte{5}, same)
+	require.NoError(t, err)
+	require.Equal(t, []byte{10}, k)
+
+	// Compare against a scan of a larger tree.
+	tree = NewMutableTree(db.NewMemDB(), 0)
+	var keys [][]byte
+	for i := 0; i < 200; i++ {
+		key := randBytes(2)
+		if updated, _ := tree.Set(key, key); !updated {
+			keys = append(keys, key)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		target := randBytes(2)
+		var want []byte
+		for _, key := range keys {
+			d, best := LexicographicDistance(key, target), LexicographicDistance(want, target)
+			if want == nil || d.Cmp(best) < 0 || (d.Cmp(best) == 0 && bytes.Compare(key, want) < 0) {
+				want = key
+			}
+		}
+		k, _, ok, err := tree.Closest(target, nil)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, want, k, "closest to %X", target)
+	}
+}
+
+func TestEstimateMemory(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.Zero(t, tree.EstimateMemory())
+
+	// 1000 keys of 10 bytes with values of 100 bytes, in 1999 unsaved nodes.
+	// Inner nodes hold a key too, and their children's hashes once hashed.
+	const n = 1000
+	for i := 0; i < n; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%06d", i)), make([]byte, 100))
+	}
+	data := int64((2*n-1)*10 + n*100)
+	structs := (2*n - 1) * nodeStructSize
+	require.Equal(t, data+structs, tree.EstimateMemory())
+	tree.WorkingHash()
+	hashes := int64((2*n-1)*32 + (n-1)*2*32)
+	require.Equal(t, data+structs+hashes, tree.EstimateMemory())
+
+	// Saving releases the children of the saved nodes, which are loaded
+	// again on demand, so the tree only holds its root, as a loaded one.
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, tree.root.estimateMemory(), tree.EstimateMemory())
+	require.True(t, tree.EstimateMemory() < nodeStructSize+200, "estimate %d", tree.EstimateMemory())
+	for i := 0; i < n; i += 99 {
+		_, value, err := tree.Get([]byte(fmt.Sprintf("key-%06d", i)))
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, 100), value)
+	}
+	require.Equal(t, tree.root.estimateMemory(), tree.EstimateMemory())
+	loaded, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	require.Equal(t, loaded.root.estimateMemory(), loaded.EstimateMemory())
+	require.True(t, loaded.EstimateMemory() < nodeStructSize+200, "estimate %d", loaded.EstimateMemory())
+}
+
+func TestFirstLastInRange(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var keys []string
+	for i := 0; i < 200; i += 2 {
+		key := fmt.Sprintf("key-%03d", i)
+		tree.Set([]byte(key), []byte("v"+key))
+		keys = append(keys, key)
+	}
+
+	// The bounds are either nil or keys around the stored ones, some of which
+	// are stored themselves.
+	bound := func() []byte {
+		if mrand.Intn(10) == 0 {
+			return nil
+		}
+		return []byte(fmt.Sprintf("key-%03d", mrand.Intn(210)-5))
+	}
+	inRange := func(key string, start, end []byte) bool {
+		return (start == nil || key >= string(start)) && (end == nil || key < string(end))
+	}
+	for i := 0; i < 2000; i++ {
+		start, end := bound(), bound()
+		var first, last string
+		for _, key := range keys {
+			if inRange(key, start, end) {
+				if first == "" {
+					first = key
+				}
+				last = key
+			}
+		}
+
+		k, v, ok, err := tree.FirstInRange(start, end)
+		require.NoError(t, err)
+		require.Equal(t, first != "", ok, "first in [%s, %s)", start, end)
+		require.Equal(t, first, string(k), "first in [%s, %s)", start, end)
+		if ok {
+			require.Equal(t, "v"+first, string(v))
+		}
+		k, v, ok, err = tree.LastInRange(start, end)
+		require.NoError(t, err)
+		require.Equal(t, last != "", ok, "last in [%s, %s)", start, end)
+		require.Equal(t, last, string(k), "last in [%s, %s)", start, end)
+		if ok {
+			require.Equal(t, "v"+last, string(v))
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	stats := func() TreeStats {
+		stats, err := tree.Stats()
+		require.NoError(t, err)
+		return stats
+	}
+	require.Equal(t, TreeStats{}, stats())
+
+	tree.Set([]byte("a"), []byte("1"))
+	require.Equal(t, TreeStats{Nodes: 1, Leaves: 1}, stats())
+
+	// A full tree of 8 leaves.
+	for _, k := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		tree.Set([]byte(k), []byte(k))
+	}
+	expected := TreeStats{Nodes: 15, Leaves: 8, MaxDepth: 3, AvgLeafDepth: 3}
+	require.Equal(t, expected, stats())
+	require.EqualValues(t, 8, tree.Size())
+	require.EqualValues(t, 3, tree.Height())
+
+	// The same once saved and reloaded, with the nodes loaded from the
+	// database.
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree = NewMutableTree(memDB, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected, stats())
+
+	tree.Set([]byte("i"), []byte("i"))
+	require.Equal(t, TreeStats{Nodes: 17, Leaves: 9, MaxDepth: 4, AvgLeafDepth: float64(3*7+4*2) / 9}, stats())
+	require.Equal(t, int(tree.Height()), stats().MaxDepth)
+}
+
+func TestBalanceReport(t *testing.T) {
+	report := func(tree *MutableTree) BalanceReport {
+		report, err := tree.BalanceReport()
+		require.NoError(t, err)
+		var nodes int64
+		for _, count := range report.Heights {
+			nodes += count
+		}
+		require.EqualValues(t, 2*tree.Size()-1, nodes)
+		require.EqualValues(t, tree.Size()-1, report.Balances[0]+report.Balances[1]+report.Balances[2])
+		require.Len(t, report.Heights, int(tree.Height())+1)
+		return report
+	}
+
+	// A bulk-loaded tree of 2^n keys is perfectly balanced.
+	kvs := make([]KVPair, 1024)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte{}}
+	}
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, tree.InitFromSorted(kvs))
+	balanced := report(tree)
+	require.Equal(t, [3]int64{0, 1023, 0}, balanced.Balances)
+	for height, count := range balanced.Heights {
+		require.EqualValues(t, 1024>>uint(height), count)
+	}
+
+	// Keys inserted in order, or in reverse, still keep every node within one
+	// of being balanced, which BalanceReport would report as an error.
+	for _, reverse := range []bool{false, true} {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		for i := range kvs {
+			if reverse {
+				i = len(kvs) - 1 - i
+			}
+			tree.Set(kvs[i].Key, kvs[i].Value)
+		}
+		sequential := report(tree)
+		t.Logf("reverse %v: balances %v, heights %v", reverse, sequential.Balances, sequential.Heights)
+		require.True(t, int(tree.Height()) <= int(1.44*math.Log2(float64(len(kvs)+2))))
+	}
+}
+
+func TestTraverseNodes(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-50"), []byte("value"))
+
+	var nodes, leaves int64
+	var keys [][]byte
+	stopped, err := tree.TraverseNodes(func(node *Node, depth int) bool {
+		if depth == 0 {
+			require.Equal(t, tree.WorkingHash(), node.Hash())
+			require.Equal(t, tree.Size(), node.Size())
+		}
+		nodes++
+		require.NotNil(t, node.Hash())
+		require.True(t, depth+int(node.Height()) <= int(tree.Height()))
+		if node.IsLeaf() {
+			leaves++
+			keys = append(keys, node.Key())
+			require.EqualValues(t, 1, node.Size())
+			require.Zero(t, node.Height())
+		} else {
+			require.True(t, node.Size() >= 2)
+			require.True(t, node.Height() > 0)
+		}
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, tree.Size(), leaves)
+	require.Equal(t, 2*leaves-1, nodes)
+	require.True(t, sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 }))
+
+	stats, err := tree.Stats()
+	require.NoError(t, err)
+	require.Equal(t, stats.Nodes, nodes)
+
+	// Returning true stops the traversal.
+	visited := 0
+	stopped, err = tree.TraverseNodes(func(node *Node, depth int) bool {
+		visited++
+		return depth == 2
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, visited)
+}
+
+func TestNodesAtVersion(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	const versions = 5
+	for v := 1; v <= versions+1; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%02d", mrand.Intn(50))), []byte(fmt.Sprintf("value-%d", v)))
+			tree.Remove([]byte(fmt.Sprintf("key-%02d", mrand.Intn(50))))
+		}
+		if v <= versions {
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	// The nodes each version introduced, as stored in the database.
+	stored := make(map[int64]map[string]bool)
+	for _, node := range tree.ndb.nodes() {
+		if stored[node.version] == nil {
+			stored[node.version] = make(map[string]bool)
+		}
+		stored[node.version][string(node.hash)] = true
+	}
+
+	// The nodes of the tree of each version, and of the working tree, are
+	// partitioned by the version which introduced them.
+	trees := []*ImmutableTree{tree.ImmutableTree}
+	for v := int64(1); v <= versions; v++ {
+		saved, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		trees = append(trees, saved)
+	}
+	for _, tr := range trees {
+		all := make(map[string]bool)
+		_, err := tr.TraverseNodes(func(node *Node, depth int) bool {
+			all[string(node.hash)] = true
+			return false
+		})
+		require.NoError(t, err)
+
+		partition := make(map[string]bool)
+		latest := tr.Version()
+		if tr == tree.ImmutableTree {
+			latest++
+		}
+		for v := int64(1); v <= latest; v++ {
+			hashes, err := tr.NodesAtVersion(v)
+			require.NoError(t, err)
+			for _, hash := range hashes {
+				require.False(t, partition[string(hash)], "node %X at several versions", hash)
+				partition[string(hash)] = true
+				require.True(t, all[string(hash)])
+			}
+			if v == latest && tr != tree.ImmutableTree {
+				// The nodes of a version all are in its tree.
+				require.Len(t, hashes, len(stored[v]))
+				for _, hash := range hashes {
+					require.True(t, stored[v][string(hash)])
+				}
+			}
+		}
+		require.Equal(t, all, partition)
+
+		hashes, err := tr.NodesAtVersion(latest + 1)
+		require.NoError(t, err)
+		require.Empty(t, hashes)
+	}
+}
+
+func TestCountInRange(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	count := func(start, end []byte) int64 {
+		count, err := tree.CountInRange(start, end)
+		require.NoError(t, err)
+		return count
+	}
+	require.EqualValues(t, 0, count(nil, nil))
+
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 50; j++ {
+			tree.Set(randBytes(1+mrand.Intn(2)), []byte{})
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		for k := 0; k < 50; k++ {
+			var start, end []byte
+			if k%5 != 0 {
+				start = randBytes(1 + mrand.Intn(2))
+			}
+			if k%7 != 0 {
+				end = randBytes(1 + mrand.Intn(2))
+			}
+			expected := 0
+			tree.IterateRange(start, end, true, func(key, value []byte) bool {
+				expected++
+				return false
+			})
+			require.EqualValues(t, expected, count(start, end), "start %X end %X", start, end)
+		}
+	}
+	require.Equal(t, tree.Size(), count(nil, nil))
+}
+
+func TestGetByIndexRange(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	keys, values, _ := tree.GetByIndexRange(0, 10)
+	require.Nil(t, keys)
+	require.Nil(t, values)
+
+	for i := 0; i < 100; i++ {
+		tree.Set(randBytes(4), randBytes(4))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set(randBytes(4), randBytes(4))
+	}
+	size := tree.Size()
+
+	for _, r := range [][2]int64{{0, size}, {0, 1}, {10, 50}, {size - 1, size}, {size - 5, size + 5}, {37, 38}} {
+		keys, values, _ := tree.GetByIndexRange(r[0], r[1])
+		expected := r[1] - r[0]
+		if r[1] > size {
+			expected = size - r[0]
+		}
+		require.Len(t, keys, int(expected))
+		require.Len(t, values, int(expected))
+		for i := range keys {
+			key, value, _ := tree.GetByIndex(r[0] + int64(i))
+			require.Equal(t, key, keys[i])
+			require.Equal(t, value, values[i])
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 5}, {5, 5}, {6, 5}, {size, size + 1}} {
+		keys, values, _ := tree.GetByIndexRange(r[0], r[1])
+		require.Nil(t, keys)
+		require.Nil(t, values)
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	keys, values, err := tree.Head(5)
+	require.NoError(t, err)
+	require.Nil(t, keys)
+	require.Nil(t, values)
+
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i * 10)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 10; i < 20; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i * 10)})
+	}
+
+	for _, n := range []int{-1, 0, 1, 7, 20, 25} {
+		expected := n
+		if expected < 0 {
+			expected = 0
+		} else if expected > 20 {
+			expected = 20
+		}
+		keys, values, err := tree.Head(n)
+		require.NoError(t, err)
+		require.Len(t, keys, expected, "n %d", n)
+		require.Len(t, values, expected, "n %d", n)
+		for i := range keys {
+			require.Equal(t, []byte{byte(i)}, keys[i])
+			require.Equal(t, []byte{byte(i * 10)}, values[i])
+		}
+
+		keys, values, err = tree.Tail(n)
+		require.NoError(t, err)
+		require.Len(t, keys, expected, "n %d", n)
+		require.Len(t, values, expected, "n %d", n)
+		for i := range keys {
+			require.Equal(t, []byte{byte(19 - i)}, keys[i])
+			require.Equal(t, []byte{byte((19 - i) * 10)}, values[i])
+		}
+	}
+}
+
 func TestPersistence(t *testing.T) {
 	db := db.NewMemDB()
 
@@ -383,7 +1172,7 @@ func TestPersistence(t *testing.T) {
 	t2 := NewMutableTree(db, 0)
 	t2.Load()
 	for key, value := range records {
-		_, t2value := t2.Get([]byte(key))
+		_, t2value, _ := t2.Get([]byte(key))
 		if string(t2value) != value {
 			t.Fatalf("Invalid value. Expected %v, got %v", value, t2value)
 		}
@@ -465,3 +1254,833 @@ func TestTreeProof(t *testing.T) {
 		}
 	}
 }
+
+func TestIterateReverseFrom(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var all []string
+	for i := 0; i < 97; i++ {
+		key := fmt.Sprintf("key-%03d", 2*i)
+		tree.Set([]byte(key), []byte("v"+key))
+		all = append([]string{key}, all...)
+	}
+
+	// Start from a missing key, or from an existing one.
+	for start, want := range map[string][]string{
+		"key-101": all[46:],
+		"key-100": all[46:],
+		"key-099": all[47:],
+		"key-000": all[96:],
+		"key":     nil,
+	} {
+		var got []string
+		_, err := tree.IterateReverseFrom([]byte(start), true, func(key, value []byte) bool {
+			got = append(got, string(key))
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, want, got, "start %s", start)
+	}
+
+	// Consecutive pages seeded with the last key of the previous page give
+	// all keys, without gaps or repeats.
+	for _, pageSize := range []int{1, 7, 10, 97, 100} {
+		var got []string
+		var start []byte
+		for page := 0; ; page++ {
+			require.True(t, page <= len(all), "too many pages")
+			var keys []string
+			_, err := tree.IterateReverseFrom(start, false, func(key, value []byte) bool {
+				require.Equal(t, "v"+string(key), string(value))
+				keys = append(keys, string(key))
+				return len(keys) == pageSize
+			})
+			require.NoError(t, err)
+			if len(keys) == 0 {
+				break
+			}
+			got = append(got, keys...)
+			start = []byte(keys[len(keys)-1])
+		}
+		require.Equal(t, all, got, "page size %d", pageSize)
+	}
+}
+
+func TestIteratePrefix(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var keys [][]byte
+	for _, a := range []byte{0x00, 0x01, 0x7f, 0xfe, 0xff} {
+		for _, b := range []byte{0x00, 0x01, 0xfe, 0xff} {
+			keys = append(keys, []byte{a}, []byte{a, b}, []byte{a, b, 0x10})
+		}
+	}
+	for _, key := range keys {
+		tree.Set(key, append([]byte("v"), key...))
+	}
+
+	prefixes := [][]byte{
+		nil, {}, {0x00}, {0x01}, {0x7f}, {0xfe}, {0xff},
+		{0x01, 0xff}, {0xff, 0xff}, {0xff, 0xff, 0x10}, {0x7f, 0x00}, {0x02},
+	}
+	for _, prefix := range prefixes {
+		var want [][]byte
+		tree.Iterate(func(key, value []byte) bool {
+			if bytes.HasPrefix(key, prefix) {
+				want = append(want, key)
+			}
+			return false
+		})
+
+		var got [][]byte
+		stopped, err := tree.IteratePrefix(prefix, func(key, value []byte) bool {
+			require.Equal(t, append([]byte("v"), key...), value)
+			got = append(got, key)
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		require.Equal(t, want, got, "prefix %X", prefix)
+	}
+
+	// Stopping early.
+	var count int
+	stopped, err := tree.IteratePrefix([]byte{0xff}, func(key, value []byte) bool {
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestGetWithVersion(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	check := func(key string, value string, version int64) {
+		actual, actualVersion, exists, err := tree.GetWithVersion([]byte(key))
+		require.NoError(t, err)
+		if value == "" {
+			require.False(t, exists, key)
+			require.Nil(t, actual)
+			require.Zero(t, actualVersion)
+			return
+		}
+		require.True(t, exists, key)
+		require.Equal(t, value, string(actual), key)
+		require.Equal(t, version, actualVersion, key)
+	}
+
+	tree.Set([]byte("a"), []byte("a1"))
+	tree.Set([]byte("b"), []byte("b1"))
+	tree.Set([]byte("c"), []byte("c1"))
+	check("a", "a1", 1) // Unsaved values have the version they will be saved as.
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("b"), []byte("b2"))
+	tree.Set([]byte("d"), []byte("d2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("c"), []byte("c1")) // Setting the same value writes it again.
+	tree.Remove([]byte("d"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	check("a", "a1", 1)
+	check("b", "b2", 2)
+	check("c", "c1", 4)
+	check("d", "", 0)
+	check("0", "", 0)
+
+	// Saved versions report the versions of their own leaves.
+	saved, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	value, version, exists, err := saved.GetWithVersion([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, "c1", string(value))
+	require.EqualValues(t, 1, version)
+}
+
+func TestForEachChangedSince(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	lastSet := map[string]int64{}
+	const versions = 6
+	for v := int64(1); v <= versions; v++ {
+		for i := 0; i < 20*int(v); i++ {
+			key := fmt.Sprintf("key-%03d", mrand.Intn(300))
+			if mrand.Intn(4) == 0 {
+				tree.Remove([]byte(key))
+				delete(lastSet, key)
+			} else {
+				tree.Set([]byte(key), []byte(fmt.Sprintf("value-%d", v)))
+				lastSet[key] = v
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	tree = NewMutableTree(memDB, 0)
+	_, err := tree.Load()
+	require.NoError(t, err)
+	for base := int64(0); base <= versions; base++ {
+		var expected []string
+		for key, v := range lastSet {
+			if v > base {
+				expected = append(expected, key)
+			}
+		}
+		sort.Strings(expected)
+
+		_, before := tree.NodeCacheStats()
+		var keys []string
+		stopped, err := tree.ForEachChangedSince(base, func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			require.Equal(t, fmt.Sprintf("value-%d", lastSet[string(key)]), string(value))
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		require.Equal(t, expected, keys, "since %d", base)
+
+		// Unchanged subtrees aren't read.
+		_, after := tree.NodeCacheStats()
+		if base > 0 && base < versions {
+			require.True(t, after-before < int64(2*tree.Size()-1), "since %d", base)
+		}
+	}
+
+	// Returning true stops.
+	count := 0
+	stopped, err := tree.ForEachChangedSince(0, func(key, value []byte) bool {
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestIterateVersionRange(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	lastSet := map[string]int64{}
+	const versions = 6
+	for v := int64(1); v <= versions; v++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key-%03d", mrand.Intn(100))
+			if mrand.Intn(4) == 0 {
+				tree.Remove([]byte(key))
+				delete(lastSet, key)
+			} else {
+				tree.Set([]byte(key), []byte(fmt.Sprintf("value-%d", v)))
+				lastSet[key] = v
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	for lo := int64(0); lo <= versions+1; lo++ {
+		for hi := lo - 1; hi <= versions+1; hi++ {
+			var expected []string
+			for key, v := range lastSet {
+				if v >= lo && v <= hi {
+					expected = append(expected, key)
+				}
+			}
+			sort.Strings(expected)
+
+			var keys []string
+			stopped, err := tree.IterateVersionRange(lo, hi, func(key, value []byte, version int64) bool {
+				keys = append(keys, string(key))
+				require.Equal(t, lastSet[string(key)], version)
+				require.Equal(t, fmt.Sprintf("value-%d", version), string(value))
+				return false
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+			require.Equal(t, expected, keys, "[%d, %d]", lo, hi)
+		}
+	}
+
+	// Returning true stops.
+	count := 0
+	stopped, err := tree.IterateVersionRange(2, 4, func(key, value []byte, version int64) bool {
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestFold(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	values := map[string]uint64{}
+	for i := 0; i < 100; i++ {
+		key, n := fmt.Sprintf("key-%03d", mrand.Intn(1000)), mrand.Uint64()%1000
+		tree.Set([]byte(key), []byte(fmt.Sprint(n)))
+		values[key] = n
+	}
+	sum := uint64(0)
+	for _, n := range values {
+		sum += n
+	}
+
+	// The values are summed, in ascending order of keys.
+	var prev []byte
+	result, err := tree.Fold(uint64(0), func(acc interface{}, key, value []byte) (interface{}, bool) {
+		require.True(t, prev == nil || bytes.Compare(prev, key) < 0, "%s after %s", key, prev)
+		prev = key
+		var n uint64
+		_, err := fmt.Sscan(string(value), &n)
+		require.NoError(t, err)
+		return acc.(uint64) + n, false
+	})
+	require.NoError(t, err)
+	require.Equal(t, sum, result)
+
+	// Stopping returns the result so far.
+	result, err = tree.Fold(0, func(acc interface{}, key, value []byte) (interface{}, bool) {
+		return acc.(int) + 1, acc.(int)+1 == 5
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, result)
+}
+
+func TestPage(t *testing.T) {
+	const limit = 7
+	for _, size := range []int{1, limit - 1, limit, limit + 1, 3 * limit, 100} {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		for tree.Size() < int64(size) {
+			tree.Set([]byte(fmt.Sprintf("key-%03d", mrand.Intn(1000))), randBytes(4))
+		}
+		var expected []KVPair
+		tree.Iterate(func(key, value []byte) bool {
+			expected = append(expected, KVPair{Key: key, Value: value})
+			return false
+		})
+
+		// The pages add up to the whole tree, each but the last one full.
+		var all []KVPair
+		var cursor []byte
+		for pages := 1; ; pages++ {
+			kvs, next, done, err := tree.Page(cursor, limit)
+			require.NoError(t, err)
+			require.True(t, len(kvs) <= limit)
+			require.Equal(t, kvs[len(kvs)-1].Key, next)
+			all = append(all, kvs...)
+			if done {
+				require.Equal(t, (size+limit-1)/limit, pages, "size %d", size)
+				break
+			}
+			require.Len(t, kvs, limit)
+			cursor = next
+		}
+		require.Equal(t, expected, all, "size %d", size)
+	}
+
+	// A cursor needn't be a key of the tree.
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, key := range []string{"a", "c", "e"} {
+		tree.Set([]byte(key), []byte{})
+	}
+	kvs, next, done, err := tree.Page([]byte("b"), 1)
+	require.NoError(t, err)
+	require.Equal(t, []KVPair{{Key: []byte("c"), Value: []byte{}}}, kvs)
+	require.Equal(t, []byte("c"), next)
+	require.False(t, done)
+	kvs, next, done, err = tree.Page([]byte("e"), 1)
+	require.NoError(t, err)
+	require.Empty(t, kvs)
+	require.Nil(t, next)
+	require.True(t, done)
+	_, _, _, err = tree.Page(nil, 0)
+	require.Error(t, err)
+}
+
+func TestCheckKeyInvariant(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", mrand.Intn(1000))), []byte{})
+	}
+	require.NoError(t, tree.CheckKeyInvariant())
+
+	// An inner node of which the key isn't the leftmost one of its right
+	// subtree is reported, while lookups could still find the key. The nodes
+	// are unsaved, so they can be changed in place.
+	var corrupt *Node
+	_, err := tree.TraverseNodes(func(node *Node, depth int) bool {
+		if depth == 2 && !node.isLeaf() {
+			corrupt = node
+			return true
+		}
+		return false
+	})
+	require.NoError(t, err)
+	original := corrupt.key
+	corrupt.key = append(append([]byte{}, original...), 0)
+	err = tree.CheckKeyInvariant()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("node %X", corrupt.key))
+	require.Contains(t, err.Error(), fmt.Sprintf("leftmost key %X", original))
+	require.Error(t, tree.Validate())
+	corrupt.key = original
+	require.NoError(t, tree.CheckKeyInvariant())
+}
+
+func TestDepth(t *testing.T) {
+	for _, size := range []int{1, 2, 3, 10, 100, 1000} {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		for tree.Size() < int64(size) {
+			tree.Set(randBytes(4), []byte{})
+		}
+		for i := 0; i < size/3; i++ {
+			key, _, _ := tree.GetByIndex(mrand.Int63n(tree.Size()))
+			tree.Remove(key)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		// The depth of a leaf is bounded as in any AVL tree.
+		bound := 1.44 * math.Log2(float64(tree.Size()+2))
+		maxDepth := 0
+		_, err = tree.TraverseNodes(func(node *Node, depth int) bool {
+			if node.IsLeaf() {
+				actual, exists, err := tree.Depth(node.Key())
+				require.NoError(t, err)
+				require.True(t, exists)
+				require.Equal(t, depth, actual)
+				require.True(t, float64(actual) <= bound, "depth %d of %d keys", actual, tree.Size())
+				if actual > maxDepth {
+					maxDepth = actual
+				}
+			}
+			return false
+		})
+		require.NoError(t, err)
+		require.EqualValues(t, tree.Height(), maxDepth)
+
+		// A missing key ends at a leaf next to it.
+		key := randBytes(5)
+		depth, exists, err := tree.Depth(key)
+		require.NoError(t, err)
+		require.False(t, exists)
+		require.True(t, depth <= maxDepth)
+	}
+}
+
+func TestPath(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", 2*i)), []byte{})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// The working tree isn't hashed yet.
+	tree.Set([]byte("key-050"), []byte("new"))
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		hashes, found, err := tree.Path(key)
+		require.NoError(t, err)
+		require.Equal(t, i%2 == 0, found)
+		depth, _, err := tree.Depth(key)
+		require.NoError(t, err)
+		require.Len(t, hashes, depth+1)
+		require.Equal(t, tree.WorkingHash(), hashes[0])
+
+		// Each hash is the one of a child of the node before it, down to
+		// the leaf of the key.
+		_, proof, err := tree.GetWithExistenceProof(key)
+		if found {
+			require.NoError(t, err)
+			leaf := proof.pathWithLeaf().Leaf.Hash()
+			require.Equal(t, leaf, hashes[depth])
+			hash := leaf
+			for j := len(proof.Path) - 1; j >= 0; j-- {
+				hash = proof.Path[j].Hash(hash)
+				require.Equal(t, hash, hashes[j])
+			}
+		}
+	}
+}
+
+func TestHashAtIndex(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", mrand.Intn(1000))), []byte{byte(i)})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// The working tree isn't hashed yet.
+	tree.Set([]byte("key-new"), []byte("new"))
+
+	for i := int64(0); i < tree.Size(); i++ {
+		hash, ok, err := tree.HashAtIndex(i)
+		require.NoError(t, err)
+		require.True(t, ok)
+		key, value, err := tree.GetByIndex(i)
+		require.NoError(t, err)
+		_, proof, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		require.Equal(t, value, []byte(proof.Value))
+		require.Equal(t, proof.pathWithLeaf().Leaf.Hash(), hash, "%d", i)
+	}
+	for _, i := range []int64{-1, tree.Size()} {
+		hash, ok, err := tree.HashAtIndex(i)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Nil(t, hash)
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	// Two trees with the same pairs but different histories and shapes.
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	other := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 200; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		other.Set([]byte(fmt.Sprintf("key-%03d", 199-i)), []byte(fmt.Sprintf("value-%d", 199-i)))
+		other.Set([]byte(fmt.Sprintf("extra-%03d", i)), []byte{})
+	}
+	for i := 0; i < 200; i++ {
+		other.Remove([]byte(fmt.Sprintf("extra-%03d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = other.SaveVersion()
+	require.NoError(t, err)
+
+	ranges := [][2][]byte{
+		{nil, nil},
+		{[]byte("key-050"), []byte("key-150")},
+		{nil, []byte("key-010")},
+		{[]byte("key-1995"), nil},
+		{[]byte("key-100"), []byte("key-100")},
+		{[]byte("z"), nil},
+	}
+	for _, r := range ranges {
+		start, end := r[0], r[1]
+		subtree, err := tree.Subtree(start, end)
+		require.NoError(t, err)
+		require.NoError(t, subtree.Validate())
+
+		var expected, actual []KVPair
+		_, err = tree.IterateRange(start, end, true, func(key, value []byte) bool {
+			expected = append(expected, KVPair{Key: key, Value: value})
+			return false
+		})
+		require.NoError(t, err)
+		_, err = subtree.Iterate(func(key, value []byte) bool {
+			actual = append(actual, KVPair{Key: key, Value: value})
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "[%s, %s)", start, end)
+		require.EqualValues(t, len(expected), subtree.Size())
+
+		// The root hash commits to the range alone.
+		otherSubtree, err := other.Subtree(start, end)
+		require.NoError(t, err)
+		require.Equal(t, subtree.Hash(), otherSubtree.Hash())
+		if len(expected) > 0 {
+			_, proof, err := subtree.GetWithExistenceProof(expected[0].Key)
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(subtree.Hash()))
+		} else {
+			require.Nil(t, subtree.Hash())
+		}
+	}
+
+	// The subtree doesn't change with the tree.
+	subtree, err := tree.Subtree([]byte("key-050"), []byte("key-150"))
+	require.NoError(t, err)
+	hash := subtree.Hash()
+	require.NotEqual(t, tree.Hash(), hash)
+	tree.Set([]byte("key-100"), []byte("changed"))
+	tree.Remove([]byte("key-000"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, hash, subtree.Hash())
+	_, value, err := subtree.Get([]byte("key-100"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-100"), value)
+}
+
+func TestEmptyTree(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	notCalled := func(key, value []byte) bool {
+		t.Errorf("callback called with key %X", key)
+		return false
+	}
+
+	testCases := map[string]func(t *testing.T, tree *ImmutableTree){
+		"Size":   func(t *testing.T, tree *ImmutableTree) { require.Zero(t, tree.Size()) },
+		"Height": func(t *testing.T, tree *ImmutableTree) { require.Zero(t, tree.Height()) },
+		"Hash":   func(t *testing.T, tree *ImmutableTree) { require.Nil(t, tree.Hash()) },
+		"Get": func(t *testing.T, tree *ImmutableTree) {
+			index, value, err := tree.Get([]byte("key"))
+			require.NoError(t, err)
+			require.Zero(t, index)
+			require.Nil(t, value)
+		},
+		"GetSafe": func(t *testing.T, tree *ImmutableTree) {
+			value, exists, err := tree.GetSafe([]byte("key"))
+			require.NoError(t, err)
+			require.False(t, exists)
+			require.Nil(t, value)
+		},
+		"Has": func(t *testing.T, tree *ImmutableTree) {
+			has, err := tree.Has([]byte("key"))
+			require.NoError(t, err)
+			require.False(t, has)
+		},
+		"GetByIndex": func(t *testing.T, tree *ImmutableTree) {
+			key, value, err := tree.GetByIndex(0)
+			require.NoError(t, err)
+			require.Nil(t, key)
+			require.Nil(t, value)
+		},
+		"GetByIndexRange": func(t *testing.T, tree *ImmutableTree) {
+			keys, values, err := tree.GetByIndexRange(0, 10)
+			require.NoError(t, err)
+			require.Empty(t, keys)
+			require.Empty(t, values)
+		},
+		"CountInRange": func(t *testing.T, tree *ImmutableTree) {
+			count, err := tree.CountInRange(nil, nil)
+			require.NoError(t, err)
+			require.Zero(t, count)
+		},
+		"Min": func(t *testing.T, tree *ImmutableTree) {
+			key, value, ok, err := tree.Min()
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.Nil(t, key)
+			require.Nil(t, value)
+		},
+		"Max": func(t *testing.T, tree *ImmutableTree) {
+			key, value, ok, err := tree.Max()
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.Nil(t, key)
+			require.Nil(t, value)
+		},
+		"Next": func(t *testing.T, tree *ImmutableTree) {
+			_, _, ok, err := tree.Next([]byte("key"))
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"Prev": func(t *testing.T, tree *ImmutableTree) {
+			_, _, ok, err := tree.Prev([]byte("key"))
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"Closest": func(t *testing.T, tree *ImmutableTree) {
+			_, _, ok, err := tree.Closest([]byte("key"), nil)
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"FirstInRange": func(t *testing.T, tree *ImmutableTree) {
+			_, _, ok, err := tree.FirstInRange(nil, nil)
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"LastInRange": func(t *testing.T, tree *ImmutableTree) {
+			_, _, ok, err := tree.LastInRange(nil, nil)
+			require.NoError(t, err)
+			require.False(t, ok)
+		},
+		"Iterate": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.Iterate(notCalled)
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"IterateRange": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.IterateRange(nil, nil, true, notCalled)
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"IterateRangeBounds": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.IterateRangeBounds(nil, nil, true, true, false, notCalled)
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"IterateRangeInclusive": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.IterateRangeInclusive(nil, nil, true, func(key, value []byte, version int64) bool {
+				return notCalled(key, value)
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"IteratePrefix": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.IteratePrefix([]byte("k"), notCalled)
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"Iterator": func(t *testing.T, tree *ImmutableTree) {
+			iter := tree.Iterator(nil, nil, true)
+			require.False(t, iter.Valid())
+			require.NoError(t, iter.Error())
+		},
+		"Stats": func(t *testing.T, tree *ImmutableTree) {
+			stats, err := tree.Stats()
+			require.NoError(t, err)
+			require.Zero(t, stats.Nodes)
+			require.Zero(t, stats.Leaves)
+		},
+		"BalanceReport": func(t *testing.T, tree *ImmutableTree) {
+			report, err := tree.BalanceReport()
+			require.NoError(t, err)
+			require.Equal(t, BalanceReport{}, report)
+		},
+		"TraverseNodes": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.TraverseNodes(func(node *Node, depth int) bool {
+				t.Errorf("callback called with node %v", node)
+				return false
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"NodesAtVersion": func(t *testing.T, tree *ImmutableTree) {
+			hashes, err := tree.NodesAtVersion(1)
+			require.NoError(t, err)
+			require.Empty(t, hashes)
+		},
+		"Subtree": func(t *testing.T, tree *ImmutableTree) {
+			subtree, err := tree.Subtree(nil, nil)
+			require.NoError(t, err)
+			require.Zero(t, subtree.Size())
+			require.Nil(t, subtree.Hash())
+		},
+		"GetWithVersion": func(t *testing.T, tree *ImmutableTree) {
+			value, version, exists, err := tree.GetWithVersion([]byte("k"))
+			require.NoError(t, err)
+			require.Nil(t, value)
+			require.Zero(t, version)
+			require.False(t, exists)
+		},
+		"ForEachChangedSince": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.ForEachChangedSince(0, notCalled)
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"Path": func(t *testing.T, tree *ImmutableTree) {
+			hashes, found, err := tree.Path([]byte("k"))
+			require.NoError(t, err)
+			require.Empty(t, hashes)
+			require.False(t, found)
+		},
+		"IterateVersionRange": func(t *testing.T, tree *ImmutableTree) {
+			stopped, err := tree.IterateVersionRange(0, 10, func(key, value []byte, version int64) bool {
+				t.Errorf("callback called with key %X", key)
+				return false
+			})
+			require.NoError(t, err)
+			require.False(t, stopped)
+		},
+		"Fold": func(t *testing.T, tree *ImmutableTree) {
+			result, err := tree.Fold("init", func(acc interface{}, key, value []byte) (interface{}, bool) {
+				return "called", false
+			})
+			require.NoError(t, err)
+			require.Equal(t, "init", result)
+		},
+		"HashAtIndex": func(t *testing.T, tree *ImmutableTree) {
+			hash, ok, err := tree.HashAtIndex(0)
+			require.NoError(t, err)
+			require.False(t, ok)
+			require.Nil(t, hash)
+		},
+		"Page": func(t *testing.T, tree *ImmutableTree) {
+			kvs, next, done, err := tree.Page(nil, 10)
+			require.NoError(t, err)
+			require.Empty(t, kvs)
+			require.Nil(t, next)
+			require.True(t, done)
+		},
+		"CheckKeyInvariant": func(t *testing.T, tree *ImmutableTree) { require.NoError(t, tree.CheckKeyInvariant()) },
+		"Depth": func(t *testing.T, tree *ImmutableTree) {
+			depth, exists, err := tree.Depth([]byte("k"))
+			require.NoError(t, err)
+			require.Zero(t, depth)
+			require.False(t, exists)
+		},
+		"Validate": func(t *testing.T, tree *ImmutableTree) { require.NoError(t, tree.Validate()) },
+		"Diff": func(t *testing.T, tree *ImmutableTree) {
+			added, updated, removed, err := tree.Diff(tree)
+			require.NoError(t, err)
+			require.Empty(t, added)
+			require.Empty(t, updated)
+			require.Empty(t, removed)
+		},
+		"RenderShape": func(t *testing.T, tree *ImmutableTree) {
+			require.NotPanics(t, func() { tree.RenderShape("  ", nil) })
+		},
+		"GetWithProof": func(t *testing.T, tree *ImmutableTree) {
+			value, proof, err := tree.GetWithProof([]byte("key"))
+			require.NoError(t, err)
+			require.Nil(t, value)
+			require.Nil(t, proof)
+		},
+		"GetRangeWithProof": func(t *testing.T, tree *ImmutableTree) {
+			keys, values, proof, err := tree.GetRangeWithProof(nil, nil, 0)
+			require.NoError(t, err)
+			require.Empty(t, keys)
+			require.Empty(t, values)
+			require.Nil(t, proof)
+		},
+		"GetWithExistenceProof": func(t *testing.T, tree *ImmutableTree) {
+			_, _, err := tree.GetWithExistenceProof([]byte("key"))
+			require.Error(t, err)
+		},
+		"GetAbsenceProof": func(t *testing.T, tree *ImmutableTree) {
+			proof, err := tree.GetAbsenceProof([]byte("key"))
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(nil, []byte("key")))
+		},
+		"GetByIndexWithProof": func(t *testing.T, tree *ImmutableTree) {
+			_, _, _, err := tree.GetByIndexWithProof(0)
+			require.Error(t, err)
+		},
+	}
+	check := func(t *testing.T) {
+		for name, tc := range testCases {
+			tc := tc
+			t.Run(name, func(t *testing.T) {
+				require.NotPanics(t, func() { tc(t, tree.ImmutableTree) })
+			})
+		}
+	}
+	t.Run("New", check)
+
+	// Removing a key from an empty tree does nothing.
+	value, removed, err := tree.Remove([]byte("key"))
+	require.NoError(t, err)
+	require.False(t, removed)
+	require.Nil(t, value)
+
+	// Setting a key gives a single leaf, and removing it an empty tree again.
+	_, err = tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, tree.Size())
+	require.Zero(t, tree.Height())
+	value, removed, err = tree.Remove([]byte("key"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, []byte("value"), value)
+	require.True(t, tree.IsEmpty())
+	t.Run("Emptied", check)
+
+	// So does a saved empty version.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	empty, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	tree.ImmutableTree = empty
+	t.Run("Saved", check)
+}
@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"sync/atomic"
+)
+
+// bloomHashes is the number of bits set per key in a bloomFilter. With 10 bits
+// per key, it gives about 1% of false positives.
+const bloomHashes = 4
+
+// bloomFilter is a bloom filter of keys, which tells that a key is definitely
+// not in a set, or that it may be. Keys can be added but not removed. Its bits
+// are set and read atomically, so keys may be added while it is read.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter returns an empty filter of at least the given number of bits.
+func newBloomFilter(bits int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (bits+63)/64)}
+}
+
+// positions calls fn with the bloomHashes bit positions of the key, derived
+// from two halves of its 64-bit FNV-1a hash.
+func (f *bloomFilter) positions(key []byte, fn func(word int, mask uint64) bool) bool {
+	h := uint64(14695981039346656037)
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	h1, h2 := h&0xffffffff, h>>32|1
+	n := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		pos := (h1 + i*h2) % n
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+// add adds the key to the filter.
+func (f *bloomFilter) add(key []byte) {
+	f.positions(key, func(word int, mask uint64) bool {
+		for {
+			old := atomic.LoadUint64(&f.bits[word])
+			if old&mask != 0 || atomic.CompareAndSwapUint64(&f.bits[word], old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+// mayContain returns false if the key was definitely never added.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	return f.positions(key, func(word int, mask uint64) bool {
+		return atomic.LoadUint64(&f.bits[word])&mask != 0
+	})
+}
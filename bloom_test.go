@@ -0,0 +1,121 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestBloomFilter(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{BloomFilterBits: 10 * 1000}
+	tree := NewMutableTreeWithOpts(memDB, 0, opts)
+	expected := NewMutableTree(db.NewMemDB(), 0)
+	r := rand.New(rand.NewSource(1))
+	check := func(tree *MutableTree) {
+		for i := 0; i < 2000; i++ {
+			key := []byte(fmt.Sprintf("key-%04d", i))
+			has, err := tree.Has(key)
+			require.NoError(t, err)
+			expectedHas, err := expected.Has(key)
+			require.NoError(t, err)
+			require.Equal(t, expectedHas, has, "%s", key)
+			value, exists, err := tree.GetSafe(key)
+			require.NoError(t, err)
+			require.Equal(t, has, exists)
+			_, expectedValue, err := expected.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value)
+		}
+	}
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 1000; i++ {
+			key := []byte(fmt.Sprintf("key-%04d", r.Intn(2000)))
+			if r.Intn(3) == 0 {
+				tree.Remove(key)
+				expected.Remove(key)
+			} else {
+				tree.Set(key, []byte{byte(v)})
+				expected.Set(key, []byte{byte(v)})
+			}
+		}
+		check(tree)
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = expected.SaveVersion()
+		require.NoError(t, err)
+	}
+	check(tree)
+
+	// Batches of pairs are added to the filter too.
+	kvs := []KVPair{{Key: []byte("batch-1"), Value: []byte{}}, {Key: []byte("batch-2"), Value: []byte{}}}
+	require.NoError(t, tree.BatchSet(kvs))
+	require.NoError(t, expected.BatchSet(kvs))
+	check(tree)
+	for _, kv := range kvs {
+		has, err := tree.Has(kv.Key)
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	tree.Rollback()
+	expected.Rollback()
+	check(tree)
+
+	// The filter is rebuilt on load, and most missing keys don't read the tree.
+	for _, bits := range []int{0, 10 * 1000} {
+		loaded := NewMutableTreeWithOpts(memDB, 0, &Options{BloomFilterBits: bits})
+		_, err := loaded.Load()
+		require.NoError(t, err)
+		check(loaded)
+
+		_, before := loaded.NodeCacheStats()
+		for i := 0; i < 1000; i++ {
+			has, err := loaded.Has([]byte(fmt.Sprintf("missing-%d", i)))
+			require.NoError(t, err)
+			require.False(t, has)
+		}
+		_, after := loaded.NodeCacheStats()
+		reads := after - before
+		t.Logf("%d bits: %d nodes read by 1000 lookups of missing keys", bits, reads)
+		if bits == 0 {
+			require.True(t, reads > 1000)
+		} else {
+			require.True(t, reads < 500)
+		}
+	}
+}
+
+// BenchmarkBloomFilter looks up missing keys in a tree loaded from the
+// database, with and without a bloom filter.
+func BenchmarkBloomFilter(b *testing.B) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%08d", i)), []byte{})
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		b.Fatal(err)
+	}
+	missing := make([][]byte, 1000)
+	for i := range missing {
+		missing[i] = []byte(fmt.Sprintf("missing-%08d", i))
+	}
+
+	for _, bits := range []int{0, 10 * 100000} {
+		b.Run(fmt.Sprintf("bits-%d", bits), func(b *testing.B) {
+			tree := NewMutableTreeWithOpts(memDB, 10000, &Options{BloomFilterBits: bits})
+			if _, err := tree.Load(); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if has, _ := tree.Has(missing[i%len(missing)]); has {
+					b.Fatal("missing key found")
+				}
+			}
+		})
+	}
+}
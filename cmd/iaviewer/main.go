@@ -104,12 +104,15 @@ func ReadTree(dir string, version int) (*iavl.MutableTree, error) {
 
 func PrintKeys(tree *iavl.MutableTree) {
 	fmt.Println("Printing all keys with hashed values (to detect diff)")
-	tree.Iterate(func(key []byte, value []byte) bool {
+	_, err := tree.Iterate(func(key []byte, value []byte) bool {
 		printKey := parseWeaveKey(key)
 		digest := sha256.Sum256(value)
 		fmt.Printf("  %s\n    %X\n", printKey, digest)
 		return false
 	})
+	if err != nil {
+		fmt.Printf("Error iterating keys: %v\n", err)
+	}
 }
 
 // parseWeaveKey assumes a separating : where all in front should be ascii,
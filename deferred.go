@@ -0,0 +1,257 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// deferredDB is a database whose writes are kept in memory, over the database
+// they are later committed to in a single batch, see MutableTree.DeferCommits.
+// Its reads see the writes, so the versions saved and deleted while commits
+// are deferred read each other's roots, orphans and nodes.
+type deferredDB struct {
+	dbm.DB
+	mtx    sync.RWMutex
+	writes map[string][]byte // Pending sets, and deletes as nil values.
+}
+
+var _ dbm.DB = (*deferredDB)(nil)
+
+func newDeferredDB(db dbm.DB) *deferredDB {
+	return &deferredDB{DB: db, writes: map[string][]byte{}}
+}
+
+func (d *deferredDB) Get(key []byte) []byte {
+	d.mtx.RLock()
+	value, ok := d.writes[string(key)]
+	d.mtx.RUnlock()
+	if ok {
+		return value
+	}
+	return d.DB.Get(key)
+}
+
+func (d *deferredDB) Has(key []byte) bool {
+	d.mtx.RLock()
+	value, ok := d.writes[string(key)]
+	d.mtx.RUnlock()
+	if ok {
+		return value != nil
+	}
+	return d.DB.Has(key)
+}
+
+func (d *deferredDB) Set(key, value []byte) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.writes[string(key)] = append([]byte{}, value...) // Never nil.
+}
+
+func (d *deferredDB) SetSync(key, value []byte) {
+	d.Set(key, value)
+}
+
+func (d *deferredDB) Delete(key []byte) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.writes[string(key)] = nil
+}
+
+func (d *deferredDB) DeleteSync(key []byte) {
+	d.Delete(key)
+}
+
+func (d *deferredDB) NewBatch() dbm.Batch {
+	return &deferredBatch{db: d}
+}
+
+func (d *deferredDB) Iterator(start, end []byte) dbm.Iterator {
+	return newDeferredIterator(d.DB.Iterator(start, end), d.pending(start, end, false), false)
+}
+
+func (d *deferredDB) ReverseIterator(start, end []byte) dbm.Iterator {
+	return newDeferredIterator(d.DB.ReverseIterator(start, end), d.pending(start, end, true), true)
+}
+
+// pending returns the pending writes in the domain, in iteration order.
+func (d *deferredDB) pending(start, end []byte, reverse bool) []KVPair {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	var kvs []KVPair
+	for key, value := range d.writes {
+		if dbm.IsKeyInDomain([]byte(key), start, end) {
+			kvs = append(kvs, KVPair{Key: []byte(key), Value: value})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return (bytes.Compare(kvs[i].Key, kvs[j].Key) < 0) != reverse
+	})
+	return kvs
+}
+
+// flush writes the pending writes to the batch, in the order of their keys.
+func (d *deferredDB) flush(batch dbm.SetDeleter) {
+	for _, kv := range d.pending(nil, nil, false) {
+		if kv.Value == nil {
+			batch.Delete(kv.Key)
+		} else {
+			batch.Set(kv.Key, kv.Value)
+		}
+	}
+}
+
+// deferredBatch is a batch of a deferredDB, written to its pending writes.
+type deferredBatch struct {
+	db  *deferredDB
+	ops []KVPair // Sets, and deletes as nil values.
+}
+
+func (b *deferredBatch) Set(key, value []byte) {
+	b.ops = append(b.ops, KVPair{Key: key, Value: append([]byte{}, value...)})
+}
+
+func (b *deferredBatch) Delete(key []byte) {
+	b.ops = append(b.ops, KVPair{Key: key})
+}
+
+func (b *deferredBatch) Write() {
+	b.db.mtx.Lock()
+	defer b.db.mtx.Unlock()
+	for _, op := range b.ops {
+		b.db.writes[string(op.Key)] = op.Value
+	}
+}
+
+func (b *deferredBatch) WriteSync() {
+	b.Write()
+}
+
+func (b *deferredBatch) Close() {
+	b.ops = nil
+}
+
+// deferredIterator merges the pending writes of a domain into an iterator of
+// the underlying database over it. A pending write replaces the key in the
+// database, and a pending delete hides it.
+type deferredIterator struct {
+	source     dbm.Iterator
+	pending    []KVPair
+	reverse    bool
+	key, value []byte
+	valid      bool
+}
+
+func newDeferredIterator(source dbm.Iterator, pending []KVPair, reverse bool) *deferredIterator {
+	itr := &deferredIterator{source: source, pending: pending, reverse: reverse}
+	itr.Next()
+	return itr
+}
+
+func (itr *deferredIterator) Domain() ([]byte, []byte) {
+	return itr.source.Domain()
+}
+
+func (itr *deferredIterator) Valid() bool {
+	return itr.valid
+}
+
+// Next moves to the next key of either the database or the pending writes,
+// skipping the deleted ones. It is also used to find the first key.
+func (itr *deferredIterator) Next() {
+	for {
+		if !itr.source.Valid() && len(itr.pending) == 0 {
+			itr.key, itr.value, itr.valid = nil, nil, false
+			return
+		}
+		c := -1 // Compares the key of the pending write to the database's.
+		if itr.source.Valid() {
+			c = 1
+			if len(itr.pending) > 0 {
+				c = bytes.Compare(itr.pending[0].Key, itr.source.Key())
+				if itr.reverse {
+					c = -c
+				}
+			}
+		}
+		if c > 0 {
+			itr.key, itr.value, itr.valid = itr.source.Key(), itr.source.Value(), true
+			itr.source.Next()
+			return
+		}
+		if c == 0 {
+			itr.source.Next()
+		}
+		kv := itr.pending[0]
+		itr.pending = itr.pending[1:]
+		if kv.Value != nil {
+			itr.key, itr.value, itr.valid = kv.Key, kv.Value, true
+			return
+		}
+	}
+}
+
+func (itr *deferredIterator) Key() []byte {
+	if !itr.valid {
+		panic("deferredIterator is invalid")
+	}
+	return itr.key
+}
+
+func (itr *deferredIterator) Value() []byte {
+	if !itr.valid {
+		panic("deferredIterator is invalid")
+	}
+	return itr.value
+}
+
+func (itr *deferredIterator) Close() {
+	itr.source.Close()
+}
+
+// deferCommits makes Commit write the batch to memory, until flushCommits.
+func (ndb *nodeDB) deferCommits() {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if _, ok := ndb.db.(*deferredDB); ok {
+		return
+	}
+	// The batch is empty between commits. While commits are deferred, it isn't
+	// logged: the flush logs all the deferred writes at once.
+	ndb.batch.Close()
+	ndb.db = newDeferredDB(ndb.db)
+	ndb.batch = ndb.db.NewBatch()
+}
+
+// flushCommits commits the writes deferred since deferCommits to the database
+// in a single batch, and stops deferring them. If the commit fails, they are
+// still deferred, so that they can be flushed again.
+func (ndb *nodeDB) flushCommits() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	d, ok := ndb.db.(*deferredDB)
+	if !ok {
+		return nil
+	}
+	ndb.batch.Write() // The writes made since the last commit, if any.
+	ndb.saved = nil
+	ndb.batch.Close()
+	ndb.db = d.DB
+	ndb.batch = ndb.db.NewBatch()
+	if ndb.wal != nil {
+		ndb.batch = &walBatch{Batch: ndb.batch}
+	}
+	d.flush(ndb.batch)
+	if err := ndb.commit(); err != nil {
+		ndb.batch.Close()
+		ndb.db = d
+		ndb.batch = ndb.db.NewBatch()
+		ndb.latestVersion = 0 // Read again from the deferred writes.
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// Diff returns the changes from the old tree to this one: the pairs added, the
+// pairs whose value was updated, with their new value, and the pairs removed,
+// each sorted by key.
+//
+// Both trees are walked in order side by side, and subtrees with the same hash
+// in both are skipped without being loaded, so the cost is proportional to the
+// changes rather than to the size of the trees. The trees are typically two
+// versions of the same MutableTree.
+func (t *ImmutableTree) Diff(old *ImmutableTree) (added, updated, removed []KVPair, err error) {
+	added, updated, _, removed, err = t.diff(old)
+	return added, updated, removed, err
+}
+
+// diff is like Diff, and also returns the old values of the updated pairs.
+func (t *ImmutableTree) diff(old *ImmutableTree) (added, updated []KVPair, previous [][]byte, removed []KVPair, err error) {
+	// Ensure that all hashes are calculated.
+	t.Hash()
+	old.Hash()
+
+	oldNodes, newNodes := newDiffStack(old), newDiffStack(t)
+	for {
+		oldNode, newNode := oldNodes.top(), newNodes.top()
+		switch {
+		case oldNode == nil && newNode == nil:
+			return added, updated, previous, removed, nil
+
+		case oldNode == nil:
+			isLeaf, err := newNodes.expand()
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if isLeaf {
+				added = append(added, KVPair{Key: newNode.key, Value: newNode.value})
+			}
+		case newNode == nil:
+			isLeaf, err := oldNodes.expand()
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if isLeaf {
+				removed = append(removed, KVPair{Key: oldNode.key, Value: oldNode.value})
+			}
+
+		case bytes.Equal(oldNode.hash, newNode.hash):
+			oldNodes.pop()
+			newNodes.pop()
+
+		// Descend into the taller subtree first, so that identical subtrees end
+		// up on top of both stacks at the same time.
+		case oldNode.height > newNode.height:
+			_, err = oldNodes.expand()
+		case newNode.height > oldNode.height:
+			_, err = newNodes.expand()
+		case !oldNode.isLeaf():
+			if _, err = oldNodes.expand(); err == nil {
+				_, err = newNodes.expand()
+			}
+
+		default:
+			switch t.compare(oldNode.key, newNode.key) {
+			case -1:
+				oldNodes.pop()
+				removed = append(removed, KVPair{Key: oldNode.key, Value: oldNode.value})
+			case 1:
+				newNodes.pop()
+				added = append(added, KVPair{Key: newNode.key, Value: newNode.value})
+			default:
+				oldNodes.pop()
+				newNodes.pop()
+				if !bytes.Equal(oldNode.value, newNode.value) {
+					updated = append(updated, KVPair{Key: newNode.key, Value: newNode.value})
+					previous = append(previous, oldNode.value)
+				}
+			}
+		}
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+}
+
+// Merge sets the pairs of the other tree in the working tree: the keys absent
+// from it are added, and for the keys in both with different values, resolve
+// is called with the key, the value in the working tree and the value in the
+// other tree, and the key is set to the value it returns. The number of such
+// conflicts is returned. Keys only in the working tree are kept.
+//
+// The pairs to set are found with Diff, so the subtrees with the same hash in
+// both trees, e.g. in two versions of the same tree, are skipped. The merge is
+// all or nothing: the pairs are all resolved first, then set at once with
+// SetAtomic, so if reading the trees fails, resolve returns nil, or a key or
+// value is longer than the options allow, the error is returned and the
+// working tree is left as is.
+func (tree *MutableTree) Merge(other *ImmutableTree, resolve func(key, a, b []byte) []byte) (conflicts int, err error) {
+	added, updated, previous, _, err := other.diff(tree.ImmutableTree)
+	if err != nil {
+		return 0, err
+	}
+
+	// Both lists are sorted by key, so the pairs are set in order, which
+	// BatchSet benefits from.
+	kvs := make([]KVPair, 0, len(added)+len(updated))
+	for i, kv := range updated {
+		for len(added) > 0 && tree.compare(added[0].Key, kv.Key) < 0 {
+			kvs, added = append(kvs, added[0]), added[1:]
+		}
+		value := resolve(kv.Key, previous[i], kv.Value)
+		if value == nil {
+			return 0, errors.Errorf("resolving key %X: nil value", kv.Key)
+		}
+		kvs = append(kvs, KVPair{Key: kv.Key, Value: value})
+	}
+	kvs = append(kvs, added...)
+
+	if err := tree.SetAtomic(kvs); err != nil {
+		return 0, err
+	}
+	return len(updated), nil
+}
+
+// diffStack holds the subtrees of a tree which are still to be visited by
+// Diff, the leftmost one on top.
+type diffStack struct {
+	t     *ImmutableTree
+	nodes []*Node
+}
+
+func newDiffStack(t *ImmutableTree) *diffStack {
+	s := &diffStack{t: t}
+	if t.root != nil {
+		s.nodes = append(s.nodes, t.root)
+	}
+	return s
+}
+
+// top returns the next subtree, or nil if there are none left.
+func (s *diffStack) top() *Node {
+	if len(s.nodes) == 0 {
+		return nil
+	}
+	return s.nodes[len(s.nodes)-1]
+}
+
+func (s *diffStack) pop() {
+	s.nodes = s.nodes[:len(s.nodes)-1]
+}
+
+// expand replaces the next subtree by its children. If it is a leaf, it is
+// popped instead, and true is returned.
+func (s *diffStack) expand() (isLeaf bool, err error) {
+	node := s.top()
+	s.pop()
+	if node.isLeaf() {
+		return true, nil
+	}
+	left, right, err := node.getChildren(s.t)
+	if err != nil {
+		return false, err
+	}
+	s.nodes = append(s.nodes, right, left)
+	return false, nil
+}
+
+// Equal returns whether both trees hold exactly the same pairs. Equal root
+// hashes imply equal pairs, so they are compared first. The hashes also depend
+// on the shape of the trees and on the versions of the nodes though, so when
+// they differ, the pairs are compared by walking both trees in order.
+func (t *ImmutableTree) Equal(other *ImmutableTree) (bool, error) {
+	if hash := t.Hash(); hash != nil && bytes.Equal(hash, other.Hash()) {
+		return true, nil
+	}
+	if t.Size() != other.Size() {
+		return false, nil
+	}
+	iter, otherIter := t.Iterator(nil, nil, true), other.Iterator(nil, nil, true)
+	defer iter.Close()
+	defer otherIter.Close()
+	for ; iter.Valid() && otherIter.Valid(); iter.Next() {
+		if !bytes.Equal(iter.Key(), otherIter.Key()) || !bytes.Equal(iter.Value(), otherIter.Value()) {
+			return false, nil
+		}
+		otherIter.Next()
+	}
+	if err := iter.Error(); err != nil {
+		return false, err
+	}
+	if err := otherIter.Error(); err != nil {
+		return false, err
+	}
+	return iter.Valid() == otherIter.Valid(), nil
+}
+
+// DeepEqual returns whether both trees hold the same pairs in the same shape:
+// every node has the same key, height and size in both. Unlike the hashes, it
+// ignores the versions of the nodes, which helps debugging differences in
+// rebalancing.
+func (t *ImmutableTree) DeepEqual(other *ImmutableTree) (bool, error) {
+	root, otherRoot := t.loadRoot(), other.loadRoot()
+	if root == nil || otherRoot == nil {
+		return root == otherRoot, nil
+	}
+	return root.deepEqual(t, otherRoot, other)
+}
+
+func (node *Node) deepEqual(t *ImmutableTree, other *Node, ot *ImmutableTree) (bool, error) {
+	if node.height != other.height || node.size != other.size || !bytes.Equal(node.key, other.key) {
+		return false, nil
+	}
+	if node.isLeaf() {
+		return bytes.Equal(node.value, other.value), nil
+	}
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return false, err
+	}
+	otherLeft, otherRight, err := other.getChildren(ot)
+	if err != nil {
+		return false, err
+	}
+	if equal, err := left.deepEqual(t, otherLeft, ot); !equal || err != nil {
+		return false, err
+	}
+	return right.deepEqual(t, otherRight, ot)
+}
@@ -0,0 +1,313 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// countingDB counts the reads of the wrapped database.
+type countingDB struct {
+	dbm.DB
+	gets int
+}
+
+func (db *countingDB) Get(key []byte) []byte {
+	db.gets++
+	return db.DB.Get(key)
+}
+
+func TestDiff(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("v1"))
+	}
+	_, v1, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("key-000"), []byte("v2"))
+	tree.Set([]byte("key-050"), []byte("v2"))
+	tree.Set([]byte("key-050a"), []byte("v2"))
+	tree.Set([]byte("key-100"), []byte("v2"))
+	tree.Set([]byte("key-051"), []byte("v1")) // Unchanged.
+	tree.Remove([]byte("key-020"))
+	tree.Remove([]byte("key-099"))
+	_, v2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	old, err := tree.GetImmutable(v1)
+	require.NoError(t, err)
+	cur, err := tree.GetImmutable(v2)
+	require.NoError(t, err)
+
+	added, updated, removed, _ := cur.Diff(old)
+	require.Equal(t, []KVPair{
+		{[]byte("key-050a"), []byte("v2")},
+		{[]byte("key-100"), []byte("v2")},
+	}, added)
+	require.Equal(t, []KVPair{
+		{[]byte("key-000"), []byte("v2")},
+		{[]byte("key-050"), []byte("v2")},
+	}, updated)
+	require.Equal(t, []KVPair{
+		{[]byte("key-020"), []byte("v1")},
+		{[]byte("key-099"), []byte("v1")},
+	}, removed)
+
+	// The other way around, additions and removals swap.
+	added, updated, removed, _ = old.Diff(cur)
+	require.Len(t, added, 2)
+	require.Len(t, removed, 2)
+	require.Equal(t, []byte("v1"), updated[0].Value)
+
+	// A diff against itself, or against the unsaved working tree.
+	added, updated, removed, _ = cur.Diff(cur)
+	require.Empty(t, added)
+	require.Empty(t, updated)
+	require.Empty(t, removed)
+	tree.Remove([]byte("key-001"))
+	_, _, removed, _ = tree.Diff(cur)
+	require.Equal(t, []KVPair{{[]byte("key-001"), []byte("v1")}}, removed)
+}
+
+func TestMerge(t *testing.T) {
+	// Two trees diverging from a common version.
+	memDB := dbm.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("base"))
+	}
+	_, base, err := tree.SaveVersion()
+	require.NoError(t, err)
+	fork := NewMutableTree(memDB, 0)
+	_, err = fork.LoadVersion(base)
+	require.NoError(t, err)
+
+	tree.Set([]byte("key-010"), []byte("tree"))
+	tree.Set([]byte("key-020"), []byte("same"))
+	tree.Set([]byte("key-030"), []byte("tree"))
+	tree.Set([]byte("key-tree"), []byte("tree"))
+	fork.Set([]byte("key-010"), []byte("fork"))
+	fork.Set([]byte("key-020"), []byte("same"))
+	fork.Set([]byte("key-040"), []byte("fork"))
+	fork.Set([]byte("key-fork"), []byte("fork"))
+	fork.Remove([]byte("key-050"))
+
+	var resolved []string
+	conflicts, err := tree.Merge(fork.ImmutableTree, func(key, a, b []byte) []byte {
+		resolved = append(resolved, fmt.Sprintf("%s:%s:%s", key, a, b))
+		return append(append([]byte{}, a...), b...)
+	})
+	require.NoError(t, err)
+
+	// The resolver is called for the keys with different values in both
+	// trees only, including the ones changed in one of them only.
+	require.Equal(t, []string{"key-010:tree:fork", "key-030:tree:base", "key-040:base:fork"}, resolved)
+	require.Equal(t, 3, conflicts)
+	expected := map[string]string{
+		"key-010":  "treefork",
+		"key-020":  "same",
+		"key-030":  "treebase",
+		"key-040":  "basefork",
+		"key-050":  "base",
+		"key-tree": "tree",
+		"key-fork": "fork",
+	}
+	for key, value := range expected {
+		_, actual, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, string(actual), key)
+	}
+	require.EqualValues(t, 102, tree.Size())
+
+	// Merging a tree into itself changes nothing.
+	hash := tree.WorkingHash()
+	conflicts, err = tree.Merge(tree.ImmutableTree, func(key, a, b []byte) []byte {
+		t.Fatalf("resolving %s", key)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Zero(t, conflicts)
+	require.Equal(t, hash, tree.WorkingHash())
+
+	// A nil resolved value, or a pair which can't be set, fails the whole
+	// merge, including the pairs before it.
+	fork.Set([]byte("key-000"), []byte("fork"))
+	fork.Set([]byte("key-long"), []byte("too long"))
+	_, err = tree.Merge(fork.ImmutableTree, func(key, a, b []byte) []byte {
+		return nil
+	})
+	require.Error(t, err)
+	require.Equal(t, hash, tree.WorkingHash())
+
+	limited := NewMutableTreeWithOpts(dbm.NewMemDB(), 0, &Options{MaxValueLength: 4})
+	limited.Set([]byte("key-000"), []byte("base"))
+	limitedHash := limited.WorkingHash()
+	_, err = limited.Merge(fork.ImmutableTree, func(key, a, b []byte) []byte { return b })
+	require.Equal(t, ErrValueTooLong, errors.Cause(err))
+	require.Equal(t, limitedHash, limited.WorkingHash())
+}
+
+func TestDiffEmpty(t *testing.T) {
+	empty := NewMutableTree(dbm.NewMemDB(), 0)
+	tree := NewMutableTree(dbm.NewMemDB(), 0)
+	for _, k := range []string{"a", "b", "c"} {
+		tree.Set([]byte(k), []byte(k))
+	}
+
+	added, updated, removed, _ := tree.Diff(empty.ImmutableTree)
+	require.Len(t, added, 3)
+	require.Empty(t, updated)
+	require.Empty(t, removed)
+
+	added, updated, removed, _ = empty.Diff(tree.ImmutableTree)
+	require.Empty(t, added)
+	require.Empty(t, updated)
+	require.Equal(t, []KVPair{{[]byte("a"), []byte("a")}, {[]byte("b"), []byte("b")}, {[]byte("c"), []byte("c")}}, removed)
+}
+
+func TestDiffMatchesBruteForce(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0)
+	var versions []*ImmutableTree
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 50; i++ {
+			key := randBytes(1)
+			if i%3 == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, randBytes(1))
+			}
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		versions = append(versions, itree)
+	}
+
+	contents := func(t *ImmutableTree) map[string]string {
+		kvs := map[string]string{}
+		t.Iterate(func(key, value []byte) bool {
+			kvs[string(key)] = string(value)
+			return false
+		})
+		return kvs
+	}
+	for i := 1; i < len(versions); i++ {
+		old, cur := contents(versions[i-1]), contents(versions[i])
+		added, updated, removed, _ := versions[i].Diff(versions[i-1])
+		for _, kv := range added {
+			_, ok := old[string(kv.Key)]
+			require.False(t, ok)
+			require.Equal(t, cur[string(kv.Key)], string(kv.Value))
+			delete(cur, string(kv.Key))
+		}
+		for _, kv := range updated {
+			require.NotEqual(t, old[string(kv.Key)], cur[string(kv.Key)])
+			require.Equal(t, cur[string(kv.Key)], string(kv.Value))
+		}
+		for _, kv := range removed {
+			_, ok := cur[string(kv.Key)]
+			require.False(t, ok)
+			require.Equal(t, old[string(kv.Key)], string(kv.Value))
+			delete(old, string(kv.Key))
+		}
+		// What remains in both is the same keys, and only updated values differ.
+		require.Len(t, old, len(cur))
+		changed := 0
+		for key, value := range cur {
+			if old[key] != value {
+				changed++
+			}
+		}
+		require.Equal(t, len(updated), changed)
+	}
+}
+
+func TestDiffSkipsUnchangedSubtrees(t *testing.T) {
+	memDB := &countingDB{DB: dbm.NewMemDB()}
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 10000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte("v1"))
+	}
+	_, v1, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-05000"), []byte("v2"))
+	_, v2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Load both versions from a fresh tree without a cache, so that every node
+	// visited has to be read from the database.
+	tree = NewMutableTree(memDB, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	old, err := tree.GetImmutable(v1)
+	require.NoError(t, err)
+	cur, err := tree.GetImmutable(v2)
+	require.NoError(t, err)
+
+	memDB.gets = 0
+	_, updated, _, _ := cur.Diff(old)
+	require.Len(t, updated, 1)
+	// Only the two paths to the updated leaf and their siblings are loaded.
+	require.True(t, memDB.gets <= 4*int(cur.Height()+1), "%d reads", memDB.gets)
+}
+
+func TestEqual(t *testing.T) {
+	equal := func(a, b *ImmutableTree) bool {
+		equal, err := a.Equal(b)
+		require.NoError(t, err)
+		return equal
+	}
+	deepEqual := func(a, b *ImmutableTree) bool {
+		equal, err := a.DeepEqual(b)
+		require.NoError(t, err)
+		return equal
+	}
+
+	// The same pairs set in different orders end up in different shapes, so
+	// with different hashes.
+	asc := NewMutableTree(dbm.NewMemDB(), 0)
+	for i := 0; i < 20; i++ {
+		asc.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	desc := NewMutableTree(dbm.NewMemDB(), 0)
+	for i := 19; i >= 0; i-- {
+		desc.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	require.NotEqual(t, asc.WorkingHash(), desc.WorkingHash())
+	require.True(t, equal(asc.ImmutableTree, desc.ImmutableTree))
+	require.True(t, equal(desc.ImmutableTree, asc.ImmutableTree))
+	require.False(t, deepEqual(asc.ImmutableTree, desc.ImmutableTree))
+	require.True(t, deepEqual(asc.ImmutableTree, asc.ImmutableTree))
+
+	// Setting a key again keeps the shape, but changes the versions and so the
+	// hashes of the nodes on its path.
+	_, version, err := asc.SaveVersion()
+	require.NoError(t, err)
+	saved, err := asc.GetImmutable(version)
+	require.NoError(t, err)
+	asc.Set([]byte("key-00"), []byte("value"))
+	require.NotEqual(t, saved.Hash(), asc.WorkingHash())
+	require.True(t, equal(asc.ImmutableTree, saved))
+	require.True(t, deepEqual(asc.ImmutableTree, saved))
+
+	// Any difference in the pairs is found.
+	desc.Set([]byte("key-00"), []byte("other"))
+	require.False(t, equal(asc.ImmutableTree, desc.ImmutableTree))
+	desc.Set([]byte("key-00"), []byte("value"))
+	desc.Set([]byte("key-20"), []byte("value"))
+	require.False(t, equal(asc.ImmutableTree, desc.ImmutableTree))
+	desc.Remove([]byte("key-19"))
+	require.False(t, equal(asc.ImmutableTree, desc.ImmutableTree))
+	require.False(t, deepEqual(asc.ImmutableTree, desc.ImmutableTree))
+
+	empty := &ImmutableTree{}
+	require.True(t, equal(empty, &ImmutableTree{}))
+	require.True(t, deepEqual(empty, &ImmutableTree{}))
+	require.False(t, equal(empty, asc.ImmutableTree))
+	require.False(t, deepEqual(asc.ImmutableTree, empty))
+}
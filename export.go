@@ -0,0 +1,202 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// The frames of an export stream. Each starts with one of these tags.
+const (
+	// A node, followed by its bytes as written by writeBytes, prefixed by
+	// their length as a uvarint. Inner nodes follow their children.
+	exportTagNode byte = iota
+	// A reference to a subtree already in the stream, followed by its hash,
+	// prefixed by its length as a uvarint.
+	exportTagRef
+	// The end of a tree.
+	exportTagEnd
+)
+
+// Exporter writes a stream of trees, typically successive versions of a
+// MutableTree, which can be read back by an Importer. Each subtree is written
+// once: when a later tree shares it, only a reference to its hash is written.
+//
+// Each tree starts with its version as a varint, followed by the frames of its
+// nodes in post-order and an end frame.
+type Exporter struct {
+	w    io.Writer
+	seen map[string]bool // hashes of the subtrees written
+}
+
+// NewExporter returns an Exporter writing to w.
+func NewExporter(w io.Writer) *Exporter {
+	return &Exporter{w: w, seen: make(map[string]bool)}
+}
+
+// Export writes the given tree to the stream. The hashes of the tree are
+// calculated first, if needed.
+func (e *Exporter) Export(t *ImmutableTree) error {
+	if err := amino.EncodeVarint(e.w, t.version); err != nil {
+		return errors.Wrap(err, "writing version")
+	}
+	if root := t.loadRoot(); root != nil {
+		t.Hash()
+		if err := e.exportNode(t, root); err != nil {
+			return err
+		}
+	}
+	_, err := e.w.Write([]byte{exportTagEnd})
+	return errors.Wrap(err, "writing end of tree")
+}
+
+func (e *Exporter) exportNode(t *ImmutableTree, node *Node) error {
+	if e.seen[string(node.hash)] {
+		if _, err := e.w.Write([]byte{exportTagRef}); err != nil {
+			return errors.Wrap(err, "writing reference")
+		}
+		return errors.Wrap(amino.EncodeByteSlice(e.w, node.hash), "writing reference")
+	}
+	if !node.isLeaf() {
+		left, right, err := node.getChildren(t)
+		if err != nil {
+			return err
+		}
+		if err := e.exportNode(t, left); err != nil {
+			return err
+		}
+		if err := e.exportNode(t, right); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := node.writeBytes(&buf); err != nil {
+		return err
+	}
+	if _, err := e.w.Write([]byte{exportTagNode}); err != nil {
+		return errors.Wrap(err, "writing node")
+	}
+	if err := amino.EncodeByteSlice(e.w, buf.Bytes()); err != nil {
+		return errors.Wrap(err, "writing node")
+	}
+	e.seen[string(node.hash)] = true
+	return nil
+}
+
+// Importer reads the trees written by an Exporter. The subtrees shared by the
+// trees are shared in memory as well.
+type Importer struct {
+	r         io.Reader
+	br        io.ByteReader
+	db        dbm.DB
+	cacheSize int
+	nodes     map[string]*Node // subtrees read, by hash
+}
+
+// NewImporter returns an Importer reading from r. The trees read are created
+// as by NewImmutableTree with the given database and cache size, and their
+// nodes are kept in memory, not saved to the database.
+func NewImporter(r io.Reader, db dbm.DB, cacheSize int) *Importer {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		rb := bufio.NewReader(r)
+		r, br = rb, rb
+	}
+	return &Importer{r: r, br: br, db: db, cacheSize: cacheSize, nodes: make(map[string]*Node)}
+}
+
+// Next reads the next tree of the stream, and validates it as by
+// ImmutableTree.Validate. It returns io.EOF when there are no trees left.
+func (im *Importer) Next() (*ImmutableTree, error) {
+	version, err := binary.ReadVarint(im.br)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading version")
+	}
+
+	// Rebuild the tree bottom up: the children of each inner node are the
+	// last two subtrees read.
+	var stack []*Node
+	for i := 0; ; i++ {
+		tag, err := im.br.ReadByte()
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading frame %d", i)
+		}
+		if tag == exportTagEnd {
+			break
+		}
+		if tag != exportTagNode && tag != exportTagRef {
+			return nil, errors.Errorf("invalid tag %d of frame %d", tag, i)
+		}
+
+		length, err := binary.ReadUvarint(im.br)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading length of frame %d", i)
+		}
+		// Don't trust the length to allocate, since it may be corrupted.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, im.r, int64(length)); err != nil {
+			return nil, errors.Wrapf(err, "reading frame %d", i)
+		}
+
+		if tag == exportTagRef {
+			node, ok := im.nodes[buf.String()]
+			if !ok {
+				return nil, errors.Errorf("unknown reference %X in frame %d", buf.Bytes(), i)
+			}
+			stack = append(stack, node)
+			continue
+		}
+
+		node, err := DecodeNode(buf.Bytes())
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding frame %d", i)
+		}
+		if !node.isLeaf() {
+			if len(stack) < 2 {
+				return nil, errors.Errorf("missing children of frame %d", i)
+			}
+			node.leftNode, node.rightNode = stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+		}
+		stack = append(stack, node)
+	}
+	if len(stack) > 1 {
+		return nil, errors.Errorf("version %d holds %d trees", version, len(stack))
+	}
+
+	tree := NewImmutableTree(im.db, im.cacheSize)
+	tree.version = version
+	if len(stack) == 1 {
+		tree.storeRoot(stack[0])
+	}
+	if err := tree.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "version %d", version)
+	}
+	// Only register the nodes once they are known to be valid, so that a
+	// reference can't be resolved to a node with a wrong hash.
+	if len(stack) == 1 {
+		tree.Hash()
+		im.register(stack[0])
+	}
+	return tree, nil
+}
+
+// register records the subtree and its descendants read from the stream.
+func (im *Importer) register(node *Node) {
+	if _, ok := im.nodes[string(node.hash)]; ok {
+		return
+	}
+	im.nodes[string(node.hash)] = node
+	if !node.isLeaf() {
+		im.register(node.leftNode)
+		im.register(node.rightNode)
+	}
+}
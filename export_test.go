@@ -0,0 +1,108 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestExportImportVersions(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 300; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-100"), []byte("updated"))
+	tree.Remove([]byte("key-200"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-999"), []byte("new"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	var versions []*ImmutableTree
+	distinct := make(map[string]bool)
+	snapshotSize := 0
+	for version := int64(1); version <= 3; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		versions = append(versions, itree)
+		itree.root.traverse(itree, true, func(node *Node) bool {
+			distinct[string(node.hash)] = true
+			return false
+		})
+		var buf bytes.Buffer
+		_, err = itree.WriteTo(&buf)
+		require.NoError(t, err)
+		snapshotSize += buf.Len()
+	}
+
+	var stream bytes.Buffer
+	exporter := NewExporter(&stream)
+	for _, itree := range versions {
+		require.NoError(t, exporter.Export(itree))
+	}
+	// Each shared subtree was written once.
+	require.Equal(t, len(distinct), len(exporter.seen))
+	require.True(t, stream.Len() < snapshotSize/2, "stream of %d bytes, snapshots of %d", stream.Len(), snapshotSize)
+
+	importer := NewImporter(&stream, nil, 0)
+	for _, itree := range versions {
+		read, err := importer.Next()
+		require.NoError(t, err)
+		require.Equal(t, itree.Version(), read.Version())
+		require.Equal(t, itree.Hash(), read.Hash())
+		itree.Iterate(func(key, value []byte) bool {
+			_, v, _ := read.Get(key)
+			require.Equal(t, value, v)
+			return false
+		})
+	}
+	require.Equal(t, len(distinct), len(importer.nodes))
+	_, err = importer.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestExportImportEmpty(t *testing.T) {
+	var stream bytes.Buffer
+	require.NoError(t, NewExporter(&stream).Export(NewImmutableTree(db.NewMemDB(), 0)))
+
+	importer := NewImporter(&stream, nil, 0)
+	read, err := importer.Next()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, read.Size())
+	_, err = importer.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestImportInvalid(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	var stream bytes.Buffer
+	exporter := NewExporter(&stream)
+	require.NoError(t, exporter.Export(tree.ImmutableTree))
+	first := stream.Len()
+	// The second tree is a single reference to the first.
+	require.NoError(t, exporter.Export(tree.ImmutableTree))
+	data := stream.Bytes()
+
+	// A reference to a subtree not in the stream.
+	_, err := NewImporter(bytes.NewReader(data[first:]), nil, 0).Next()
+	require.Error(t, err)
+
+	// Truncated.
+	_, err = NewImporter(bytes.NewReader(data[:first-1]), nil, 0).Next()
+	require.Error(t, err)
+
+	// A changed value no longer matches the hashes of its ancestors.
+	corrupted := bytes.Replace(data, []byte("value-3"), []byte("value-X"), 1)
+	_, err = NewImporter(bytes.NewReader(corrupted), nil, 0).Next()
+	require.Error(t, err)
+}
@@ -1,19 +1,39 @@
 package iavl
 
 import (
+	"bytes"
 	"fmt"
+	"hash"
+	"math"
+	"math/big"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"unsafe"
 
+	"github.com/pkg/errors"
 	dbm "github.com/tendermint/tm-db"
 )
 
+// ErrPrefixCompareUnsupported is returned when iterating over a prefix of a
+// tree with a custom comparator, see Options.Compare, under which the keys with
+// a prefix need not be contiguous.
+var ErrPrefixCompareUnsupported = fmt.Errorf("prefix iteration is not supported with a custom comparator")
+
 // ImmutableTree is a container for an immutable AVL+ ImmutableTree. Changes are performed by
 // swapping the internal root with a new one, while the container is mutable.
-// Note that this tree is not thread-safe.
+// The root is swapped atomically, and the reads of keys (Get, Has, GetByIndex,
+// the Iterate methods, Iterator, etc.) work on the root they started with, so
+// any number of them may run concurrently with a single writer changing keys.
+// Other operations are not thread-safe, see MutableTree.
+//
+// A nil root is the empty tree: every method handles it, returning zero values
+// and no error, e.g. a size of 0 or a nil value, rather than panicking.
 type ImmutableTree struct {
 	root    *Node
 	ndb     *nodeDB
 	version int64
+	bloom   *bloomFilter // Keys which may be in the tree, if enabled.
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -24,7 +44,7 @@ func NewImmutableTree(db dbm.DB, cacheSize int) *ImmutableTree {
 	}
 	return &ImmutableTree{
 		// NodeDB-backed Tree.
-		ndb: newNodeDB(db, cacheSize),
+		ndb: newNodeDB(db, cacheSize, nil),
 	}
 }
 
@@ -78,8 +98,12 @@ func (t *ImmutableTree) renderNode(node *Node, indent string, depth int, encoder
 
 	// recurse on inner node
 	here := fmt.Sprintf("%s%s", prefix, encoder(node.hash, depth, false))
-	left := t.renderNode(node.getLeftNode(t), indent, depth+1, encoder)
-	right := t.renderNode(node.getRightNode(t), indent, depth+1, encoder)
+	leftNode, rightNode, err := node.getChildren(t)
+	if err != nil {
+		return []string{here, fmt.Sprintf("%s%s<error: %v>", prefix, indent, err)}
+	}
+	left := t.renderNode(leftNode, indent, depth+1, encoder)
+	right := t.renderNode(rightNode, indent, depth+1, encoder)
 	result := append(left, here)
 	result = append(result, right...)
 	return result
@@ -87,10 +111,11 @@ func (t *ImmutableTree) renderNode(node *Node, indent string, depth int, encoder
 
 // Size returns the number of leaf nodes in the tree.
 func (t *ImmutableTree) Size() int64 {
-	if t.root == nil {
+	root := t.loadRoot()
+	if root == nil {
 		return 0
 	}
-	return t.root.size
+	return root.size
 }
 
 // Version returns the version of the tree.
@@ -100,60 +125,733 @@ func (t *ImmutableTree) Version() int64 {
 
 // Height returns the height of the tree.
 func (t *ImmutableTree) Height() int8 {
-	if t.root == nil {
+	root := t.loadRoot()
+	if root == nil {
 		return 0
 	}
-	return t.root.height
+	return root.height
 }
 
-// Has returns whether or not a key exists.
-func (t *ImmutableTree) Has(key []byte) bool {
-	if t.root == nil {
+// TreeStats describes the shape of a tree, see ImmutableTree.Stats.
+type TreeStats struct {
+	Nodes  int64 // number of nodes, inner nodes and leaves
+	Leaves int64 // number of leaves, i.e. of keys
+
+	// The depth of the root is 0.
+	MaxDepth     int     // largest depth of a leaf
+	AvgLeafDepth float64 // average depth of the leaves
+}
+
+// Stats walks the whole tree, visiting each node once, and returns its
+// statistics. The nodes not in memory are loaded from the database.
+func (t *ImmutableTree) Stats() (TreeStats, error) {
+	var stats TreeStats
+	root := t.loadRoot()
+	if root == nil {
+		return stats, nil
+	}
+	var depthSum int64
+	_, err := root.traverseWithDepth(t, true, func(node *Node, depth uint8) bool {
+		stats.Nodes++
+		if node.isLeaf() {
+			stats.Leaves++
+			depthSum += int64(depth)
+			if int(depth) > stats.MaxDepth {
+				stats.MaxDepth = int(depth)
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return TreeStats{}, err
+	}
+	stats.AvgLeafDepth = float64(depthSum) / float64(stats.Leaves)
+	return stats, nil
+}
+
+// BalanceReport describes how balanced a tree is, see ImmutableTree.BalanceReport.
+type BalanceReport struct {
+	// Balances counts the inner nodes by balance factor, the height of their
+	// left subtree minus the height of their right one, at index factor+1.
+	Balances [3]int64
+	// Heights counts the nodes by height, leaves at index 0.
+	Heights []int64
+}
+
+// BalanceReport walks the whole tree and returns how many of its inner nodes
+// lean left, are balanced or lean right, and how many nodes there are at each
+// height. A workload leaving many nodes unbalanced is close to rotations, and
+// more nodes at the upper heights means a taller tree than the keys require.
+func (t *ImmutableTree) BalanceReport() (BalanceReport, error) {
+	var report BalanceReport
+	root := t.loadRoot()
+	if root == nil {
+		return report, nil
+	}
+	report.Heights = make([]int64, root.height+1)
+	var err error
+	_, travErr := root.traverse(t, true, func(node *Node) bool {
+		report.Heights[node.height]++
+		if node.isLeaf() {
+			return false
+		}
+		var balance int
+		if balance, err = node.calcBalance(t); err != nil {
+			return true
+		}
+		if balance < -1 || balance > 1 {
+			err = errors.Errorf("node %X has a balance factor of %d", node.key, balance)
+			return true
+		}
+		report.Balances[balance+1]++
 		return false
+	})
+	if travErr != nil {
+		return BalanceReport{}, travErr
+	}
+	if err != nil {
+		return BalanceReport{}, err
+	}
+	return report, nil
+}
+
+// nodeStructSize is the memory held by a Node struct, without its slices.
+var nodeStructSize = int64(unsafe.Sizeof(Node{}))
+
+// EstimateMemory returns an estimate of the bytes held by the nodes of the
+// tree resident in memory: the node structs, and their keys, values and
+// hashes. Only the nodes reachable from the root through in-memory children
+// are counted, i.e. unsaved nodes and the root of a loaded tree, but not the
+// nodes left in the database or those in the node cache. Nothing is loaded.
+func (t *ImmutableTree) EstimateMemory() int64 {
+	root := t.loadRoot()
+	if root == nil {
+		return 0
+	}
+	return root.estimateMemory()
+}
+
+// TraverseNodes calls fn on every node of the tree, inner nodes and leaves, in
+// pre-order, along with its depth, which is 0 for the root. It is meant for
+// tools inspecting the shape or the hashes of a tree, so the hashes are
+// computed first. The nodes must not be modified. It stops if fn returns true,
+// and returns whether it stopped.
+func (t *ImmutableTree) TraverseNodes(fn func(node *Node, depth int) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	root.hashWithCount(t.hashFunc())
+	return root.traverseWithDepth(t, true, func(node *Node, depth uint8) bool {
+		return fn(node, int(depth))
+	})
+}
+
+// NodesAtVersion returns the hashes of the nodes of the tree, inner nodes and
+// leaves, which were created at the given version, in pre-order. Only the
+// nodes reachable from the root of this tree are considered, not the orphans
+// of other versions still in the database, so the nodes a version introduced
+// are those at that version in the tree of that version. In a working tree,
+// the nodes not saved yet have the version the tree will be saved as.
+func (t *ImmutableTree) NodesAtVersion(version int64) ([][]byte, error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil
+	}
+	root.hashWithCount(t.hashFunc())
+	var hashes [][]byte
+	if err := root.appendNodesAtVersion(t, version, &hashes); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// ForEachChangedSince calls fn, in order, on the pairs set after the base
+// version, i.e. whose leaf has a later version, e.g. to build a changelog of
+// the sets since a version. Removed keys are not reported, see Diff for them.
+// As a node is never older than its children, the subtrees unchanged since
+// the base version are skipped without being read. It stops if fn returns
+// true, and returns whether it stopped.
+func (t *ImmutableTree) ForEachChangedSince(baseVersion int64, fn func(key, value []byte) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	return root.traverseVersionRange(t, baseVersion+1, math.MaxInt64, func(key, value []byte, _ int64) bool {
+		return fn(key, value)
+	})
+}
+
+// IterateVersionRange calls fn, in order, on the pairs of the tree whose leaf
+// has a version in [lo, hi], i.e. which were last set in one of these
+// versions, along with that version, e.g. to report the changes of a window
+// of versions. Only the current pairs of the tree are visited: pairs set in
+// the window but set again after it, or removed, are not. The subtrees last
+// changed before lo are skipped without being read. It stops if fn returns
+// true, and returns whether it stopped.
+func (t *ImmutableTree) IterateVersionRange(lo, hi int64, fn func(key, value []byte, version int64) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	return root.traverseVersionRange(t, lo, hi, fn)
+}
+
+// Root returns the root node of the tree, or nil if it is empty, for tools
+// walking the tree with Child. As with TraverseNodes, the hashes are computed
+// first, and the nodes must not be modified.
+func (t *ImmutableTree) Root() *Node {
+	root := t.loadRoot()
+	if root != nil {
+		root.hashWithCount(t.hashFunc())
+	}
+	return root
+}
+
+// Child returns the left or right child of an inner node of the tree, loading
+// it from the database if it is not in memory. It returns an error if node is
+// a leaf, or if the child can't be loaded, which is ErrNodeMissing if the node
+// is not in the database.
+func (t *ImmutableTree) Child(node *Node, left bool) (*Node, error) {
+	if node.isLeaf() {
+		return nil, errors.Errorf("node %X is a leaf", node.key)
 	}
-	return t.root.has(t, key)
+	if left {
+		return node.getLeftNode(t)
+	}
+	return node.getRightNode(t)
 }
 
-// Hash returns the root hash.
+// Contains returns whether the key is in a keys-only tree, see
+// Options.KeysOnly. It is Has, named for sets of keys.
+func (t *ImmutableTree) Contains(key []byte) (bool, error) {
+	return t.Has(key)
+}
+
+// Has returns whether or not a key exists. With Options.BloomFilterBits, the
+// working tree of a MutableTree returns false without a lookup for the keys
+// its bloom filter rejects.
+func (t *ImmutableTree) Has(key []byte) (bool, error) {
+	root := t.loadRoot()
+	if root == nil || (t.bloom != nil && !t.bloom.mayContain(key)) {
+		return false, nil
+	}
+	return root.has(t, key)
+}
+
+// Depth returns the number of inner nodes above the leaf of the key, e.g. to
+// find keys sitting unusually deep, and whether the key exists. For a missing
+// key, it is the depth of the leaf its lookup ends at, next to where it would
+// be inserted. An empty tree returns a depth of 0.
+func (t *ImmutableTree) Depth(key []byte) (depth int, exists bool, err error) {
+	node := t.loadRoot()
+	if node == nil {
+		return 0, false, nil
+	}
+	for !node.isLeaf() {
+		if t.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		depth++
+	}
+	return depth, t.compare(node.key, key) == 0, nil
+}
+
+// Path returns the hashes of the nodes on the path from the root down to the
+// leaf of the key, in that order, and whether the key exists. For a missing
+// key, the path ends at the leaf its lookup ends at, as with Depth. The hashes
+// of the nodes changed since the tree was last hashed are computed first. An
+// empty tree returns no hashes.
+func (t *ImmutableTree) Path(key []byte) (hashes [][]byte, found bool, err error) {
+	node := t.loadRoot()
+	if node == nil {
+		return nil, false, nil
+	}
+	t.hashWithCount(node)
+	for {
+		hashes = append(hashes, node.hash)
+		if node.isLeaf() {
+			return hashes, t.compare(node.key, key) == 0, nil
+		}
+		if t.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Hash returns the root hash, or nil for an empty tree. The hashes of the
+// nodes changed since they were last hashed are computed and kept, so calling
+// Hash again only hashes the nodes changed in between. Nothing is persisted.
 func (t *ImmutableTree) Hash() []byte {
 	if t.root == nil {
 		return nil
 	}
-	hash, _ := t.root.hashWithCount()
+	hash, _ := t.hashWithCount(t.root)
 	return hash
 }
 
-// hashWithCount returns the root hash and hash count.
-func (t *ImmutableTree) hashWithCount() ([]byte, int64) {
+// HashWithCount returns the root hash like Hash, along with the number of
+// nodes whose hash had to be computed since they changed, i.e. since the last
+// hash of the tree. It measures how expensive a commit was: a few keys changed
+// in a large tree only rehash their paths to the root. On a MutableTree, it
+// hashes the working tree, like WorkingHash.
+func (t *ImmutableTree) HashWithCount() (hash []byte, count int64) {
 	if t.root == nil {
 		return nil, 0
 	}
-	return t.root.hashWithCount()
+	return t.hashWithCount(t.root)
+}
+
+// hashWithCount hashes the subtree with the hash function of the tree, in
+// parallel if the options enable it, see Node.hashWithCount.
+func (t *ImmutableTree) hashWithCount(node *Node) ([]byte, int64) {
+	if t.ndb == nil {
+		return node.hashWithCount(t.hashFunc())
+	}
+	return node.hashWithCountParallel(t.hashFunc(), t.ndb.opts.ParallelHashThreshold)
+}
+
+// NodeCacheStats returns the number of nodes loaded from the node cache and
+// from the database, to help tune the cache size. The counts are shared by all
+// trees using the same database handle, i.e. all versions of a MutableTree.
+func (t *ImmutableTree) NodeCacheStats() (hits, misses int64) {
+	if t.ndb == nil {
+		return 0, 0
+	}
+	return t.ndb.cacheStats()
+}
+
+// compare orders two keys with the comparator of the tree, returning -1, 0 or
+// 1.
+func (t *ImmutableTree) compare(a, b []byte) int {
+	if t.ndb == nil || t.ndb.opts.Compare == nil {
+		return bytes.Compare(a, b)
+	}
+	switch c := t.ndb.opts.Compare(a, b); {
+	case c < 0:
+		return -1
+	case c > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// hashFunc returns the hash function of the tree's nodes.
+func (t *ImmutableTree) hashFunc() func() hash.Hash {
+	if t.ndb == nil {
+		return Options{}.hashFunc()
+	}
+	return t.ndb.hashFunc()
 }
 
 // Get returns the index and value of the specified key if it exists, or nil
-// and the next index, if it doesn't.
-func (t *ImmutableTree) Get(key []byte) (index int64, value []byte) {
-	if t.root == nil {
-		return 0, nil
+// and the next index, if it doesn't. A key set to an empty value has a non-nil
+// empty value, so it can be told apart from an absent key.
+//
+// Like all the reads of the tree, it returns an error if a node can't be
+// loaded from the database, which is ErrNodeMissing if the node is not there.
+//
+// The value is the one held by the node, not a copy: modifying it corrupts the
+// tree and the node cache, so callers which do must use GetSafe. The same goes
+// for the keys and values passed by the Iterate methods and Iterator.
+func (t *ImmutableTree) Get(key []byte) (index int64, value []byte, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return 0, nil, nil
 	}
-	return t.root.get(t, key)
+	return root.get(t, key)
+}
+
+// GetWithVersion returns the value of the key along with the version of its
+// leaf, which is the version the value was last set at, e.g. for MVCC. In a
+// working tree, a value set since the last save has the version it will be
+// saved as.
+func (t *ImmutableTree) GetWithVersion(key []byte) (value []byte, version int64, exists bool, err error) {
+	node := t.loadRoot()
+	if node == nil {
+		return nil, 0, false, nil
+	}
+	for !node.isLeaf() {
+		if t.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+	}
+	if t.compare(node.key, key) != 0 {
+		return nil, 0, false, nil
+	}
+	return node.value, node.version, true, nil
+}
+
+// GetSafe returns a copy of the value of the specified key, which the caller
+// may modify, and whether the key exists. Like Has, it uses the bloom filter
+// of the tree, if any; Get doesn't, as it returns the index of missing keys.
+func (t *ImmutableTree) GetSafe(key []byte) (value []byte, exists bool, err error) {
+	if t.bloom != nil && !t.bloom.mayContain(key) {
+		return nil, false, nil
+	}
+	_, value, err = t.Get(key)
+	if value == nil || err != nil {
+		return nil, false, err
+	}
+	return append([]byte{}, value...), true, nil
+}
+
+// GetMany gets the values of the keys, in the same order, and whether each was
+// found. The keys are looked up in a single descent: the inner nodes on the
+// paths of several keys, such as those of nearby keys, are visited once. Like
+// Get, the values are the ones held by the nodes, not copies.
+func (t *ImmutableTree) GetMany(keys [][]byte) (values [][]byte, found []bool, err error) {
+	values, found = make([][]byte, len(keys)), make([]bool, len(keys))
+	root := t.loadRoot()
+	if root == nil {
+		return values, found, nil
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return t.compare(keys[order[i]], keys[order[j]]) < 0 })
+	if err := root.getMany(t, keys, order, values, found); err != nil {
+		return nil, nil, err
+	}
+	return values, found, nil
+}
+
+// Min returns the smallest key in the tree and its value, or ok=false if the
+// tree is empty.
+func (t *ImmutableTree) Min() (key, value []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, false, nil
+	}
+	leaf, err := root.lmd(t)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return leaf.key, leaf.value, true, nil
+}
+
+// Max returns the largest key in the tree and its value, or ok=false if the
+// tree is empty.
+func (t *ImmutableTree) Max() (key, value []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, false, nil
+	}
+	leaf, err := root.rmd(t)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return leaf.key, leaf.value, true, nil
+}
+
+// Next returns the smallest key in the tree greater than the given key, which
+// doesn't have to exist, and its value, or ok=false if there is none.
+func (t *ImmutableTree) Next(key []byte) (k, v []byte, ok bool, err error) {
+	return t.next(key, false)
+}
+
+// Prev returns the largest key in the tree smaller than the given key, which
+// doesn't have to exist, and its value, or ok=false if there is none.
+func (t *ImmutableTree) Prev(key []byte) (k, v []byte, ok bool, err error) {
+	return t.prev(key, false)
+}
+
+// FirstInRange returns the smallest key between start (inclusive) and end
+// (exclusive), and its value, or ok=false if there is none. If either are nil,
+// then it is open on that side. It descends straight to the key, without
+// iterating over the range.
+func (t *ImmutableTree) FirstInRange(start, end []byte) (k, v []byte, ok bool, err error) {
+	if start == nil {
+		k, v, ok, err = t.Min()
+	} else {
+		k, v, ok, err = t.next(start, true)
+	}
+	if !ok || err != nil || (end != nil && t.compare(k, end) >= 0) {
+		return nil, nil, false, err
+	}
+	return k, v, true, nil
+}
+
+// LastInRange returns the largest key between start (inclusive) and end
+// (exclusive), and its value, or ok=false if there is none. If either are nil,
+// then it is open on that side. It descends straight to the key, without
+// iterating over the range.
+func (t *ImmutableTree) LastInRange(start, end []byte) (k, v []byte, ok bool, err error) {
+	if end == nil {
+		k, v, ok, err = t.Max()
+	} else {
+		k, v, ok, err = t.prev(end, false)
+	}
+	if !ok || err != nil || (start != nil && t.compare(k, start) < 0) {
+		return nil, nil, false, err
+	}
+	return k, v, true, nil
+}
+
+// Closest returns the key in the tree closest to the given one, which doesn't
+// have to exist, and its value, or ok=false if the tree is empty. The key
+// itself is returned if it exists; otherwise the closer of the keys before and
+// after it by the given distance, or the one before it on a tie. If distance
+// is nil, LexicographicDistance is used. Both neighbors are found in a single
+// descent.
+func (t *ImmutableTree) Closest(key []byte, distance func(a, b []byte) *big.Int) (k, v []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, false, nil
+	}
+	// As in next and prev, the subtrees at the last left and right turns hold
+	// the neighbors which aren't the leaf reached.
+	var next, prev *Node
+	node := root
+	for !node.isLeaf() {
+		if t.compare(key, node.key) < 0 {
+			next = node
+			node, err = node.getLeftNode(t)
+		} else {
+			prev = node
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	var before, after *Node
+	switch t.compare(node.key, key) {
+	case 0:
+		return node.key, node.value, true, nil
+	case -1:
+		before = node
+		if next != nil {
+			if after, err = next.getRightNode(t); err == nil {
+				after, err = after.lmd(t)
+			}
+		}
+	default:
+		after = node
+		if prev != nil {
+			if before, err = prev.getLeftNode(t); err == nil {
+				before, err = before.rmd(t)
+			}
+		}
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if distance == nil {
+		distance = LexicographicDistance
+	}
+	closest := before
+	if before == nil || (after != nil && distance(after.key, key).Cmp(distance(key, before.key)) < 0) {
+		closest = after
+	}
+	return closest.key, closest.value, true, nil
+}
+
+// LexicographicDistance returns the distance between two keys in bytewise
+// order: the keys are padded with zeros to the same length, and read as
+// big-endian numbers, which are subtracted. It is the absolute difference, so
+// it doesn't depend on the order of the keys.
+func LexicographicDistance(a, b []byte) *big.Int {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	x := new(big.Int).SetBytes(append(append(make([]byte, 0, n), a...), make([]byte, n-len(a))...))
+	y := new(big.Int).SetBytes(append(append(make([]byte, 0, n), b...), make([]byte, n-len(b))...))
+	return x.Abs(x.Sub(x, y))
+}
+
+// next returns the smallest key greater than the given key, or equal to it if
+// inclusive.
+func (t *ImmutableTree) next(key []byte, inclusive bool) (k, v []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, false, nil
+	}
+	// The right subtree at the last left turn holds the next keys once the
+	// leaf for the key is passed.
+	var next *Node
+	node := root
+	for !node.isLeaf() {
+		if t.compare(key, node.key) < 0 {
+			next = node
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if cmp := t.compare(node.key, key); cmp > 0 || (inclusive && cmp == 0) {
+		return node.key, node.value, true, nil
+	}
+	if next == nil {
+		return nil, nil, false, nil
+	}
+	if node, err = next.getRightNode(t); err == nil {
+		node, err = node.lmd(t)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return node.key, node.value, true, nil
+}
+
+// prev returns the largest key smaller than the given key, or equal to it if
+// inclusive.
+func (t *ImmutableTree) prev(key []byte, inclusive bool) (k, v []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, false, nil
+	}
+	// The left subtree at the last right turn holds the previous keys once
+	// the leaf for the key is passed.
+	var prev *Node
+	node := root
+	for !node.isLeaf() {
+		if t.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			prev = node
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if cmp := t.compare(node.key, key); cmp < 0 || (inclusive && cmp == 0) {
+		return node.key, node.value, true, nil
+	}
+	if prev == nil {
+		return nil, nil, false, nil
+	}
+	if node, err = prev.getLeftNode(t); err == nil {
+		node, err = node.rmd(t)
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return node.key, node.value, true, nil
 }
 
 // GetByIndex gets the key and value at the specified index.
-func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte) {
-	if t.root == nil {
-		return nil, nil
+func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil, nil, nil
 	}
-	return t.root.getByIndex(t, index)
+	return root.getByIndex(t, index)
 }
 
-// Iterate iterates over all keys of the tree, in order.
-func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
-	if t.root == nil {
-		return false
+// HashAtIndex returns the hash of the leaf at the index in the sorted order
+// of keys, so that a leaf referenced by its index can be checked later, e.g.
+// against a proof of its key. It returns false if the index is out of range.
+// The hashes of the nodes changed since the tree was last hashed are computed
+// first.
+func (t *ImmutableTree) HashAtIndex(index int64) (leafHash []byte, ok bool, err error) {
+	root := t.loadRoot()
+	if root == nil || index < 0 || index >= root.size {
+		return nil, false, nil
+	}
+	t.hashWithCount(root)
+	leaf, err := root.getLeafByIndex(t, index)
+	if err != nil {
+		return nil, false, err
+	}
+	return leaf.hash, true, nil
+}
+
+// GetByIndexRange gets the keys and values with index between fromIndex
+// (inclusive) and toIndex (exclusive), in order. Indexes past the end of the
+// tree are ignored, so the result may hold fewer than toIndex-fromIndex
+// entries. It returns nil if fromIndex is negative or not less than toIndex.
+func (t *ImmutableTree) GetByIndexRange(fromIndex, toIndex int64) (keys [][]byte, values [][]byte, err error) {
+	root := t.loadRoot()
+	if root == nil || fromIndex < 0 || fromIndex >= toIndex {
+		return nil, nil, nil
+	}
+	if toIndex > root.size {
+		toIndex = root.size
+	}
+	if fromIndex >= toIndex {
+		return nil, nil, nil
+	}
+	keys = make([][]byte, 0, toIndex-fromIndex)
+	values = make([][]byte, 0, toIndex-fromIndex)
+	if err := root.appendByIndexRange(t, fromIndex, toIndex, &keys, &values); err != nil {
+		return nil, nil, err
+	}
+	return keys, values, nil
+}
+
+// Head gets the n smallest keys and their values, in ascending order, or all
+// of them if the tree holds fewer. Only the nodes leading to them are visited.
+func (t *ImmutableTree) Head(n int) (keys [][]byte, values [][]byte, err error) {
+	return t.GetByIndexRange(0, int64(n))
+}
+
+// Tail gets the n largest keys and their values, in descending order, or all
+// of them if the tree holds fewer. Only the nodes leading to them are visited.
+func (t *ImmutableTree) Tail(n int) (keys [][]byte, values [][]byte, err error) {
+	root := t.loadRoot()
+	if root == nil || n <= 0 {
+		return nil, nil, nil
 	}
-	return t.root.traverse(t, true, func(node *Node) bool {
+	from := root.size - int64(n)
+	if from < 0 {
+		from = 0
+	}
+	keys, values = make([][]byte, 0, root.size-from), make([][]byte, 0, root.size-from)
+	if err := root.appendByIndexRange(t, from, root.size, &keys, &values); err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+		values[i], values[j] = values[j], values[i]
+	}
+	return keys, values, nil
+}
+
+// CountInRange returns the number of keys between start (inclusive) and end
+// (exclusive). If either are nil, then it is open on that side. It runs in
+// O(log n), using the subtree sizes stored in the inner nodes.
+func (t *ImmutableTree) CountInRange(start, end []byte) (int64, error) {
+	root := t.loadRoot()
+	if root == nil {
+		return 0, nil
+	}
+	return root.countInRange(t, start, end, nil, nil)
+}
+
+// Iterate iterates over all keys of the tree, in order. The iteration stops
+// early if fn returns true, or if a node can't be loaded, in which case the
+// error is returned. The keys and values must not be modified, see Get.
+func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	return root.traverse(t, true, func(node *Node) bool {
 		if node.height == 0 {
 			return fn(node.key, node.value)
 		}
@@ -161,13 +859,47 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped
 	})
 }
 
+// Fold calls fn on each key and value in ascending order of keys, with the
+// result of the previous call, or init for the first one, and returns the last
+// result, e.g. to sum values without keeping the sum outside of fn. Returning
+// stop from fn ends the fold with its result.
+func (t *ImmutableTree) Fold(init interface{}, fn func(acc interface{}, key, value []byte) (result interface{}, stop bool)) (interface{}, error) {
+	acc := init
+	_, err := t.Iterate(func(key, value []byte) (stop bool) {
+		acc, stop = fn(acc, key, value)
+		return stop
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
 // IterateRange makes a callback for all nodes with key between start and end non-inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate)
-func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool) {
-	if t.root == nil {
+func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	return root.traverseInRange(t, start, end, ascending, false, 0, func(node *Node, _ uint8) bool {
+		if node.height == 0 {
+			return fn(node.key, node.value)
+		}
 		return false
+	})
+}
+
+// IterateRangeBounds makes a callback for all nodes with key between start and
+// end, where startInclusive and endInclusive control whether a key equal to
+// start or end is included. If either are nil, then it is open on that side.
+// An exclusive start allows resuming an iteration after the last key seen.
+func (t *ImmutableTree) IterateRangeBounds(start, end []byte, startInclusive, endInclusive, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
 	}
-	return t.root.traverseInRange(t, start, end, ascending, false, 0, func(node *Node, _ uint8) bool {
+	return root.traverseInBounds(t, start, end, startInclusive, endInclusive, ascending, 0, func(node *Node, _ uint8) bool {
 		if node.height == 0 {
 			return fn(node.key, node.value)
 		}
@@ -175,13 +907,41 @@ func (t *ImmutableTree) IterateRange(start, end []byte, ascending bool, fn func(
 	})
 }
 
+// Page returns up to limit pairs with keys strictly after afterKey, or from
+// the first key if afterKey is nil, in ascending order, for paginated APIs.
+// The next page starts after nextCursor, the last key returned, and done tells
+// whether there are no more pairs after it. The traversal stops after the key
+// following the page, which tells whether it was the last one.
+func (t *ImmutableTree) Page(afterKey []byte, limit int) (kvs []KVPair, nextCursor []byte, done bool, err error) {
+	if limit <= 0 {
+		return nil, nil, false, errors.Wrapf(ErrInvalidInputs, "page limit %d", limit)
+	}
+	more := false
+	_, err = t.IterateRangeBounds(afterKey, nil, false, false, true, func(key, value []byte) bool {
+		if len(kvs) == limit {
+			more = true
+			return true
+		}
+		kvs = append(kvs, KVPair{Key: key, Value: value})
+		return false
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(kvs) > 0 {
+		nextCursor = kvs[len(kvs)-1].Key
+	}
+	return kvs, nextCursor, !more, nil
+}
+
 // IterateRangeInclusive makes a callback for all nodes with key between start and end inclusive.
 // If either are nil, then it is open on that side (nil, nil is the same as Iterate)
-func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool, fn func(key, value []byte, version int64) bool) (stopped bool) {
-	if t.root == nil {
-		return false
+func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool, fn func(key, value []byte, version int64) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
 	}
-	return t.root.traverseInRange(t, start, end, ascending, true, 0, func(node *Node, _ uint8) bool {
+	return root.traverseInRange(t, start, end, ascending, true, 0, func(node *Node, _ uint8) bool {
 		if node.height == 0 {
 			return fn(node.key, node.value, node.version)
 		}
@@ -189,6 +949,91 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 	})
 }
 
+// IterateReverseFrom makes a callback for all nodes with key smaller than or,
+// if inclusive, equal to start, in descending order. A nil start begins from
+// the largest key. For descending pagination, each page after the first
+// resumes from the last key of the previous one, exclusively.
+func (t *ImmutableTree) IterateReverseFrom(start []byte, inclusive bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	return t.IterateRangeBounds(nil, start, true, inclusive, false, fn)
+}
+
+// IteratePrefix makes a callback for all nodes with key starting with prefix,
+// in ascending order. An empty prefix is the same as Iterate. With a custom
+// comparator, it returns ErrPrefixCompareUnsupported.
+func (t *ImmutableTree) IteratePrefix(prefix []byte, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	if t.ndb != nil && t.ndb.opts.Compare != nil {
+		return false, ErrPrefixCompareUnsupported
+	}
+	return t.IterateRange(prefix, prefixEnd(prefix), true, fn)
+}
+
+// Subtree returns a new tree holding exactly the pairs of the tree in the
+// range [start, end), where nil bounds are unbounded, e.g. to hand a part of
+// the state over. It is built from the sorted pairs of the range in O(k), so
+// its shape and root hash only depend on the pairs and the version, not on
+// how the tree was changed: its nodes all have the version of the tree. It
+// has the options of the tree, and an in-memory database of its own.
+func (t *ImmutableTree) Subtree(start, end []byte) (*ImmutableTree, error) {
+	var kvs []KVPair
+	if _, err := t.IterateRange(start, end, true, func(key, value []byte) bool {
+		kvs = append(kvs, KVPair{Key: key, Value: value})
+		return false
+	}); err != nil {
+		return nil, err
+	}
+	opts := DefaultOptions()
+	if t.ndb != nil {
+		*opts = t.ndb.opts
+	}
+	subtree := &ImmutableTree{
+		ndb:     newNodeDB(dbm.NewMemDB(), 0, opts),
+		version: t.version,
+	}
+	if len(kvs) > 0 {
+		subtree.root = loadFromSorted(kvs, t.version)
+	}
+	return subtree, nil
+}
+
+// Validate checks that the tree is well-formed: the heights, sizes and keys
+// of the inner nodes match their children, the tree is balanced, and every
+// hash matches the recomputed one. It returns an error naming the first node
+// which violates them, or which cannot be loaded. It is meant for debugging
+// and for detecting corruption, and loads the whole tree.
+func (t *ImmutableTree) Validate() (err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return nil
+	}
+	_, _, err = root.validate(t, nil, nil)
+	return err
+}
+
+// CheckKeyInvariant checks that the key of every inner node is the leftmost
+// key of its right subtree, which lookups and traversals rely on, and returns
+// an error identifying the first node which breaks it. Unlike Validate, it
+// checks nothing else and hashes nothing, so it is a cheaper way to detect
+// corrupted keys. Each node is visited once.
+func (t *ImmutableTree) CheckKeyInvariant() error {
+	root := t.loadRoot()
+	if root == nil {
+		return nil
+	}
+	_, err := root.checkKeyInvariant(t)
+	return err
+}
+
+// loadRoot returns the root with an atomic load, so that readers get a
+// consistent snapshot of the tree while a writer swaps in a new root.
+func (t *ImmutableTree) loadRoot() *Node {
+	return (*Node)(atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&t.root))))
+}
+
+// storeRoot replaces the root with an atomic store. See loadRoot.
+func (t *ImmutableTree) storeRoot(root *Node) {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&t.root)), unsafe.Pointer(root))
+}
+
 // Clone creates a clone of the tree.
 // Used internally by MutableTree.
 func (t *ImmutableTree) clone() *ImmutableTree {
@@ -196,15 +1041,18 @@ func (t *ImmutableTree) clone() *ImmutableTree {
 		root:    t.root,
 		ndb:     t.ndb,
 		version: t.version,
+		bloom:   t.bloom,
 	}
 }
 
-// nodeSize is like Size, but includes inner nodes too.
+// nodeSize is like Size, but includes inner nodes too. Only used in testing.
 func (t *ImmutableTree) nodeSize() int {
 	size := 0
-	t.root.traverse(t, true, func(n *Node) bool {
+	if _, err := t.root.traverse(t, true, func(n *Node) bool {
 		size++
 		return false
-	})
+	}); err != nil {
+		panic(err)
+	}
 	return size
 }
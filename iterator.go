@@ -0,0 +1,255 @@
+package iavl
+
+import (
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Iterator is a pull-based cursor over the leaves of an ImmutableTree within
+// the domain [start, end). It implements dbm.Iterator.
+//
+// Unlike Iterate and IterateRange, it does not run the traversal through a
+// callback: the pending inner nodes are kept on an explicit stack, so a caller
+// may stop at any point without leaking a goroutine.
+type Iterator struct {
+	start, end []byte
+	ascending  bool
+
+	t     *ImmutableTree
+	stack []*Node // Nodes still to be visited, the next one on top.
+
+	key, value []byte
+	valid      bool
+	err        error
+}
+
+var _ dbm.Iterator = (*Iterator)(nil)
+
+// Iterator returns an iterator over the leaves with key between start
+// (inclusive) and end (exclusive). If either are nil, then it is open on that
+// side. The iterator must be closed with Close when no longer needed.
+func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) *Iterator {
+	iter := &Iterator{
+		start:     start,
+		end:       end,
+		ascending: ascending,
+		t:         t,
+	}
+	if root := t.loadRoot(); root != nil {
+		iter.stack = append(iter.stack, root)
+	}
+	iter.next()
+	return iter
+}
+
+// Domain implements dbm.Iterator.
+func (iter *Iterator) Domain() (start, end []byte) {
+	return iter.start, iter.end
+}
+
+// Valid implements dbm.Iterator.
+func (iter *Iterator) Valid() bool {
+	return iter.valid
+}
+
+// Next implements dbm.Iterator.
+func (iter *Iterator) Next() {
+	iter.assertIsValid()
+	iter.next()
+}
+
+// Key implements dbm.Iterator.
+func (iter *Iterator) Key() []byte {
+	iter.assertIsValid()
+	return iter.key
+}
+
+// Value implements dbm.Iterator.
+func (iter *Iterator) Value() []byte {
+	iter.assertIsValid()
+	return iter.value
+}
+
+// Error returns the error which ended the iteration early, if a node couldn't
+// be loaded. The iterator is then invalid.
+func (iter *Iterator) Error() error {
+	return iter.err
+}
+
+// Close implements dbm.Iterator.
+func (iter *Iterator) Close() {
+	iter.t = nil
+	iter.stack = nil
+	iter.key, iter.value = nil, nil
+	iter.valid = false
+}
+
+// next pops nodes off the stack until it finds a leaf within the domain,
+// pushing the children of inner nodes that may hold keys in the domain, using
+// the same bounds checks as traverseInRange.
+func (iter *Iterator) next() {
+	for len(iter.stack) > 0 {
+		node := iter.stack[len(iter.stack)-1]
+		iter.stack = iter.stack[:len(iter.stack)-1]
+
+		afterStart := iter.start == nil || iter.t.compare(iter.start, node.key) < 0
+		startOrAfter := iter.start == nil || iter.t.compare(iter.start, node.key) <= 0
+		beforeEnd := iter.end == nil || iter.t.compare(node.key, iter.end) < 0
+
+		if node.isLeaf() {
+			if startOrAfter && beforeEnd {
+				iter.key, iter.value, iter.valid = node.key, node.value, true
+				return
+			}
+			continue
+		}
+
+		left, right, err := node.getChildren(iter.t)
+		if err != nil {
+			iter.err = err
+			break
+		}
+		// Push the child to visit first last, so it ends up on top.
+		if iter.ascending {
+			if beforeEnd {
+				iter.stack = append(iter.stack, right)
+			}
+			if afterStart {
+				iter.stack = append(iter.stack, left)
+			}
+		} else {
+			if afterStart {
+				iter.stack = append(iter.stack, left)
+			}
+			if beforeEnd {
+				iter.stack = append(iter.stack, right)
+			}
+		}
+	}
+	iter.stack = nil
+	iter.key, iter.value, iter.valid = nil, nil, false
+}
+
+func (iter *Iterator) assertIsValid() {
+	if !iter.valid {
+		panic("iterator is invalid")
+	}
+}
+
+// iterateFastWindow is the largest number of leaves in the subtrees which
+// IterateFast loads a level at a time.
+const iterateFastWindow = 256
+
+// IterateFast iterates over all keys of the tree, in ascending or descending
+// order, like Iterate. Rather than reading the nodes of a persisted tree one by
+// one as it descends, it splits the tree into subtrees of up to a few hundred
+// leaves, and reads each of them a level at a time, in the order of the node
+// keys in the database. Each node is read once per scan, and the nodes read
+// are not added to the node cache, so a full scan neither evicts the nodes
+// which are read often nor slows down from cache churn.
+//
+// The iteration stops early if fn returns true, or if a node can't be loaded,
+// in which case the error is returned. The keys and values must not be
+// modified, see Get.
+func (t *ImmutableTree) IterateFast(ascending bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	root := t.loadRoot()
+	if root == nil {
+		return false, nil
+	}
+	return t.iterateFast(root, ascending, fn)
+}
+
+func (t *ImmutableTree) iterateFast(node *Node, ascending bool, fn func(key []byte, value []byte) bool) (bool, error) {
+	if node.size <= iterateFastWindow {
+		children, err := t.loadSubtree(node)
+		if err != nil {
+			return false, err
+		}
+		return iterateLoaded(node, children, ascending, fn), nil
+	}
+
+	children, err := t.loadChildren([]*Node{node})
+	if err != nil {
+		return false, err
+	}
+	first, second := children[node][0], children[node][1]
+	if !ascending {
+		first, second = second, first
+	}
+	if stop, err := t.iterateFast(first, ascending, fn); stop || err != nil {
+		return stop, err
+	}
+	return t.iterateFast(second, ascending, fn)
+}
+
+// loadSubtree loads all the nodes of the subtree a level at a time, and
+// returns the children of its inner nodes.
+func (t *ImmutableTree) loadSubtree(node *Node) (map[*Node][2]*Node, error) {
+	children := make(map[*Node][2]*Node, node.size)
+	for level := []*Node{node}; len(level) > 0; {
+		loaded, err := t.loadChildren(level)
+		if err != nil {
+			return nil, err
+		}
+		level = level[:0:0]
+		for parent, pair := range loaded {
+			children[parent] = pair
+			for _, child := range pair {
+				if !child.isLeaf() {
+					level = append(level, child)
+				}
+			}
+		}
+	}
+	return children, nil
+}
+
+// loadChildren returns the children of the inner nodes among the given ones,
+// reading those which aren't in memory with a single GetNodes.
+func (t *ImmutableTree) loadChildren(nodes []*Node) (map[*Node][2]*Node, error) {
+	type slot struct {
+		parent *Node
+		side   int
+	}
+	children := make(map[*Node][2]*Node, len(nodes))
+	var hashes [][]byte
+	var slots []slot
+	for _, node := range nodes {
+		if node.isLeaf() {
+			continue
+		}
+		pair := [2]*Node{node.leftNode, node.rightNode}
+		if pair[0] == nil {
+			hashes, slots = append(hashes, node.leftHash), append(slots, slot{node, 0})
+		}
+		if pair[1] == nil {
+			hashes, slots = append(hashes, node.rightHash), append(slots, slot{node, 1})
+		}
+		children[node] = pair
+	}
+	if len(hashes) == 0 {
+		return children, nil
+	}
+	loaded, err := t.ndb.GetNodes(hashes)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range slots {
+		pair := children[s.parent]
+		pair[s.side] = loaded[i]
+		children[s.parent] = pair
+	}
+	return children, nil
+}
+
+// iterateLoaded calls fn on the leaves of the subtree, whose inner nodes have
+// their children in the map.
+func iterateLoaded(node *Node, children map[*Node][2]*Node, ascending bool, fn func(key []byte, value []byte) bool) bool {
+	if node.isLeaf() {
+		return fn(node.key, node.value)
+	}
+	first, second := children[node][0], children[node][1]
+	if !ascending {
+		first, second = second, first
+	}
+	return iterateLoaded(first, children, ascending, fn) || iterateLoaded(second, children, ascending, fn)
+}
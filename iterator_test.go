@@ -0,0 +1,170 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestIterator(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 200; i++ {
+		tree.Set(randBytes(2), randBytes(8))
+	}
+	// Persist part of the tree so the iterator also loads nodes from the db.
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set(randBytes(2), randBytes(8))
+	}
+
+	ranges := [][2][]byte{
+		{nil, nil},
+		{randBytes(2), nil},
+		{nil, randBytes(2)},
+		{{0x40}, {0xc0}},
+		{{0xf0, 0x00}, {0xf0, 0x01}},
+	}
+	for _, r := range ranges {
+		start, end := r[0], r[1]
+		for _, ascending := range []bool{true, false} {
+			var expected [][]byte
+			tree.IterateRange(start, end, ascending, func(key, value []byte) bool {
+				expected = append(expected, key, value)
+				return false
+			})
+
+			var actual [][]byte
+			iter := tree.Iterator(start, end, ascending)
+			for ; iter.Valid(); iter.Next() {
+				actual = append(actual, iter.Key(), iter.Value())
+			}
+			iter.Close()
+
+			require.Equal(t, expected, actual, "start %X end %X ascending %v", start, end, ascending)
+		}
+	}
+}
+
+func TestIteratorEarlyClose(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		tree.Set([]byte(k), []byte(k))
+	}
+
+	iter := tree.Iterator([]byte("b"), []byte("e"), true)
+	start, end := iter.Domain()
+	require.Equal(t, []byte("b"), start)
+	require.Equal(t, []byte("e"), end)
+	require.True(t, iter.Valid())
+	require.Equal(t, []byte("b"), iter.Key())
+	iter.Next()
+	require.Equal(t, []byte("c"), iter.Key())
+	iter.Close()
+
+	require.False(t, iter.Valid())
+	require.Panics(t, func() { iter.Key() })
+	require.Panics(t, func() { iter.Next() })
+}
+
+func TestIteratorEmptyTree(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	iter := tree.Iterator(nil, nil, true)
+	require.False(t, iter.Valid())
+	iter.Close()
+}
+
+func TestIterateFast(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 2000; i++ {
+		tree.Set(randBytes(3), randBytes(8))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	collect := func(iterate func(bool, func(key, value []byte) bool) (bool, error), ascending bool) [][]byte {
+		var kvs [][]byte
+		stopped, err := iterate(ascending, func(key, value []byte) bool {
+			kvs = append(kvs, key, value)
+			return false
+		})
+		require.NoError(t, err)
+		require.False(t, stopped)
+		return kvs
+	}
+	requireSame := func(tree *ImmutableTree) {
+		for _, ascending := range []bool{true, false} {
+			expected := collect(func(ascending bool, fn func(key, value []byte) bool) (bool, error) {
+				return tree.IterateRange(nil, nil, ascending, fn)
+			}, ascending)
+			require.Len(t, expected, 2*int(tree.Size()))
+			require.Equal(t, expected, collect(tree.IterateFast, ascending), "ascending %v", ascending)
+		}
+	}
+
+	// A cold tree, whose nodes are all read from the database, once each,
+	// without filling the cache.
+	cold := NewMutableTree(memDB, 100)
+	_, err = cold.Load()
+	require.NoError(t, err)
+	collect(cold.IterateFast, true)
+	_, misses := cold.NodeCacheStats()
+	require.EqualValues(t, 2*cold.Size()-1, misses)
+	require.Len(t, cold.ndb.nodeCache, 1) // The root, cached by Load.
+	requireSame(cold.ImmutableTree)
+
+	// A working tree mixing saved and unsaved nodes.
+	for i := 0; i < 300; i++ {
+		tree.Set(randBytes(3), randBytes(8))
+	}
+	requireSame(tree.ImmutableTree)
+
+	// Stopping early.
+	var count int
+	stopped, err := tree.IterateFast(false, func(key, value []byte) bool {
+		count++
+		return count == 10
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 10, count)
+}
+
+func BenchmarkIterateFast(b *testing.B) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100000; i++ {
+		tree.Set(randBytes(8), randBytes(32))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+
+	iterations := map[string]func(*ImmutableTree) (bool, error){
+		"Iterate": func(tree *ImmutableTree) (bool, error) {
+			return tree.Iterate(func(key, value []byte) bool { return false })
+		},
+		"IterateFast": func(tree *ImmutableTree) (bool, error) {
+			return tree.IterateFast(true, func(key, value []byte) bool { return false })
+		},
+	}
+	for name, iterate := range iterations {
+		b.Run(name, func(b *testing.B) {
+			var reads int64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				cold := NewMutableTree(memDB, 10000)
+				_, err := cold.Load()
+				require.NoError(b, err)
+				b.StartTimer()
+
+				_, err = iterate(cold.ImmutableTree)
+				require.NoError(b, err)
+				_, misses := cold.NodeCacheStats()
+				reads += misses
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
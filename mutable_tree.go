@@ -2,7 +2,9 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"sort"
 
 	"github.com/pkg/errors"
@@ -13,19 +15,61 @@ import (
 // ErrVersionDoesNotExist is returned if a requested version does not exist.
 var ErrVersionDoesNotExist = fmt.Errorf("version does not exist")
 
+// ErrKeyTooLong and ErrValueTooLong are returned when setting a key or value
+// longer than Options.MaxKeyLength or Options.MaxValueLength.
+var (
+	ErrKeyTooLong   = fmt.Errorf("key too long")
+	ErrValueTooLong = fmt.Errorf("value too long")
+)
+
+// ErrFrozen is returned when changing the working tree of a frozen tree, see
+// MutableTree.Freeze.
+var ErrFrozen = fmt.Errorf("tree is frozen")
+
+// ErrKeysOnly is returned when setting a value in a keys-only tree, or adding
+// a key without a value to a tree of pairs, see Options.KeysOnly.
+var ErrKeysOnly = fmt.Errorf("keys-only mismatch")
+
+// maxPathLen is the tree height up to which set and remove keep the path from
+// the root in a fixed array on the goroutine stack; deeper paths spill over to
+// the heap. An AVL tree of this height holds more leaves than fit in memory.
+const maxPathLen = 64
+
 // MutableTree is a persistent tree which keeps track of versions.
+//
+// A MutableTree has a single writer. Set and Remove build a new root by
+// copying the nodes on their path and swap it in atomically, so reads of keys
+// from the working tree may run concurrently with them from any number of
+// goroutines, without ever observing a partial change. Saving a version,
+// computing the working hash or proofs, and loading or deleting versions
+// update nodes and tree state in place, so they must not run concurrently with
+// anything else; trees returned by GetImmutable may be read at any time.
 type MutableTree struct {
 	*ImmutableTree                  // The current, working tree.
 	lastSaved      *ImmutableTree   // The most recently saved tree.
 	orphans        map[string]int64 // Nodes removed by changes to working tree.
 	versions       map[int64]bool   // The previous, saved versions of the tree.
+	frozen         bool             // Whether changes to the working tree are rejected.
 	ndb            *nodeDB
 }
 
 // NewMutableTree returns a new tree with the specified cache size and datastore.
+// The datastore must not hold another, independent tree: nodes are keyed by
+// their hash, without reference counts, so deleting a version of one tree
+// would delete the nodes it orphaned even if versions of the other still use
+// them. Independent trees need a datastore each, e.g. a dbm.NewPrefixDB.
 func NewMutableTree(db dbm.DB, cacheSize int) *MutableTree {
-	ndb := newNodeDB(db, cacheSize)
+	return NewMutableTreeWithOpts(db, cacheSize, nil)
+}
+
+// NewMutableTreeWithOpts returns a new tree with the specified options. Nil
+// options give the default behavior.
+func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) *MutableTree {
+	ndb := newNodeDB(db, cacheSize, opts)
 	head := &ImmutableTree{ndb: ndb}
+	if ndb.opts.BloomFilterBits > 0 {
+		head.bloom = newBloomFilter(ndb.opts.BloomFilterBits)
+	}
 
 	return &MutableTree{
 		ImmutableTree: head,
@@ -36,6 +80,61 @@ func NewMutableTree(db dbm.DB, cacheSize int) *MutableTree {
 	}
 }
 
+// Freeze makes every following change to the working tree, such as Set or
+// Remove, return ErrFrozen instead of building a new root, e.g. to hand the
+// tree to readers as a fixed state once a version is saved. Reads and proofs
+// are still served. Saving, loading and deleting versions aren't affected.
+func (tree *MutableTree) Freeze() {
+	tree.frozen = true
+}
+
+// IsFrozen returns whether the tree is frozen, see Freeze.
+func (tree *MutableTree) IsFrozen() bool {
+	return tree.frozen
+}
+
+// Thaw returns a clone of the tree which can be changed, as with Clone, while
+// the tree itself stays frozen for its readers.
+func (tree *MutableTree) Thaw() *MutableTree {
+	return tree.Clone()
+}
+
+// SetObserver registers an observer notified of the node operations of the
+// database of the tree, and of the trees of its saved versions, replacing any
+// previous one. A nil observer removes it.
+func (tree *MutableTree) SetObserver(observer NodeDBObserver) {
+	tree.ndb.setObserver(observer)
+}
+
+// SetWAL makes the tree append the database writes of each version it saves
+// or deletes to a write-ahead log before making them, and truncate the log
+// once they are made, so that a database which can't write a batch
+// atomically is never left with part of a version. It first recovers the
+// database from the log: a version logged in full is written again, and one
+// interrupted while being logged is dropped, as none of its writes were made.
+// It must be called before loading a version. A nil log stops logging.
+func (tree *MutableTree) SetWAL(wal WALWriter) error {
+	return tree.ndb.setWAL(wal)
+}
+
+// DeferCommits makes SaveVersion, DeleteVersion and the other methods which
+// commit to the database write to memory instead, until FlushCommits commits
+// all their writes in a single batch, e.g. to save a version and prune old ones
+// in one backing-store transaction. The tree, and the trees sharing its
+// database, read the deferred writes as if they were committed, but other trees
+// opened on the database don't, and they are lost if the process stops before
+// the flush. A write-ahead log can't be set while commits are deferred.
+func (tree *MutableTree) DeferCommits() {
+	tree.ndb.deferCommits()
+}
+
+// FlushCommits commits the writes deferred since DeferCommits to the database
+// in a single batch, logged to the write-ahead log if one is set, and stops
+// deferring commits. It does nothing if commits aren't deferred.
+func (tree *MutableTree) FlushCommits() error {
+	return tree.ndb.flushCommits()
+}
+
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
 // not empty can be saved.
 func (tree *MutableTree) IsEmpty() bool {
@@ -68,7 +167,9 @@ func (tree *MutableTree) Hash() []byte {
 	return nil
 }
 
-// WorkingHash returns the hash of the current working tree.
+// WorkingHash returns the hash of the current working tree, including the
+// unsaved changes, or nil if it is empty. It gives the state root after a batch
+// of changes without saving a version.
 func (tree *MutableTree) WorkingHash() []byte {
 	return tree.ImmutableTree.Hash()
 }
@@ -84,161 +185,581 @@ func (tree *MutableTree) prepareOrphansSlice() []*Node {
 	return make([]*Node, 0, tree.Height()+3)
 }
 
-// Set sets a key in the working tree. Nil values are not supported.
-func (tree *MutableTree) Set(key, value []byte) bool {
-	orphaned, updated := tree.set(key, value)
-	tree.addOrphans(orphaned)
-	return updated
+// Set sets a key in the working tree, and returns whether it was an update of
+// an existing key. Nil values are not supported, but empty ones are, see Get.
+// If the key or value is longer than the options allow, or a node can't be
+// loaded, the error is returned and the working tree is left as is.
+func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
+	return tree.SetCB(key, value, nil)
+}
+
+// SetCB is like Set, and calls onOrphan, unless it is nil, on each saved node
+// which the change orphans, once the change is made. The hash and version of
+// the node are those to schedule its deletion with, e.g. to stream them to a
+// pruning queue. The nodes must not be modified.
+//
+// This is a notification, not a streaming path: the orphans of the change are
+// still collected first, since a failed change orphans nothing, and are still
+// recorded for SaveVersion, so it saves neither the slice nor the bookkeeping.
+func (tree *MutableTree) SetCB(key, value []byte, onOrphan func(*Node)) (updated bool, err error) {
+	_, orphaned, updated, err := tree.set(key, value)
+	if err != nil {
+		return false, err
+	}
+	tree.addOrphans(orphaned, onOrphan)
+	return updated, nil
+}
+
+// CompareAndSet sets the key to newValue only if its current value in the
+// working tree is expected, or, if expected is nil, only if the key is absent,
+// and returns whether it did. A mismatch leaves the working tree as is, so an
+// update computed from a value read earlier is never applied over a newer one.
+// The value is compared in the descent of the set, once its leaf is reached,
+// before any node is cloned.
+func (tree *MutableTree) CompareAndSet(key, expected, newValue []byte) (ok bool, err error) {
+	_, orphaned, _, ok, err := tree.setIf(key, newValue, func(value []byte, exists bool) bool {
+		return exists == (expected != nil) && bytes.Equal(value, expected)
+	})
+	if err != nil || !ok {
+		return false, err
+	}
+	tree.addOrphans(orphaned, nil)
+	return true, nil
+}
+
+// SetIfAbsent sets the key to the value only if the key is absent from the
+// working tree, and returns whether it did, e.g. to claim a unique id. A key
+// already in the tree keeps its value and version, and the tree is left as is.
+func (tree *MutableTree) SetIfAbsent(key, value []byte) (inserted bool, err error) {
+	return tree.CompareAndSet(key, nil, value)
+}
+
+// appendKeyLength is the length of the keys set by Append.
+const appendKeyLength = 8
+
+// Append sets the value under the key following the greatest key of the
+// working tree, as a log would, and returns the key. Keys are 8-byte
+// big-endian counters, so they are in the order of their appends, and the
+// first key of an empty tree is 0. It returns an error if the greatest key
+// isn't such a counter, or if the counter is at its maximum, and with a custom
+// comparator, which could order the keys otherwise.
+func (tree *MutableTree) Append(value []byte) (key []byte, err error) {
+	if tree.ndb.opts.Compare != nil {
+		return nil, errors.New("can't append to a tree with a custom comparator")
+	}
+	last, _, ok, err := tree.Max()
+	if err != nil {
+		return nil, err
+	}
+	var counter uint64
+	if ok {
+		if len(last) != appendKeyLength {
+			return nil, errors.Errorf("greatest key %X isn't a %d-byte counter", last, appendKeyLength)
+		}
+		if counter = binary.BigEndian.Uint64(last); counter == math.MaxUint64 {
+			return nil, errors.Errorf("greatest key %X is the maximum counter", last)
+		}
+		counter++
+	}
+	key = make([]byte, appendKeyLength)
+	binary.BigEndian.PutUint64(key, counter)
+	if _, err := tree.Set(key, value); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Replace sets the key to the value in the working tree like Set, and returns
+// the value it replaced and whether the key existed, in the same descent.
+func (tree *MutableTree) Replace(key, value []byte) (oldValue []byte, existed bool, err error) {
+	oldValue, orphaned, existed, err := tree.set(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	tree.addOrphans(orphaned, nil)
+	return oldValue, existed, nil
+}
+
+// Add adds the key to a keys-only tree, see Options.KeysOnly, and returns
+// whether it is new. A key already in the tree is left as is, along with the
+// version of its leaf.
+func (tree *MutableTree) Add(key []byte) (added bool, err error) {
+	if !tree.ndb.opts.KeysOnly {
+		return false, errors.Wrapf(ErrKeysOnly, "adding key %X to a tree of pairs", key)
+	}
+	if has, err := tree.Has(key); err != nil || has {
+		return false, err
+	}
+	if _, err := tree.Set(key, nil); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated bool) {
-	if value == nil {
+// InitFromSorted fills an empty working tree with the given pairs, which must
+// be sorted by strictly ascending key in the order of the tree, like
+// LoadFromSorted. It is much faster than calling Set for each pair, e.g. when
+// restoring a snapshot.
+func (tree *MutableTree) InitFromSorted(kvs []KVPair) error {
+	if tree.frozen {
+		return ErrFrozen
+	}
+	if tree.root != nil {
+		return errors.New("working tree is not empty")
+	}
+	for _, kv := range kvs {
+		if err := tree.ndb.opts.checkPair(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	if err := checkSorted(kvs, tree.compare, tree.ndb.opts.KeysOnly); err != nil {
+		return err
+	}
+	if len(kvs) > 0 {
+		for _, kv := range kvs {
+			tree.addToBloom(kv.Key)
+		}
+		tree.storeRoot(loadFromSorted(kvs, tree.version+1))
+	}
+	return nil
+}
+
+// BatchSet sets each of the given pairs in the working tree, in order. The
+// resulting tree, and its root hash, are the same as when calling Set for each
+// pair. Nil values are not supported.
+//
+// The new root is only published once all pairs are set, so the inner nodes
+// cloned for one pair don't have to be cloned again by the following pairs
+// whose path goes through them. Pairs sorted by key share the most of their
+// paths, and benefit the most.
+//
+// If a key or value is longer than the options allow, or a node can't be
+// loaded, the error is returned and none of the pairs are set.
+func (tree *MutableTree) BatchSet(kvs []KVPair) error {
+	if tree.frozen {
+		return ErrFrozen
+	}
+	for _, kv := range kvs {
+		if kv.Value == nil && !tree.ndb.opts.KeysOnly {
+			panic(fmt.Sprintf("Attempt to store nil value at key '%s'", kv.Key))
+		}
+		if err := tree.ndb.opts.checkPair(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+
+	root := tree.root
+	orphans := tree.prepareOrphansSlice()
+	fresh := make(map[*Node]bool)
+	for _, kv := range kvs {
+		tree.addToBloom(kv.Key)
+		if root == nil {
+			root = NewNode(kv.Key, kv.Value, tree.version+1)
+			continue
+		}
+		var err error
+		if root, _, _, err = tree.iterativeSet(root, kv.Key, kv.Value, nil, &orphans, fresh); err != nil {
+			return err
+		}
+	}
+	tree.storeRoot(root)
+	tree.addOrphans(orphans, nil)
+	return nil
+}
+
+// SetAtomic sets each of the given pairs in the working tree, in order, like
+// BatchSet, or none of them. The whole batch is validated before any pair is
+// set, and a nil value returns an error rather than panicking, so an invalid
+// pair anywhere in the batch leaves the working tree as is, as does a node
+// which can't be loaded.
+func (tree *MutableTree) SetAtomic(kvs []KVPair) error {
+	for i, kv := range kvs {
+		if kv.Value == nil && !tree.ndb.opts.KeysOnly {
+			return errors.Errorf("pair #%d: nil value at key %X", i, kv.Key)
+		}
+		if err := tree.ndb.opts.checkPair(kv.Key, kv.Value); err != nil {
+			return errors.Wrapf(err, "pair #%d", i)
+		}
+	}
+	return tree.BatchSet(kvs)
+}
+
+// addToBloom adds the key to the bloom filter of the tree, if it has one.
+func (tree *MutableTree) addToBloom(key []byte) {
+	if tree.bloom != nil {
+		tree.bloom.add(key)
+	}
+}
+
+// rebuildBloom replaces the bloom filter of the tree, if enabled, by one of the
+// keys of the working tree, reading the whole tree.
+func (tree *MutableTree) rebuildBloom() error {
+	if tree.ndb.opts.BloomFilterBits <= 0 {
+		return nil
+	}
+	bloom := newBloomFilter(tree.ndb.opts.BloomFilterBits)
+	if _, err := tree.ImmutableTree.Iterate(func(key, value []byte) bool {
+		bloom.add(key)
+		return false
+	}); err != nil {
+		return err
+	}
+	tree.ImmutableTree.bloom = bloom
+	tree.lastSaved.bloom = bloom
+	return nil
+}
+
+func (tree *MutableTree) set(key []byte, value []byte) (oldValue []byte, orphans []*Node, updated bool, err error) {
+	oldValue, orphans, updated, _, err = tree.setIf(key, value, nil)
+	return oldValue, orphans, updated, err
+}
+
+// setIf is like set, but only sets the key if match, unless it is nil, returns
+// true for its current value and whether it exists, and returns whether it did.
+func (tree *MutableTree) setIf(key []byte, value []byte, match func(value []byte, exists bool) bool) (
+	oldValue []byte, orphans []*Node, updated bool, ok bool, err error,
+) {
+	if tree.frozen {
+		return nil, nil, false, false, ErrFrozen
+	}
+	if value == nil && !tree.ndb.opts.KeysOnly {
 		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
 	}
+	if err := tree.ndb.opts.checkPair(key, value); err != nil {
+		return nil, nil, false, false, err
+	}
 
+	var newRoot *Node
 	if tree.ImmutableTree.root == nil {
-		tree.ImmutableTree.root = NewNode(key, value, tree.version+1)
-		return nil, updated
+		if match != nil && !match(nil, false) {
+			return nil, nil, false, false, nil
+		}
+		newRoot = NewNode(key, value, tree.version+1)
+	} else {
+		orphans = tree.prepareOrphansSlice()
+		newRoot, oldValue, updated, err = tree.iterativeSet(tree.root, key, value, match, &orphans, nil)
+		if err != nil {
+			return nil, nil, false, false, err
+		}
+		if newRoot == nil {
+			return nil, nil, false, false, nil
+		}
 	}
-
-	orphans = tree.prepareOrphansSlice()
-	tree.ImmutableTree.root, updated = tree.recursiveSet(tree.ImmutableTree.root, key, value, &orphans)
-	return orphans, updated
+	// The key is added to the bloom filter before the new root is published,
+	// so that concurrent readers never miss it.
+	tree.addToBloom(key)
+	tree.storeRoot(newRoot)
+	return oldValue, orphans, updated, true, nil
 }
 
-func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orphans *[]*Node) (
-	newSelf *Node, updated bool,
+// iterativeSet sets a key in the tree under root and returns the new root, and
+// the value it replaced if the key was updated. If match is not nil, it is
+// called with the current value of the key and whether it exists once the
+// leaf is reached, and if it returns false, nothing is cloned or orphaned and
+// the new root is nil.
+// Inner nodes in fresh were created by the caller for the working version and
+// are not reachable from any published root, so they are updated in place
+// rather than orphaned and cloned again. The clones made are added to fresh,
+// unless it is nil.
+func (tree *MutableTree) iterativeSet(root *Node, key []byte, value []byte, match func(value []byte, exists bool) bool,
+	orphans *[]*Node, fresh map[*Node]bool) (newSelf *Node, oldValue []byte, updated bool, err error,
 ) {
 	version := tree.version + 1
 
-	if node.isLeaf() {
-		switch bytes.Compare(key, node.key) {
-		case -1:
-			return &Node{
-				key:       node.key,
-				height:    1,
-				size:      2,
-				leftNode:  NewNode(key, value, version),
-				rightNode: node,
-				version:   version,
-			}, false
-		case 1:
-			return &Node{
-				key:       key,
-				height:    1,
-				size:      2,
-				leftNode:  node,
-				rightNode: NewNode(key, value, version),
-				version:   version,
-			}, false
-		default:
-			*orphans = append(*orphans, node)
-			return NewNode(key, value, version), true
+	// Walk down to the leaf.
+	var buf [maxPathLen]*Node
+	path := buf[:0]
+	node := root
+	for !node.isLeaf() {
+		path = append(path, node)
+		if tree.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(tree.ImmutableTree)
+		} else {
+			node, err = node.getRightNode(tree.ImmutableTree)
 		}
-	} else {
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if match != nil {
+		exists := tree.compare(key, node.key) == 0
+		var current []byte
+		if exists {
+			current = node.value
+		}
+		if !match(current, exists) {
+			return nil, nil, false, nil
+		}
+	}
+
+	// Orphan and clone the inner nodes on the path.
+	for i, inner := range path {
+		if !fresh[inner] {
+			*orphans = append(*orphans, inner)
+		}
+		path[i] = cloneUnlessFresh(inner, version, fresh)
+	}
+
+	// Splitting the leaf, the new inner node takes the key of whichever leaf
+	// ends up on its right, the leftmost key of its right subtree, as get and
+	// traverse expect.
+	switch tree.compare(key, node.key) {
+	case -1:
+		newSelf = newInnerNode()
+		*newSelf = Node{
+			key:       node.key,
+			height:    1,
+			size:      2,
+			leftNode:  NewNode(key, value, version),
+			rightNode: node,
+			version:   version,
+		}
+	case 1:
+		newSelf = newInnerNode()
+		*newSelf = Node{
+			key:       key,
+			height:    1,
+			size:      2,
+			leftNode:  node,
+			rightNode: NewNode(key, value, version),
+			version:   version,
+		}
+	default:
 		*orphans = append(*orphans, node)
-		node = node.clone(version)
+		newSelf, oldValue, updated = NewNode(key, value, version), node.value, true
+	}
+	if fresh != nil && !updated {
+		fresh[newSelf] = true
+	}
 
-		if bytes.Compare(key, node.key) < 0 {
-			node.leftNode, updated = tree.recursiveSet(node.getLeftNode(tree.ImmutableTree), key, value, orphans)
+	// Walk back up, attaching each new child to its cloned parent. An update
+	// leaves the shape of the tree as is, so there is nothing to rebalance.
+	for i := len(path) - 1; i >= 0; i-- {
+		node = path[i]
+		if tree.compare(key, node.key) < 0 {
+			node.leftNode = newSelf
 			node.leftHash = nil // leftHash is yet unknown
 		} else {
-			node.rightNode, updated = tree.recursiveSet(node.getRightNode(tree.ImmutableTree), key, value, orphans)
+			node.rightNode = newSelf
 			node.rightHash = nil // rightHash is yet unknown
 		}
-
-		if updated {
-			return node, updated
+		if !updated {
+			if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+				return nil, nil, false, err
+			}
+			if node, err = tree.balanceFresh(node, orphans, fresh); err != nil {
+				return nil, nil, false, err
+			}
 		}
-		node.calcHeightAndSize(tree.ImmutableTree)
-		newNode := tree.balance(node, orphans)
-		return newNode, updated
+		newSelf = node
 	}
+	return newSelf, oldValue, updated, nil
 }
 
-// Remove removes a key from the working tree.
-func (tree *MutableTree) Remove(key []byte) ([]byte, bool) {
-	val, orphaned, removed := tree.remove(key)
-	tree.addOrphans(orphaned)
-	return val, removed
+// Remove removes a key from the working tree, and returns its value and
+// whether it was found. If a node can't be loaded, the error is returned and
+// the working tree is left as is.
+func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	return tree.RemoveCB(key, nil)
+}
+
+// RemoveCB is like Remove, and calls onOrphan on each saved node which the
+// change orphans once it is made, like SetCB.
+func (tree *MutableTree) RemoveCB(key []byte, onOrphan func(*Node)) ([]byte, bool, error) {
+	val, orphaned, removed, err := tree.remove(key)
+	if err != nil {
+		return nil, false, err
+	}
+	tree.addOrphans(orphaned, onOrphan)
+	return val, removed, nil
 }
 
 // remove tries to remove a key from the tree and if removed, returns its
 // value, nodes orphaned and 'true'.
-func (tree *MutableTree) remove(key []byte) (value []byte, orphaned []*Node, removed bool) {
+func (tree *MutableTree) remove(key []byte) (value []byte, orphaned []*Node, removed bool, err error) {
+	if tree.frozen {
+		return nil, nil, false, ErrFrozen
+	}
 	if tree.root == nil {
-		return nil, nil, false
+		return nil, nil, false, nil
 	}
 	orphaned = tree.prepareOrphansSlice()
-	newRootHash, newRoot, _, value := tree.recursiveRemove(tree.root, key, &orphaned)
+	newRootHash, newRoot, _, value, err := tree.iterativeRemove(tree.root, key, &orphaned, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
 	if len(orphaned) == 0 {
-		return nil, nil, false
+		return nil, nil, false, nil
 	}
 
 	if newRoot == nil && newRootHash != nil {
-		tree.root = tree.ndb.GetNode(newRootHash)
-	} else {
-		tree.root = newRoot
+		if newRoot, err = tree.ndb.GetNode(newRootHash); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	tree.storeRoot(newRoot)
+	return value, orphaned, true, nil
+}
+
+// RemoveRange removes the keys between start (inclusive) and end (exclusive)
+// from the working tree, and returns how many were removed. If either are nil,
+// then it is open on that side. The result is the same as removing the keys one
+// by one, down to the root hash, but each inner node is cloned at most once, as
+// with BatchSet. If a node can't be loaded, the error is returned and the
+// working tree is left as is.
+func (tree *MutableTree) RemoveRange(start, end []byte) (removed int, err error) {
+	if tree.frozen {
+		return 0, ErrFrozen
+	}
+	var keys [][]byte
+	_, err = tree.IterateRange(start, end, true, func(key, _ []byte) bool {
+		keys = append(keys, key)
+		return false
+	})
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+
+	root := tree.root
+	orphans := tree.prepareOrphansSlice()
+	fresh := make(map[*Node]bool)
+	for _, key := range keys {
+		newRootHash, newRoot, _, _, err := tree.iterativeRemove(root, key, &orphans, fresh)
+		if err != nil {
+			return 0, err
+		}
+		if newRoot == nil && newRootHash != nil {
+			if newRoot, err = tree.ndb.GetNode(newRootHash); err != nil {
+				return 0, err
+			}
+		}
+		root = newRoot
+	}
+	tree.storeRoot(root)
+	tree.addOrphans(orphans, nil)
+	return len(keys), nil
+}
+
+// cloneUnlessFresh returns node itself if it is in fresh, and can so be updated
+// in place, or else a clone of it, which is added to fresh unless it is nil.
+func cloneUnlessFresh(node *Node, version int64, fresh map[*Node]bool) *Node {
+	if fresh[node] {
+		return node
+	}
+	clone := node.clone(version)
+	if fresh != nil {
+		fresh[clone] = true
+	}
+	return clone
+}
+
+// balanceFresh balances node like balance, and removes it from fresh if it was
+// replaced, and so released to the pool.
+func (tree *MutableTree) balanceFresh(node *Node, orphans *[]*Node, fresh map[*Node]bool) (*Node, error) {
+	balanced, err := tree.balance(node, orphans)
+	if err != nil {
+		return nil, err
+	}
+	if balanced != node {
+		delete(fresh, node)
 	}
-	return value, orphaned, true
+	return balanced, nil
 }
 
-// removes the node corresponding to the passed key and balances the tree.
+// removes the node corresponding to the passed key from the tree under root
+// and balances the tree. Inner nodes in fresh are updated in place, as in
+// iterativeSet, and the ones which are dropped are released to the node pool.
 // It returns:
-// - the hash of the new node (or nil if the node is the one removed)
-// - the node that replaces the orig. node after remove
+// - the hash of the new root (or nil if the root is the one removed)
+// - the node that replaces the orig. root after remove
 // - new leftmost leaf key for tree after successfully removing 'key' if changed.
 // - the removed value
 // - the orphaned nodes.
-func (tree *MutableTree) recursiveRemove(node *Node, key []byte, orphans *[]*Node) (newHash []byte, newSelf *Node, newKey []byte, newValue []byte) {
+func (tree *MutableTree) iterativeRemove(root *Node, key []byte, orphans *[]*Node, fresh map[*Node]bool) (
+	newHash []byte, newSelf *Node, newKey []byte, newValue []byte, err error,
+) {
 	version := tree.version + 1
 
-	if node.isLeaf() {
-		if bytes.Equal(key, node.key) {
-			*orphans = append(*orphans, node)
-			return nil, nil, nil, node.value
+	// Walk down to the leaf. Nothing is orphaned unless the key is found.
+	var buf [maxPathLen]*Node
+	path := buf[:0]
+	node := root
+	for !node.isLeaf() {
+		path = append(path, node)
+		if tree.compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(tree.ImmutableTree)
+		} else {
+			node, err = node.getRightNode(tree.ImmutableTree)
 		}
-		return node.hash, node, nil, nil
-	}
-
-	// node.key < key; we go to the left to find the key:
-	if bytes.Compare(key, node.key) < 0 {
-		newLeftHash, newLeftNode, newKey, value := tree.recursiveRemove(node.getLeftNode(tree.ImmutableTree), key, orphans)
-
-		if len(*orphans) == 0 {
-			return node.hash, node, nil, value
-		} else if newLeftHash == nil && newLeftNode == nil { // left node held value, was removed
-			return node.rightHash, node.rightNode, node.key, value
+		if err != nil {
+			return nil, nil, nil, nil, err
 		}
-		*orphans = append(*orphans, node)
-
-		newNode := node.clone(version)
-		newNode.leftHash, newNode.leftNode = newLeftHash, newLeftNode
-		newNode.calcHeightAndSize(tree.ImmutableTree)
-		newNode = tree.balance(newNode, orphans)
-		return newNode.hash, newNode, newKey, value
 	}
-	// node.key >= key; either found or look to the right:
-	newRightHash, newRightNode, newKey, value := tree.recursiveRemove(node.getRightNode(tree.ImmutableTree), key, orphans)
-
-	if len(*orphans) == 0 {
-		return node.hash, node, nil, value
-	} else if newRightHash == nil && newRightNode == nil { // right node held value, was removed
-		return node.leftHash, node.leftNode, nil, value
+	if !bytes.Equal(key, node.key) {
+		return root.hash, root, nil, nil, nil
 	}
 	*orphans = append(*orphans, node)
+	newValue = node.value
+
+	// Walk back up, orphaning and replacing each node on the path. The parent
+	// of the removed leaf is replaced by its other child, the others by a
+	// rebalanced clone.
+	for i := len(path) - 1; i >= 0; i-- {
+		node = path[i]
+		isFresh := fresh[node]
+		if !isFresh {
+			*orphans = append(*orphans, node)
+		}
 
-	newNode := node.clone(version)
-	newNode.rightHash, newNode.rightNode = newRightHash, newRightNode
-	if newKey != nil {
-		newNode.key = newKey
+		// node.key < key; we went to the left to find the key:
+		if tree.compare(key, node.key) < 0 {
+			if newHash == nil && newSelf == nil { // left node held value, was removed
+				newHash, newSelf, newKey = node.rightHash, node.rightNode, node.key
+				if isFresh {
+					delete(fresh, node)
+					releaseNode(node)
+				}
+				continue
+			}
+
+			newNode := cloneUnlessFresh(node, version, fresh)
+			newNode.leftHash, newNode.leftNode = newHash, newSelf
+			if err := newNode.calcHeightAndSize(tree.ImmutableTree); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			if newNode, err = tree.balanceFresh(newNode, orphans, fresh); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			newHash, newSelf = newNode.hash, newNode
+			continue
+		}
+		// node.key >= key; we went to the right:
+		if newHash == nil && newSelf == nil { // right node held value, was removed
+			newHash, newSelf, newKey = node.leftHash, node.leftNode, nil
+			if isFresh {
+				delete(fresh, node)
+				releaseNode(node)
+			}
+			continue
+		}
+
+		newNode := cloneUnlessFresh(node, version, fresh)
+		newNode.rightHash, newNode.rightNode = newHash, newSelf
+		if newKey != nil {
+			newNode.key = newKey
+		}
+		if err := newNode.calcHeightAndSize(tree.ImmutableTree); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if newNode, err = tree.balanceFresh(newNode, orphans, fresh); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		newHash, newSelf, newKey = newNode.hash, newNode, nil
 	}
-	newNode.calcHeightAndSize(tree.ImmutableTree)
-	newNode = tree.balance(newNode, orphans)
-	return newNode.hash, newNode, nil, value
+	return newHash, newSelf, newKey, newValue, nil
 }
 
-// Load the latest versioned tree from disk.
+// Load the latest versioned tree from disk. See LoadVersion.
 func (tree *MutableTree) Load() (int64, error) {
 	return tree.LoadVersion(int64(0))
 }
@@ -260,6 +781,9 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 	if latestVersion <= 0 {
 		return 0, nil
 	}
+	if err := tree.ndb.checkFormat(); err != nil {
+		return 0, err
+	}
 
 	// default to the latest version if the targeted version is non-positive
 	if targetVersion <= 0 {
@@ -271,22 +795,35 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		return latestVersion, ErrVersionDoesNotExist
 	}
 
+	root, err := tree.ndb.GetNode(rootHash)
+	if err != nil {
+		return latestVersion, err
+	}
 	tree.versions[targetVersion] = true
 
 	iTree := &ImmutableTree{
 		ndb:     tree.ndb,
 		version: targetVersion,
-		root:    tree.ndb.GetNode(rootHash),
+		root:    root,
 	}
 
 	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
+	if err := tree.rebuildBloom(); err != nil {
+		return targetVersion, err
+	}
 
 	return targetVersion, nil
 }
 
-// Returns the version number of the latest version found
+// LoadVersion loads the given saved version as the working tree, or the latest
+// one if the version is 0, and returns the version loaded. Only the root is
+// read: the other nodes are loaded from the database as they are needed, so a
+// process can resume from its last saved state without reading the whole tree,
+// unless Options.BloomFilterBits enables a bloom filter, which is rebuilt from
+// all the keys. If the version was never saved or has been deleted, the error wraps
+// ErrVersionDoesNotExist and the tree is left as is.
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	roots, err := tree.ndb.getRoots()
 	if err != nil {
@@ -296,12 +833,14 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	if len(roots) == 0 {
 		return 0, nil
 	}
+	if err := tree.ndb.checkFormat(); err != nil {
+		return 0, err
+	}
 
 	latestVersion := int64(0)
 
 	var latestRoot []byte
 	for version, r := range roots {
-		tree.versions[version] = true
 		if version > latestVersion && (targetVersion == 0 || version <= targetVersion) {
 			latestVersion = version
 			latestRoot = r
@@ -309,7 +848,7 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	}
 
 	if !(targetVersion == 0 || latestVersion == targetVersion) {
-		return latestVersion, fmt.Errorf("wanted to load target %v but only found up to %v",
+		return latestVersion, errors.Wrapf(ErrVersionDoesNotExist, "wanted to load target %v but only found up to %v",
 			targetVersion, latestVersion)
 	}
 
@@ -319,12 +858,20 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	}
 
 	if len(latestRoot) != 0 {
-		t.root = tree.ndb.GetNode(latestRoot)
+		if t.root, err = tree.ndb.GetNode(latestRoot); err != nil {
+			return latestVersion, err
+		}
 	}
 
+	for version := range roots {
+		tree.versions[version] = true
+	}
 	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = t
 	tree.lastSaved = t.clone()
+	if err := tree.rebuildBloom(); err != nil {
+		return latestVersion, err
+	}
 
 	return latestVersion, nil
 }
@@ -351,40 +898,167 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 			version: version,
 		}, nil
 	}
+	root, err := tree.ndb.GetNode(rootHash)
+	if err != nil {
+		return nil, err
+	}
 	return &ImmutableTree{
-		root:    tree.ndb.GetNode(rootHash),
+		root:    root,
 		ndb:     tree.ndb,
 		version: version,
 	}, nil
 }
 
+// MetadataMismatch is a node of which the stored height or size differ from
+// the ones computed from its children, see MutableTree.RecomputeMetadata.
+type MetadataMismatch struct {
+	Key          []byte
+	Hash         []byte // The hash of the node as it was loaded.
+	StoredHeight int8
+	StoredSize   int64
+	Height       int8
+	Size         int64
+}
+
+// RecomputeMetadata walks the whole working tree, recomputing the height and
+// size of each node bottom-up from its children rather than trusting the ones
+// read from disk, and returns the nodes of which they differ, e.g. after a bug
+// stored wrong ones, which lookups by index would silently trust. The nodes
+// are repaired in the working tree, like a change, by replacing each of them
+// and its ancestors with clones at the next version, so the repair is saved
+// with the next version. A tree without mismatches is left as is.
+func (tree *MutableTree) RecomputeMetadata() ([]MetadataMismatch, error) {
+	if tree.frozen {
+		return nil, ErrFrozen
+	}
+	if tree.root == nil {
+		return nil, nil
+	}
+	var (
+		mismatches []MetadataMismatch
+		orphans    []*Node
+	)
+	root, err := tree.recomputeMetadata(tree.root, &orphans, &mismatches)
+	if err != nil {
+		return nil, err
+	}
+	if len(mismatches) > 0 {
+		tree.addOrphans(orphans, nil)
+		tree.storeRoot(root)
+	}
+	return mismatches, nil
+}
+
+// recomputeMetadata returns the node, or a clone of it with the height and
+// size computed from its repaired children if they differ.
+func (tree *MutableTree) recomputeMetadata(node *Node, orphans *[]*Node, mismatches *[]MetadataMismatch) (*Node, error) {
+	version := tree.version + 1
+	if node.isLeaf() {
+		if node.size == 1 {
+			return node, nil
+		}
+		*mismatches = append(*mismatches, MetadataMismatch{
+			Key: node.key, Hash: node.hash, StoredSize: node.size, Size: 1,
+		})
+		*orphans = append(*orphans, node)
+		return NewNode(node.key, node.value, version), nil
+	}
+
+	left, right, err := node.getChildren(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	newLeft, err := tree.recomputeMetadata(left, orphans, mismatches)
+	if err != nil {
+		return nil, err
+	}
+	newRight, err := tree.recomputeMetadata(right, orphans, mismatches)
+	if err != nil {
+		return nil, err
+	}
+	height := maxInt8(newLeft.height, newRight.height) + 1
+	size := newLeft.size + newRight.size
+	if node.height != height || node.size != size {
+		*mismatches = append(*mismatches, MetadataMismatch{
+			Key: node.key, Hash: node.hash,
+			StoredHeight: node.height, StoredSize: node.size,
+			Height: height, Size: size,
+		})
+	} else if newLeft == left && newRight == right {
+		return node, nil
+	}
+
+	*orphans = append(*orphans, node)
+	node = node.clone(version)
+	if newLeft != left {
+		node.leftNode, node.leftHash = newLeft, nil
+	}
+	if newRight != right {
+		node.rightNode, node.rightHash = newRight, nil
+	}
+	node.height, node.size = height, size
+	return node, nil
+}
+
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
 func (tree *MutableTree) Rollback() {
 	if tree.version > 0 {
 		tree.ImmutableTree = tree.lastSaved.clone()
 	} else {
-		tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, version: 0}
+		tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, version: 0, bloom: tree.bloom}
 	}
 	tree.orphans = map[string]int64{}
 }
 
-// GetVersioned gets the value at the specified key and version.
+// Clone returns a copy of the tree, including unsaved changes, which can be
+// changed independently, e.g. to speculatively apply changes and maybe discard
+// them. Both trees share their nodes and database: changes copy the nodes on
+// their path instead of modifying them, so neither tree sees the changes of
+// the other. As saving writes to the shared database, at most one of the
+// trees may be saved, and the others must then be discarded.
+func (tree *MutableTree) Clone() *MutableTree {
+	orphans := make(map[string]int64, len(tree.orphans))
+	for hash, version := range tree.orphans {
+		orphans[hash] = version
+	}
+	versions := make(map[int64]bool, len(tree.versions))
+	for version, exists := range tree.versions {
+		versions[version] = exists
+	}
+	return &MutableTree{
+		ImmutableTree: tree.ImmutableTree.clone(),
+		lastSaved:     tree.lastSaved,
+		orphans:       orphans,
+		versions:      versions,
+		ndb:           tree.ndb,
+	}
+}
+
+// GetVersioned gets the value at the specified key and version, reading from
+// the root saved for that version. As with Get, a key absent from the version
+// gives the index it would have and a nil value. If the version was never
+// saved or has been deleted, the index is -1 and the value nil.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) (
-	index int64, value []byte,
+	index int64, value []byte, err error,
 ) {
 	if tree.versions[version] {
 		t, err := tree.GetImmutable(version)
-		if err != nil {
-			return -1, nil
+		if err == ErrVersionDoesNotExist {
+			return -1, nil, nil
+		} else if err != nil {
+			return -1, nil, err
 		}
 		return t.Get(key)
 	}
-	return -1, nil
+	return -1, nil, nil
 }
 
 // SaveVersion saves a new tree version to disk, based on the current state of
-// the tree. Returns the hash and new version number.
+// the tree. Returns the hash and new version number. The nodes created since
+// the last save are written along with the root of the version in one batch,
+// and are marked as persisted. Saving a version which another tree sharing the
+// database already saved, e.g. a clone, fails without writing anything.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 	version := tree.version + 1
 
@@ -404,26 +1078,35 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 			version, newHash, existingHash)
 	}
 
+	// Check the version before writing anything, so that a failed save leaves
+	// neither the database nor the nodes of the working tree changed. All
+	// writes then go to a single batch, so either the whole version lands or
+	// none of it.
+	if latest := tree.ndb.getLatestVersion(); version != latest+1 {
+		return nil, version, fmt.Errorf("must save consecutive versions. Expected %d, got %d", latest+1, version)
+	}
+
 	if tree.root == nil {
 		// There can still be orphans, for example if the root is the node being
 		// removed.
 		debug("SAVE EMPTY TREE %v\n", version)
 		tree.ndb.SaveOrphans(version, tree.orphans)
-		err := tree.ndb.SaveEmptyRoot(version)
-		if err != nil {
-			panic(err)
+		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
+			return nil, version, err
 		}
 	} else {
 		debug("SAVE TREE %v\n", version)
-		// Save the current tree.
+		// Save the current tree, hashed first so that it may be in parallel.
+		tree.ImmutableTree.hashWithCount(tree.root)
 		tree.ndb.SaveBranch(tree.root)
 		tree.ndb.SaveOrphans(version, tree.orphans)
-		err := tree.ndb.SaveRoot(tree.root, version)
-		if err != nil {
-			panic(err)
+		if err := tree.ndb.SaveRoot(tree.root, version); err != nil {
+			return nil, version, err
 		}
 	}
-	tree.ndb.Commit()
+	if err := tree.ndb.Commit(); err != nil {
+		return nil, version, err
+	}
 	tree.version = version
 	tree.versions[version] = true
 
@@ -435,6 +1118,29 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 	return tree.Hash(), version, nil
 }
 
+// Commit saves the working tree as a new version like SaveVersion, hashing
+// the nodes changed since the last save in a single pass first. Set, Remove
+// and the other mutations never hash nodes, so a block of changes can be made
+// without hashing anything and committed at its end. Only reads which need
+// hashes hash the working tree early, such as WorkingHash and the proofs, and
+// the nodes they hash must then be hashed again if they change.
+func (tree *MutableTree) Commit() ([]byte, int64, error) {
+	if tree.root != nil {
+		tree.ImmutableTree.hashWithCount(tree.root)
+	}
+	return tree.SaveVersion()
+}
+
+// DirtyNodes returns the number of nodes of the working tree which aren't
+// hashed yet: the nodes created by the changes since the last save, unless a
+// read hashed them. Commit hashes each of them once.
+func (tree *MutableTree) DirtyNodes() int64 {
+	if tree.root == nil {
+		return 0
+	}
+	return tree.root.countUnhashed()
+}
+
 // DeleteVersion deletes a tree version from disk. The version can then no
 // longer be accessed.
 func (tree *MutableTree) DeleteVersion(version int64) error {
@@ -449,13 +1155,107 @@ func (tree *MutableTree) DeleteVersion(version int64) error {
 	}
 
 	tree.ndb.DeleteVersion(version, true)
-	tree.ndb.Commit()
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
 
 	delete(tree.versions, version)
 
 	return nil
 }
 
+// Compact saves the working tree as a new version, like SaveVersion, then
+// deletes all the previous versions, like DeleteVersion, and returns the new
+// version and how many versions were deleted. It is akin to a database vacuum:
+// the database is left with only the nodes reachable from the new version, and
+// no orphans. The root hash is the working hash, as the nodes keep the version
+// they were created in, which is part of their hash.
+//
+// The versions are deleted oldest first, each in its own commit, since deleting
+// a version reads the orphans which the deletion of the previous one moved. If
+// one fails, the error is returned along with the count of the versions deleted
+// before it; those are gone, and it and the later ones are still available, so
+// they can be deleted with DeleteVersion.
+func (tree *MutableTree) Compact() (version int64, deleted int, err error) {
+	_, version, err = tree.SaveVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, v := range tree.AvailableVersions() {
+		if int64(v) == version {
+			continue
+		}
+		if err := tree.DeleteVersion(int64(v)); err != nil {
+			return version, deleted, errors.Wrapf(err, "deleting version %d", v)
+		}
+		deleted++
+	}
+	return version, deleted, nil
+}
+
+// IntegrityDigest checks every node stored in the database, including the
+// nodes of old versions which are no longer reachable from the latest root, so
+// aren't covered by its hash. Each node must decode and hash to the hash it is
+// stored under, or ErrNodeCorrupted is returned naming it. It returns a digest
+// of the hashes of all the stored nodes, which changes when nodes are saved or
+// deleted. It reads the whole database, so is meant for maintenance tools.
+func (tree *MutableTree) IntegrityDigest() ([]byte, error) {
+	return tree.ndb.integrityDigest()
+}
+
+// Repair recovers a tree whose latest versions can't be loaded, e.g. because
+// a crash left some of their nodes missing from the database, by truncating it
+// to the latest version which validates. The versions after it are deleted,
+// the working tree is reset to it, and the number of versions deleted is
+// returned. If no version validates, nothing is changed and the error of the
+// latest version is returned, wrapping ErrNodeMissing if a node is missing.
+//
+// To find what is broken, call Validate on the tree of a version: the error
+// names the inner node whose child is missing, and the range of its keys. As
+// every node of every version is read, Repair is meant for a tree just opened,
+// whose node cache can't hide the missing nodes.
+func (tree *MutableTree) Repair() (repaired int, err error) {
+	roots, err := tree.ndb.getRoots()
+	if err != nil {
+		return 0, err
+	}
+	versions := make([]int64, 0, len(roots))
+	for version := range roots {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+	var latestErr error
+	for i, version := range versions {
+		if err := tree.validateVersion(version); err != nil {
+			if latestErr == nil {
+				latestErr = errors.Wrapf(err, "version %d", version)
+			}
+			continue
+		}
+		if i == 0 {
+			return 0, nil
+		}
+		if _, err := tree.LoadVersion(version); err != nil {
+			return 0, err
+		}
+		if err := tree.deleteVersionsFrom(version + 1); err != nil {
+			return 0, err
+		}
+		return i, nil
+	}
+	return 0, latestErr
+}
+
+// validateVersion loads and validates the whole tree of a saved version.
+func (tree *MutableTree) validateVersion(version int64) error {
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return err
+	}
+	return t.Validate()
+}
+
 // deleteVersionsFrom deletes tree version from disk specified version to latest version. The version can then no
 // longer be accessed.
 func (tree *MutableTree) deleteVersionsFrom(version int64) error {
@@ -474,97 +1274,145 @@ func (tree *MutableTree) deleteVersionsFrom(version int64) error {
 		tree.ndb.DeleteVersion(version, false)
 		delete(tree.versions, version)
 	}
-	tree.ndb.Commit()
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
 	tree.ndb.resetLatestVersion(newLatestVersion)
 	return nil
 }
 
 // Rotate right and return the new node and orphan.
-func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
+func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node, error) {
 	version := tree.version + 1
 
 	// TODO: optimize balance & rotate.
 	node = node.clone(version)
-	orphaned := node.getLeftNode(tree.ImmutableTree)
+	orphaned, err := node.getLeftNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, nil, err
+	}
 	newNode := orphaned.clone(version)
 
 	newNoderHash, newNoderCached := newNode.rightHash, newNode.rightNode
 	newNode.rightHash, newNode.rightNode = node.hash, node
 	node.leftHash, node.leftNode = newNoderHash, newNoderCached
 
-	node.calcHeightAndSize(tree.ImmutableTree)
-	newNode.calcHeightAndSize(tree.ImmutableTree)
+	if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+		return nil, nil, err
+	}
+	if err := newNode.calcHeightAndSize(tree.ImmutableTree); err != nil {
+		return nil, nil, err
+	}
 
-	return newNode, orphaned
+	return newNode, orphaned, nil
 }
 
 // Rotate left and return the new node and orphan.
-func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node) {
+func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node, error) {
 	version := tree.version + 1
 
 	// TODO: optimize balance & rotate.
 	node = node.clone(version)
-	orphaned := node.getRightNode(tree.ImmutableTree)
+	orphaned, err := node.getRightNode(tree.ImmutableTree)
+	if err != nil {
+		return nil, nil, err
+	}
 	newNode := orphaned.clone(version)
 
 	newNodelHash, newNodelCached := newNode.leftHash, newNode.leftNode
 	newNode.leftHash, newNode.leftNode = node.hash, node
 	node.rightHash, node.rightNode = newNodelHash, newNodelCached
 
-	node.calcHeightAndSize(tree.ImmutableTree)
-	newNode.calcHeightAndSize(tree.ImmutableTree)
+	if err := node.calcHeightAndSize(tree.ImmutableTree); err != nil {
+		return nil, nil, err
+	}
+	if err := newNode.calcHeightAndSize(tree.ImmutableTree); err != nil {
+		return nil, nil, err
+	}
 
-	return newNode, orphaned
+	return newNode, orphaned, nil
 }
 
-// NOTE: assumes that node can be modified
+// NOTE: assumes that node can be modified, i.e. that it was created by the
+// ongoing mutation and is not reachable from any published root. When node is
+// rotated, it is replaced by a clone and released to the node pool.
 // TODO: optimize balance & rotate
-func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node) {
+func (tree *MutableTree) balance(node *Node, orphans *[]*Node) (newSelf *Node, err error) {
 	if node.persisted {
 		panic("Unexpected balance() call on persisted node")
 	}
-	balance := node.calcBalance(tree.ImmutableTree)
+	left, right, err := node.getChildren(tree.ImmutableTree)
+	if err != nil {
+		return nil, err
+	}
+	balance := int(left.height) - int(right.height)
 
 	if balance > 1 {
-		if node.getLeftNode(tree.ImmutableTree).calcBalance(tree.ImmutableTree) >= 0 {
+		leftBalance, err := left.calcBalance(tree.ImmutableTree)
+		if err != nil {
+			return nil, err
+		}
+		if leftBalance >= 0 {
 			// Left Left Case
-			newNode, orphaned := tree.rotateRight(node)
+			newNode, orphaned, err := tree.rotateRight(node)
+			if err != nil {
+				return nil, err
+			}
 			*orphans = append(*orphans, orphaned)
-			return newNode
+			releaseNode(node)
+			return newNode, nil
 		}
 		// Left Right Case
 		var leftOrphaned *Node
 
-		left := node.getLeftNode(tree.ImmutableTree)
 		node.leftHash = nil
-		node.leftNode, leftOrphaned = tree.rotateLeft(left)
-		newNode, rightOrphaned := tree.rotateRight(node)
+		if node.leftNode, leftOrphaned, err = tree.rotateLeft(left); err != nil {
+			return nil, err
+		}
+		newNode, rightOrphaned, err := tree.rotateRight(node)
+		if err != nil {
+			return nil, err
+		}
 		*orphans = append(*orphans, left, leftOrphaned, rightOrphaned)
-		return newNode
+		releaseNode(node)
+		return newNode, nil
 	}
 	if balance < -1 {
-		if node.getRightNode(tree.ImmutableTree).calcBalance(tree.ImmutableTree) <= 0 {
+		rightBalance, err := right.calcBalance(tree.ImmutableTree)
+		if err != nil {
+			return nil, err
+		}
+		if rightBalance <= 0 {
 			// Right Right Case
-			newNode, orphaned := tree.rotateLeft(node)
+			newNode, orphaned, err := tree.rotateLeft(node)
+			if err != nil {
+				return nil, err
+			}
 			*orphans = append(*orphans, orphaned)
-			return newNode
+			releaseNode(node)
+			return newNode, nil
 		}
 		// Right Left Case
 		var rightOrphaned *Node
 
-		right := node.getRightNode(tree.ImmutableTree)
 		node.rightHash = nil
-		node.rightNode, rightOrphaned = tree.rotateRight(right)
-		newNode, leftOrphaned := tree.rotateLeft(node)
+		if node.rightNode, rightOrphaned, err = tree.rotateRight(right); err != nil {
+			return nil, err
+		}
+		newNode, leftOrphaned, err := tree.rotateLeft(node)
+		if err != nil {
+			return nil, err
+		}
 
 		*orphans = append(*orphans, right, leftOrphaned, rightOrphaned)
-		return newNode
+		releaseNode(node)
+		return newNode, nil
 	}
 	// Nothing changed
-	return node
+	return node, nil
 }
 
-func (tree *MutableTree) addOrphans(orphans []*Node) {
+func (tree *MutableTree) addOrphans(orphans []*Node, onOrphan func(*Node)) {
 	for _, node := range orphans {
 		if !node.persisted {
 			// We don't need to orphan nodes that were never persisted.
@@ -574,5 +1422,8 @@ func (tree *MutableTree) addOrphans(orphans []*Node) {
 			panic("Expected to find node hash, but was empty")
 		}
 		tree.orphans[string(node.hash)] = node.version
+		if onOrphan != nil {
+			onOrphan(node)
+		}
 	}
 }
@@ -1,9 +1,21 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"math/rand"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
 
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/crypto/tmhash"
 	db "github.com/tendermint/tm-db"
 )
 
@@ -22,3 +34,1726 @@ func BenchmarkMutableTree_Set(b *testing.B) {
 		t.Set(randBytes(10), []byte{})
 	}
 }
+
+func TestMutableTree_SetRemoveOrphans(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"a", "b", "c"} {
+		tree.Set([]byte(k), []byte(k))
+	}
+	// The tree is now b -> (a, c -> (b, c)).
+	root := tree.root
+	inner := root.rightNode
+	leafB, leafC := inner.leftNode, inner.rightNode
+
+	// Updating orphans the path from the root down to the leaf.
+	oldValue, orphans, updated, _ := tree.set([]byte("c"), []byte("new"))
+	require.True(t, updated)
+	require.Equal(t, []byte("c"), oldValue)
+	require.Equal(t, []*Node{root, inner, leafC}, orphans)
+	tree.root = root
+
+	// Removing orphans the leaf and then the path back up to the root,
+	// including the parent which is replaced by the leaf's sibling.
+	value, orphans, removed, _ := tree.remove([]byte("b"))
+	require.True(t, removed)
+	require.Equal(t, []byte("b"), value)
+	require.Equal(t, []*Node{leafB, inner, root}, orphans)
+	require.Equal(t, []byte("c"), tree.root.key)
+	require.Equal(t, int64(2), tree.root.size)
+
+	_, orphans, removed, _ = tree.remove([]byte("x"))
+	require.False(t, removed)
+	require.Empty(t, orphans)
+}
+
+func TestMutableTree_SetRemoveBalanced(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	keys := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		key := randBytes(2)
+		if i%3 == 2 {
+			_, removed, _ := tree.Remove(key)
+			require.Equal(t, keys[string(key)], removed)
+			delete(keys, string(key))
+		} else {
+			tree.Set(key, key)
+			keys[string(key)] = true
+		}
+		if i%500 == 0 {
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	require.Equal(t, int64(len(keys)), tree.Size())
+	for key := range keys {
+		_, value, _ := tree.Get([]byte(key))
+		require.Equal(t, []byte(key), value)
+	}
+	requireBalanced(t, tree.ImmutableTree)
+}
+
+func TestMutableTree_InitFromSorted(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 7, 8, 100, 1001} {
+		kvs := make([]KVPair, n)
+		for i := range kvs {
+			kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%08d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+		}
+		memDB := db.NewMemDB()
+		tree := NewMutableTree(memDB, 0)
+		require.NoError(t, tree.InitFromSorted(kvs))
+		require.Equal(t, int64(n), tree.Size())
+		requireBalanced(t, tree.ImmutableTree)
+
+		for i, kv := range kvs {
+			index, value, _ := tree.Get(kv.Key)
+			require.Equal(t, int64(i), index)
+			require.Equal(t, kv.Value, value)
+		}
+
+		// The tree can be saved, reloaded and modified as usual.
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, 1, version)
+		tree = NewMutableTree(memDB, 0)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		require.Equal(t, int64(n), tree.Size())
+		tree.Set([]byte("new"), []byte("value"))
+		tree.Remove([]byte("key-00000000"))
+		requireBalanced(t, tree.ImmutableTree)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestMutableTree_InitFromSortedInvalid(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, kvs := range [][]KVPair{
+		{{[]byte("b"), []byte{}}, {[]byte("a"), []byte{}}},
+		{{[]byte("a"), []byte{}}, {[]byte("a"), []byte{}}},
+		{{[]byte("a"), []byte{}}, {[]byte("b"), nil}},
+	} {
+		require.Error(t, tree.InitFromSorted(kvs))
+		require.True(t, tree.IsEmpty())
+	}
+
+	tree.Set([]byte("a"), []byte{})
+	require.Error(t, tree.InitFromSorted([]KVPair{{[]byte("b"), []byte{}}}))
+}
+
+func requireBalanced(t *testing.T, tree *ImmutableTree) {
+	if tree.root == nil {
+		return
+	}
+	var check func(node *Node)
+	check = func(node *Node) {
+		if node.isLeaf() {
+			return
+		}
+		left, right, err := node.getChildren(tree)
+		require.NoError(t, err)
+		check(left)
+		check(right)
+		require.Equal(t, left.size+right.size, node.size)
+		require.Equal(t, maxInt8(left.height, right.height)+1, node.height)
+		balance, _ := node.calcBalance(tree)
+		require.True(t, balance >= -1 && balance <= 1, "unbalanced node %X", node.key)
+	}
+	check(tree.root)
+}
+
+func BenchmarkMutableTree_InitFromSorted(b *testing.B) {
+	kvs := make([]KVPair, 1000000)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%08d", i)), Value: []byte{}}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.Run("InitFromSorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewMutableTree(db.NewMemDB(), 0)
+			if err := t.InitFromSorted(kvs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t := NewMutableTree(db.NewMemDB(), 0)
+			for _, kv := range kvs {
+				t.Set(kv.Key, kv.Value)
+			}
+		}
+	})
+}
+
+func TestMutableTree_BatchSet(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	randomKVs := func(n int) []KVPair {
+		kvs := make([]KVPair, n)
+		for i := range kvs {
+			kvs[i] = KVPair{
+				Key:   []byte(fmt.Sprintf("key-%04d", r.Intn(2000))),
+				Value: []byte(fmt.Sprintf("value-%d", r.Int())),
+			}
+		}
+		return kvs
+	}
+
+	for _, sorted := range []bool{true, false} {
+		batched := NewMutableTree(db.NewMemDB(), 0)
+		looped := NewMutableTree(db.NewMemDB(), 0)
+		for version := 0; version < 5; version++ {
+			kvs := randomKVs(300)
+			if sorted {
+				sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+			}
+			batched.BatchSet(kvs)
+			for _, kv := range kvs {
+				looped.Set(kv.Key, kv.Value)
+			}
+			require.NoError(t, batched.Validate())
+			require.Equal(t, looped.WorkingHash(), batched.WorkingHash())
+			require.Equal(t, looped.orphans, batched.orphans)
+
+			_, _, err := batched.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = looped.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestMutableTree_RemoveRange(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%04d", i))
+	}
+	ranged := NewMutableTree(db.NewMemDB(), 0)
+	looped := NewMutableTree(db.NewMemDB(), 0)
+	bounds := [][2][]byte{
+		{key(100), key(400)},
+		{nil, key(150)},
+		{key(1700), nil},
+		{key(500), key(500)},
+		{key(600), key(601)},
+		{nil, nil},
+	}
+	for _, bound := range bounds {
+		for i := 0; i < 500; i++ {
+			k := key(r.Intn(2000))
+			ranged.Set(k, k)
+			looped.Set(k, k)
+		}
+		var keys [][]byte
+		looped.IterateRange(bound[0], bound[1], true, func(key, _ []byte) bool {
+			keys = append(keys, key)
+			return false
+		})
+		for _, key := range keys {
+			_, removed, err := looped.Remove(key)
+			require.NoError(t, err)
+			require.True(t, removed)
+		}
+
+		removed, err := ranged.RemoveRange(bound[0], bound[1])
+		require.NoError(t, err)
+		require.Equal(t, len(keys), removed)
+		require.NoError(t, ranged.Validate())
+		require.Equal(t, looped.WorkingHash(), ranged.WorkingHash())
+		require.Equal(t, looped.orphans, ranged.orphans)
+
+		_, _, err = ranged.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = looped.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.True(t, ranged.IsEmpty())
+}
+
+func TestMutableTree_BatchSetNilValue(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.Panics(t, func() {
+		tree.BatchSet([]KVPair{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b")}})
+	})
+	// Nothing is set if any value is nil.
+	require.Nil(t, tree.root)
+}
+
+func BenchmarkMutableTree_BatchSet(b *testing.B) {
+	tree := NewMutableTree(db.NewMemDB(), 100000)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%08d", i*10)), []byte{})
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		b.Fatal(err)
+	}
+	kvs := make([]KVPair, 10000)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%08d", i*10+5)), Value: []byte{}}
+	}
+	b.ResetTimer()
+
+	b.Run("BatchSet", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t := tree.Clone()
+			t.BatchSet(kvs)
+		}
+	})
+	b.Run("Set", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t := tree.Clone()
+			for _, kv := range kvs {
+				t.Set(kv.Key, kv.Value)
+			}
+		}
+	})
+}
+
+// BenchmarkMutableTree_Commit commits blocks of 1000 mixed sets and removes.
+// The dirty nodes per block are reported, along with the hashers created per
+// dirty node at commit, which is below 2 as only leaves hash their value.
+func BenchmarkMutableTree_Commit(b *testing.B) {
+	hashers := 0
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 10000, &Options{HashFunc: countingHashFunc(&hashers)})
+	r := rand.New(rand.NewSource(1))
+	mixedOps(tree, r, 10000)
+	if _, _, err := tree.Commit(); err != nil {
+		b.Fatal(err)
+	}
+	var dirty int64
+	hashers = 0
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		before := hashers
+		mixedOps(tree, r, 1000)
+		if hashers != before {
+			b.Fatalf("%d hashers created by mutations", hashers-before)
+		}
+		dirty += tree.DirtyNodes()
+		if _, _, err := tree.Commit(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(dirty)/float64(b.N), "dirty/op")
+	b.ReportMetric(float64(hashers)/float64(dirty), "hashers/dirty")
+}
+
+// BenchmarkMutableTree_ParallelHash hashes a large tree whose nodes are all
+// new, sequentially and in parallel.
+func BenchmarkMutableTree_ParallelHash(b *testing.B) {
+	kvs := make([]KVPair, 100000)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%08d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+	}
+	for _, threshold := range []int64{0, 1024} {
+		b.Run(fmt.Sprintf("threshold-%d", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{ParallelHashThreshold: threshold})
+				if err := tree.InitFromSorted(kvs); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				tree.WorkingHash()
+			}
+		})
+	}
+}
+
+// Appending keys in order rebalances the tree on most sets, so this benchmark
+// shows the allocations saved by recycling the nodes replaced by rotations.
+func BenchmarkMutableTree_SetSequential(b *testing.B) {
+	keys := make([][]byte, 10000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%08d", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		for _, key := range keys {
+			tree.Set(key, []byte{})
+		}
+	}
+}
+
+func TestMutableTree_WorkingHash(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.Nil(t, tree.WorkingHash())
+
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	hash := tree.WorkingHash()
+	require.NotNil(t, hash)
+
+	// Hashing again gives the same hash without hashing any node.
+	require.Equal(t, hash, tree.WorkingHash())
+	_, count := tree.HashWithCount()
+	require.Zero(t, count)
+	require.Empty(t, tree.ndb.nodes())
+
+	// A change gives a new hash, which only rehashes the path to the key.
+	tree.Set([]byte("key-20"), []byte("value"))
+	changed, count := tree.HashWithCount()
+	require.NotEqual(t, hash, changed)
+	require.True(t, count > 0 && count <= int64(tree.Height())+2, "hashed %d nodes", count)
+	require.Equal(t, changed, tree.WorkingHash())
+
+	// Updating a value leaves the shape of the tree as is, so restoring the
+	// value restores the hash.
+	tree.Set([]byte("key-00"), []byte("other"))
+	require.NotEqual(t, changed, tree.WorkingHash())
+	tree.Set([]byte("key-00"), []byte("value"))
+	require.Equal(t, changed, tree.WorkingHash())
+
+	saved, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, changed, saved)
+}
+
+func BenchmarkMutableTree_RemoveRange(b *testing.B) {
+	tree := NewMutableTree(db.NewMemDB(), 100000)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%08d", i)), []byte{})
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		b.Fatal(err)
+	}
+	start, end := []byte("key-00020000"), []byte("key-00030000")
+	b.ResetTimer()
+
+	b.Run("RemoveRange", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t := tree.Clone()
+			t.RemoveRange(start, end)
+		}
+	})
+	b.Run("Remove", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			t := tree.Clone()
+			var keys [][]byte
+			t.IterateRange(start, end, true, func(key, _ []byte) bool {
+				keys = append(keys, key)
+				return false
+			})
+			for _, key := range keys {
+				t.Remove(key)
+			}
+		}
+	})
+}
+
+func TestMutableTree_HashFunc(t *testing.T) {
+	hashFuncs := map[string]func() hash.Hash{
+		"default": nil,
+		"sha1":    sha1.New,
+		"sha512":  sha512.New,
+	}
+	rootHashes := map[string]bool{}
+	for name, hashFunc := range hashFuncs {
+		memDB := db.NewMemDB()
+		opts := &Options{HashFunc: hashFunc}
+		tree := NewMutableTreeWithOpts(memDB, 0, opts)
+		for i := 0; i < 100; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err, name)
+		for i := 0; i < 50; i++ {
+			tree.Remove([]byte(fmt.Sprintf("key-%03d", 2*i)))
+		}
+		rootHash, _, err := tree.SaveVersion()
+		require.NoError(t, err, name)
+		require.Len(t, rootHash, opts.hashFunc()().Size(), name)
+		rootHashes[string(rootHash)] = true
+
+		// The tree reloads and prunes fine with keys sized for the hash.
+		tree = NewMutableTreeWithOpts(memDB, 0, opts)
+		_, err = tree.Load()
+		require.NoError(t, err, name)
+		require.Equal(t, rootHash, tree.Hash(), name)
+		require.NoError(t, tree.DeleteVersion(1), name)
+		for i := 0; i < 100; i++ {
+			_, value, _ := tree.Get([]byte(fmt.Sprintf("key-%03d", i)))
+			if i%2 == 0 {
+				require.Nil(t, value, name)
+			} else {
+				require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value, name)
+			}
+		}
+
+		_, _, err = tree.GetWithProof([]byte("key-001"))
+		_, _, existenceErr := tree.GetWithExistenceProof([]byte("key-001"))
+		if hashFunc == nil {
+			require.NoError(t, err, name)
+			require.NoError(t, existenceErr, name)
+		} else {
+			require.True(t, errors.Cause(err) == ErrProofHashUnsupported, name)
+			require.True(t, errors.Cause(existenceErr) == ErrProofHashUnsupported, name)
+		}
+	}
+	require.Len(t, rootHashes, len(hashFuncs))
+}
+
+// countingHashFunc returns the default hash function, counting the hashers it
+// creates.
+func countingHashFunc(hashers *int) func() hash.Hash {
+	return func() hash.Hash {
+		*hashers++
+		return tmhash.New()
+	}
+}
+
+// mixedOps sets and removes random keys.
+func mixedOps(tree *MutableTree, r *rand.Rand, ops int) {
+	for i := 0; i < ops; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", r.Intn(2000)))
+		if r.Intn(3) == 0 {
+			tree.Remove(key)
+		} else {
+			tree.Set(key, []byte(fmt.Sprintf("value-%d", i)))
+		}
+	}
+}
+
+func TestMutableTree_Commit(t *testing.T) {
+	hashers := 0
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{HashFunc: countingHashFunc(&hashers)})
+	hashers = 0 // The database sizes its keys with a hasher.
+	expected := NewMutableTree(db.NewMemDB(), 0)
+	r, expectedR := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for v := 0; v < 5; v++ {
+		// Mutations don't hash anything.
+		mixedOps(tree, r, 1000)
+		require.Zero(t, hashers)
+		mixedOps(expected, expectedR, 1000)
+
+		// Commit hashes each dirty node once: a leaf hashes its value too.
+		var inner, leaves int64
+		var count func(node *Node)
+		count = func(node *Node) {
+			if node == nil || node.hash != nil {
+				return
+			}
+			if node.isLeaf() {
+				leaves++
+			} else {
+				inner++
+			}
+			count(node.leftNode)
+			count(node.rightNode)
+		}
+		count(tree.root)
+		require.Equal(t, inner+leaves, tree.DirtyNodes())
+		require.NotZero(t, leaves)
+
+		hash, version, err := tree.Commit()
+		require.NoError(t, err)
+		require.EqualValues(t, inner+2*leaves, hashers)
+		require.Zero(t, tree.DirtyNodes())
+		hashers = 0
+
+		expectedHash, expectedVersion, err := expected.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash)
+		require.Equal(t, expectedVersion, version)
+	}
+
+	// A read hashing the working tree early leaves nothing for Commit.
+	mixedOps(tree, r, 10)
+	tree.WorkingHash()
+	require.Zero(t, tree.DirtyNodes())
+	hashers = 0
+	_, _, err := tree.Commit()
+	require.NoError(t, err)
+	require.Zero(t, hashers)
+}
+
+func TestMutableTree_Repair(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	hashes := map[int64][]byte{}
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 100; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%03d", rand.Intn(200))), []byte(fmt.Sprintf("value-%d", v)))
+		}
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	// Nothing to repair.
+	repaired, err := tree.Repair()
+	require.NoError(t, err)
+	require.Zero(t, repaired)
+	require.EqualValues(t, 3, tree.Version())
+
+	// An inner node of the latest version only, as if its write was lost.
+	var parent, lost *Node
+	_, err = tree.TraverseNodes(func(node *Node, depth int) bool {
+		if node.isLeaf() || node.version != 3 {
+			return false
+		}
+		left, err := tree.Child(node, true)
+		require.NoError(t, err)
+		if !left.isLeaf() && left.version == 3 {
+			parent, lost = node, left
+			return true
+		}
+		return false
+	})
+	require.NoError(t, err)
+	require.NotNil(t, lost)
+	require.NoError(t, tree.Validate())
+	memDB.Delete(tree.ndb.nodeKey(lost.hash))
+
+	// Validate reports the broken path.
+	tree = NewMutableTree(memDB, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	err = tree.Validate()
+	require.Equal(t, ErrNodeMissing, errors.Cause(err))
+	require.Contains(t, err.Error(), fmt.Sprintf("%X", lost.hash))
+	require.Contains(t, err.Error(), fmt.Sprintf("%X", parent.hash))
+
+	// The tree is truncated to the previous version, which works.
+	repaired, err = tree.Repair()
+	require.NoError(t, err)
+	require.Equal(t, 1, repaired)
+	require.EqualValues(t, 2, tree.Version())
+	require.Equal(t, hashes[2], tree.Hash())
+	require.NoError(t, tree.Validate())
+	require.False(t, tree.VersionExists(3))
+	tree.Set([]byte("key-new"), []byte("value"))
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+
+	reloaded := NewMutableTree(memDB, 0)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.NoError(t, reloaded.Validate())
+	require.Equal(t, tree.Hash(), reloaded.Hash())
+
+	// A node of every version can't be repaired, and the tree is left as is.
+	var shared *Node
+	_, err = reloaded.TraverseNodes(func(node *Node, depth int) bool {
+		if node.version == 1 && depth > 0 {
+			shared = node
+			return true
+		}
+		return false
+	})
+	require.NoError(t, err)
+	require.NotNil(t, shared)
+	memDB.Delete(reloaded.ndb.nodeKey(shared.hash))
+	broken := NewMutableTree(memDB, 0)
+	_, err = broken.Load()
+	require.NoError(t, err)
+	repaired, err = broken.Repair()
+	require.Equal(t, ErrNodeMissing, errors.Cause(err))
+	require.Zero(t, repaired)
+	require.EqualValues(t, 3, broken.Version())
+	require.True(t, broken.VersionExists(1))
+}
+
+// TestMutableTree_ParallelHash also runs the parallel hashing under the race
+// detector, with go test -race.
+func TestMutableTree_ParallelHash(t *testing.T) {
+	hashes := map[int64][][]byte{}
+	for _, threshold := range []int64{0, 1, 2, 16, 1000} {
+		tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{ParallelHashThreshold: threshold})
+		r := rand.New(rand.NewSource(1))
+		for v := 0; v < 3; v++ {
+			mixedOps(tree, r, 2000)
+			workingHash := tree.WorkingHash()
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, workingHash, hash)
+			hashes[threshold] = append(hashes[threshold], hash)
+		}
+		mixedOps(tree, r, 2000)
+		hash, _, err := tree.Commit()
+		require.NoError(t, err)
+		hashes[threshold] = append(hashes[threshold], hash)
+		require.NoError(t, tree.Validate())
+	}
+	for threshold, h := range hashes {
+		require.Equal(t, hashes[0], h, "threshold %d", threshold)
+	}
+}
+
+func TestMutableTree_GetVersioned(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("c"), []byte("1"))
+	_, v1, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte("2"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, v2, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("working"))
+
+	// Older versions keep their values after the key is overwritten.
+	index, value, _ := tree.GetVersioned([]byte("a"), v1)
+	require.EqualValues(t, 0, index)
+	require.Equal(t, []byte("1"), value)
+	index, value, _ = tree.GetVersioned([]byte("a"), v2)
+	require.EqualValues(t, 0, index)
+	require.Equal(t, []byte("2"), value)
+
+	// A key absent at a version gives the index it would have.
+	index, value, _ = tree.GetVersioned([]byte("b"), v1)
+	require.EqualValues(t, 1, index)
+	require.Nil(t, value)
+	index, value, _ = tree.GetVersioned([]byte("c"), v2)
+	require.EqualValues(t, 2, index)
+	require.Equal(t, []byte("1"), value)
+
+	// A deleted or never saved version gives -1.
+	require.NoError(t, tree.DeleteVersion(v1))
+	index, value, _ = tree.GetVersioned([]byte("a"), v1)
+	require.EqualValues(t, -1, index)
+	require.Nil(t, value)
+	index, value, _ = tree.GetVersioned([]byte("a"), v2+1)
+	require.EqualValues(t, -1, index)
+	require.Nil(t, value)
+}
+
+func TestMutableTree_HashWithCount(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	hash, count := tree.HashWithCount()
+	require.Nil(t, hash)
+	require.Zero(t, count)
+
+	const size = 10000
+	for i := 0; i < size; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%05d", i)), []byte("value"))
+	}
+	hash, count = tree.HashWithCount()
+	require.Equal(t, tree.WorkingHash(), hash)
+	require.EqualValues(t, 2*size-1, count)
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Setting a key in the large tree only hashes the path to it.
+	tree.Set([]byte("key-05000"), []byte("other"))
+	hash, count = tree.HashWithCount()
+	require.Equal(t, tree.WorkingHash(), hash)
+	require.True(t, count > 0 && count <= int64(tree.Height())+1, "hashed %d nodes", count)
+}
+
+func TestMutableTree_SaveVersion(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	hashes := map[int64][]byte{}
+	for version := int64(1); version <= 3; version++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", version)))
+		}
+		hash, v, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, version, v)
+		hashes[version] = hash
+	}
+
+	// Saving a version already saved by a clone fails without writing.
+	clone := tree.Clone()
+	clone.Set([]byte("key-00"), []byte("clone"))
+	_, _, err := clone.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-00"), []byte("tree"))
+	countKeys := func() (n int) {
+		iter := memDB.Iterator(nil, nil)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		return n
+	}
+	keys := countKeys()
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	require.Equal(t, keys, countKeys())
+
+	// Every version loads independently in a fresh tree.
+	for version, hash := range hashes {
+		reloaded := NewMutableTree(memDB, 0)
+		_, err := reloaded.LoadVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, hash, reloaded.Hash())
+		_, value, err := reloaded.Get([]byte("key-19"))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d", version)), value)
+	}
+}
+
+func TestMutableTree_MaxLength(t *testing.T) {
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxKeyLength: 4, MaxValueLength: 8})
+	_, err := tree.Set([]byte("key1"), []byte("value-01"))
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	// Oversized keys and values are rejected, leaving the tree as is.
+	_, err = tree.Set([]byte("key-2"), []byte("value"))
+	require.Equal(t, ErrKeyTooLong, errors.Cause(err))
+	_, err = tree.Set([]byte("key2"), []byte("value-002"))
+	require.Equal(t, ErrValueTooLong, errors.Cause(err))
+	_, err = tree.Set([]byte("key1"), []byte("value-001"))
+	require.Equal(t, ErrValueTooLong, errors.Cause(err))
+	err = tree.BatchSet([]KVPair{
+		{Key: []byte("key3"), Value: []byte("value")},
+		{Key: []byte("key-4"), Value: []byte("value")},
+	})
+	require.Equal(t, ErrKeyTooLong, errors.Cause(err))
+	require.Equal(t, hash, tree.WorkingHash())
+	require.EqualValues(t, 1, tree.Size())
+
+	// Empty keys and values are fine, and so are those at the limit.
+	require.NoError(t, tree.BatchSet([]KVPair{
+		{Key: []byte{}, Value: []byte{}},
+		{Key: []byte("key3"), Value: []byte("value-03")},
+	}))
+	require.EqualValues(t, 3, tree.Size())
+
+	empty := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxValueLength: 1})
+	err = empty.InitFromSorted([]KVPair{{Key: []byte("a"), Value: []byte("ab")}})
+	require.Equal(t, ErrValueTooLong, errors.Cause(err))
+	require.True(t, empty.IsEmpty())
+
+	// Zero means unlimited.
+	unlimited := NewMutableTree(db.NewMemDB(), 0)
+	_, err = unlimited.Set(bytes.Repeat([]byte{'k'}, 1<<16), bytes.Repeat([]byte{'v'}, 1<<20))
+	require.NoError(t, err)
+}
+
+func TestMutableTree_SetAtomic(t *testing.T) {
+	tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxValueLength: 8})
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	hash := tree.WorkingHash()
+
+	batch := func(invalid KVPair) []KVPair {
+		return []KVPair{
+			{Key: []byte("key-00"), Value: []byte("new")},
+			{Key: []byte("key-50"), Value: []byte("new")},
+			invalid,
+			{Key: []byte("key-51"), Value: []byte("new")},
+		}
+	}
+	err := tree.SetAtomic(batch(KVPair{Key: []byte("key-02"), Value: []byte("too-long-value")}))
+	require.Equal(t, ErrValueTooLong, errors.Cause(err))
+	require.Equal(t, hash, tree.WorkingHash())
+	err = tree.SetAtomic(batch(KVPair{Key: []byte("key-02")}))
+	require.Error(t, err)
+	require.Equal(t, hash, tree.WorkingHash())
+	require.EqualValues(t, 50, tree.Size())
+
+	// A valid batch gives the same tree as BatchSet.
+	valid := batch(KVPair{Key: []byte("key-02"), Value: []byte("new")})
+	require.NoError(t, tree.SetAtomic(valid))
+	expected := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 50; i++ {
+		expected.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	require.NoError(t, expected.BatchSet(valid))
+	require.Equal(t, expected.WorkingHash(), tree.WorkingHash())
+}
+
+func TestMutableTree_Compare(t *testing.T) {
+	// Decimal keys in numeric order, where "9" is before "10".
+	numeric := func(a, b []byte) int {
+		x, err := strconv.Atoi(string(a))
+		require.NoError(t, err)
+		y, err := strconv.Atoi(string(b))
+		require.NoError(t, err)
+		return x - y
+	}
+	key := func(i int) []byte { return []byte(strconv.Itoa(i)) }
+	keys := func(tree *ImmutableTree, iterate func(fn func(key, value []byte) bool) (bool, error)) (got []int) {
+		_, err := iterate(func(k, v []byte) bool {
+			i, err := strconv.Atoi(string(k))
+			require.NoError(t, err)
+			got = append(got, i)
+			return false
+		})
+		require.NoError(t, err)
+		return got
+	}
+
+	memDB := db.NewMemDB()
+	opts := &Options{Compare: numeric}
+	tree := NewMutableTreeWithOpts(memDB, 0, opts)
+	var sorted []KVPair
+	for _, i := range rand.Perm(100) {
+		tree.Set(key(i), key(i))
+	}
+	for i := 0; i < 100; i++ {
+		sorted = append(sorted, KVPair{Key: key(i), Value: key(i)})
+	}
+	require.NoError(t, tree.Validate())
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Iterations follow the numeric order, not the bytewise one.
+	var want []int
+	for i := 0; i < 100; i++ {
+		want = append(want, i)
+	}
+	require.Equal(t, want, keys(tree.ImmutableTree, tree.Iterate))
+	require.Equal(t, want[9:11], keys(tree.ImmutableTree, func(fn func(key, value []byte) bool) (bool, error) {
+		return tree.IterateRange(key(9), key(11), true, fn)
+	}))
+	var iterated []int
+	for iter := tree.Iterator(key(95), nil, false); iter.Valid(); iter.Next() {
+		i, _ := strconv.Atoi(string(iter.Key()))
+		iterated = append(iterated, i)
+	}
+	require.Equal(t, []int{99, 98, 97, 96, 95}, iterated)
+	k, _, _, err := tree.Next(key(9))
+	require.NoError(t, err)
+	require.Equal(t, key(10), k)
+	count, err := tree.CountInRange(key(5), key(50))
+	require.NoError(t, err)
+	require.EqualValues(t, 45, count)
+	_, value, err := tree.Get(key(42))
+	require.NoError(t, err)
+	require.Equal(t, key(42), value)
+	// Keys with a prefix aren't contiguous in numeric order, e.g. 1 and 10.
+	_, err = tree.IteratePrefix(key(1), func(key, value []byte) bool { return false })
+	require.Equal(t, ErrPrefixCompareUnsupported, errors.Cause(err))
+
+	// The tree reloads with the same comparator, and can be built from pairs
+	// in numeric order, but not bytewise order.
+	reloaded := NewMutableTreeWithOpts(memDB, 0, opts)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	_, _, err = reloaded.Remove(key(42))
+	require.NoError(t, err)
+	require.NoError(t, reloaded.Validate())
+	require.Equal(t, append(want[:42:42], want[43:]...), keys(reloaded.ImmutableTree, reloaded.Iterate))
+
+	built := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts)
+	require.NoError(t, built.InitFromSorted(sorted))
+	require.NoError(t, built.Validate())
+	require.Equal(t, want, keys(built.ImmutableTree, built.Iterate))
+	bytewise := append([]KVPair{}, sorted...)
+	sort.Slice(bytewise, func(i, j int) bool { return bytes.Compare(bytewise[i].Key, bytewise[j].Key) < 0 })
+	require.Error(t, NewMutableTreeWithOpts(db.NewMemDB(), 0, opts).InitFromSorted(bytewise))
+
+	// The order changes the shape of the tree, and proofs are unsupported.
+	other := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		other.Set(key(i), key(i))
+	}
+	require.NotEqual(t, hash, other.WorkingHash())
+	_, _, err = tree.GetWithProof(key(1))
+	require.Equal(t, ErrProofCompareUnsupported, errors.Cause(err))
+}
+
+func TestMutableTree_CompareAndSet(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("empty"), []byte{})
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.root
+
+	// A mismatch, present or absent, leaves the tree as is, without cloning or
+	// orphaning any node.
+	for _, c := range []struct{ key, expected string }{
+		{"a", "2"},
+		{"b", "1"},
+	} {
+		ok, err := tree.CompareAndSet([]byte(c.key), []byte(c.expected), []byte("3"))
+		require.NoError(t, err)
+		require.False(t, ok, "%s=%s", c.key, c.expected)
+		require.Equal(t, hash, tree.WorkingHash())
+	}
+	ok, err := tree.CompareAndSet([]byte("a"), nil, []byte("3"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = tree.CompareAndSet([]byte("empty"), nil, []byte("3"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, hash, tree.WorkingHash())
+	require.True(t, root == tree.root)
+	require.Empty(t, tree.orphans)
+
+	// A match sets the new value.
+	ok, err = tree.CompareAndSet([]byte("a"), []byte("1"), []byte("2"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = tree.CompareAndSet([]byte("empty"), []byte{}, []byte("2"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = tree.CompareAndSet([]byte("b"), nil, []byte("2"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	for _, key := range []string{"a", "b", "empty"} {
+		_, value, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), value)
+	}
+}
+
+func TestMutableTree_Replace(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	expected := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i%20))
+		value := []byte(fmt.Sprintf("value-%d", i))
+		_, before, err := tree.Get(key)
+		require.NoError(t, err)
+
+		oldValue, existed, err := tree.Replace(key, value)
+		require.NoError(t, err)
+		require.Equal(t, i >= 20, existed)
+		require.Equal(t, before, oldValue)
+		if i >= 20 {
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i-20)), oldValue)
+		}
+
+		_, err = expected.Set(key, value)
+		require.NoError(t, err)
+		require.Equal(t, expected.WorkingHash(), tree.WorkingHash())
+		if i%10 == 0 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = expected.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	// An empty value is returned as such, not as a missing one.
+	oldValue, existed, err := tree.Replace([]byte("empty"), []byte{})
+	require.NoError(t, err)
+	require.False(t, existed)
+	require.Nil(t, oldValue)
+	oldValue, existed, err = tree.Replace([]byte("empty"), []byte("full"))
+	require.NoError(t, err)
+	require.True(t, existed)
+	require.Equal(t, []byte{}, oldValue)
+}
+
+func TestMutableTree_KeysOnly(t *testing.T) {
+	dbSize := func(memDB db.DB) (size int) {
+		itr := memDB.Iterator(nil, nil)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			size += len(itr.Value())
+		}
+		return size
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+
+	setDB, pairsDB := db.NewMemDB(), db.NewMemDB()
+	set := NewMutableTreeWithOpts(setDB, 0, &Options{KeysOnly: true})
+	pairs := NewMutableTree(pairsDB, 0)
+	for i := 0; i < 100; i++ {
+		added, err := set.Add(key(2 * i))
+		require.NoError(t, err)
+		require.True(t, added)
+		pairs.Set(key(2*i), []byte{})
+	}
+	added, err := set.Add(key(10))
+	require.NoError(t, err)
+	require.False(t, added)
+	_, err = set.Set(key(1), []byte{})
+	require.Equal(t, ErrKeysOnly, errors.Cause(err))
+	_, err = pairs.Add(key(1))
+	require.Equal(t, ErrKeysOnly, errors.Cause(err))
+
+	hash, _, err := set.SaveVersion()
+	require.NoError(t, err)
+	pairsHash, _, err := pairs.SaveVersion()
+	require.NoError(t, err)
+	require.NotEqual(t, pairsHash, hash)
+	require.True(t, dbSize(setDB) < dbSize(pairsDB), "%d >= %d bytes", dbSize(setDB), dbSize(pairsDB))
+
+	// The keys are read back from the database, or bulk loaded, as a set.
+	loaded := NewMutableTreeWithOpts(setDB, 0, &Options{KeysOnly: true})
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, loaded.Hash())
+
+	// Either database opened with the other setting is rejected.
+	for _, mismatched := range []*MutableTree{
+		NewMutableTree(setDB, 0),
+		NewMutableTreeWithOpts(pairsDB, 0, &Options{KeysOnly: true}),
+	} {
+		_, err = mismatched.LoadVersion(0)
+		require.Equal(t, ErrKeysOnly, errors.Cause(err))
+		_, err = mismatched.LazyLoadVersion(0)
+		require.Equal(t, ErrKeysOnly, errors.Cause(err))
+		require.True(t, mismatched.IsEmpty())
+	}
+	kvs := make([]KVPair, 100)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: key(2 * i)}
+	}
+	bulk := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{KeysOnly: true})
+	require.NoError(t, bulk.InitFromSorted(kvs))
+	var bulkKVs []KVPair
+	bulk.Iterate(func(key, value []byte) bool {
+		bulkKVs = append(bulkKVs, KVPair{Key: key, Value: value})
+		return false
+	})
+	require.Equal(t, kvs, bulkKVs)
+	for i := 0; i < 200; i++ {
+		contains, err := loaded.Contains(key(i))
+		require.NoError(t, err)
+		require.Equal(t, i%2 == 0, contains)
+	}
+	_, err = loaded.IntegrityDigest()
+	require.NoError(t, err)
+
+	// Membership proofs verify with nil values, and not with empty ones.
+	value, proof, err := loaded.GetWithExistenceProof(key(10))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.NoError(t, proof.Verify(hash))
+	proof.Value = []byte{}
+	require.Error(t, proof.Verify(hash))
+
+	value, rangeProof, err := loaded.GetWithProof(key(10))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.NoError(t, rangeProof.Verify(hash))
+	require.NoError(t, rangeProof.VerifyItem(key(10), nil))
+	require.Error(t, rangeProof.VerifyItem(key(10), []byte{}))
+	_, rangeProof, err = loaded.GetWithProof(key(11))
+	require.NoError(t, err)
+	require.NoError(t, rangeProof.Verify(hash))
+	require.NoError(t, rangeProof.VerifyAbsence(key(11)))
+
+	_, multiProof, err := loaded.GetWithMultiProof([][]byte{key(10), key(20)})
+	require.NoError(t, err)
+	require.NoError(t, multiProof.Verify(hash, map[string][]byte{string(key(10)): nil, string(key(20)): nil}))
+}
+
+func TestMutableTree_LoadVersion(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for version := 1; version <= 4; version++ {
+		tree.Set([]byte("key"), []byte(fmt.Sprintf("value-%d", version)))
+		tree.Set([]byte(fmt.Sprintf("key-%d", version)), []byte("value"))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(3))
+
+	// A restarted process loads version 2 without reading the whole tree.
+	restarted := NewMutableTree(memDB, 0)
+	version, err := restarted.LoadVersion(2)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.EqualValues(t, 2, restarted.Version())
+	require.EqualValues(t, 3, restarted.Size())
+	_, misses := restarted.NodeCacheStats()
+	require.EqualValues(t, 1, misses)
+	_, value, err := restarted.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-2"), value)
+	has, err := restarted.Has([]byte("key-3"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Deleted and unknown versions fail, leaving the tree as is.
+	for _, version := range []int64{3, 5} {
+		_, err = restarted.LoadVersion(version)
+		require.Error(t, err)
+		require.Equal(t, ErrVersionDoesNotExist, errors.Cause(err))
+		require.EqualValues(t, 2, restarted.Version())
+	}
+
+	// Load resumes from the latest version.
+	version, err = NewMutableTree(memDB, 0).Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+}
+
+func TestMutableTree_OrphanCallback(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Each change reports the saved nodes set and remove orphan, as applied
+	// to a clone, once each, and the tree records them as orphans too.
+	expectOrphans := func(orphaned []*Node) map[string]int64 {
+		expected := map[string]int64{}
+		for _, node := range orphaned {
+			if node.persisted {
+				expected[string(node.hash)] = node.version
+			}
+		}
+		return expected
+	}
+	total := 0
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", rand.Intn(120)))
+		clone := tree.Clone()
+		reported := map[string]int64{}
+		onOrphan := func(node *Node) {
+			require.NotContains(t, reported, string(node.Hash()))
+			reported[string(node.Hash())] = node.Version()
+		}
+
+		var expected map[string]int64
+		if i%3 == 0 {
+			_, orphaned, _, err := clone.remove(key)
+			require.NoError(t, err)
+			expected = expectOrphans(orphaned)
+			_, _, err = tree.RemoveCB(key, onOrphan)
+			require.NoError(t, err)
+		} else {
+			_, orphaned, _, err := clone.set(key, []byte(fmt.Sprintf("value-%d", i)))
+			require.NoError(t, err)
+			expected = expectOrphans(orphaned)
+			_, err = tree.SetCB(key, []byte(fmt.Sprintf("value-%d", i)), onOrphan)
+			require.NoError(t, err)
+		}
+		require.Equal(t, expected, reported)
+		total += len(reported)
+		for hash, version := range reported {
+			require.Equal(t, version, tree.orphans[hash])
+		}
+
+		if i%20 == 19 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	require.NotZero(t, total)
+}
+
+func TestMutableTree_SetInnerKeys(t *testing.T) {
+	// permute calls fn with every permutation of keys.
+	var permute func(keys [][]byte, k int, fn func([][]byte))
+	permute = func(keys [][]byte, k int, fn func([][]byte)) {
+		if k == len(keys) {
+			fn(keys)
+			return
+		}
+		for i := k; i < len(keys); i++ {
+			keys[k], keys[i] = keys[i], keys[k]
+			permute(keys, k+1, fn)
+			keys[k], keys[i] = keys[i], keys[k]
+		}
+	}
+	// requireInnerKeys checks that the key of every inner node is the leftmost
+	// key of its right subtree, which get and traverse rely on.
+	requireInnerKeys := func(tree *MutableTree, order [][]byte) {
+		_, err := tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+			if !node.isLeaf() {
+				right, err := node.getRightNode(tree.ImmutableTree)
+				require.NoError(t, err)
+				leftmost, err := right.lmd(tree.ImmutableTree)
+				require.NoError(t, err)
+				require.Equal(t, leftmost.key, node.key, "order %q", order)
+			}
+			return false
+		})
+		require.NoError(t, err)
+		require.NoError(t, tree.Validate(), "order %q", order)
+	}
+
+	for n := 1; n <= 6; n++ {
+		keys := make([][]byte, n)
+		for i := range keys {
+			keys[i] = []byte{byte('a' + i)}
+		}
+		permute(keys, 0, func(order [][]byte) {
+			tree := NewMutableTree(db.NewMemDB(), 0)
+			for _, key := range order {
+				tree.Set(key, key)
+				requireInnerKeys(tree, order)
+			}
+			// Setting the keys again only updates the leaves.
+			for _, key := range order {
+				updated, err := tree.Set(key, []byte("new"))
+				require.NoError(t, err)
+				require.True(t, updated)
+				requireInnerKeys(tree, order)
+			}
+			var got []byte
+			tree.Iterate(func(key, value []byte) bool {
+				got = append(got, key...)
+				return false
+			})
+			require.Equal(t, "abcdef"[:n], string(got), "order %q", order)
+		})
+	}
+}
+
+func TestMutableTree_Compact(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for version := 0; version < 10; version++ {
+		for i := 0; i < 50; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%02d", rand.Intn(100))), []byte(fmt.Sprintf("value-%d", version)))
+		}
+		tree.Remove([]byte(fmt.Sprintf("key-%02d", rand.Intn(100))))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	tree.Set([]byte("key-unsaved"), []byte("value"))
+	hash := tree.WorkingHash()
+	require.NotEmpty(t, tree.ndb.orphans())
+
+	version, deleted, err := tree.Compact()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, version)
+	require.Equal(t, 10, deleted)
+	require.Equal(t, hash, tree.Hash())
+	require.Equal(t, []int{11}, tree.AvailableVersions())
+
+	// Only the nodes of the new version are left.
+	require.Len(t, tree.ndb.roots(), 1)
+	require.Empty(t, tree.ndb.orphans())
+	require.Len(t, tree.ndb.nodes(), int(2*tree.Size()-1))
+
+	reloaded := NewMutableTree(memDB, 0)
+	version, err = reloaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 11, version)
+	require.Equal(t, hash, reloaded.Hash())
+	require.NoError(t, reloaded.Validate())
+}
+
+func TestMutableTree_Clone(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("saved"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// Unsaved changes are shared with the clone too.
+	for i := 0; i < 50; i += 5 {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("working"))
+	}
+	hash := tree.WorkingHash()
+
+	clone := tree.Clone()
+	require.Equal(t, hash, clone.WorkingHash())
+
+	// Diverge the clones: changing one leaves the other as it was. Hashes are
+	// cached in the nodes, so compare the contents too.
+	contents := func(tree *MutableTree) (kvs [][]byte) {
+		tree.Iterate(func(key, value []byte) bool {
+			kvs = append(kvs, key, value)
+			return false
+		})
+		return kvs
+	}
+	before := contents(tree)
+	clone.Set([]byte("key-00"), []byte("clone"))
+	clone.Remove([]byte("key-01"))
+	require.Equal(t, hash, tree.WorkingHash())
+	require.Equal(t, before, contents(tree))
+	cloneHash := clone.WorkingHash()
+	require.NotEqual(t, hash, cloneHash)
+
+	tree.Set([]byte("key-02"), []byte("tree"))
+	require.Equal(t, cloneHash, clone.WorkingHash())
+	require.NotEqual(t, hash, tree.WorkingHash())
+	require.NotEqual(t, cloneHash, tree.WorkingHash())
+
+	_, value, _ := tree.Get([]byte("key-01"))
+	require.Equal(t, []byte("saved"), value)
+	_, value, _ = clone.Get([]byte("key-01"))
+	require.Nil(t, value)
+
+	// Keep the clone: saving it persists its changes, and the original is
+	// discarded.
+	cloneHash, _, err = clone.SaveVersion()
+	require.NoError(t, err)
+	reloaded := NewMutableTree(memDB, 0)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, cloneHash, reloaded.Hash())
+	_, value, _ = reloaded.Get([]byte("key-00"))
+	require.Equal(t, []byte("clone"), value)
+	_, value, _ = reloaded.Get([]byte("key-01"))
+	require.Nil(t, value)
+	_, value, _ = reloaded.GetVersioned([]byte("key-01"), 1)
+	require.Equal(t, []byte("saved"), value)
+}
+
+// Run with -race to check that readers never race with the writer.
+func TestMutableTree_ConcurrentReaders(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 100)
+	// Readers look for the even keys, which the writer never touches.
+	for i := 0; i < 200; i += 2 {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("fixed"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < 200; i += 2 {
+					key := []byte(fmt.Sprintf("key-%03d", i))
+					if _, value, _ := tree.Get(key); !bytes.Equal(value, []byte("fixed")) {
+						errs <- fmt.Errorf("missing key %s", key)
+						return
+					}
+				}
+				var prev []byte
+				count := 0
+				iter := tree.Iterator(nil, nil, true)
+				for ; iter.Valid(); iter.Next() {
+					if prev != nil && bytes.Compare(prev, iter.Key()) >= 0 {
+						errs <- fmt.Errorf("keys out of order: %s, %s", prev, iter.Key())
+						return
+					}
+					prev = iter.Key()
+					count++
+				}
+				iter.Close()
+				if count < 100 {
+					errs <- fmt.Errorf("iterated %d keys", count)
+					return
+				}
+				tree.GetByIndex(int64(count / 2))
+			}
+		}()
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", 2*rand.Intn(100)+1))
+		if i%3 == 0 {
+			tree.Remove(key)
+		} else {
+			tree.Set(key, []byte("changing"))
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMutableTree_SetIfAbsent(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	inserted, err := tree.SetIfAbsent([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.True(t, inserted)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// A present key keeps its value and version, and the tree is left as is.
+	hash := tree.WorkingHash()
+	inserted, err = tree.SetIfAbsent([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	require.False(t, inserted)
+	require.Equal(t, hash, tree.WorkingHash())
+	value, version, _, err := tree.GetWithVersion([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	require.EqualValues(t, 1, version)
+
+	inserted, err = tree.SetIfAbsent([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	require.True(t, inserted)
+	_, value, err = tree.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), value)
+}
+
+func TestMutableTree_RecomputeMetadata(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte{byte(i)})
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Store a wrong size for an inner node, as a bug would have.
+	left, err := tree.root.getLeftNode(tree.ImmutableTree)
+	require.NoError(t, err)
+	require.False(t, left.isLeaf())
+	corrupt, err := MakeNode(memDB.Get(tree.ndb.nodeKey(left.hash)))
+	require.NoError(t, err)
+	corrupt.size += 3
+	var buf bytes.Buffer
+	require.NoError(t, corrupt.writeBytes(&buf))
+	memDB.Set(tree.ndb.nodeKey(left.hash), buf.Bytes())
+
+	loaded := NewMutableTree(memDB, 0)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	require.Error(t, loaded.Validate())
+
+	mismatches, err := loaded.RecomputeMetadata()
+	require.NoError(t, err)
+	require.Equal(t, []MetadataMismatch{{
+		Key: left.key, Hash: left.hash,
+		StoredHeight: left.height, StoredSize: left.size + 3,
+		Height: left.height, Size: left.size,
+	}}, mismatches)
+	require.NoError(t, loaded.Validate())
+	require.EqualValues(t, 50, loaded.Size())
+	for i := 0; i < 50; i++ {
+		key, value, err := loaded.GetByIndex(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("key-%02d", i), string(key))
+		require.Equal(t, []byte{byte(i)}, value)
+	}
+
+	// The repair is saved with the next version, after which there is
+	// nothing left to repair.
+	_, version, err := loaded.SaveVersion()
+	require.NoError(t, err)
+	reloaded := NewMutableTree(memDB, 0)
+	_, err = reloaded.LoadVersion(version)
+	require.NoError(t, err)
+	require.NoError(t, reloaded.Validate())
+	hash := reloaded.WorkingHash()
+	mismatches, err = reloaded.RecomputeMetadata()
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+	require.Equal(t, hash, reloaded.WorkingHash())
+}
+
+func TestMutableTree_Append(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var keys [][]byte
+	for i := 0; i < 300; i++ {
+		key, err := tree.Append([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		if i == 0 {
+			require.Equal(t, make([]byte, 8), key)
+		} else {
+			require.True(t, bytes.Compare(keys[i-1], key) < 0)
+		}
+		keys = append(keys, key)
+		if i == 150 {
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	// The pairs iterate in the order of their appends.
+	i := 0
+	tree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, keys[i], key)
+		require.Equal(t, strconv.Itoa(i), string(value))
+		i++
+		return false
+	})
+	require.Equal(t, 300, i)
+
+	// A removed last key is assigned again.
+	_, _, err := tree.Remove(keys[299])
+	require.NoError(t, err)
+	key, err := tree.Append([]byte("again"))
+	require.NoError(t, err)
+	require.Equal(t, keys[299], key)
+
+	// The counter can't overflow, and other keys can't be counted.
+	max := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	tree.Set(max, []byte{})
+	hash := tree.WorkingHash()
+	_, err = tree.Append([]byte{})
+	require.Error(t, err)
+	require.Equal(t, hash, tree.WorkingHash())
+	tree.Set(append(max, 0), []byte{})
+	hash = tree.WorkingHash()
+	_, err = tree.Append([]byte{})
+	require.Error(t, err)
+	require.Equal(t, hash, tree.WorkingHash())
+}
+
+func TestMutableTree_Freeze(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte{byte(i)})
+	}
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Freeze()
+	require.True(t, tree.IsFrozen())
+
+	// Changes are rejected and leave the tree as is.
+	_, err = tree.Set([]byte("key-00"), []byte("new"))
+	require.Equal(t, ErrFrozen, errors.Cause(err))
+	_, _, err = tree.Replace([]byte("new"), []byte("new"))
+	require.Equal(t, ErrFrozen, errors.Cause(err))
+	_, _, err = tree.Remove([]byte("key-01"))
+	require.Equal(t, ErrFrozen, errors.Cause(err))
+	_, err = tree.RemoveRange(nil, nil)
+	require.Equal(t, ErrFrozen, errors.Cause(err))
+	err = tree.BatchSet([]KVPair{{Key: []byte("new"), Value: []byte("new")}})
+	require.Equal(t, ErrFrozen, errors.Cause(err))
+	require.Equal(t, hash, tree.WorkingHash())
+
+	// Reads and proofs are still served.
+	_, value, err := tree.Get([]byte("key-05"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{5}, value)
+	count := 0
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, 20, count)
+	value, proof, err := tree.GetWithProof([]byte("key-07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{7}, value)
+	require.NoError(t, proof.Verify(hash))
+	require.NoError(t, proof.VerifyItem([]byte("key-07"), value))
+
+	// A thawed tree can be changed and saved, while the frozen one stays as is.
+	thawed := tree.Thaw()
+	require.False(t, thawed.IsFrozen())
+	_, err = thawed.Set([]byte("key-00"), []byte("new"))
+	require.NoError(t, err)
+	_, thawedVersion, err := thawed.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, version+1, thawedVersion)
+	require.True(t, tree.IsFrozen())
+	require.Equal(t, hash, tree.WorkingHash())
+	_, value, err = tree.Get([]byte("key-00"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0}, value)
+}
+
+func TestMutableTree_DeferCommits(t *testing.T) {
+	// The same versions are saved and deleted with and without deferring, and
+	// must leave the same database.
+	run := func(memDB db.DB, deferred bool) *MutableTree {
+		r := rand.New(rand.NewSource(1))
+		// External values are also read back from the deferred writes.
+		tree := NewMutableTreeWithOpts(memDB, 0, &Options{ExternalValues: true})
+		for version := 1; version <= 8; version++ {
+			if deferred && version == 3 {
+				tree.DeferCommits()
+			}
+			for i := 0; i < 30; i++ {
+				tree.Set([]byte(fmt.Sprintf("key-%02d", r.Intn(60))), []byte(fmt.Sprintf("value-%d", version)))
+			}
+			tree.Remove([]byte(fmt.Sprintf("key-%02d", r.Intn(60))))
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			if version >= 4 {
+				require.NoError(t, tree.DeleteVersion(int64(version-2)))
+			}
+		}
+		require.NoError(t, tree.DeleteVersion(1))
+		return tree
+	}
+	contents := func(memDB db.DB) (kvs []KVPair) {
+		itr := memDB.Iterator(nil, nil)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			kvs = append(kvs, KVPair{Key: itr.Key(), Value: itr.Value()})
+		}
+		return kvs
+	}
+
+	expectedDB := db.NewMemDB()
+	expected := run(expectedDB, false)
+
+	memDB := db.NewMemDB()
+	tree := run(memDB, true)
+	require.Error(t, tree.SetWAL(&memWAL{}))
+
+	// The tree reads its deferred versions, but the database only has the
+	// versions committed before deferring.
+	require.Equal(t, expected.Hash(), tree.Hash())
+	require.Equal(t, expected.AvailableVersions(), tree.AvailableVersions())
+	previous, err := tree.GetImmutable(7)
+	require.NoError(t, err)
+	require.NoError(t, previous.Validate())
+	_, err = tree.IntegrityDigest()
+	require.NoError(t, err)
+	opts := &Options{ExternalValues: true}
+	version, err := NewMutableTreeWithOpts(memDB, 0, opts).Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+
+	// The flush commits them all at once, to the same database.
+	require.NoError(t, tree.FlushCommits())
+	require.Equal(t, contents(expectedDB), contents(memDB))
+	require.NoError(t, tree.FlushCommits())
+
+	// Commits are no longer deferred.
+	tree.Set([]byte("new"), []byte("value"))
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	loaded, err := NewMutableTreeWithOpts(memDB, 0, opts).Load()
+	require.NoError(t, err)
+	require.Equal(t, version, loaded)
+}
+
+func TestMutableTree_FlushCommitsFailure(t *testing.T) {
+	memDB := db.NewMemDB()
+	wal := &memWAL{}
+	tree := NewMutableTree(memDB, 0)
+	require.NoError(t, tree.SetWAL(wal))
+	tree.Set([]byte("a"), []byte("1"))
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.DeferCommits()
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("c"), []byte("3"))
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// A failed flush keeps the writes deferred, and the tree reading them.
+	wal.crash = -1
+	require.Equal(t, errCrash, errors.Cause(tree.FlushCommits()))
+	loaded, err := NewMutableTree(memDB, 0).Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, loaded)
+	previous, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	require.NoError(t, previous.Validate())
+	require.EqualValues(t, version, tree.ndb.getLatestVersion())
+
+	// The next flush commits them.
+	wal.crash = 0
+	require.NoError(t, tree.FlushCommits())
+	require.Empty(t, wal.records)
+	reloaded := NewMutableTree(memDB, 0)
+	loaded, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, loaded)
+	require.Equal(t, hash, reloaded.Hash())
+}
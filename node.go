@@ -6,12 +6,14 @@ package iavl
 import (
 	"bytes"
 	"fmt"
+	"hash"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/pkg/errors"
 
 	amino "github.com/tendermint/go-amino"
-	"github.com/tendermint/tendermint/crypto/tmhash"
 )
 
 // Node represents a node in a Tree.
@@ -40,38 +42,158 @@ func NewNode(key []byte, value []byte, version int64) *Node {
 	}
 }
 
+// innerNodePool recycles the inner nodes allocated by the mutations of a
+// MutableTree. A node may only be released once it is unreachable: it was
+// created by the ongoing mutation and never published in a root. Orphaned
+// nodes are never released, since retained versions, the node cache and
+// concurrent readers may still hold them.
+var innerNodePool = sync.Pool{
+	New: func() interface{} { return new(Node) },
+}
+
+// newInnerNode returns a zeroed node from the pool.
+func newInnerNode() *Node {
+	return innerNodePool.Get().(*Node)
+}
+
+// releaseNode zeroes the node and returns it to the pool. See innerNodePool
+// for when it is safe.
+func releaseNode(node *Node) {
+	*node = Node{}
+	innerNodePool.Put(node)
+}
+
+// KVPair is a key-value pair, as passed to LoadFromSorted.
+type KVPair struct {
+	Key   []byte
+	Value []byte
+}
+
+// LoadFromSorted builds a balanced tree holding the given pairs at the given
+// version, and returns its root. It works bottom-up in O(n), without the
+// rotations and orphans of setting the keys one at a time. The keys must be
+// strictly ascending, and the values non-nil. An empty input gives a nil root.
+func LoadFromSorted(kvs []KVPair, version int64) (*Node, error) {
+	if err := checkSorted(kvs, bytes.Compare, false); err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	return loadFromSorted(kvs, version), nil
+}
+
+// checkSorted returns an error unless the keys are strictly ascending in the
+// order of compare, and the values non-nil unless the tree is keys-only.
+func checkSorted(kvs []KVPair, compare func(a, b []byte) int, keysOnly bool) error {
+	for i, kv := range kvs {
+		if kv.Value == nil && !keysOnly {
+			return errors.Errorf("nil value at key %X", kv.Key)
+		}
+		if i > 0 && compare(kvs[i-1].Key, kv.Key) >= 0 {
+			return errors.Errorf("keys are not strictly ascending at index %d (%X)", i, kv.Key)
+		}
+	}
+	return nil
+}
+
+func loadFromSorted(kvs []KVPair, version int64) *Node {
+	if len(kvs) == 1 {
+		return NewNode(kvs[0].Key, kvs[0].Value, version)
+	}
+	// An even split keeps the heights of the halves within one of each other.
+	mid := len(kvs) / 2
+	left, right := loadFromSorted(kvs[:mid], version), loadFromSorted(kvs[mid:], version)
+	return &Node{
+		key:       kvs[mid].Key, // The leftmost key of the right subtree.
+		height:    maxInt8(left.height, right.height) + 1,
+		size:      left.size + right.size,
+		leftNode:  left,
+		rightNode: right,
+		version:   version,
+	}
+}
+
 // MakeNode constructs an *Node from an encoded byte slice.
 //
+// The buffer usually comes straight from the database, so it is treated as
+// untrusted: a truncated or otherwise malformed buffer results in an error,
+// never in a panic.
+//
 // The new node doesn't have its hash saved or set. The caller must set it
-// afterwards.
+// afterwards. Bytes following the node are ignored, see DecodeNode.
 func MakeNode(buf []byte) (*Node, error) {
+	return makeNode(buf, false)
+}
+
+// makeNode is like MakeNode, for a keys-only tree if keysOnly is set, see
+// decodeNode.
+func makeNode(buf []byte, keysOnly bool) (*Node, error) {
+	node, _, err := decodeNode(buf, keysOnly)
+	return node, err
+}
+
+// DecodeNode is like MakeNode, but strict: it returns an error if bytes
+// follow the encoded node, which MakeNode ignores, as they reveal a buffer
+// which wasn't written by writeBytes, e.g. of another encoding.
+func DecodeNode(buf []byte) (*Node, error) {
+	return decodeNodeExact(buf, false)
+}
+
+// decodeNodeExact is like DecodeNode, for a keys-only tree if keysOnly is set,
+// see decodeNode.
+func decodeNodeExact(buf []byte, keysOnly bool) (*Node, error) {
+	node, rest, err := decodeNode(buf, keysOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.Errorf("decoding node: %d trailing bytes", len(rest))
+	}
+	return node, nil
+}
+
+// decodeNode decodes a node, and returns the bytes following it. The leaves of
+// a keys-only tree, see Options.KeysOnly, end with their key and have a nil
+// value, and those of other trees must have a value, so that a leaf truncated
+// after its key is rejected rather than read as a key without a value.
+func decodeNode(buf []byte, keysOnly bool) (node *Node, rest []byte, err error) {
+	if len(buf) == 0 {
+		return nil, nil, errors.New("decoding node: empty buffer")
+	}
 
 	// Read node header (height, size, version, key).
 	height, n, cause := amino.DecodeInt8(buf)
 	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.height")
+		return nil, nil, errors.Wrap(cause, "decoding node.height")
+	}
+	if height < 0 {
+		return nil, nil, errors.Errorf("decoding node.height: invalid height %d", height)
 	}
 	buf = buf[n:]
 
 	size, n, cause := amino.DecodeVarint(buf)
 	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.size")
+		return nil, nil, errors.Wrap(cause, "decoding node.size")
+	}
+	if (height == 0 && size != 1) || (height > 0 && size < 2) {
+		return nil, nil, errors.Errorf("decoding node.size: invalid size %d for height %d", size, height)
 	}
 	buf = buf[n:]
 
 	ver, n, cause := amino.DecodeVarint(buf)
 	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.version")
+		return nil, nil, errors.Wrap(cause, "decoding node.version")
 	}
 	buf = buf[n:]
 
 	key, n, cause := amino.DecodeByteSlice(buf)
 	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.key")
+		return nil, nil, errors.Wrap(cause, "decoding node.key")
 	}
 	buf = buf[n:]
 
-	node := &Node{
+	node = &Node{
 		height:  height,
 		size:    size,
 		version: ver,
@@ -81,26 +203,34 @@ func MakeNode(buf []byte) (*Node, error) {
 	// Read node body.
 
 	if node.isLeaf() {
-		val, _, cause := amino.DecodeByteSlice(buf)
-		if cause != nil {
-			return nil, errors.Wrap(cause, "decoding node.value")
+		if keysOnly {
+			if len(buf) > 0 {
+				return nil, nil, errors.Wrap(ErrKeysOnly, "decoding node.value: value in a keys-only leaf")
+			}
+		} else {
+			val, n, cause := amino.DecodeByteSlice(buf)
+			if cause != nil {
+				return nil, nil, errors.Wrap(cause, "decoding node.value")
+			}
+			buf = buf[n:]
+			node.value = val
 		}
-		node.value = val
 	} else { // Read children.
 		leftHash, n, cause := amino.DecodeByteSlice(buf)
 		if cause != nil {
-			return nil, errors.Wrap(cause, "deocding node.leftHash")
+			return nil, nil, errors.Wrap(cause, "deocding node.leftHash")
 		}
 		buf = buf[n:]
 
-		rightHash, _, cause := amino.DecodeByteSlice(buf)
+		rightHash, n, cause := amino.DecodeByteSlice(buf)
 		if cause != nil {
-			return nil, errors.Wrap(cause, "decoding node.rightHash")
+			return nil, nil, errors.Wrap(cause, "decoding node.rightHash")
 		}
+		buf = buf[n:]
 		node.leftHash = leftHash
 		node.rightHash = rightHash
 	}
-	return node, nil
+	return node, buf, nil
 }
 
 // String returns a string representation of the node.
@@ -117,12 +247,45 @@ func (node *Node) String() string {
 		hashstr)
 }
 
+// Key returns the key of a leaf, or for an inner node the smallest key of its
+// right subtree. It must not be modified.
+func (node *Node) Key() []byte {
+	return node.key
+}
+
+// Height returns the height of the node's subtree, 0 for a leaf.
+func (node *Node) Height() int8 {
+	return node.height
+}
+
+// Size returns the number of leaves in the node's subtree, 1 for a leaf.
+func (node *Node) Size() int64 {
+	return node.size
+}
+
+// Version returns the version the node was created in.
+func (node *Node) Version() int64 {
+	return node.version
+}
+
+// Hash returns the hash of the node, or nil if it has not been computed yet.
+// It must not be modified.
+func (node *Node) Hash() []byte {
+	return node.hash
+}
+
+// IsLeaf returns whether the node is a leaf, i.e. holds a key and value.
+func (node *Node) IsLeaf() bool {
+	return node.isLeaf()
+}
+
 // clone creates a shallow copy of a node with its hash set to nil.
 func (node *Node) clone(version int64) *Node {
 	if node.isLeaf() {
 		panic("Attempt to copy a leaf node")
 	}
-	return &Node{
+	clone := newInnerNode()
+	*clone = Node{
 		key:       node.key,
 		height:    node.height,
 		version:   version,
@@ -134,6 +297,7 @@ func (node *Node) clone(version int64) *Node {
 		rightNode: node.rightNode,
 		persisted: false,
 	}
+	return clone
 }
 
 func (node *Node) isLeaf() bool {
@@ -141,72 +305,187 @@ func (node *Node) isLeaf() bool {
 }
 
 // Check if the node has a descendant with the given key.
-func (node *Node) has(t *ImmutableTree, key []byte) (has bool) {
+func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	if bytes.Equal(node.key, key) {
-		return true
+		return true, nil
 	}
 	if node.isLeaf() {
-		return false
+		return false, nil
 	}
-	if bytes.Compare(key, node.key) < 0 {
-		return node.getLeftNode(t).has(t, key)
+	var child *Node
+	if t.compare(key, node.key) < 0 {
+		child, err = node.getLeftNode(t)
+	} else {
+		child, err = node.getRightNode(t)
 	}
-	return node.getRightNode(t).has(t, key)
+	if err != nil {
+		return false, err
+	}
+	return child.has(t, key)
 }
 
 // Get a key under the node.
-func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte) {
+func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte, err error) {
 	if node.isLeaf() {
-		switch bytes.Compare(node.key, key) {
+		switch t.compare(node.key, key) {
 		case -1:
-			return 1, nil
+			return 1, nil, nil
 		case 1:
-			return 0, nil
+			return 0, nil, nil
 		default:
-			return 0, node.value
+			return 0, node.value, nil
 		}
 	}
 
-	if bytes.Compare(key, node.key) < 0 {
-		return node.getLeftNode(t).get(t, key)
+	if t.compare(key, node.key) < 0 {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return 0, nil, err
+		}
+		return leftNode.get(t, key)
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return 0, nil, err
 	}
-	rightNode := node.getRightNode(t)
-	index, value = rightNode.get(t, key)
+	index, value, err = rightNode.get(t, key)
 	index += node.size - rightNode.size
-	return index, value
+	return index, value, err
 }
 
-func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value []byte) {
+// getMany looks up the keys at the given indexes, sorted by key, in the
+// subtree, and sets the values and found flags of those found.
+func (node *Node) getMany(t *ImmutableTree, keys [][]byte, order []int, values [][]byte, found []bool) error {
+	if node.isLeaf() {
+		for _, i := range order {
+			if bytes.Equal(keys[i], node.key) {
+				values[i], found[i] = node.value, true
+			}
+		}
+		return nil
+	}
+
+	split := sort.Search(len(order), func(j int) bool { return t.compare(keys[order[j]], node.key) >= 0 })
+	if split > 0 {
+		left, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := left.getMany(t, keys, order[:split], values, found); err != nil {
+			return err
+		}
+	}
+	if split < len(order) {
+		right, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		return right.getMany(t, keys, order[split:], values, found)
+	}
+	return nil
+}
+
+func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value []byte, err error) {
+	leaf, err := node.getLeafByIndex(t, index)
+	if err != nil || leaf == nil {
+		return nil, nil, err
+	}
+	return leaf.key, leaf.value, nil
+}
+
+// getLeafByIndex returns the leaf at the index under the node, or nil if there
+// is none.
+func (node *Node) getLeafByIndex(t *ImmutableTree, index int64) (*Node, error) {
 	if node.isLeaf() {
 		if index == 0 {
-			return node.key, node.value
+			return node, nil
 		}
 		return nil, nil
 	}
-	// TODO: could improve this by storing the
-	// sizes as well as left/right hash.
-	leftNode := node.getLeftNode(t)
+	// TODO: could avoid loading the left node by storing the sizes as well as
+	// left/right hash. Proofs don't need them, see PathToLeaf.Index.
+	leftNode, err := node.getLeftNode(t)
+	if err != nil {
+		return nil, err
+	}
 
 	if index < leftNode.size {
-		return leftNode.getByIndex(t, index)
+		return leftNode.getLeafByIndex(t, index)
+	}
+	rightNode, err := node.getRightNode(t)
+	if err != nil {
+		return nil, err
+	}
+	return rightNode.getLeafByIndex(t, index-leftNode.size)
+}
+
+// appendByIndexRange appends the keys and values of the leaves under the node
+// with index in [from, to), relative to the node's leftmost leaf. Subtrees
+// which lie entirely outside the bounds are skipped using their size.
+func (node *Node) appendByIndexRange(t *ImmutableTree, from, to int64, keys, values *[][]byte) error {
+	if to <= 0 || node.size <= from {
+		return nil
+	}
+	if node.isLeaf() {
+		*keys = append(*keys, node.key)
+		*values = append(*values, node.value)
+		return nil
+	}
+	leftNode, rightNode, err := node.getChildren(t)
+	if err != nil {
+		return err
 	}
-	return node.getRightNode(t).getByIndex(t, index-leftNode.size)
+	if err := leftNode.appendByIndexRange(t, from, to, keys, values); err != nil {
+		return err
+	}
+	return rightNode.appendByIndexRange(t, from-leftNode.size, to-leftNode.size, keys, values)
+}
+
+// countInRange counts the leaves under the node with key in [start, end),
+// given that every key under the node is known to lie in [lo, hi). Nil bounds
+// are open. Subtrees which lie entirely within the range contribute their size
+// without being visited, so only the nodes along the two range boundaries are
+// loaded.
+func (node *Node) countInRange(t *ImmutableTree, start, end, lo, hi []byte) (int64, error) {
+	startOK := start == nil || (lo != nil && t.compare(start, lo) <= 0)
+	endOK := end == nil || (hi != nil && t.compare(hi, end) <= 0)
+	if startOK && endOK {
+		return node.size, nil
+	}
+	if (start != nil && hi != nil && t.compare(hi, start) <= 0) ||
+		(end != nil && lo != nil && t.compare(end, lo) <= 0) {
+		return 0, nil
+	}
+	if node.isLeaf() {
+		if (start == nil || t.compare(start, node.key) <= 0) &&
+			(end == nil || t.compare(node.key, end) < 0) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	leftNode, rightNode, err := node.getChildren(t)
+	if err != nil {
+		return 0, err
+	}
+	leftCount, err := leftNode.countInRange(t, start, end, lo, node.key)
+	if err != nil {
+		return 0, err
+	}
+	rightCount, err := rightNode.countInRange(t, start, end, node.key, hi)
+	return leftCount + rightCount, err
 }
 
 // Computes the hash of the node without computing its descendants. Must be
 // called on nodes which have descendant node hashes already computed.
-func (node *Node) _hash() []byte {
+func (node *Node) _hash(hashFunc func() hash.Hash) []byte {
 	if node.hash != nil {
 		return node.hash
 	}
 
-	h := tmhash.New()
-	buf := new(bytes.Buffer)
-	if err := node.writeHashBytes(buf); err != nil {
-		panic(err)
-	}
-	_, err := h.Write(buf.Bytes())
-	if err != nil {
+	// The hash bytes are written straight into the hasher, without an
+	// intermediate buffer.
+	h := hashFunc()
+	if err := node.writeHashBytes(h, hashFunc); err != nil {
 		panic(err)
 	}
 	node.hash = h.Sum(nil)
@@ -216,87 +495,140 @@ func (node *Node) _hash() []byte {
 
 // Hash the node and its descendants recursively. This usually mutates all
 // descendant nodes. Returns the node hash and number of nodes hashed.
-func (node *Node) hashWithCount() ([]byte, int64) {
+func (node *Node) hashWithCount(hashFunc func() hash.Hash) ([]byte, int64) {
 	if node.hash != nil {
 		return node.hash, 0
 	}
 
-	h := tmhash.New()
-	buf := new(bytes.Buffer)
-	hashCount, err := node.writeHashBytesRecursively(buf)
+	// The children are hashed with hashers of their own before anything is
+	// written to h, so the hash bytes can be written straight into it.
+	h := hashFunc()
+	hashCount, err := node.writeHashBytesRecursively(h, hashFunc)
 	if err != nil {
 		panic(err)
 	}
-	_, err = h.Write(buf.Bytes())
-	if err != nil {
+	node.hash = h.Sum(nil)
+
+	return node.hash, hashCount + 1
+}
+
+// hashWithCountParallel is like hashWithCount, but hashes the two children of
+// the inner nodes of subtrees with more than threshold leaves in parallel.
+func (node *Node) hashWithCountParallel(hashFunc func() hash.Hash, threshold int64) ([]byte, int64) {
+	if node.hash != nil || threshold <= 0 || node.size <= threshold {
+		return node.hashWithCount(hashFunc)
+	}
+
+	var leftCount, rightCount int64
+	var wg sync.WaitGroup
+	if node.leftNode != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			node.leftHash, leftCount = node.leftNode.hashWithCountParallel(hashFunc, threshold)
+		}()
+	}
+	if node.rightNode != nil {
+		node.rightHash, rightCount = node.rightNode.hashWithCountParallel(hashFunc, threshold)
+	}
+	wg.Wait()
+
+	h := hashFunc()
+	if err := node.writeHashBytes(h, hashFunc); err != nil {
 		panic(err)
 	}
 	node.hash = h.Sum(nil)
 
-	return node.hash, hashCount + 1
+	return node.hash, leftCount + rightCount + 1
+}
+
+// NodeHashPreimage returns the bytes hashed to get the hash of the node with
+// the default hash function, which proofs require, so that other
+// implementations can check that they hash nodes the same way. The hashes of
+// the children of an inner node must be known.
+func NodeHashPreimage(node *Node) []byte {
+	var buf bytes.Buffer
+	if err := node.writeHashBytes(&buf, Options{}.hashFunc()); err != nil {
+		panic(err) // Writing to a bytes.Buffer doesn't fail.
+	}
+	return buf.Bytes()
 }
 
 // Writes the node's hash to the given io.Writer. This function expects
 // child hashes to be already set.
-func (node *Node) writeHashBytes(w io.Writer) error {
-	err := amino.EncodeInt8(w, node.height)
+func (node *Node) writeHashBytes(w io.Writer, hashFunc func() hash.Hash) error {
+	if node.isLeaf() && node.value == nil {
+		// A leaf of a keys-only tree has no value hash.
+		return writeHashPreimage(w, node.height, node.size, node.version, node.key, nil)
+	}
+	if node.isLeaf() {
+		// Indirection needed to provide proofs without values.
+		// (e.g. proofLeafNode.ValueHash)
+		h := hashFunc()
+		if _, err := h.Write(node.value); err != nil {
+			return errors.Wrap(err, "hashing value")
+		}
+		return writeHashPreimage(w, node.height, node.size, node.version, node.key, h.Sum(nil))
+	}
+	if node.leftHash == nil || node.rightHash == nil {
+		panic("Found an empty child hash")
+	}
+	return writeHashPreimage(w, node.height, node.size, node.version, node.leftHash, node.rightHash)
+}
+
+// writeHashPreimage writes the bytes hashed to get the hash of a node: its
+// height, size and version, then the key and value hash of a leaf, or the
+// hashes of the left and right children of an inner node. The key is not
+// written for inner nodes, unlike writeBytes. An empty value hash is not
+// written either, for the leaves of a keys-only tree, as the hash of a value
+// is never empty. Nodes and proofs are both hashed through it, so they can't
+// drift apart.
+func writeHashPreimage(w io.Writer, height int8, size, version int64, first, second []byte) error {
+	err := amino.EncodeInt8(w, height)
 	if err != nil {
 		return errors.Wrap(err, "writing height")
 	}
-	err = amino.EncodeVarint(w, node.size)
+	err = amino.EncodeVarint(w, size)
 	if err != nil {
 		return errors.Wrap(err, "writing size")
 	}
-	err = amino.EncodeVarint(w, node.version)
+	err = amino.EncodeVarint(w, version)
 	if err != nil {
 		return errors.Wrap(err, "writing version")
 	}
 
-	// Key is not written for inner nodes, unlike writeBytes.
-
-	if node.isLeaf() {
-		err = amino.EncodeByteSlice(w, node.key)
-		if err != nil {
-			return errors.Wrap(err, "writing key")
-		}
-		// Indirection needed to provide proofs without values.
-		// (e.g. proofLeafNode.ValueHash)
-		valueHash := tmhash.Sum(node.value)
-		err = amino.EncodeByteSlice(w, valueHash)
-		if err != nil {
-			return errors.Wrap(err, "writing value")
-		}
-	} else {
-		if node.leftHash == nil || node.rightHash == nil {
-			panic("Found an empty child hash")
-		}
-		err = amino.EncodeByteSlice(w, node.leftHash)
-		if err != nil {
-			return errors.Wrap(err, "writing left hash")
-		}
-		err = amino.EncodeByteSlice(w, node.rightHash)
-		if err != nil {
-			return errors.Wrap(err, "writing right hash")
-		}
+	firstName, secondName := "left hash", "right hash"
+	if height == 0 {
+		firstName, secondName = "key", "value hash"
+	}
+	err = amino.EncodeByteSlice(w, first)
+	if err != nil {
+		return errors.Wrap(err, "writing "+firstName)
+	}
+	if height == 0 && len(second) == 0 {
+		return nil
+	}
+	err = amino.EncodeByteSlice(w, second)
+	if err != nil {
+		return errors.Wrap(err, "writing "+secondName)
 	}
-
 	return nil
 }
 
 // Writes the node's hash to the given io.Writer.
 // This function has the side-effect of calling hashWithCount.
-func (node *Node) writeHashBytesRecursively(w io.Writer) (hashCount int64, err error) {
+func (node *Node) writeHashBytesRecursively(w io.Writer, hashFunc func() hash.Hash) (hashCount int64, err error) {
 	if node.leftNode != nil {
-		leftHash, leftCount := node.leftNode.hashWithCount()
+		leftHash, leftCount := node.leftNode.hashWithCount(hashFunc)
 		node.leftHash = leftHash
 		hashCount += leftCount
 	}
 	if node.rightNode != nil {
-		rightHash, rightCount := node.rightNode.hashWithCount()
+		rightHash, rightCount := node.rightNode.hashWithCount(hashFunc)
 		node.rightHash = rightHash
 		hashCount += rightCount
 	}
-	err = node.writeHashBytes(w)
+	err = node.writeHashBytes(w, hashFunc)
 
 	return
 }
@@ -307,7 +639,9 @@ func (node *Node) aminoSize() int {
 		amino.VarintSize(node.version) +
 		amino.ByteSliceSize(node.key)
 	if node.isLeaf() {
-		n += amino.ByteSliceSize(node.value)
+		if node.value != nil {
+			n += amino.ByteSliceSize(node.value)
+		}
 	} else {
 		n += amino.ByteSliceSize(node.leftHash) +
 			amino.ByteSliceSize(node.rightHash)
@@ -337,9 +671,12 @@ func (node *Node) writeBytes(w io.Writer) error {
 	}
 
 	if node.isLeaf() {
-		cause = amino.EncodeByteSlice(w, node.value)
-		if cause != nil {
-			return errors.Wrap(cause, "writing value")
+		// The leaves of a keys-only tree end with their key.
+		if node.value != nil {
+			cause = amino.EncodeByteSlice(w, node.value)
+			if cause != nil {
+				return errors.Wrap(cause, "writing value")
+			}
 		}
 	} else {
 		if node.leftHash == nil {
@@ -361,92 +698,325 @@ func (node *Node) writeBytes(w io.Writer) error {
 	return nil
 }
 
-func (node *Node) getLeftNode(t *ImmutableTree) *Node {
+func (node *Node) getLeftNode(t *ImmutableTree) (*Node, error) {
 	if node.leftNode != nil {
-		return node.leftNode
+		return node.leftNode, nil
 	}
 	return t.ndb.GetNode(node.leftHash)
 }
 
-func (node *Node) getRightNode(t *ImmutableTree) *Node {
+func (node *Node) getRightNode(t *ImmutableTree) (*Node, error) {
 	if node.rightNode != nil {
-		return node.rightNode
+		return node.rightNode, nil
 	}
 	return t.ndb.GetNode(node.rightHash)
 }
 
+// getChildren returns both children of an inner node.
+func (node *Node) getChildren(t *ImmutableTree) (left, right *Node, err error) {
+	if left, err = node.getLeftNode(t); err != nil {
+		return nil, nil, err
+	}
+	if right, err = node.getRightNode(t); err != nil {
+		return nil, nil, err
+	}
+	return left, right, nil
+}
+
 // NOTE: mutates height and size
-func (node *Node) calcHeightAndSize(t *ImmutableTree) {
-	node.height = maxInt8(node.getLeftNode(t).height, node.getRightNode(t).height) + 1
-	node.size = node.getLeftNode(t).size + node.getRightNode(t).size
+func (node *Node) calcHeightAndSize(t *ImmutableTree) error {
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return err
+	}
+	node.height = maxInt8(left.height, right.height) + 1
+	node.size = left.size + right.size
+	return nil
 }
 
-func (node *Node) calcBalance(t *ImmutableTree) int {
-	return int(node.getLeftNode(t).height) - int(node.getRightNode(t).height)
+func (node *Node) calcBalance(t *ImmutableTree) (int, error) {
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return 0, err
+	}
+	return int(left.height) - int(right.height), nil
 }
 
 // traverse is a wrapper over traverseInRange when we want the whole tree
-func (node *Node) traverse(t *ImmutableTree, ascending bool, cb func(*Node) bool) bool {
+func (node *Node) traverse(t *ImmutableTree, ascending bool, cb func(*Node) bool) (bool, error) {
 	return node.traverseInRange(t, nil, nil, ascending, false, 0, func(node *Node, depth uint8) bool {
 		return cb(node)
 	})
 }
 
-func (node *Node) traverseWithDepth(t *ImmutableTree, ascending bool, cb func(*Node, uint8) bool) bool {
+func (node *Node) traverseWithDepth(t *ImmutableTree, ascending bool, cb func(*Node, uint8) bool) (bool, error) {
 	return node.traverseInRange(t, nil, nil, ascending, false, 0, cb)
 }
 
-func (node *Node) traverseInRange(t *ImmutableTree, start, end []byte, ascending bool, inclusive bool, depth uint8, cb func(*Node, uint8) bool) bool {
-	afterStart := start == nil || bytes.Compare(start, node.key) < 0
-	startOrAfter := start == nil || bytes.Compare(start, node.key) <= 0
-	beforeEnd := end == nil || bytes.Compare(node.key, end) < 0
-	if inclusive {
-		beforeEnd = end == nil || bytes.Compare(node.key, end) <= 0
+// traversePost calls cb on every node of the subtree in post-order: the left
+// subtree, the right subtree, then the node itself. It stops if cb returns
+// true, and returns whether it stopped.
+func (node *Node) traversePost(t *ImmutableTree, cb func(*Node) bool) (bool, error) {
+	if !node.isLeaf() {
+		left, right, err := node.getChildren(t)
+		if err != nil {
+			return false, err
+		}
+		if stop, err := left.traversePost(t, cb); stop || err != nil {
+			return stop, err
+		}
+		if stop, err := right.traversePost(t, cb); stop || err != nil {
+			return stop, err
+		}
+	}
+	return cb(node), nil
+}
+
+// appendNodesAtVersion appends the hashes of the nodes of the subtree with the
+// given version to hashes, in pre-order. A node is never older than its
+// children, so subtrees whose root is older than version are skipped.
+func (node *Node) appendNodesAtVersion(t *ImmutableTree, version int64, hashes *[][]byte) error {
+	if node.version < version {
+		return nil
+	}
+	if node.version == version {
+		*hashes = append(*hashes, node.hash)
+	}
+	if node.isLeaf() {
+		return nil
+	}
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return err
+	}
+	if err := left.appendNodesAtVersion(t, version, hashes); err != nil {
+		return err
+	}
+	return right.appendNodesAtVersion(t, version, hashes)
+}
+
+func (node *Node) traverseInRange(t *ImmutableTree, start, end []byte, ascending bool, inclusive bool, depth uint8, cb func(*Node, uint8) bool) (bool, error) {
+	return node.traverseInBounds(t, start, end, true, inclusive, ascending, depth, cb)
+}
+
+// traverseInBounds is like traverseInRange, with separate control over whether
+// each of start and end is included. It descends into a subtree only if it may
+// hold keys within the bounds, and calls cb on inner nodes and on the leaves
+// within the bounds.
+func (node *Node) traverseInBounds(t *ImmutableTree, start, end []byte, startInclusive, endInclusive, ascending bool, depth uint8, cb func(*Node, uint8) bool) (bool, error) {
+	afterStart := start == nil || t.compare(start, node.key) < 0
+	startOrAfter := start == nil || t.compare(start, node.key) <= 0
+	beforeEnd := end == nil || t.compare(node.key, end) < 0
+	if endInclusive {
+		beforeEnd = end == nil || t.compare(node.key, end) <= 0
+	}
+	inBounds := afterStart && beforeEnd
+	if startInclusive {
+		inBounds = startOrAfter && beforeEnd
 	}
 
 	// Run callback per inner/leaf node.
-	stop := false
-	if !node.isLeaf() || (startOrAfter && beforeEnd) {
-		stop = cb(node, depth)
-		if stop {
-			return stop
+	if !node.isLeaf() || inBounds {
+		if cb(node, depth) {
+			return true, nil
 		}
 	}
 	if node.isLeaf() {
-		return stop
+		return false, nil
 	}
 
-	if ascending {
-		// check lower nodes, then higher
-		if afterStart {
-			stop = node.getLeftNode(t).traverseInRange(t, start, end, ascending, inclusive, depth+1, cb)
+	// Visit the lower nodes first if ascending, else the higher ones.
+	visitLeft := func() (bool, error) {
+		if !afterStart {
+			return false, nil
+		}
+		left, err := node.getLeftNode(t)
+		if err != nil {
+			return false, err
 		}
-		if stop {
-			return stop
+		return left.traverseInBounds(t, start, end, startInclusive, endInclusive, ascending, depth+1, cb)
+	}
+	visitRight := func() (bool, error) {
+		if !beforeEnd {
+			return false, nil
+		}
+		right, err := node.getRightNode(t)
+		if err != nil {
+			return false, err
 		}
-		if beforeEnd {
-			stop = node.getRightNode(t).traverseInRange(t, start, end, ascending, inclusive, depth+1, cb)
+		return right.traverseInBounds(t, start, end, startInclusive, endInclusive, ascending, depth+1, cb)
+	}
+	first, second := visitLeft, visitRight
+	if !ascending {
+		first, second = visitRight, visitLeft
+	}
+	if stop, err := first(); stop || err != nil {
+		return stop, err
+	}
+	return second()
+}
+
+// estimateMemory returns an estimate of the bytes held by the node and its
+// descendants in memory, see ImmutableTree.EstimateMemory.
+func (node *Node) estimateMemory() int64 {
+	size := nodeStructSize + int64(len(node.key)+len(node.value)+
+		len(node.hash)+len(node.leftHash)+len(node.rightHash))
+	if node.leftNode != nil {
+		size += node.leftNode.estimateMemory()
+	}
+	if node.rightNode != nil {
+		size += node.rightNode.estimateMemory()
+	}
+	return size
+}
+
+// traverseVersionRange calls fn on the leaves of the subtree with a version in
+// [lo, hi], in order. A node is never older than its children, so subtrees
+// whose root is before lo are skipped. It stops if fn returns true.
+func (node *Node) traverseVersionRange(t *ImmutableTree, lo, hi int64, fn func(key, value []byte, version int64) bool) (bool, error) {
+	if node.version < lo {
+		return false, nil
+	}
+	if node.isLeaf() {
+		if node.version > hi {
+			return false, nil
+		}
+		return fn(node.key, node.value, node.version), nil
+	}
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return false, err
+	}
+	if stop, err := left.traverseVersionRange(t, lo, hi, fn); stop || err != nil {
+		return stop, err
+	}
+	return right.traverseVersionRange(t, lo, hi, fn)
+}
+
+// countUnhashed returns the number of nodes of the subtree whose hash isn't
+// computed yet. The nodes of a hashed subtree are all hashed, since changing a
+// node replaces it and every node on the path to it.
+func (node *Node) countUnhashed() int64 {
+	if node.hash != nil {
+		return 0
+	}
+	count := int64(1)
+	if node.leftNode != nil {
+		count += node.leftNode.countUnhashed()
+	}
+	if node.rightNode != nil {
+		count += node.rightNode.countUnhashed()
+	}
+	return count
+}
+
+// validate checks the AVL and merkle invariants of the subtree, whose keys
+// must be in [lo, hi), and returns its recomputed hash and leftmost key.
+func (node *Node) validate(t *ImmutableTree, lo, hi []byte) (hash, leftmost []byte, err error) {
+	fail := func(format string, args ...interface{}) error {
+		return errors.Errorf("node %X (hash %X): %s", node.key, node.hash, fmt.Sprintf(format, args...))
+	}
+	if (lo != nil && t.compare(node.key, lo) < 0) || (hi != nil && t.compare(node.key, hi) >= 0) {
+		return nil, nil, fail("key out of order, expected in [%X, %X)", lo, hi)
+	}
+
+	computed := *node
+	leftmost = node.key
+	if node.isLeaf() {
+		if node.height != 0 || node.size != 1 {
+			return nil, nil, fail("leaf has height %d and size %d", node.height, node.size)
 		}
 	} else {
-		// check the higher nodes first
-		if beforeEnd {
-			stop = node.getRightNode(t).traverseInRange(t, start, end, ascending, inclusive, depth+1, cb)
+		if node.leftNode == nil && len(node.leftHash) == 0 {
+			return nil, nil, fail("missing left child")
+		}
+		if node.rightNode == nil && len(node.rightHash) == 0 {
+			return nil, nil, fail("missing right child")
+		}
+		left, right, err := node.getChildren(t)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "node %X (hash %X) in [%X, %X)", node.key, node.hash, lo, hi)
+		}
+		if height := maxInt8(left.height, right.height) + 1; node.height != height {
+			return nil, nil, fail("height %d, expected %d", node.height, height)
 		}
-		if stop {
-			return stop
+		if size := left.size + right.size; node.size != size {
+			return nil, nil, fail("size %d, expected %d", node.size, size)
 		}
-		if afterStart {
-			stop = node.getLeftNode(t).traverseInRange(t, start, end, ascending, inclusive, depth+1, cb)
+		if balance := int(left.height) - int(right.height); balance < -1 || balance > 1 {
+			return nil, nil, fail("unbalanced, balance factor %d", balance)
+		}
+
+		var rightmost []byte
+		if computed.leftHash, leftmost, err = left.validate(t, lo, node.key); err != nil {
+			return nil, nil, err
+		}
+		if computed.rightHash, rightmost, err = right.validate(t, node.key, hi); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(node.key, rightmost) {
+			return nil, nil, fail("key is not the leftmost key %X of the right subtree", rightmost)
+		}
+		if node.leftHash != nil && !bytes.Equal(node.leftHash, computed.leftHash) {
+			return nil, nil, fail("left hash %X, expected %X", node.leftHash, computed.leftHash)
+		}
+		if node.rightHash != nil && !bytes.Equal(node.rightHash, computed.rightHash) {
+			return nil, nil, fail("right hash %X, expected %X", node.rightHash, computed.rightHash)
 		}
 	}
 
-	return stop
+	// Hash a copy, so that the cached hashes are left as they are.
+	computed.hash = nil
+	hash = computed._hash(t.hashFunc())
+	if node.hash != nil && !bytes.Equal(node.hash, hash) {
+		return nil, nil, fail("hash mismatch, expected %X", hash)
+	}
+	return hash, leftmost, nil
 }
 
-// Only used in testing...
-func (node *Node) lmd(t *ImmutableTree) *Node {
+// checkKeyInvariant checks the key of every inner node under the node against
+// the leftmost key of its right subtree, and returns the leftmost key under
+// the node, so that the leftmost leaf of each subtree is found once.
+func (node *Node) checkKeyInvariant(t *ImmutableTree) (leftmost []byte, err error) {
 	if node.isLeaf() {
-		return node
+		return node.key, nil
 	}
-	return node.getLeftNode(t).lmd(t)
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return nil, errors.Wrapf(err, "node %X (hash %X)", node.key, node.hash)
+	}
+	if leftmost, err = left.checkKeyInvariant(t); err != nil {
+		return nil, err
+	}
+	rightmost, err := right.checkKeyInvariant(t)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(node.key, rightmost) {
+		return nil, errors.Errorf("node %X (hash %X): key is not the leftmost key %X of the right subtree",
+			node.key, node.hash, rightmost)
+	}
+	return leftmost, nil
+}
+
+// lmd returns the leftmost leaf of the subtree.
+func (node *Node) lmd(t *ImmutableTree) (*Node, error) {
+	var err error
+	for !node.isLeaf() {
+		if node, err = node.getLeftNode(t); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// rmd returns the rightmost leaf of the subtree.
+func (node *Node) rmd(t *ImmutableTree) (*Node, error) {
+	var err error
+	for !node.isLeaf() {
+		if node, err = node.getRightNode(t); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
 }
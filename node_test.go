@@ -2,10 +2,16 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
 	"math/rand"
+	"sort"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	amino "github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/crypto/tmhash"
 )
 
 func TestNode_aminoSize(t *testing.T) {
@@ -31,6 +37,136 @@ func TestNode_aminoSize(t *testing.T) {
 	require.Equal(t, 57, node.aminoSize())
 }
 
+func TestMakeNode_Truncated(t *testing.T) {
+	leaf := NewNode(randBytes(10), randBytes(10), 1)
+	inner := &Node{
+		key:       randBytes(10),
+		version:   1,
+		height:    1,
+		size:      2,
+		leftHash:  randBytes(20),
+		rightHash: randBytes(20),
+	}
+
+	for _, node := range []*Node{leaf, inner} {
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		bz := buf.Bytes()
+
+		decoded, err := MakeNode(bz)
+		require.NoError(t, err)
+		require.Equal(t, node.key, decoded.key)
+		require.Equal(t, node.height, decoded.height)
+
+		// Every strict prefix of a valid encoding must be rejected, including
+		// a leaf cut right after its key.
+		for i := 0; i < len(bz); i++ {
+			require.NotPanics(t, func() {
+				decoded, err = MakeNode(bz[:i])
+			})
+			require.Error(t, err, "prefix of length %d", i)
+		}
+	}
+
+	// A leaf cut after its key is only one of a keys-only tree, which must
+	// not have a value.
+	var buf bytes.Buffer
+	require.NoError(t, leaf.writeBytes(&buf))
+	keyEnd := buf.Len() - amino.ByteSliceSize(leaf.value)
+	_, err := MakeNode(buf.Bytes()[:keyEnd])
+	require.Error(t, err)
+	decoded, err := makeNode(buf.Bytes()[:keyEnd], true)
+	require.NoError(t, err)
+	require.Equal(t, leaf.key, decoded.key)
+	require.Nil(t, decoded.value)
+	_, err = makeNode(buf.Bytes(), true)
+	require.Equal(t, ErrKeysOnly, errors.Cause(err))
+}
+
+func TestDecodeNode_TrailingBytes(t *testing.T) {
+	leaf := NewNode(randBytes(10), randBytes(10), 1)
+	inner := &Node{
+		key:       randBytes(10),
+		version:   1,
+		height:    1,
+		size:      2,
+		leftHash:  randBytes(20),
+		rightHash: randBytes(20),
+	}
+
+	for _, node := range []*Node{leaf, inner} {
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		bz := buf.Bytes()
+
+		// An exactly sized buffer decodes.
+		decoded, err := DecodeNode(bz)
+		require.NoError(t, err)
+		require.Equal(t, node.key, decoded.key)
+		require.Equal(t, node.value, decoded.value)
+		require.Equal(t, node.leftHash, decoded.leftHash)
+		require.Equal(t, node.rightHash, decoded.rightHash)
+
+		// An over-long one only decodes with MakeNode.
+		overlong := append(append([]byte{}, bz...), 0, 1)
+		_, err = DecodeNode(overlong)
+		require.EqualError(t, err, "decoding node: 2 trailing bytes")
+		decoded, err = MakeNode(overlong)
+		require.NoError(t, err)
+		require.Equal(t, node.key, decoded.key)
+	}
+}
+
+func TestMakeNode_EmptyValue(t *testing.T) {
+	// An empty value decodes to an empty slice rather than nil, which Get
+	// would report as an absent key.
+	var buf bytes.Buffer
+	require.NoError(t, NewNode([]byte("key"), []byte{}, 1).writeBytes(&buf))
+	decoded, err := MakeNode(buf.Bytes())
+	require.NoError(t, err)
+	require.NotNil(t, decoded.value)
+	require.Empty(t, decoded.value)
+}
+
+func TestMakeNode_InvalidHeader(t *testing.T) {
+	for _, node := range []*Node{
+		{key: []byte{1}, height: -1, size: 2, leftHash: []byte{1}, rightHash: []byte{2}},
+		{key: []byte{1}, value: []byte{1}, height: 0, size: 2},
+		{key: []byte{1}, height: 1, size: 1, leftHash: []byte{1}, rightHash: []byte{2}},
+	} {
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		_, err := MakeNode(buf.Bytes())
+		require.Error(t, err)
+	}
+}
+
+func TestNode_hashWithCount(t *testing.T) {
+	kvs := make([]KVPair, 100)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%03d", i)), Value: []byte(fmt.Sprintf("value-%03d", i))}
+	}
+	root, err := LoadFromSorted(kvs, 1)
+	require.NoError(t, err)
+	hashFunc := Options{}.hashFunc()
+
+	hash, count := root.hashWithCount(hashFunc)
+	require.EqualValues(t, 2*len(kvs)-1, count)
+	// The hash of a given tree is fixed by the encoding of its nodes.
+	require.Equal(t, "333a352576f57537765db8f0c11bee741b2cc648bbacb3954e88db8935c4775a", hex.EncodeToString(hash))
+
+	// Every node hashes the bytes writeHashBytes writes for it.
+	_, err = root.traverse(&ImmutableTree{root: root}, true, func(node *Node) bool {
+		var buf bytes.Buffer
+		require.NoError(t, node.writeHashBytes(&buf, hashFunc))
+		h := hashFunc()
+		h.Write(buf.Bytes())
+		require.Equal(t, h.Sum(nil), node.hash)
+		return false
+	})
+	require.NoError(t, err)
+}
+
 func BenchmarkNode_aminoSize(b *testing.B) {
 	node := &Node{
 		key:       randBytes(25),
@@ -76,3 +212,65 @@ func BenchmarkNode_WriteBytes(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkNode_HashWithCount(b *testing.B) {
+	kvs := make([]KVPair, 10000)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: randBytes(25), Value: randBytes(100)}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	hashFunc := Options{}.hashFunc()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		root, err := LoadFromSorted(kvs, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		root.hashWithCount(hashFunc)
+	}
+}
+
+func TestNodeHashPreimage(t *testing.T) {
+	leaf := NewNode([]byte("key"), []byte("value"), 1)
+	inner := &Node{
+		key:       []byte("key"),
+		height:    1,
+		size:      2,
+		version:   2,
+		leftHash:  bytes.Repeat([]byte{0x01}, 32),
+		rightHash: bytes.Repeat([]byte{0x02}, 32),
+	}
+
+	testcases := map[string]struct {
+		node     *Node
+		preimage string
+		hash     string
+		proof    []byte
+	}{
+		"leaf": {
+			leaf,
+			"000202036b657920cd42404d52ad55ccfa9aca4adc828aa5800ad9d385a0671fbcbf724118320619",
+			"85e286d2d33ee15ccc8a98f26ad8305dac3512dd5658432351c74b93a6471211",
+			proofLeafNode{Key: leaf.key, ValueHash: tmhash.Sum(leaf.value), Version: leaf.version}.Hash(),
+		},
+		"inner": {
+			inner,
+			"020404200101010101010101010101010101010101010101010101010101010101010101200202020202020202020202020202020202020202020202020202020202020202",
+			"e4e453d900dbb405b80972023b36b9da4112d81c7175d6117e3e8bdf346dddeb",
+			proofInnerNode{Height: 1, Size: 2, Version: 2, Right: inner.rightHash}.Hash(inner.leftHash),
+		},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.preimage, hex.EncodeToString(NodeHashPreimage(tc.node)))
+			require.Equal(t, tc.hash, hex.EncodeToString(tmhash.Sum(NodeHashPreimage(tc.node))))
+			require.Equal(t, tc.hash, hex.EncodeToString(tc.node._hash(Options{}.hashFunc())))
+			require.Equal(t, tc.hash, hex.EncodeToString(tc.proof))
+		})
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"container/list"
 	"fmt"
+	"hash"
 	"sort"
 	"sync"
 
+	"github.com/pkg/errors"
 	"github.com/tendermint/tendermint/crypto/tmhash"
 	dbm "github.com/tendermint/tm-db"
 )
@@ -16,6 +18,18 @@ const (
 	hashSize  = tmhash.Size
 )
 
+// ErrNodeMissing is returned when a node referenced by the tree is not in the
+// database.
+var ErrNodeMissing = fmt.Errorf("node missing from database")
+
+// ErrNodeCorrupted is returned when a node stored in the database can't be
+// decoded, or doesn't hash to the hash it is stored under.
+var ErrNodeCorrupted = fmt.Errorf("node corrupted in database")
+
+// ErrExternalValues is returned when loading a version of a database saved
+// with another Options.ExternalValues setting than the tree's.
+var ErrExternalValues = fmt.Errorf("external values mismatch")
+
 var (
 	// All node keys are prefixed with the byte 'n'. This ensures no collision is
 	// possible with the other keys, and makes them easier to traverse. They are indexed by the node hash.
@@ -30,64 +44,166 @@ var (
 
 	// Root nodes are indexed separately by their version
 	rootKeyFormat = NewKeyFormat('r', int64Size) // r<version>
+
+	// With Options.ExternalValues, the values of leaves are stored apart from
+	// them, indexed by the hash of their leaf.
+	valueKeyFormat = NewKeyFormat('v', hashSize) // v<hash>
+
+	// The options which change how nodes are stored are recorded as a byte of
+	// format flags when a version is first saved, see nodeDB.checkFormat.
+	formatKeyFormat = NewKeyFormat('f') // f
+)
+
+// Flags of the storage format recorded in the database.
+const (
+	formatKeysOnly       byte = 1 << iota // Options.KeysOnly
+	formatExternalValues                  // Options.ExternalValues
 )
 
+// NodeDBObserver is notified of the node operations of the database of a
+// tree, e.g. to export metrics on read amplification, write volume and
+// pruning. Its methods are called with the database locked, so they must be
+// fast and must not use the tree.
+type NodeDBObserver interface {
+	// OnGet is called when a node is loaded, with whether it was in the node
+	// cache or had to be read from the database.
+	OnGet(hash []byte, hit bool)
+	// OnWrite is called when a node is written, with its encoded size.
+	OnWrite(hash []byte, bytes int)
+	// OnRemove is called when a node is deleted by deleting a version.
+	OnRemove(hash []byte)
+}
+
+// nodeDB stores the nodes of the versions of a single tree. The versions share
+// the nodes they have in common, which are only deleted, as orphans, with the
+// last version to use them. Nodes aren't reference counted, so a nodeDB must
+// not be shared by independent trees, which could share nodes too.
 type nodeDB struct {
 	mtx   sync.Mutex // Read/write lock.
 	db    dbm.DB     // Persistent node storage.
 	batch dbm.Batch  // Batched writing buffer.
-
-	latestVersion  int64
-	nodeCache      map[string]*list.Element // Node cache.
-	nodeCacheSize  int                      // Node cache size limit in elements.
-	nodeCacheQueue *list.List               // LRU queue of cache elements. Used for deletion.
-}
-
-func newNodeDB(db dbm.DB, cacheSize int) *nodeDB {
+	opts  Options    // Options to customize for the tree.
+
+	nodeKeyFormat   *KeyFormat // Node keys, sized by the hash function.
+	orphanKeyFormat *KeyFormat // Orphan keys, sized by the hash function.
+	valueKeyFormat  *KeyFormat // External value keys, sized by the hash function.
+
+	latestVersion   int64
+	nodeCache       map[string]*list.Element // Node cache.
+	nodeCacheSize   int                      // Node cache size limit in elements.
+	nodeCacheQueue  *list.List               // LRU queue of cache elements. Used for deletion.
+	nodeCacheHits   int64                    // Number of GetNode calls served from the cache.
+	nodeCacheMisses int64                    // Number of GetNode calls which read the db.
+	observer        NodeDBObserver           // Notified of node operations, if set.
+	wal             WALWriter                // Logs the batch before it is written, if set.
+	saved           []*Node                  // Nodes saved to the batch, unsaved if the commit fails.
+}
+
+func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
 	ndb := &nodeDB{
 		db:             db,
 		batch:          db.NewBatch(),
+		opts:           *opts,
 		latestVersion:  0, // initially invalid
 		nodeCache:      make(map[string]*list.Element),
 		nodeCacheSize:  cacheSize,
 		nodeCacheQueue: list.New(),
 	}
+	if size := opts.hashFunc()().Size(); size == hashSize {
+		ndb.nodeKeyFormat, ndb.orphanKeyFormat, ndb.valueKeyFormat = nodeKeyFormat, orphanKeyFormat, valueKeyFormat
+	} else {
+		ndb.nodeKeyFormat = NewKeyFormat('n', size)
+		ndb.orphanKeyFormat = NewKeyFormat('o', int64Size, int64Size, size)
+		ndb.valueKeyFormat = NewKeyFormat('v', size)
+	}
 	return ndb
 }
 
+// hashFunc returns the hash function of the nodes.
+func (ndb *nodeDB) hashFunc() func() hash.Hash {
+	return ndb.opts.hashFunc()
+}
+
 // GetNode gets a node from cache or disk. If it is an inner node, it does not
-// load its children.
-func (ndb *nodeDB) GetNode(hash []byte) *Node {
+// load its children. If the node is not in the database, e.g. because its
+// version was deleted, the error is ErrNodeMissing.
+func (ndb *nodeDB) GetNode(hash []byte) (*Node, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.getNode(hash, true)
+}
+
+// GetNodes gets the nodes with the given hashes, in the same order, like
+// GetNode. The nodes missing from the cache are read from the database in the
+// order of their keys, which the database stores them in, and are not added to
+// the cache, so that reading many nodes once doesn't evict the nodes which are
+// read often.
+func (ndb *nodeDB) GetNodes(hashes [][]byte) ([]*Node, error) {
+	order := make([]int, len(hashes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return bytes.Compare(hashes[order[i]], hashes[order[j]]) < 0 })
+
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
+	nodes := make([]*Node, len(hashes))
+	for _, i := range order {
+		node, err := ndb.getNode(hashes[i], false)
+		if err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
 
+// getNode gets a node from cache or disk, adding it to the cache if it is read
+// from disk and cache is true. The caller must hold the lock.
+func (ndb *nodeDB) getNode(hash []byte, cache bool) (*Node, error) {
 	if len(hash) == 0 {
-		panic("nodeDB.GetNode() requires hash")
+		return nil, errors.New("nodeDB.GetNode() requires hash")
 	}
 
 	// Check the cache.
 	if elem, ok := ndb.nodeCache[string(hash)]; ok {
 		// Already exists. Move to back of nodeCacheQueue.
 		ndb.nodeCacheQueue.MoveToBack(elem)
-		return elem.Value.(*Node)
+		ndb.nodeCacheHits++
+		if ndb.observer != nil {
+			ndb.observer.OnGet(hash, true)
+		}
+		return elem.Value.(*Node), nil
 	}
 
 	// Doesn't exist, load.
+	ndb.nodeCacheMisses++
+	if ndb.observer != nil {
+		ndb.observer.OnGet(hash, false)
+	}
 	buf := ndb.db.Get(ndb.nodeKey(hash))
 	if buf == nil {
-		panic(fmt.Sprintf("Value missing for hash %x corresponding to nodeKey %s", hash, ndb.nodeKey(hash)))
+		return nil, errors.Wrapf(ErrNodeMissing, "hash %X", hash)
 	}
 
-	node, err := MakeNode(buf)
+	node, err := makeNode(buf, ndb.opts.KeysOnly)
 	if err != nil {
-		panic(fmt.Sprintf("Error reading Node. bytes: %x, error: %v", buf, err))
+		return nil, errors.Wrapf(err, "reading node %X", hash)
+	}
+	if err := ndb.loadValue(hash, node); err != nil {
+		return nil, err
 	}
 
 	node.hash = hash
 	node.persisted = true
-	ndb.cacheNode(node)
+	if cache {
+		ndb.cacheNode(node)
+	}
 
-	return node
+	return node, nil
 }
 
 // SaveNode saves a node to disk.
@@ -102,17 +218,27 @@ func (ndb *nodeDB) SaveNode(node *Node) {
 		panic("Shouldn't be calling save on an already persisted node.")
 	}
 
-	// Save node bytes to db.
+	// Save node bytes to db, with the hash of the value in place of an
+	// external value.
+	stored := node
+	if ndb.hasExternalValue(node) {
+		ndb.batch.Set(ndb.valueKey(node.hash), node.value)
+		stored = &Node{key: node.key, value: ndb.valueHash(node.value), version: node.version, size: node.size}
+	}
 	var buf bytes.Buffer
-	buf.Grow(node.aminoSize())
-	if err := node.writeBytes(&buf); err != nil {
+	buf.Grow(stored.aminoSize())
+	if err := stored.writeBytes(&buf); err != nil {
 		panic(err)
 	}
 	ndb.batch.Set(ndb.nodeKey(node.hash), buf.Bytes())
 	debug("BATCH SAVE %X %p\n", node.hash, node)
+	if ndb.observer != nil {
+		ndb.observer.OnWrite(node.hash, buf.Len())
+	}
 
 	node.persisted = true
 	ndb.cacheNode(node)
+	ndb.saved = append(ndb.saved, node)
 }
 
 // Has checks if a hash exists in the database.
@@ -145,7 +271,7 @@ func (ndb *nodeDB) SaveBranch(node *Node) []byte {
 		node.rightHash = ndb.SaveBranch(node.rightNode)
 	}
 
-	node._hash()
+	node._hash(ndb.hashFunc())
 	ndb.SaveNode(node)
 
 	node.leftNode = nil
@@ -199,7 +325,7 @@ func (ndb *nodeDB) deleteOrphans(version int64) {
 
 		// See comment on `orphanKeyFmt`. Note that here, `version` and
 		// `toVersion` are always equal.
-		orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+		ndb.orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
 
 		// Delete orphan key and reverse-lookup key.
 		ndb.batch.Delete(key)
@@ -212,7 +338,13 @@ func (ndb *nodeDB) deleteOrphans(version int64) {
 		if predecessor < fromVersion || fromVersion == toVersion {
 			debug("DELETE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
 			ndb.batch.Delete(ndb.nodeKey(hash))
+			if ndb.opts.ExternalValues {
+				ndb.batch.Delete(ndb.valueKey(hash))
+			}
 			ndb.uncacheNode(hash)
+			if ndb.observer != nil {
+				ndb.observer.OnRemove(hash)
+			}
 		} else {
 			debug("MOVE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
 			ndb.saveOrphan(hash, fromVersion, predecessor)
@@ -221,11 +353,51 @@ func (ndb *nodeDB) deleteOrphans(version int64) {
 }
 
 func (ndb *nodeDB) nodeKey(hash []byte) []byte {
-	return nodeKeyFormat.KeyBytes(hash)
+	return ndb.nodeKeyFormat.KeyBytes(hash)
+}
+
+func (ndb *nodeDB) valueKey(hash []byte) []byte {
+	return ndb.valueKeyFormat.KeyBytes(hash)
+}
+
+// hasExternalValue returns whether the value of the node is stored apart from
+// it, see Options.ExternalValues. The nil values of keys-only trees are not.
+func (ndb *nodeDB) hasExternalValue(node *Node) bool {
+	return ndb.opts.ExternalValues && node.isLeaf() && node.value != nil
+}
+
+// valueHash returns the hash of an external value stored in its leaf.
+func (ndb *nodeDB) valueHash(value []byte) []byte {
+	h := ndb.hashFunc()()
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// loadValue replaces the value hash of a node with an external value, read
+// from the database, by the value. It returns ErrNodeCorrupted if the value
+// is missing or doesn't match the hash. An empty value may read back as nil,
+// which hashes like it, so a nil value is only missing if its key is.
+func (ndb *nodeDB) loadValue(hash []byte, node *Node) error {
+	if !ndb.hasExternalValue(node) {
+		return nil
+	}
+	key := ndb.valueKey(hash)
+	value := ndb.db.Get(key)
+	if value == nil {
+		if !ndb.db.Has(key) {
+			return errors.Wrapf(ErrNodeCorrupted, "value of node %X missing", hash)
+		}
+		value = []byte{}
+	}
+	if !bytes.Equal(ndb.valueHash(value), node.value) {
+		return errors.Wrapf(ErrNodeCorrupted, "value of node %X not matching its hash", hash)
+	}
+	node.value = value
+	return nil
 }
 
 func (ndb *nodeDB) orphanKey(fromVersion, toVersion int64, hash []byte) []byte {
-	return orphanKeyFormat.Key(toVersion, fromVersion, hash)
+	return ndb.orphanKeyFormat.Key(toVersion, fromVersion, hash)
 }
 
 func (ndb *nodeDB) rootKey(version int64) []byte {
@@ -277,12 +449,12 @@ func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) {
 }
 
 func (ndb *nodeDB) traverseOrphans(fn func(k, v []byte)) {
-	ndb.traversePrefix(orphanKeyFormat.Key(), fn)
+	ndb.traversePrefix(ndb.orphanKeyFormat.Key(), fn)
 }
 
 // Traverse orphans ending at a certain version.
 func (ndb *nodeDB) traverseOrphansVersion(version int64, fn func(k, v []byte)) {
-	ndb.traversePrefix(orphanKeyFormat.Key(version), fn)
+	ndb.traversePrefix(ndb.orphanKeyFormat.Key(version), fn)
 }
 
 // Traverse all keys.
@@ -305,6 +477,61 @@ func (ndb *nodeDB) traversePrefix(prefix []byte, fn func(k, v []byte)) {
 	}
 }
 
+// integrityDigest checks that every node stored in the database, reachable
+// or not, decodes and hashes to the hash it is stored under, and returns the
+// hash of all their hashes, in the order of their keys.
+func (ndb *nodeDB) integrityDigest() ([]byte, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	hashFunc := ndb.hashFunc()
+	digest := hashFunc()
+	var err error
+	ndb.traversePrefix(ndb.nodeKeyFormat.Key(), func(key, value []byte) {
+		if err != nil {
+			return
+		}
+		var hash []byte
+		ndb.nodeKeyFormat.Scan(key, &hash)
+		node, cause := decodeNodeExact(value, ndb.opts.KeysOnly)
+		if cause != nil {
+			err = errors.Wrapf(ErrNodeCorrupted, "node %X: %v", hash, cause)
+			return
+		}
+		if err = ndb.loadValue(hash, node); err != nil {
+			return
+		}
+		h := hashFunc()
+		if cause := node.writeHashBytes(h, hashFunc); cause != nil {
+			err = errors.Wrapf(ErrNodeCorrupted, "node %X: %v", hash, cause)
+			return
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, hash) {
+			err = errors.Wrapf(ErrNodeCorrupted, "node %X hashes to %X", hash, sum)
+			return
+		}
+		digest.Write(hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+// setObserver sets the observer notified of node operations, nil for none.
+func (ndb *nodeDB) setObserver(observer NodeDBObserver) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.observer = observer
+}
+
+// cacheStats returns the number of cache hits and misses of GetNode.
+func (ndb *nodeDB) cacheStats() (hits, misses int64) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.nodeCacheHits, ndb.nodeCacheMisses
+}
+
 func (ndb *nodeDB) uncacheNode(hash []byte) {
 	if elem, ok := ndb.nodeCache[string(hash)]; ok {
 		ndb.nodeCacheQueue.Remove(elem)
@@ -325,14 +552,77 @@ func (ndb *nodeDB) cacheNode(node *Node) {
 	}
 }
 
-// Write to disk.
-func (ndb *nodeDB) Commit() {
+// Commit writes the batch to the database. With a write-ahead log, the batch
+// is first appended to it, then written and synced, and the log is truncated
+// only once the batch is durable, so that a crash can't lose both.
+// While commits are deferred, see deferCommits, the batch is written to memory.
+func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
+	return ndb.commit()
+}
+
+// commit commits the batch. The caller must hold the lock.
+func (ndb *nodeDB) commit() error {
+	b, logging := ndb.batch.(*walBatch)
+	if logging && b.count > 0 {
+		if err := ndb.wal.Append(b.encode()); err != nil {
+			ndb.rollback()
+			return errors.Wrap(err, "appending to write-ahead log")
+		}
+	}
+	if logging {
+		ndb.batch.WriteSync()
+	} else {
+		ndb.batch.Write()
+	}
+	ndb.saved = nil
+	ndb.resetBatch()
+	if logging && b.count > 0 {
+		if err := ndb.wal.Truncate(); err != nil {
+			return errors.Wrap(err, "truncating write-ahead log")
+		}
+	}
+	return nil
+}
 
-	ndb.batch.Write()
+// resetBatch replaces the batch with an empty one, logged if it was. The
+// caller must hold the lock.
+func (ndb *nodeDB) resetBatch() {
+	_, logging := ndb.batch.(*walBatch)
 	ndb.batch.Close()
 	ndb.batch = ndb.db.NewBatch()
+	if logging {
+		ndb.batch = &walBatch{Batch: ndb.batch}
+	}
+}
+
+// rollback discards the batch of a failed commit, and undoes what saving it
+// did to the nodeDB and the saved nodes, so that the version can be saved
+// again: the nodes are unpersisted, uncached and linked back to the children
+// saved with them, and the latest version is read again from the database.
+// The caller must hold the lock.
+func (ndb *nodeDB) rollback() {
+	ndb.resetBatch()
+	saved := make(map[string]*Node, len(ndb.saved))
+	for _, node := range ndb.saved {
+		saved[string(node.hash)] = node
+	}
+	for _, node := range ndb.saved {
+		node.persisted = false
+		ndb.uncacheNode(node.hash)
+		if node.isLeaf() {
+			continue
+		}
+		if node.leftNode == nil {
+			node.leftNode = saved[string(node.leftHash)]
+		}
+		if node.rightNode == nil {
+			node.rightNode = saved[string(node.rightHash)]
+		}
+	}
+	ndb.saved = nil
+	ndb.latestVersion = 0 // Read again from the database.
 }
 
 func (ndb *nodeDB) getRoot(version int64) []byte {
@@ -374,11 +664,51 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 
 	key := ndb.rootKey(version)
 	ndb.batch.Set(key, hash)
+	if ndb.db.Get(formatKeyFormat.Key()) == nil {
+		ndb.batch.Set(formatKeyFormat.Key(), []byte{ndb.format()})
+	}
 	ndb.updateLatestVersion(version)
 
 	return nil
 }
 
+// format returns the format flags of the options of the database.
+func (ndb *nodeDB) format() byte {
+	var format byte
+	if ndb.opts.KeysOnly {
+		format |= formatKeysOnly
+	}
+	if ndb.opts.ExternalValues {
+		format |= formatExternalValues
+	}
+	return format
+}
+
+// checkFormat returns an error if the database was saved with options which
+// store nodes otherwise than the options it is opened with, which would
+// misread them. A database saved before the format was recorded has the
+// default one.
+func (ndb *nodeDB) checkFormat() error {
+	var format byte
+	switch bz := ndb.db.Get(formatKeyFormat.Key()); len(bz) {
+	case 0:
+	case 1:
+		format = bz[0]
+	default:
+		return errors.Errorf("invalid format %X in database", bz)
+	}
+	diff := format ^ ndb.format()
+	if diff&formatKeysOnly != 0 {
+		return errors.Wrapf(ErrKeysOnly, "database saved with KeysOnly %t, opened with %t",
+			format&formatKeysOnly != 0, ndb.opts.KeysOnly)
+	}
+	if diff&formatExternalValues != 0 {
+		return errors.Wrapf(ErrExternalValues, "database saved with ExternalValues %t, opened with %t",
+			format&formatExternalValues != 0, ndb.opts.ExternalValues)
+	}
+	return nil
+}
+
 ////////////////// Utility and test functions /////////////////////////////////
 
 func (ndb *nodeDB) leafNodes() []*Node {
@@ -429,12 +759,15 @@ func (ndb *nodeDB) size() int {
 func (ndb *nodeDB) traverseNodes(fn func(hash []byte, node *Node)) {
 	nodes := []*Node{}
 
-	ndb.traversePrefix(nodeKeyFormat.Key(), func(key, value []byte) {
-		node, err := MakeNode(value)
+	ndb.traversePrefix(ndb.nodeKeyFormat.Key(), func(key, value []byte) {
+		node, err := makeNode(value, ndb.opts.KeysOnly)
 		if err != nil {
 			panic(fmt.Sprintf("Couldn't decode node from database: %v", err))
 		}
-		nodeKeyFormat.Scan(key, &node.hash)
+		ndb.nodeKeyFormat.Scan(key, &node.hash)
+		if err := ndb.loadValue(node.hash, node); err != nil {
+			panic(fmt.Sprintf("Couldn't load node value from database: %v", err))
+		}
 		nodes = append(nodes, node)
 	})
 
@@ -465,13 +798,13 @@ func (ndb *nodeDB) String() string {
 		if len(hash) == 0 {
 			str += fmt.Sprintf("<nil>\n")
 		} else if node == nil {
-			str += fmt.Sprintf("%s%40x: <nil>\n", nodeKeyFormat.Prefix(), hash)
+			str += fmt.Sprintf("%s%40x: <nil>\n", ndb.nodeKeyFormat.Prefix(), hash)
 		} else if node.value == nil && node.height > 0 {
 			str += fmt.Sprintf("%s%40x: %s   %-16s h=%d version=%d\n",
-				nodeKeyFormat.Prefix(), hash, node.key, "", node.height, node.version)
+				ndb.nodeKeyFormat.Prefix(), hash, node.key, "", node.height, node.version)
 		} else {
 			str += fmt.Sprintf("%s%40x: %s = %-16s h=%d version=%d\n",
-				nodeKeyFormat.Prefix(), hash, node.key, node.value, node.height, node.version)
+				ndb.nodeKeyFormat.Prefix(), hash, node.key, node.value, node.height, node.version)
 		}
 		index++
 	})
@@ -1,13 +1,22 @@
 package iavl
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	db "github.com/tendermint/tm-db"
 )
 
 func BenchmarkNodeKey(b *testing.B) {
-	ndb := &nodeDB{}
+	ndb := newNodeDB(db.NewMemDB(), 0, nil)
 	hashes := makeHashes(b, 2432325)
 	for i := 0; i < b.N; i++ {
 		ndb.nodeKey(hashes[i])
@@ -15,7 +24,7 @@ func BenchmarkNodeKey(b *testing.B) {
 }
 
 func BenchmarkOrphanKey(b *testing.B) {
-	ndb := &nodeDB{}
+	ndb := newNodeDB(db.NewMemDB(), 0, nil)
 	hashes := makeHashes(b, 2432325)
 	for i := 0; i < b.N; i++ {
 		ndb.orphanKey(1234, 1239, hashes[i])
@@ -37,3 +46,481 @@ func makeHashes(b *testing.B, seed int64) [][]byte {
 	b.StartTimer()
 	return hashes
 }
+
+func TestNodeCacheStats(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Without a cache, loading reads the root, and each get all the nodes
+	// below it on the path.
+	tree = NewMutableTree(memDB, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	tree.Get(i2b(50))
+	tree.Get(i2b(50))
+	hits, misses := tree.NodeCacheStats()
+	require.Zero(t, hits)
+	require.EqualValues(t, 1+2*int64(tree.Height()), misses)
+
+	// With a cache, the second descent is served from it.
+	tree = NewMutableTree(memDB, 1000)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	tree.Get(i2b(50))
+	tree.Get(i2b(50))
+	hits, misses = tree.NodeCacheStats()
+	require.EqualValues(t, tree.Height(), hits)
+	require.EqualValues(t, 1+int64(tree.Height()), misses)
+}
+
+func TestNodeCacheDeleteVersion(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 1000)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		tree.Remove(i2b(i))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersion(1))
+
+	// Nodes deleted from the database are no longer cached.
+	require.Len(t, tree.ndb.nodeCache, tree.nodeSize())
+	for _, node := range tree.ndb.nodes() {
+		require.Contains(t, tree.ndb.nodeCache, string(node.hash))
+	}
+}
+
+func TestDeleteVersionSharedNodes(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	// Each version changes a single key, so it shares most of its nodes with
+	// the ones before and after it.
+	for v := 1; v <= 4; v++ {
+		if v > 1 {
+			tree.Set(i2b(v), i2b(-v))
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	hashes := func(version int64) map[string]bool {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		hashes := map[string]bool{}
+		_, err = itree.TraverseNodes(func(node *Node, _ int) bool {
+			hashes[string(node.hash)] = true
+			return false
+		})
+		require.NoError(t, err)
+		return hashes
+	}
+	v1, v2, v3, v4 := hashes(1), hashes(2), hashes(3), hashes(4)
+	shared := 0
+	for hash := range v2 {
+		if v1[hash] && v3[hash] {
+			shared++
+		}
+	}
+	require.True(t, shared > len(v2)/2)
+
+	// Deleting the versions around version 2 deletes only the nodes which it
+	// doesn't share with them.
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NoError(t, tree.DeleteVersion(3))
+	for hash := range v2 {
+		require.True(t, tree.ndb.Has([]byte(hash)), "%X", hash)
+	}
+	for _, deleted := range []map[string]bool{v1, v3} {
+		for hash := range deleted {
+			if !v2[hash] && !v4[hash] {
+				require.False(t, tree.ndb.Has([]byte(hash)), "%X", hash)
+			}
+		}
+	}
+
+	// Version 2 is still whole when loaded from the database.
+	loaded := NewMutableTree(memDB, 0)
+	_, err := loaded.LoadVersion(2)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		expected := i2b(i)
+		if i == 2 {
+			expected = i2b(-2)
+		}
+		_, value, err := loaded.Get(i2b(i))
+		require.NoError(t, err)
+		require.Equal(t, expected, value, "%d", i)
+	}
+}
+
+func TestIntegrityDigest(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	digest1, err := tree.IntegrityDigest()
+	require.NoError(t, err)
+	for i := 0; i < 100; i += 2 {
+		tree.Set(i2b(i), i2b(i+1))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	digest2, err := tree.IntegrityDigest()
+	require.NoError(t, err)
+	require.NotEqual(t, digest1, digest2)
+
+	// The digest only depends on the stored nodes.
+	loaded := NewMutableTree(memDB, 0)
+	_, err = loaded.Load()
+	require.NoError(t, err)
+	digest, err := loaded.IntegrityDigest()
+	require.NoError(t, err)
+	require.Equal(t, digest2, digest)
+
+	// Find a leaf of the first version which is no longer in the tree.
+	var orphan *Node
+	for _, node := range tree.ndb.nodes() {
+		if node.isLeaf() && node.version == 1 && bytes.Equal(node.value, i2b(0)) {
+			orphan = node
+		}
+	}
+	require.NotNil(t, orphan)
+	key := tree.ndb.nodeKey(orphan.hash)
+	stored := memDB.Get(key)
+
+	// A changed value no longer hashes to the hash of the node, even though
+	// the latest version doesn't reach it.
+	corrupted := append([]byte{}, stored...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	memDB.Set(key, corrupted)
+	_, err = tree.IntegrityDigest()
+	require.Equal(t, ErrNodeCorrupted, errors.Cause(err))
+	require.Contains(t, err.Error(), fmt.Sprintf("%X", orphan.hash))
+	require.NoError(t, tree.Validate())
+
+	// So does a node which can't be decoded, or is followed by other bytes.
+	for _, corrupted := range [][]byte{{0xff}, append(append([]byte{}, stored...), 0)} {
+		memDB.Set(key, corrupted)
+		_, err = tree.IntegrityDigest()
+		require.Equal(t, ErrNodeCorrupted, errors.Cause(err))
+		require.Contains(t, err.Error(), fmt.Sprintf("%X", orphan.hash))
+	}
+
+	memDB.Set(key, stored)
+	digest, err = tree.IntegrityDigest()
+	require.NoError(t, err)
+	require.Equal(t, digest2, digest)
+}
+
+type recordingObserver struct {
+	hits, misses [][]byte
+	writes       map[string]int
+	removes      [][]byte
+}
+
+func (o *recordingObserver) OnGet(hash []byte, hit bool) {
+	if hit {
+		o.hits = append(o.hits, hash)
+	} else {
+		o.misses = append(o.misses, hash)
+	}
+}
+
+func (o *recordingObserver) OnWrite(hash []byte, bytes int) {
+	o.writes[string(hash)] = bytes
+}
+
+func (o *recordingObserver) OnRemove(hash []byte) {
+	o.removes = append(o.removes, hash)
+}
+
+func TestNodeDBObserver(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 10)
+	observer := &recordingObserver{writes: map[string]int{}}
+	tree.SetObserver(observer)
+	for i := 0; i < 100; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Every saved node is written once, with its encoded size.
+	require.Len(t, observer.writes, 2*100-1)
+	for hash, size := range observer.writes {
+		require.Len(t, memDB.Get(tree.ndb.nodeKey([]byte(hash))), size)
+	}
+
+	// Each node loaded is a hit or a miss of the cache.
+	tree = NewMutableTree(memDB, 10)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	observer = &recordingObserver{writes: map[string]int{}}
+	tree.SetObserver(observer)
+	hits, misses := tree.NodeCacheStats()
+	for i := 0; i < 100; i++ {
+		tree.Get(i2b(rand.Intn(100)))
+	}
+	afterHits, afterMisses := tree.NodeCacheStats()
+	require.EqualValues(t, afterHits-hits, len(observer.hits))
+	require.EqualValues(t, afterMisses-misses, len(observer.misses))
+	require.NotEmpty(t, observer.hits)
+	require.NotEmpty(t, observer.misses)
+
+	hash := tree.root.leftHash
+	observer.hits, observer.misses = nil, nil
+	tree.ndb.uncacheNode(hash)
+	_, err = tree.ndb.GetNode(hash)
+	require.NoError(t, err)
+	_, err = tree.ndb.GetNode(hash)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{hash}, observer.misses)
+	require.Equal(t, [][]byte{hash}, observer.hits)
+
+	// Deleting a version removes the nodes orphaned by the next one.
+	for i := 0; i < 100; i += 2 {
+		tree.Remove(i2b(i))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	before := len(tree.ndb.nodes())
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Len(t, observer.removes, before-len(tree.ndb.nodes()))
+	for _, hash := range observer.removes {
+		require.Nil(t, memDB.Get(tree.ndb.nodeKey(hash)))
+	}
+
+	// Without an observer nothing is recorded.
+	tree.SetObserver(nil)
+	observer.hits, observer.misses = nil, nil
+	tree.Set(i2b(1000), i2b(1000))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, observer.hits)
+	require.Empty(t, observer.misses)
+}
+
+// BenchmarkNodeCache gets random keys of a tree loaded from the database with
+// different cache sizes. The number of nodes read from the database per get is
+// logged.
+func BenchmarkNodeCache(b *testing.B) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100000; i++ {
+		tree.Set(i2b(i), i2b(i))
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, cacheSize := range []int{0, 10000, 1000000} {
+		b.Run(fmt.Sprintf("cache-%d", cacheSize), func(b *testing.B) {
+			tree := NewMutableTree(memDB, cacheSize)
+			if _, err := tree.Load(); err != nil {
+				b.Fatal(err)
+			}
+			_, before := tree.NodeCacheStats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tree.Get(i2b(rand.Intn(100000)))
+			}
+			_, after := tree.NodeCacheStats()
+			b.Logf("%d gets, %.2f db reads per get", b.N, float64(after-before)/float64(b.N))
+		})
+	}
+}
+
+// unbatchedDB is a database without batches: the writes of its batches are
+// made one by one as they come, as on a backend which can only put keys.
+type unbatchedDB struct {
+	db.DB
+}
+
+func (d unbatchedDB) NewBatch() db.Batch {
+	return unbatchedBatch{d.DB}
+}
+
+type unbatchedBatch struct {
+	db db.DB
+}
+
+func (b unbatchedBatch) Set(key, value []byte) { b.db.Set(key, value) }
+func (b unbatchedBatch) Delete(key []byte)     { b.db.Delete(key) }
+func (b unbatchedBatch) Write()                {}
+func (b unbatchedBatch) WriteSync()            {}
+func (b unbatchedBatch) Close()                {}
+
+// BenchmarkNodeDB_SaveVersion saves versions of 1000 new keys to a LevelDB
+// database, with the writes of each version made in a single batch, as the
+// nodeDB does, and one by one.
+func BenchmarkNodeDB_SaveVersion(b *testing.B) {
+	for _, batched := range []bool{true, false} {
+		b.Run(fmt.Sprintf("batched-%v", batched), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "iavl")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			levelDB, err := db.NewGoLevelDB("bench", dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer levelDB.Close()
+			var d db.DB = levelDB
+			if !batched {
+				d = unbatchedDB{levelDB}
+			}
+
+			tree := NewMutableTree(d, 0)
+			r := rand.New(rand.NewSource(1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < 1000; j++ {
+					tree.Set(i2b(r.Int()), i2b(j))
+				}
+				b.StartTimer()
+				if _, _, err := tree.SaveVersion(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestExternalValues(t *testing.T) {
+	prefixSizes := func(memDB db.DB) map[byte]int {
+		sizes := map[byte]int{}
+		itr := memDB.Iterator(nil, nil)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			sizes[itr.Key()[0]] += len(itr.Value())
+		}
+		return sizes
+	}
+	external, inline := db.NewMemDB(), db.NewMemDB()
+	tree := NewMutableTreeWithOpts(external, 0, &Options{ExternalValues: true})
+	expected := NewMutableTree(inline, 0)
+	r := rand.New(rand.NewSource(1))
+	values := map[string][]byte{}
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key-%02d", r.Intn(40))
+			value := make([]byte, r.Intn(100000))
+			r.Read(value)
+			values[key] = value
+			tree.Set([]byte(key), value)
+			expected.Set([]byte(key), value)
+		}
+		tree.Set([]byte("empty"), []byte{})
+		expected.Set([]byte("empty"), []byte{})
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expectedHash, _, err := expected.SaveVersion()
+		require.NoError(t, err)
+		require.Equal(t, expectedHash, hash)
+	}
+
+	// The nodes are small, and the values take the same space either way.
+	externalSizes, inlineSizes := prefixSizes(external), prefixSizes(inline)
+	t.Logf("node bytes: %d external, %d inline", externalSizes['n'], inlineSizes['n'])
+	require.True(t, externalSizes['n'] < 10000)
+	require.True(t, externalSizes['n']+externalSizes['v'] < inlineSizes['n']+10000)
+
+	// The values are read back from the database, and their leaves are proven
+	// by the hash of the value.
+	loaded := NewMutableTreeWithOpts(external, 0, &Options{ExternalValues: true})
+	_, err := loaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, expected.Hash(), loaded.Hash())
+	values["empty"] = []byte{}
+	for key, value := range values {
+		_, actual, err := loaded.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, actual)
+
+		_, proof, err := loaded.GetWithProof([]byte(key))
+		require.NoError(t, err)
+		require.NoError(t, proof.Verify(loaded.Hash()))
+		require.Equal(t, tmhash.Sum(value), []byte(proof.Leaves[0].ValueHash))
+	}
+	_, err = loaded.IntegrityDigest()
+	require.NoError(t, err)
+
+	// Either database opened with the other setting is rejected, rather than
+	// reading value hashes as values, or the reverse.
+	for _, mismatched := range []*MutableTree{
+		NewMutableTree(external, 0),
+		NewMutableTreeWithOpts(inline, 0, &Options{ExternalValues: true}),
+	} {
+		_, err = mismatched.LoadVersion(0)
+		require.Equal(t, ErrExternalValues, errors.Cause(err))
+		_, err = mismatched.LazyLoadVersion(0)
+		require.Equal(t, ErrExternalValues, errors.Cause(err))
+	}
+
+	// Deleting versions deletes the values of their leaves.
+	require.NoError(t, loaded.DeleteVersion(1))
+	require.NoError(t, loaded.DeleteVersion(2))
+	require.True(t, prefixSizes(external)['v'] < externalSizes['v'])
+	var leaves int
+	loaded.Iterate(func(key, value []byte) bool {
+		leaves++
+		return false
+	})
+	require.Equal(t, leaves, countPrefix(external, 'v'))
+
+	// A value which doesn't match its leaf is detected.
+	var leafHash []byte
+	loaded.TraverseNodes(func(node *Node, depth int) bool {
+		leafHash = node.Hash()
+		return node.IsLeaf()
+	})
+	external.Set(loaded.ndb.valueKey(leafHash), []byte("corrupted"))
+	fresh := NewMutableTreeWithOpts(external, 0, &Options{ExternalValues: true})
+	_, err = fresh.Load()
+	require.NoError(t, err)
+	_, err = fresh.IntegrityDigest()
+	require.Equal(t, ErrNodeCorrupted, errors.Cause(err))
+	_, err = fresh.Iterate(func(key, value []byte) bool { return false })
+	require.Equal(t, ErrNodeCorrupted, errors.Cause(err))
+
+	// So is a missing empty value, which would hash like the nil one read.
+	var emptyHash []byte
+	expected.TraverseNodes(func(node *Node, depth int) bool {
+		if node.IsLeaf() && string(node.Key()) == "empty" {
+			emptyHash = node.Hash()
+		}
+		return false
+	})
+	require.NotNil(t, emptyHash)
+	external.Delete(loaded.ndb.valueKey(emptyHash))
+	fresh = NewMutableTreeWithOpts(external, 0, &Options{ExternalValues: true})
+	_, err = fresh.Load()
+	require.NoError(t, err)
+	_, _, err = fresh.Get([]byte("empty"))
+	require.Equal(t, ErrNodeCorrupted, errors.Cause(err))
+}
+
+func countPrefix(memDB db.DB, prefix byte) (count int) {
+	itr := memDB.Iterator([]byte{prefix}, []byte{prefix + 1})
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	return count
+}
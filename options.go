@@ -0,0 +1,104 @@
+package iavl
+
+import (
+	"hash"
+
+	"github.com/pkg/errors"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// Options define tree settings which are fixed for the lifetime of a database.
+// The zero value gives the default behavior.
+type Options struct {
+	// HashFunc creates the hasher used for node hashes and leaf value hashes.
+	// If nil, tmhash (SHA-256) is used. The layout of the hashed bytes is the
+	// same for any hash function, only the digests differ.
+	//
+	// Changing the hash function changes every hash in the tree, and nodes
+	// are stored by hash, so a database must always be opened with the hash
+	// function it was written with. Proofs are only supported if HashFunc is
+	// nil.
+	HashFunc func() hash.Hash
+
+	// Compare orders the keys, returning a negative number, zero or a positive
+	// number if a is before, equal to or after b, and zero only for equal
+	// keys. If nil, keys are ordered bytewise with bytes.Compare.
+	//
+	// The order decides the shape of the tree, and so its hashes, so a
+	// database must always be opened with the comparator it was written with.
+	// Proofs, whose verification orders keys bytewise, and IteratePrefix are
+	// only supported if Compare is nil.
+	Compare func(a, b []byte) int
+
+	// MaxKeyLength and MaxValueLength are the largest keys and values, in
+	// bytes, which can be set. Setting a larger one returns ErrKeyTooLong or
+	// ErrValueTooLong. Zero means unlimited. They only apply to new pairs, so
+	// they may be changed when reopening a database.
+	MaxKeyLength   int
+	MaxValueLength int
+
+	// ParallelHashThreshold enables hashing the two children of an inner node
+	// in parallel, when committing or computing the root hash, for subtrees
+	// with more leaves than it. Zero hashes sequentially. The hashes are the
+	// same either way, so it may be changed when reopening a database. The
+	// HashFunc must be safe to call concurrently if it is set.
+	ParallelHashThreshold int64
+
+	// BloomFilterBits enables a bloom filter of this many bits of the keys of
+	// the working tree of a MutableTree, so that Has and GetSafe return
+	// missing keys without reading the tree for most of them. About 10 bits
+	// per key give 1% of lookups of missing keys still reading the tree. Keys
+	// are added by sets, but not removed, so more removed keys give more false
+	// positives, until the filter is rebuilt when a version is loaded, which
+	// reads the whole tree. Zero disables the filter.
+	BloomFilterBits int
+
+	// KeysOnly makes the tree a set of keys, without values: keys are added
+	// with MutableTree.Add, and looked up with Contains. Its leaves are stored
+	// without a value, and hashed without a value hash, so they are smaller
+	// and their hashes differ from those of leaves with empty values. The
+	// setting is recorded in the database when a version is first saved, and
+	// loading a version with the other setting returns an error wrapping
+	// ErrKeysOnly. Values read from the tree are nil, and proofs prove keys
+	// with a nil value.
+	KeysOnly bool
+
+	// ExternalValues stores the value of each leaf apart from it, keyed by
+	// the hash of the leaf, and only the hash of the value in the leaf, so
+	// that large values don't bloat the stored nodes. Values are read along
+	// with their leaf, and checked against the hash. Leaves are hashed from
+	// the hash of their value either way, so the hashes of the tree, and its
+	// proofs, are the same with or without it. The setting is recorded in the
+	// database when a version is first saved, and loading a version with the
+	// other setting returns an error wrapping ErrExternalValues.
+	ExternalValues bool
+}
+
+// DefaultOptions returns the default options.
+func DefaultOptions() *Options {
+	return &Options{}
+}
+
+// hashFunc returns the configured hash function, or the default.
+func (opts Options) hashFunc() func() hash.Hash {
+	if opts.HashFunc == nil {
+		return tmhash.New
+	}
+	return opts.HashFunc
+}
+
+// checkPair returns an error if the key or value is longer than allowed, or
+// if a value is given to a keys-only tree.
+func (opts Options) checkPair(key, value []byte) error {
+	if opts.KeysOnly && value != nil {
+		return errors.Wrapf(ErrKeysOnly, "value at key %X", key)
+	}
+	if opts.MaxKeyLength > 0 && len(key) > opts.MaxKeyLength {
+		return errors.Wrapf(ErrKeyTooLong, "key of %d bytes exceeds %d", len(key), opts.MaxKeyLength)
+	}
+	if opts.MaxValueLength > 0 && len(value) > opts.MaxValueLength {
+		return errors.Wrapf(ErrValueTooLong, "value of %d bytes exceeds %d", len(value), opts.MaxValueLength)
+	}
+	return nil
+}
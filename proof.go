@@ -5,8 +5,8 @@ import (
 	"fmt"
 
 	"github.com/pkg/errors"
-
 	amino "github.com/tendermint/go-amino"
+
 	cmn "github.com/tendermint/iavl/common"
 	"github.com/tendermint/tendermint/crypto/tmhash"
 )
@@ -20,8 +20,67 @@ var (
 
 	// ErrInvalidRoot is returned when the root passed in does not match the proof's.
 	ErrInvalidRoot = fmt.Errorf("invalid root")
+
+	// ErrKeyDoesNotExist is returned when a proof of existence is requested
+	// for a key which is not in the tree.
+	ErrKeyDoesNotExist = fmt.Errorf("key does not exist")
+
+	// ErrProofHashUnsupported is returned when a proof is requested from a
+	// tree with a custom hash function, as proofs are verified with tmhash.
+	ErrProofHashUnsupported = fmt.Errorf("proofs are not supported with a custom hash function")
+
+	// ErrProofCompareUnsupported is returned when a proof is requested from a
+	// tree with a custom comparator, as proofs order keys bytewise.
+	ErrProofCompareUnsupported = fmt.Errorf("proofs are not supported with a custom comparator")
 )
 
+// Formats of the binary encodings of proofs, see ExistenceProof.MarshalBinary,
+// AbsenceProof.MarshalBinary and RangeProof.MarshalBinary. Each encoding starts
+// with its format byte, which tells both the type of the proof and the version
+// of its layout. A change to a layout gets a new format byte, so that parsers
+// of the old layout reject it rather than misread it. In all layouts, lengths
+// and unsigned integers are varints, signed integers zigzag varints, as in
+// protobuf, and byte slices are prefixed with their length.
+const (
+	proofFormatExistence byte = 0x01
+	proofFormatAbsence   byte = 0x02
+	proofFormatRange     byte = 0x03
+)
+
+// checkProofFormat returns an error unless the encoded proof starts with the
+// format byte.
+func checkProofFormat(bz []byte, format byte) error {
+	if len(bz) == 0 {
+		return errors.New("decoding proof: missing format")
+	}
+	if bz[0] != format {
+		return errors.Errorf("decoding proof: format %#02x, expected %#02x", bz[0], format)
+	}
+	return nil
+}
+
+// checkProofSupport returns ErrProofHashUnsupported if the tree nodes are not
+// hashed with the hash function that proofs are verified with, and
+// ErrProofCompareUnsupported if the keys are not in the order proofs expect.
+func (t *ImmutableTree) checkProofSupport() error {
+	if t.ndb != nil && t.ndb.opts.HashFunc != nil {
+		return ErrProofHashUnsupported
+	}
+	if t.ndb != nil && t.ndb.opts.Compare != nil {
+		return ErrProofCompareUnsupported
+	}
+	return nil
+}
+
+// valueHash returns the hash of a leaf value in proofs, or nil for the nil
+// value of a key of a keys-only tree, whose leaves have no value hash.
+func valueHash(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return tmhash.Sum(value)
+}
+
 //----------------------------------------
 
 type proofInnerNode struct {
@@ -53,40 +112,14 @@ func (pin proofInnerNode) stringIndented(indent string) string {
 }
 
 func (pin proofInnerNode) Hash(childHash []byte) []byte {
-	hasher := tmhash.New()
-	buf := new(bytes.Buffer)
-
-	err := amino.EncodeInt8(buf, pin.Height)
-	if err == nil {
-		err = amino.EncodeVarint(buf, pin.Size)
-	}
-	if err == nil {
-		err = amino.EncodeVarint(buf, pin.Version)
-	}
-
+	left, right := pin.Left, childHash
 	if len(pin.Left) == 0 {
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, childHash)
-		}
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, pin.Right)
-		}
-	} else {
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, pin.Left)
-		}
-		if err == nil {
-			err = amino.EncodeByteSlice(buf, childHash)
-		}
+		left, right = childHash, pin.Right
 	}
-	if err != nil {
+	hasher := tmhash.New()
+	if err := writeHashPreimage(hasher, pin.Height, pin.Size, pin.Version, left, right); err != nil {
 		panic(fmt.Sprintf("Failed to hash proofInnerNode: %v", err))
 	}
-
-	_, err = hasher.Write(buf.Bytes())
-	if err != nil {
-		panic(err)
-	}
 	return hasher.Sum(nil)
 }
 
@@ -116,30 +149,9 @@ func (pln proofLeafNode) stringIndented(indent string) string {
 
 func (pln proofLeafNode) Hash() []byte {
 	hasher := tmhash.New()
-	buf := new(bytes.Buffer)
-
-	err := amino.EncodeInt8(buf, 0)
-	if err == nil {
-		err = amino.EncodeVarint(buf, 1)
-	}
-	if err == nil {
-		err = amino.EncodeVarint(buf, pln.Version)
-	}
-	if err == nil {
-		err = amino.EncodeByteSlice(buf, pln.Key)
-	}
-	if err == nil {
-		err = amino.EncodeByteSlice(buf, pln.ValueHash)
-	}
-	if err != nil {
+	if err := writeHashPreimage(hasher, 0, 1, pln.Version, pln.Key, pln.ValueHash); err != nil {
 		panic(fmt.Sprintf("Failed to hash proofLeafNode: %v", err))
 	}
-	_, err = hasher.Write(buf.Bytes())
-	if err != nil {
-		panic(err)
-
-	}
-
 	return hasher.Sum(nil)
 }
 
@@ -162,9 +174,13 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, path *PathToLeaf) (*N
 		if bytes.Equal(node.key, key) {
 			return node, nil
 		}
-		return node, errors.New("key does not exist")
+		return node, ErrKeyDoesNotExist
 	}
 
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return nil, err
+	}
 	if bytes.Compare(key, node.key) < 0 {
 		// left side
 		pin := proofInnerNode{
@@ -172,10 +188,10 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, path *PathToLeaf) (*N
 			Size:    node.size,
 			Version: node.version,
 			Left:    nil,
-			Right:   node.getRightNode(t).hash,
+			Right:   right.hash,
 		}
 		*path = append(*path, pin)
-		n, err := node.getLeftNode(t).pathToLeaf(t, key, path)
+		n, err := left.pathToLeaf(t, key, path)
 		return n, err
 	}
 	// right side
@@ -183,10 +199,94 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, path *PathToLeaf) (*N
 		Height:  node.height,
 		Size:    node.size,
 		Version: node.version,
-		Left:    node.getLeftNode(t).hash,
+		Left:    left.hash,
 		Right:   nil,
 	}
 	*path = append(*path, pin)
-	n, err := node.getRightNode(t).pathToLeaf(t, key, path)
+	n, err := right.pathToLeaf(t, key, path)
 	return n, err
 }
+
+// encode writes the node as its height, size and version, then its left and
+// right hashes, each length-prefixed and empty if the child is on the path.
+func (pin proofInnerNode) encode(buf *bytes.Buffer) error {
+	if err := amino.EncodeInt8(buf, pin.Height); err != nil {
+		return err
+	}
+	if err := amino.EncodeVarint(buf, pin.Size); err != nil {
+		return err
+	}
+	if err := amino.EncodeVarint(buf, pin.Version); err != nil {
+		return err
+	}
+	if err := amino.EncodeByteSlice(buf, pin.Left); err != nil {
+		return err
+	}
+	return amino.EncodeByteSlice(buf, pin.Right)
+}
+
+// decodeProofInnerNode decodes a node written by encode, and returns the
+// bytes which follow it.
+func decodeProofInnerNode(bz []byte) (pin proofInnerNode, rest []byte, err error) {
+	var n int
+	if pin.Height, n, err = amino.DecodeInt8(bz); err != nil {
+		return pin, nil, errors.Wrap(err, "decoding height")
+	}
+	bz = bz[n:]
+	if pin.Size, n, err = amino.DecodeVarint(bz); err != nil {
+		return pin, nil, errors.Wrap(err, "decoding size")
+	}
+	bz = bz[n:]
+	if pin.Version, n, err = amino.DecodeVarint(bz); err != nil {
+		return pin, nil, errors.Wrap(err, "decoding version")
+	}
+	bz = bz[n:]
+	if pin.Left, n, err = amino.DecodeByteSlice(bz); err != nil {
+		return pin, nil, errors.Wrap(err, "decoding left hash")
+	}
+	bz = bz[n:]
+	if pin.Right, n, err = amino.DecodeByteSlice(bz); err != nil {
+		return pin, nil, errors.Wrap(err, "decoding right hash")
+	}
+	// The hash of the child on the path is nil, as in proofs from a tree.
+	if len(pin.Left) == 0 {
+		pin.Left = nil
+	}
+	if len(pin.Right) == 0 {
+		pin.Right = nil
+	}
+	return pin, bz[n:], nil
+}
+
+// encode writes the leaf as its length-prefixed key and value hash, then its
+// version.
+func (pln proofLeafNode) encode(buf *bytes.Buffer) error {
+	if err := amino.EncodeByteSlice(buf, pln.Key); err != nil {
+		return err
+	}
+	if err := amino.EncodeByteSlice(buf, pln.ValueHash); err != nil {
+		return err
+	}
+	return amino.EncodeVarint(buf, pln.Version)
+}
+
+// decodeProofLeafNode decodes a leaf written by encode, and returns the bytes
+// which follow it.
+func decodeProofLeafNode(bz []byte) (pln proofLeafNode, rest []byte, err error) {
+	var n int
+	if pln.Key, n, err = amino.DecodeByteSlice(bz); err != nil {
+		return pln, nil, errors.Wrap(err, "decoding key")
+	}
+	bz = bz[n:]
+	if pln.ValueHash, n, err = amino.DecodeByteSlice(bz); err != nil {
+		return pln, nil, errors.Wrap(err, "decoding value hash")
+	}
+	bz = bz[n:]
+	if len(pln.ValueHash) == 0 {
+		pln.ValueHash = nil // A leaf of a keys-only tree.
+	}
+	if pln.Version, n, err = amino.DecodeVarint(bz); err != nil {
+		return pln, nil, errors.Wrap(err, "decoding version")
+	}
+	return pln, bz[n:], nil
+}
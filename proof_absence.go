@@ -0,0 +1,191 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Flags of the binary encoding of an AbsenceProof, telling which leaves it has.
+const (
+	absenceHasLeft  byte = 1 << 0
+	absenceHasRight byte = 1 << 1
+)
+
+// AbsenceProof proves that a key is not in the tree with a given root hash, by
+// proving the existence of its two neighbors and that they are adjacent
+// leaves. Left is nil if the key is before the first leaf, Right is nil if it
+// is after the last leaf, and both are nil for an empty tree.
+type AbsenceProof struct {
+	Left  *ExistenceProof `json:"left"`  // The greatest leaf before the key.
+	Right *ExistenceProof `json:"right"` // The least leaf after the key.
+}
+
+// String returns a string representation of the proof.
+func (proof *AbsenceProof) String() string {
+	if proof == nil {
+		return "<nil-AbsenceProof>"
+	}
+	return proof.StringIndented("")
+}
+
+func (proof *AbsenceProof) StringIndented(indent string) string {
+	return fmt.Sprintf(`AbsenceProof{
+%s  Left:  %v
+%s  Right: %v
+%s}`,
+		indent, proof.Left.StringIndented(indent+"  "),
+		indent, proof.Right.StringIndented(indent+"  "),
+		indent)
+}
+
+// Verify checks that the proof is a valid proof of absence of key in the tree
+// with the given root hash.
+func (proof *AbsenceProof) Verify(rootHash []byte, key []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	left, right := proof.Left, proof.Right
+
+	if left == nil && right == nil {
+		if len(rootHash) != 0 {
+			return errors.Wrap(ErrInvalidProof, "no leaves in proof of non-empty tree")
+		}
+		return nil
+	}
+	if left != nil {
+		if err := left.Verify(rootHash); err != nil {
+			return errors.Wrap(err, "verifying left leaf")
+		}
+		if bytes.Compare(left.Key, key) >= 0 {
+			return errors.Wrap(ErrInvalidProof, "left leaf is not before key")
+		}
+	}
+	if right != nil {
+		if err := right.Verify(rootHash); err != nil {
+			return errors.Wrap(err, "verifying right leaf")
+		}
+		if bytes.Compare(key, right.Key) >= 0 {
+			return errors.Wrap(ErrInvalidProof, "right leaf is not after key")
+		}
+	}
+
+	switch {
+	case left == nil && !right.Path.isLeftmost():
+		return errors.Wrap(ErrInvalidProof, "right leaf is not the first leaf")
+	case right == nil && !left.Path.isRightmost():
+		return errors.Wrap(ErrInvalidProof, "left leaf is not the last leaf")
+	case left != nil && right != nil && right.Path.Index() != left.Path.Index()+1:
+		// The leaf indexes follow from the sizes in the paths, which the root
+		// hash commits to.
+		return errors.Wrap(ErrInvalidProof, "left and right leaves are not adjacent")
+	}
+	return nil
+}
+
+// GetAbsenceProof returns a proof that the key is not in the tree. It returns
+// an error if the key exists.
+func (t *ImmutableTree) GetAbsenceProof(key []byte) (*AbsenceProof, error) {
+	if err := t.checkProofSupport(); err != nil {
+		return nil, err
+	}
+	if t.root == nil {
+		return &AbsenceProof{}, nil
+	}
+	t.root.hashWithCount(t.hashFunc()) // Ensure that all hashes are calculated.
+
+	// The path leads to the greatest leaf before the key, or to the first leaf
+	// if the key is before all of them.
+	path, leaf, err := t.root.PathToLeaf(t, key)
+	if err == nil {
+		return nil, errors.Errorf("key %X exists", key)
+	} else if err != ErrKeyDoesNotExist {
+		return nil, err
+	}
+	neighbor := &ExistenceProof{
+		Key:     leaf.key,
+		Value:   leaf.value,
+		Version: leaf.version,
+		Path:    path,
+	}
+	if bytes.Compare(key, leaf.key) < 0 {
+		return &AbsenceProof{Right: neighbor}, nil
+	}
+
+	proof := &AbsenceProof{Left: neighbor}
+	if index := path.Index() + 1; index < t.root.size {
+		rightKey, _, err := t.root.getByIndex(t, index)
+		if err != nil {
+			return nil, err
+		}
+		_, proof.Right, err = t.GetWithExistenceProof(rightKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "proving right leaf")
+		}
+	}
+	return proof, nil
+}
+
+// MarshalBinary encodes the proof for light clients. It holds the format byte
+// proofFormatAbsence, then a flags byte telling whether the proof has a left
+// and a right leaf, then each of them, left first, encoded as by
+// ExistenceProof.MarshalBinary without its format byte.
+func (proof *AbsenceProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(proofFormatAbsence)
+	var flags byte
+	if proof.Left != nil {
+		flags |= absenceHasLeft
+	}
+	if proof.Right != nil {
+		flags |= absenceHasRight
+	}
+	buf.WriteByte(flags)
+	if proof.Left != nil {
+		if err := proof.Left.encode(&buf); err != nil {
+			return nil, errors.Wrap(err, "encoding left leaf")
+		}
+	}
+	if proof.Right != nil {
+		if err := proof.Right.encode(&buf); err != nil {
+			return nil, errors.Wrap(err, "encoding right leaf")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a proof encoded by MarshalBinary.
+func (proof *AbsenceProof) UnmarshalBinary(bz []byte) error {
+	if err := checkProofFormat(bz, proofFormatAbsence); err != nil {
+		return err
+	}
+	bz = bz[1:]
+	if len(bz) == 0 {
+		return errors.New("decoding proof: missing flags")
+	}
+	flags := bz[0]
+	bz = bz[1:]
+	if flags&^(absenceHasLeft|absenceHasRight) != 0 {
+		return errors.Errorf("decoding proof: invalid flags %b", flags)
+	}
+	var decoded AbsenceProof
+	var err error
+	if flags&absenceHasLeft != 0 {
+		decoded.Left = &ExistenceProof{}
+		if bz, err = decoded.Left.decode(bz); err != nil {
+			return errors.Wrap(err, "decoding left leaf")
+		}
+	}
+	if flags&absenceHasRight != 0 {
+		decoded.Right = &ExistenceProof{}
+		if bz, err = decoded.Right.decode(bz); err != nil {
+			return errors.Wrap(err, "decoding right leaf")
+		}
+	}
+	if len(bz) > 0 {
+		return errors.Errorf("decoding proof: %d bytes left over", len(bz))
+	}
+	*proof = decoded
+	return nil
+}
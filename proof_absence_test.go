@@ -0,0 +1,126 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestAbsenceProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(2 * i)}, randBytes(8))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 100; i < 120; i++ {
+		tree.Set([]byte{byte(2 * i)}, randBytes(8))
+	}
+	root := tree.WorkingHash()
+
+	// Every odd key is absent, including the one after the last leaf, and so is
+	// the empty key before the first leaf.
+	absent := [][]byte{{}}
+	for i := 0; i < 120; i++ {
+		absent = append(absent, []byte{byte(2*i + 1)})
+	}
+	for _, key := range absent {
+		proof, err := tree.GetAbsenceProof(key)
+		require.NoError(t, err)
+		require.NoError(t, proof.Verify(root, key), "key %X: %v", key, proof)
+		require.Error(t, proof.Verify(randBytes(len(root)), key))
+	}
+
+	_, err = tree.GetAbsenceProof([]byte{4})
+	require.Error(t, err)
+}
+
+func TestAbsenceProofBinary(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	empty, err := tree.GetAbsenceProof([]byte{1})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte{byte(2*i + 2)}, randBytes(8))
+	}
+	root := tree.WorkingHash()
+
+	proofs := map[string]*AbsenceProof{"empty tree": empty}
+	for _, key := range [][]byte{{0}, {51}, {101}, {255}} {
+		proof, err := tree.GetAbsenceProof(key)
+		require.NoError(t, err)
+		proofs[string(key)] = proof
+	}
+	for name, proof := range proofs {
+		bz, err := proof.MarshalBinary()
+		require.NoError(t, err)
+		decoded := &AbsenceProof{}
+		require.NoError(t, decoded.UnmarshalBinary(bz), name)
+		require.Equal(t, proof, decoded, name)
+		if name != "empty tree" {
+			require.NoError(t, decoded.Verify(root, []byte(name)))
+		}
+
+		// Every truncation fails to decode, as do trailing bytes and other
+		// formats.
+		for i := 0; i < len(bz); i++ {
+			require.Error(t, (&AbsenceProof{}).UnmarshalBinary(bz[:i]), name)
+		}
+		require.Error(t, (&AbsenceProof{}).UnmarshalBinary(append(bz, 0)), name)
+		require.Error(t, (&ExistenceProof{}).UnmarshalBinary(bz), name)
+	}
+}
+
+func TestAbsenceProofInvalid(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"b", "d", "f", "h", "j", "l", "n"} {
+		tree.Set([]byte(k), []byte("value_"+k))
+	}
+	root := tree.WorkingHash()
+
+	proof, err := tree.GetAbsenceProof([]byte("e"))
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(root, []byte("e")))
+
+	// The key must lie strictly between the neighbors.
+	for _, k := range []string{"a", "d", "f", "g"} {
+		require.True(t, errors.Cause(proof.Verify(root, []byte(k))) == ErrInvalidProof, k)
+	}
+
+	// Neighbors which are not adjacent don't prove anything.
+	_, far, err := tree.GetWithExistenceProof([]byte("h"))
+	require.NoError(t, err)
+	gap := &AbsenceProof{Left: proof.Left, Right: far}
+	require.True(t, errors.Cause(gap.Verify(root, []byte("g"))) == ErrInvalidProof)
+
+	// Dropping a neighbor is only allowed at the ends of the tree.
+	require.Error(t, (&AbsenceProof{Left: proof.Left}).Verify(root, []byte("e")))
+	require.Error(t, (&AbsenceProof{Right: proof.Right}).Verify(root, []byte("e")))
+	require.Error(t, (&AbsenceProof{}).Verify(root, []byte("e")))
+
+	// A tampered neighbor fails verification.
+	proof.Right.Value = []byte("other")
+	require.Error(t, proof.Verify(root, []byte("e")))
+
+	var nilProof *AbsenceProof
+	require.Error(t, nilProof.Verify(root, []byte("e")))
+}
+
+func TestAbsenceProofSmallTrees(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	proof, err := tree.GetAbsenceProof([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(tree.WorkingHash(), []byte("a")))
+	require.Error(t, proof.Verify(randBytes(20), []byte("a")))
+
+	for _, k := range []string{"b", "d"} {
+		tree.Set([]byte(k), []byte(k))
+		root := tree.WorkingHash()
+		for _, key := range []string{"a", "c", "e"} {
+			proof, err := tree.GetAbsenceProof([]byte(key))
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(root, []byte(key)), "key %s: %v", key, proof)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// proofBatchCacheSize is the largest number of inner nodes a ProofBatcher
+// keeps. Deeper nodes are loaded from the node DB as usual once it's full.
+const proofBatchCacheSize = 100000
+
+// ProofBatcher serves many existence proofs against a single saved version of
+// a tree. The inner nodes it loads are kept in a map of its own, so proofs for
+// further keys only load the nodes on their paths which earlier proofs didn't,
+// however small the node cache. Proofs take the sibling hashes along a path
+// from the inner nodes, rather than loading the siblings.
+//
+// A ProofBatcher is safe for concurrent use, and keeps serving its version
+// while the tree advances to newer versions, until the version is deleted.
+type ProofBatcher struct {
+	tree *ImmutableTree
+
+	mtx   sync.RWMutex
+	nodes map[string]*Node // Inner nodes loaded, by hash.
+}
+
+// ProofBatch returns a ProofBatcher for the given saved version. It returns an
+// error wrapping ErrVersionDoesNotExist if the version was never saved or has
+// been deleted.
+func (tree *MutableTree) ProofBatch(version int64) (*ProofBatcher, error) {
+	if !tree.versions[version] {
+		return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkProofSupport(); err != nil {
+		return nil, err
+	}
+	return &ProofBatcher{tree: t, nodes: make(map[string]*Node)}, nil
+}
+
+// Version returns the version the proofs are for.
+func (pb *ProofBatcher) Version() int64 {
+	return pb.tree.version
+}
+
+// Hash returns the root hash of the version, which the proofs verify against.
+func (pb *ProofBatcher) Hash() []byte {
+	return pb.tree.Hash()
+}
+
+// Prove gets the value under the key along with a proof of its existence, the
+// same as ImmutableTree.GetWithExistenceProof would for the version. If the key
+// does not exist, ErrKeyDoesNotExist is returned.
+func (pb *ProofBatcher) Prove(key []byte) (value []byte, proof *ExistenceProof, err error) {
+	node := pb.tree.root
+	if node == nil {
+		return nil, nil, errors.Wrap(ErrKeyDoesNotExist, "tree is empty")
+	}
+	var path PathToLeaf
+	for !node.isLeaf() {
+		pin := proofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+		}
+		child, childHash := node.leftNode, node.leftHash
+		if bytes.Compare(key, node.key) < 0 {
+			pin.Right = node.rightHash
+		} else {
+			pin.Left = node.leftHash
+			child, childHash = node.rightNode, node.rightHash
+		}
+		path = append(path, pin)
+		if child == nil {
+			if child, err = pb.getNode(childHash); err != nil {
+				return nil, nil, err
+			}
+		}
+		node = child
+	}
+	if !bytes.Equal(node.key, key) {
+		return nil, nil, ErrKeyDoesNotExist
+	}
+	return node.value, &ExistenceProof{
+		Key:     node.key,
+		Value:   node.value,
+		Version: node.version,
+		Path:    path,
+	}, nil
+}
+
+// getNode gets a node from the batcher's map or the node DB, keeping it in the
+// map if it is an inner node and the map isn't full.
+func (pb *ProofBatcher) getNode(hash []byte) (*Node, error) {
+	pb.mtx.RLock()
+	node, ok := pb.nodes[string(hash)]
+	pb.mtx.RUnlock()
+	if ok {
+		return node, nil
+	}
+
+	node, err := pb.tree.ndb.GetNode(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !node.isLeaf() {
+		pb.mtx.Lock()
+		if len(pb.nodes) < proofBatchCacheSize {
+			pb.nodes[string(hash)] = node
+		}
+		pb.mtx.Unlock()
+	}
+	return node, nil
+}
+
+// ProveMany gets proofs of existence of the keys, in the same order, as
+// GetWithExistenceProof would for each of them. The tree is hashed once, then
+// the keys are proven together in a single descent, so the inner nodes shared
+// by their paths are visited once, and siblings are never loaded. If a key
+// does not exist, an error wrapping ErrKeyDoesNotExist is returned.
+func (t *ImmutableTree) ProveMany(keys [][]byte) ([]*ExistenceProof, error) {
+	if err := t.checkProofSupport(); err != nil {
+		return nil, err
+	}
+	root := t.loadRoot()
+	if root == nil && len(keys) > 0 {
+		return nil, errors.Wrap(ErrKeyDoesNotExist, "tree is empty")
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	t.hashWithCount(root)
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	proofs := make([]*ExistenceProof, len(keys))
+	if err := root.proveMany(t, nil, keys, order, proofs); err != nil {
+		return nil, err
+	}
+	return proofs, nil
+}
+
+// proveMany sets the proofs of the keys at the sorted indexes order, which are
+// all under the node, whose path from the root is path.
+func (node *Node) proveMany(t *ImmutableTree, path PathToLeaf, keys [][]byte, order []int, proofs []*ExistenceProof) error {
+	if node.isLeaf() {
+		for _, i := range order {
+			if !bytes.Equal(node.key, keys[i]) {
+				return errors.Wrapf(ErrKeyDoesNotExist, "key %X", keys[i])
+			}
+			proofs[i] = &ExistenceProof{
+				Key:     node.key,
+				Value:   node.value,
+				Version: node.version,
+				Path:    append(PathToLeaf(nil), path...),
+			}
+		}
+		return nil
+	}
+
+	split := sort.Search(len(order), func(i int) bool {
+		return bytes.Compare(keys[order[i]], node.key) >= 0
+	})
+	pin := proofInnerNode{Height: node.height, Size: node.size, Version: node.version}
+	if split > 0 {
+		left, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		pin.Left, pin.Right = nil, node.rightHash
+		if err := left.proveMany(t, append(path, pin), keys, order[:split], proofs); err != nil {
+			return err
+		}
+	}
+	if split < len(order) {
+		right, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		pin.Left, pin.Right = node.leftHash, nil
+		if err := right.proveMany(t, append(path, pin), keys, order[split:], proofs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
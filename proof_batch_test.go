@@ -0,0 +1,156 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestProofBatcher(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.ProofBatch(version + 1)
+	require.Equal(t, ErrVersionDoesNotExist, errors.Cause(err))
+	batcher, err := tree.ProofBatch(version)
+	require.NoError(t, err)
+	require.Equal(t, version, batcher.Version())
+	require.Equal(t, hash, batcher.Hash())
+
+	// The tree advances while the batcher serves the version it was made for.
+	for i := 0; i < 500; i += 3 {
+		tree.Remove([]byte(fmt.Sprintf("key-%03d", i)))
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i+1)), []byte("new"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 500; i += 4 {
+				key := []byte(fmt.Sprintf("key-%03d", i))
+				value, proof, err := batcher.Prove(key)
+				require.NoError(t, err)
+				require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+				require.NoError(t, proof.Verify(hash))
+
+				_, expected, err := tree.GetVersionedWithExistenceProof(key, version)
+				require.NoError(t, err)
+				require.Equal(t, expected, proof)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, key := range []string{"key-500", "key", ""} {
+		_, _, err = batcher.Prove([]byte(key))
+		require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err), key)
+	}
+}
+
+func TestProveMany(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// The working tree isn't hashed yet.
+	for i := 0; i < 500; i += 7 {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte("new"))
+	}
+
+	// Unsorted, clustered and repeated keys.
+	var keys [][]byte
+	for _, i := range []int{499, 7, 100, 101, 102, 103, 0, 7, 250} {
+		keys = append(keys, []byte(fmt.Sprintf("key-%03d", i)))
+	}
+	proofs, err := tree.ProveMany(keys)
+	require.NoError(t, err)
+	require.Len(t, proofs, len(keys))
+	root := tree.WorkingHash()
+	for i, key := range keys {
+		value, expected, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, proofs[i], "%s", key)
+		require.Equal(t, value, []byte(proofs[i].Value))
+		require.NoError(t, proofs[i].Verify(root))
+	}
+
+	_, err = tree.ProveMany(append(keys, []byte("missing")))
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+	proofs, err = tree.ProveMany(nil)
+	require.NoError(t, err)
+	require.Empty(t, proofs)
+	_, err = NewMutableTree(db.NewMemDB(), 0).ProveMany(keys)
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+}
+
+// BenchmarkProveMany proves 100 clustered keys of a tree loaded from the
+// database, together and one by one.
+func BenchmarkProveMany(b *testing.B) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%06d", i)), randBytes(32))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%06d", 50000+i))
+	}
+
+	b.Run("GetWithExistenceProof", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				_, _, err := tree.GetWithExistenceProof(key)
+				require.NoError(b, err)
+			}
+		}
+	})
+	b.Run("ProveMany", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := tree.ProveMany(keys)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func BenchmarkProofBatcher(b *testing.B) {
+	tree := NewMutableTree(db.NewMemDB(), 1000)
+	keys := make([][]byte, 100000)
+	for i := range keys {
+		keys[i] = randBytes(8)
+		tree.Set(keys[i], randBytes(32))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(b, err)
+
+	b.Run("GetVersionedWithExistenceProof", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _, err := tree.GetVersionedWithExistenceProof(keys[i%len(keys)], version)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("ProofBatcher", func(b *testing.B) {
+		batcher, err := tree.ProofBatch(version)
+		require.NoError(b, err)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _, err := batcher.Prove(keys[i%len(keys)])
+			require.NoError(b, err)
+		}
+	})
+}
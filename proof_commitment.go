@@ -0,0 +1,289 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+
+	cmn "github.com/tendermint/iavl/common"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// CommitmentProof proves that a key is set to a value in the tree with a given
+// root hash, in the layout of an ICS-23 existence proof: a leaf op hashing the
+// key and value into the hash of their leaf, then inner ops, from the parent
+// of the leaf up to the root, each hashing the hash below between a prefix and
+// a suffix into the hash of the parent. All of the node headers and sibling
+// hashes are in the prefixes and suffixes, so a verifier only concatenates
+// bytes and hashes them, with no knowledge of the IAVL hash preimages.
+//
+// The ops match the ICS-23 spec for IAVL: SHA-256 hashes, the key as is and
+// the value hashed with SHA-256, both prefixed with their length as a
+// protobuf varint.
+type CommitmentProof struct {
+	Key   cmn.HexBytes `json:"key"`
+	Value cmn.HexBytes `json:"value"`
+	Leaf  LeafOp       `json:"leaf"`
+	Path  []InnerOp    `json:"path"` // From the parent of the leaf up to the root.
+}
+
+// The bounds of the inner ops, as in the ICS-23 spec for IAVL: a prefix holds
+// the header of the parent and the length of the hash of the child, and one
+// length-prefixed sibling hash is either at the end of the prefix or in the
+// suffix.
+const (
+	innerMinPrefixLength = 4
+	innerMaxPrefixLength = 12
+	innerChildSize       = 1 + tmhash.Size
+)
+
+// readHeader reads the header of a node, its height, size and version, off
+// the start of a prefix and returns the rest of the prefix.
+func readHeader(prefix []byte) (height int8, size, version int64, rest []byte, err error) {
+	r := bytes.NewReader(prefix)
+	h, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, 0, 0, nil, errors.Wrap(ErrInvalidProof, "reading height")
+	}
+	if h < math.MinInt8 || h > math.MaxInt8 {
+		return 0, 0, 0, nil, errors.Wrapf(ErrInvalidProof, "height %d", h)
+	}
+	if size, err = binary.ReadVarint(r); err != nil {
+		return 0, 0, 0, nil, errors.Wrap(ErrInvalidProof, "reading size")
+	}
+	if version, err = binary.ReadVarint(r); err != nil {
+		return 0, 0, 0, nil, errors.Wrap(ErrInvalidProof, "reading version")
+	}
+	return int8(h), size, version, prefix[len(prefix)-r.Len():], nil
+}
+
+// LeafOp hashes a key and value into the hash of their leaf.
+type LeafOp struct {
+	// Prefix is the header of the leaf: its height, size and version.
+	Prefix cmn.HexBytes `json:"prefix"`
+}
+
+// check checks that the prefix is exactly the header of a leaf, of height 0,
+// size 1 and a version of at least 0, so that no inner node can pass as one.
+func (op LeafOp) check() error {
+	height, size, version, rest, err := readHeader(op.Prefix)
+	if err != nil {
+		return err
+	}
+	if height != 0 || size != 1 || version < 0 || len(rest) > 0 {
+		return errors.Wrapf(ErrInvalidProof, "leaf prefix %X is not the header of a leaf", []byte(op.Prefix))
+	}
+	return nil
+}
+
+// Apply returns the hash of the leaf of the key and value: the hash of the
+// prefix, then the length-prefixed key and value hash. The nil value of a key
+// of a keys-only tree has no value hash, which isn't part of the ICS-23 spec.
+// If the prefix isn't the header of a leaf, ErrInvalidProof is returned.
+func (op LeafOp) Apply(key, value []byte) ([]byte, error) {
+	if err := op.check(); err != nil {
+		return nil, err
+	}
+	hasher := tmhash.New()
+	hasher.Write(op.Prefix)
+	err := amino.EncodeByteSlice(hasher, key)
+	if err == nil && value != nil {
+		err = amino.EncodeByteSlice(hasher, tmhash.Sum(value))
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Failed to hash LeafOp: %v", err))
+	}
+	return hasher.Sum(nil), nil
+}
+
+// InnerOp hashes the hash of a child into the hash of its parent.
+type InnerOp struct {
+	// Prefix is the header of the parent, its height, size and version,
+	// followed by the length-prefixed left hash if the child is on the right,
+	// then the length of the hash of the child.
+	Prefix cmn.HexBytes `json:"prefix"`
+	// Suffix is the length-prefixed right hash if the child is on the left,
+	// and empty otherwise.
+	Suffix cmn.HexBytes `json:"suffix"`
+}
+
+// check checks that the prefix starts with the header of an inner node, of a
+// height above 0 and a version of at least 0, that one sibling hash follows
+// the header or is the suffix, and that the lengths are within the bounds of
+// the ICS-23 spec. It returns the height of the node.
+func (op InnerOp) check() (int8, error) {
+	if len(op.Prefix) < innerMinPrefixLength || len(op.Prefix) > innerMaxPrefixLength+innerChildSize {
+		return 0, errors.Wrapf(ErrInvalidProof, "inner prefix of length %d", len(op.Prefix))
+	}
+	height, size, version, rest, err := readHeader(op.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	if height <= 0 || size < 0 || version < 0 {
+		return 0, errors.Wrapf(ErrInvalidProof, "inner prefix %X is not the header of an inner node", []byte(op.Prefix))
+	}
+	switch {
+	case len(rest) == 1 && len(op.Suffix) == innerChildSize:
+	case len(rest) == 1+innerChildSize && len(op.Suffix) == 0:
+	default:
+		return 0, errors.Wrapf(ErrInvalidProof, "inner op with %d bytes after the header and a suffix of length %d",
+			len(rest), len(op.Suffix))
+	}
+	return height, nil
+}
+
+// Apply returns the hash of the parent of the child. If the op isn't one of
+// an inner node, ErrInvalidProof is returned.
+func (op InnerOp) Apply(child []byte) ([]byte, error) {
+	if _, err := op.check(); err != nil {
+		return nil, err
+	}
+	if len(child) != tmhash.Size {
+		return nil, errors.Wrapf(ErrInvalidProof, "child hash of length %d", len(child))
+	}
+	hasher := tmhash.New()
+	hasher.Write(op.Prefix)
+	hasher.Write(child)
+	hasher.Write(op.Suffix)
+	return hasher.Sum(nil), nil
+}
+
+// String returns a string representation of the proof.
+func (proof *CommitmentProof) String() string {
+	if proof == nil {
+		return "<nil-CommitmentProof>"
+	}
+	return proof.StringIndented("")
+}
+
+func (proof *CommitmentProof) StringIndented(indent string) string {
+	ops := make([]string, len(proof.Path))
+	for i, op := range proof.Path {
+		ops[i] = fmt.Sprintf("%v:Inner prefix %X suffix %X", i, op.Prefix, op.Suffix)
+	}
+	return fmt.Sprintf(`CommitmentProof{
+%s  Key:   %X
+%s  Value: %X
+%s  Leaf:  prefix %X
+%s  Path:
+%s    %v
+%s}`,
+		indent, proof.Key,
+		indent, proof.Value,
+		indent, proof.Leaf.Prefix,
+		indent,
+		indent, strings.Join(ops, "\n"+indent+"    "),
+		indent)
+}
+
+// ComputeRootHash applies the ops in order and returns the root hash they
+// reach, or nil if an op is invalid. Does not verify the root hash.
+func (proof *CommitmentProof) ComputeRootHash() []byte {
+	if proof == nil {
+		return nil
+	}
+	hash, err := proof.computeRootHash()
+	if err != nil {
+		return nil
+	}
+	return hash
+}
+
+// computeRootHash is like ComputeRootHash, but returns why an op is invalid.
+// The inner ops must also go up the tree, each above the height of the last.
+func (proof *CommitmentProof) computeRootHash() ([]byte, error) {
+	hash, err := proof.Leaf.Apply(proof.Key, proof.Value)
+	if err != nil {
+		return nil, errors.Wrap(err, "leaf op")
+	}
+	var below int8
+	for i, op := range proof.Path {
+		height, err := op.check()
+		if err != nil {
+			return nil, errors.Wrapf(err, "inner op #%d", i)
+		}
+		if height <= below {
+			return nil, errors.Wrapf(ErrInvalidProof, "inner op #%d has height %d, not above %d", i, height, below)
+		}
+		below = height
+		if hash, err = op.Apply(hash); err != nil {
+			return nil, errors.Wrapf(err, "inner op #%d", i)
+		}
+	}
+	return hash, nil
+}
+
+// Verify checks that the ops are those of a leaf and of inner nodes above it,
+// and that they reach the given root hash from the key and value.
+func (proof *CommitmentProof) Verify(rootHash []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	hash, err := proof.computeRootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, rootHash) {
+		return errors.Wrap(ErrInvalidProof, "ops don't reach the root hash")
+	}
+	return nil
+}
+
+// GetCommitmentProof gets a proof that the key is set to its value, as a list
+// of ops which ICS-23 verifiers can apply. If the key does not exist,
+// ErrKeyDoesNotExist is returned.
+func (t *ImmutableTree) GetCommitmentProof(key []byte) (*CommitmentProof, error) {
+	_, existence, err := t.GetWithExistenceProof(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ops are split out of the hash preimages of the nodes, so they hash
+	// the same bytes as the nodes and can't drift apart from them.
+	var buf bytes.Buffer
+	leaf := existence.pathWithLeaf().Leaf
+	if err := writeHashPreimage(&buf, 0, 1, leaf.Version, leaf.Key, leaf.ValueHash); err != nil {
+		return nil, err
+	}
+	preimage := buf.Bytes()
+	tail := amino.ByteSliceSize(leaf.Key)
+	if len(leaf.ValueHash) > 0 {
+		tail += amino.ByteSliceSize(leaf.ValueHash)
+	}
+	proof := &CommitmentProof{
+		Key:   existence.Key,
+		Value: existence.Value,
+		Leaf:  LeafOp{Prefix: append([]byte{}, preimage[:len(preimage)-tail]...)},
+		Path:  make([]InnerOp, 0, len(existence.Path)),
+	}
+
+	child := tmhash.Sum(preimage)
+	for i := len(existence.Path) - 1; i >= 0; i-- {
+		pin := existence.Path[i]
+		left, right := pin.Left, child
+		if len(pin.Left) == 0 {
+			left, right = child, pin.Right
+		}
+		buf.Reset()
+		if err := writeHashPreimage(&buf, pin.Height, pin.Size, pin.Version, left, right); err != nil {
+			return nil, err
+		}
+		preimage := buf.Bytes()
+		// The child hash is the last bytes, or is followed by the right hash.
+		end := len(preimage)
+		if len(pin.Left) == 0 {
+			end -= amino.ByteSliceSize(pin.Right)
+		}
+		proof.Path = append(proof.Path, InnerOp{
+			Prefix: append([]byte{}, preimage[:end-len(child)]...),
+			Suffix: append([]byte{}, preimage[end:]...),
+		})
+		child = tmhash.Sum(preimage)
+	}
+	return proof, nil
+}
@@ -0,0 +1,168 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	amino "github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestGetCommitmentProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	tree.Set([]byte("empty"), []byte{})
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-050"), []byte("updated"))
+	root := tree.WorkingHash()
+
+	// fold applies the ops by hand, as a standalone ICS-23 verifier would.
+	lengthPrefixed := func(bz []byte) []byte {
+		var length [binary.MaxVarintLen64]byte
+		return append(length[:binary.PutUvarint(length[:], uint64(len(bz)))], bz...)
+	}
+	fold := func(proof *CommitmentProof) []byte {
+		valueHash := sha256.Sum256(proof.Value)
+		var preimage bytes.Buffer
+		preimage.Write(proof.Leaf.Prefix)
+		preimage.Write(lengthPrefixed(proof.Key))
+		preimage.Write(lengthPrefixed(valueHash[:]))
+		hash := sha256.Sum256(preimage.Bytes())
+		for _, op := range proof.Path {
+			hash = sha256.Sum256(append(append(append([]byte{}, op.Prefix...), hash[:]...), op.Suffix...))
+		}
+		return hash[:]
+	}
+
+	for _, key := range []string{"key-000", "key-050", "key-099", "empty"} {
+		proof, err := tree.GetCommitmentProof([]byte(key))
+		require.NoError(t, err)
+		_, value, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, []byte(proof.Value))
+		require.Equal(t, root, fold(proof), key)
+		require.Equal(t, root, proof.ComputeRootHash())
+		require.NoError(t, proof.Verify(root))
+
+		// Each inner op holds the sibling hash on one side.
+		_, existence, err := tree.GetWithExistenceProof([]byte(key))
+		require.NoError(t, err)
+		require.Len(t, proof.Path, len(existence.Path))
+		for i, op := range proof.Path {
+			pin := existence.Path[len(existence.Path)-1-i]
+			if len(pin.Left) > 0 {
+				require.True(t, bytes.HasSuffix(op.Prefix, append(lengthPrefixed(pin.Left), sha256.Size)))
+				require.Empty(t, op.Suffix)
+			} else {
+				require.Equal(t, lengthPrefixed(pin.Right), []byte(op.Suffix))
+			}
+		}
+
+		tampered := *proof
+		tampered.Value = []byte("tampered")
+		require.Equal(t, ErrInvalidProof, errors.Cause(tampered.Verify(root)))
+	}
+
+	_, err = tree.GetCommitmentProof([]byte("missing"))
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+}
+
+func TestCommitmentProof_InnerNodeAsLeaf(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	root := tree.WorkingHash()
+
+	// Find a leaf on the right of its parent, so that the parent's hash is
+	// that of a leaf with the left hash as its key, and the preimage of the
+	// leaf's hash as its value.
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		proof, err := tree.GetCommitmentProof(key)
+		require.NoError(t, err)
+		_, existence, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		parent := existence.Path[len(existence.Path)-1]
+		if len(parent.Left) == 0 || len(existence.Path) < 2 {
+			continue
+		}
+
+		var header, leaf bytes.Buffer
+		require.NoError(t, amino.EncodeInt8(&header, parent.Height))
+		require.NoError(t, amino.EncodeVarint(&header, parent.Size))
+		require.NoError(t, amino.EncodeVarint(&header, parent.Version))
+		leaf.Write(proof.Leaf.Prefix)
+		require.NoError(t, amino.EncodeByteSlice(&leaf, key))
+		require.NoError(t, amino.EncodeByteSlice(&leaf, tmhash.Sum(proof.Value)))
+		forged := &CommitmentProof{
+			Key:   parent.Left,
+			Value: leaf.Bytes(),
+			Leaf:  LeafOp{Prefix: header.Bytes()},
+			Path:  proof.Path[1:],
+		}
+
+		// The ops of the forgery hash up to the root, but its leaf op is the
+		// header of an inner node.
+		var preimage bytes.Buffer
+		preimage.Write(forged.Leaf.Prefix)
+		require.NoError(t, amino.EncodeByteSlice(&preimage, forged.Key))
+		require.NoError(t, amino.EncodeByteSlice(&preimage, tmhash.Sum(forged.Value)))
+		hash := tmhash.Sum(preimage.Bytes())
+		for _, op := range forged.Path {
+			hash = tmhash.Sum(append(append(append([]byte{}, op.Prefix...), hash...), op.Suffix...))
+		}
+		require.Equal(t, root, hash)
+
+		require.Equal(t, ErrInvalidProof, errors.Cause(forged.Verify(root)))
+		require.Nil(t, forged.ComputeRootHash())
+		return
+	}
+	t.Fatal("no leaf on the right of its parent")
+}
+
+func TestCommitmentProof_InvalidOps(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	root := tree.WorkingHash()
+	proof, err := tree.GetCommitmentProof([]byte("key-07"))
+	require.NoError(t, err)
+	require.True(t, len(proof.Path) >= 2)
+	require.NoError(t, proof.Verify(root))
+
+	for name, tamper := range map[string]func(p *CommitmentProof){
+		"leaf prefix with trailing bytes": func(p *CommitmentProof) { p.Leaf.Prefix = append(p.Leaf.Prefix, 0) },
+		"leaf prefix truncated":           func(p *CommitmentProof) { p.Leaf.Prefix = p.Leaf.Prefix[:1] },
+		"inner op as leaf op":             func(p *CommitmentProof) { p.Leaf.Prefix = p.Path[0].Prefix },
+		"leaf op as inner op":             func(p *CommitmentProof) { p.Path[0].Prefix = p.Leaf.Prefix },
+		"sibling hash on both sides": func(p *CommitmentProof) {
+			p.Path[0].Suffix = append([]byte{sha256.Size}, make([]byte, sha256.Size)...)
+			p.Path[0].Prefix = append(p.Path[0].Prefix[:len(p.Path[0].Prefix)-1], p.Path[0].Suffix...)
+			p.Path[0].Prefix = append(p.Path[0].Prefix, sha256.Size)
+		},
+		"inner prefix too long": func(p *CommitmentProof) {
+			p.Path[0].Prefix = append(make([]byte, innerMaxPrefixLength+innerChildSize), p.Path[0].Prefix...)
+		},
+		"inner ops out of order": func(p *CommitmentProof) { p.Path[0], p.Path[1] = p.Path[1], p.Path[0] },
+	} {
+		tampered := *proof
+		tampered.Leaf.Prefix = append([]byte{}, proof.Leaf.Prefix...)
+		tampered.Path = make([]InnerOp, len(proof.Path))
+		for i, op := range proof.Path {
+			tampered.Path[i] = InnerOp{Prefix: append([]byte{}, op.Prefix...), Suffix: append([]byte{}, op.Suffix...)}
+		}
+		tamper(&tampered)
+		require.Equal(t, ErrInvalidProof, errors.Cause(tampered.Verify(root)), name)
+	}
+}
@@ -0,0 +1,353 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+
+	cmn "github.com/tendermint/iavl/common"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// ExistenceProof proves that a single key is set to a value in the tree with
+// a given root hash. Unlike RangeProof it only covers one leaf, and it can only
+// prove existence.
+type ExistenceProof struct {
+	Key     cmn.HexBytes `json:"key"`
+	Value   cmn.HexBytes `json:"value"`
+	Version int64        `json:"version"` // The version of the leaf node.
+	Path    PathToLeaf   `json:"path"`
+}
+
+// String returns a string representation of the proof.
+func (proof *ExistenceProof) String() string {
+	if proof == nil {
+		return "<nil-ExistenceProof>"
+	}
+	return proof.StringIndented("")
+}
+
+func (proof *ExistenceProof) StringIndented(indent string) string {
+	return fmt.Sprintf(`ExistenceProof{
+%s  Key:     %X
+%s  Value:   %X
+%s  Version: %v
+%s  Path:    %v
+%s}`,
+		indent, proof.Key,
+		indent, proof.Value,
+		indent, proof.Version,
+		indent, proof.Path.stringIndented(indent+"  "),
+		indent)
+}
+
+// Verify checks that the leaf holding the proof's key and value, hashed the
+// same way as a leaf node, merkle-izes through Path to the given root hash.
+func (proof *ExistenceProof) Verify(rootHash []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	for i, pin := range proof.Path {
+		if (len(pin.Left) == 0) == (len(pin.Right) == 0) {
+			return errors.Wrapf(ErrInvalidProof, "path node #%d must have exactly one child hash", i)
+		}
+	}
+	return proof.pathWithLeaf().verify(rootHash)
+}
+
+// VerifyIndex verifies the proof as by Verify, and checks that the key is at
+// the given index in the tree, i.e. that index keys are smaller than it. The
+// index is computed from the sizes of the inner nodes along Path, as the size
+// of a left subtree is the size of its parent less the size of its sibling on
+// the path. Since the sizes are part of the hashed bytes of the inner nodes,
+// they are covered by the root hash.
+func (proof *ExistenceProof) VerifyIndex(rootHash []byte, index int64) error {
+	if err := proof.Verify(rootHash); err != nil {
+		return err
+	}
+	if actual := proof.Path.Index(); actual != index {
+		return errors.Wrapf(ErrInvalidProof, "key is at index %d, not %d", actual, index)
+	}
+	return nil
+}
+
+// ComputeRootHash computes the root hash implied by the proof. Does not verify
+// the root hash.
+func (proof *ExistenceProof) ComputeRootHash() []byte {
+	if proof == nil {
+		return nil
+	}
+	return proof.pathWithLeaf().computeRootHash()
+}
+
+func (proof *ExistenceProof) pathWithLeaf() pathWithLeaf {
+	return pathWithLeaf{
+		Path: proof.Path,
+		Leaf: proofLeafNode{
+			Key:       proof.Key,
+			ValueHash: valueHash(proof.Value),
+			Version:   proof.Version,
+		},
+	}
+}
+
+// Flags of the inner nodes in the binary encoding of an ExistenceProof.
+const (
+	existenceSiblingLeft byte = 1 << 0 // The sibling hash is Left, not Right.
+	existenceHeightTwo   byte = 1 << 1 // The height is the child's plus 2, not 1.
+)
+
+// MarshalBinary encodes the proof compactly, for light clients. It holds the
+// format byte proofFormatExistence, the length-prefixed key and value and the
+// version of the leaf, then the length of the path and its inner nodes from
+// the parent of the leaf up to the root, each with only what can't be derived
+// from the node below it:
+//   - a flags byte, telling the side of the sibling hash, and whether the
+//     height is one or two more than the height of the node below, which are
+//     the only possibilities in an AVL tree,
+//   - the size of the sibling, which the size of the node below adds up to
+//     the size of the node,
+//   - the version of the node less the version of the node below, which is
+//     never older,
+//   - the sibling hash, without its length, which is tmhash.Size.
+//
+// Leaves always have a height of 0 and a size of 1, so these are omitted. A
+// proof which doesn't satisfy these constraints can't be encoded, and could
+// not have been generated from a tree. Neither can a proof of a key of a
+// keys-only tree, whose nil value would decode as an empty one.
+func (proof *ExistenceProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(proofFormatExistence)
+	if err := proof.encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encode writes the proof as MarshalBinary does, without the format byte.
+func (proof *ExistenceProof) encode(buf *bytes.Buffer) error {
+	if proof.Value == nil {
+		return errors.New("can't encode the nil value of a key of a keys-only tree")
+	}
+	if err := amino.EncodeByteSlice(buf, proof.Key); err != nil {
+		return err
+	}
+	if err := amino.EncodeByteSlice(buf, proof.Value); err != nil {
+		return err
+	}
+	if proof.Version < 0 {
+		return errors.Wrapf(ErrInvalidProof, "leaf of version %d", proof.Version)
+	}
+	if err := amino.EncodeVarint(buf, proof.Version); err != nil {
+		return err
+	}
+	if err := amino.EncodeUvarint(buf, uint64(len(proof.Path))); err != nil {
+		return err
+	}
+
+	height, size, version := int8(0), int64(1), proof.Version
+	for i := len(proof.Path) - 1; i >= 0; i-- {
+		pin := proof.Path[i]
+		var flags byte
+		sibling := pin.Right
+		if len(pin.Left) > 0 {
+			flags |= existenceSiblingLeft
+			sibling = pin.Left
+			if len(pin.Right) > 0 {
+				return errors.Wrapf(ErrInvalidProof, "path node #%d has two child hashes", i)
+			}
+		}
+		if len(sibling) != tmhash.Size {
+			return errors.Wrapf(ErrInvalidProof, "path node #%d has a child hash of length %d", i, len(sibling))
+		}
+		switch pin.Height - height {
+		case 1:
+		case 2:
+			flags |= existenceHeightTwo
+		default:
+			return errors.Wrapf(ErrInvalidProof, "path node #%d has height %d above height %d", i, pin.Height, height)
+		}
+		if pin.Size <= size {
+			return errors.Wrapf(ErrInvalidProof, "path node #%d has size %d above size %d", i, pin.Size, size)
+		}
+		if pin.Version < version {
+			return errors.Wrapf(ErrInvalidProof, "path node #%d has version %d above version %d", i, pin.Version, version)
+		}
+
+		buf.WriteByte(flags)
+		if err := amino.EncodeUvarint(buf, uint64(pin.Size-size)); err != nil {
+			return err
+		}
+		if err := amino.EncodeUvarint(buf, uint64(pin.Version-version)); err != nil {
+			return err
+		}
+		buf.Write(sibling)
+		height, size, version = pin.Height, pin.Size, pin.Version
+	}
+	return nil
+}
+
+// UnmarshalBinary decodes a proof encoded by MarshalBinary, rebuilding the
+// heights, sizes and versions of the inner nodes of its path, so that they
+// hash the same as those of the encoded proof.
+func (proof *ExistenceProof) UnmarshalBinary(bz []byte) error {
+	if err := checkProofFormat(bz, proofFormatExistence); err != nil {
+		return err
+	}
+	rest, err := proof.decode(bz[1:])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.Errorf("decoding proof: %d bytes left over", len(rest))
+	}
+	return nil
+}
+
+// decode decodes a proof written by encode, and returns the bytes which follow
+// it.
+func (proof *ExistenceProof) decode(bz []byte) (rest []byte, err error) {
+	key, n, err := amino.DecodeByteSlice(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding key")
+	}
+	bz = bz[n:]
+	value, n, err := amino.DecodeByteSlice(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding value")
+	}
+	bz = bz[n:]
+	version, n, err := amino.DecodeVarint(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding version")
+	}
+	bz = bz[n:]
+	if version < 0 {
+		return nil, errors.Wrapf(ErrInvalidProof, "leaf of version %d", version)
+	}
+	length, n, err := amino.DecodeUvarint(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding path length")
+	}
+	bz = bz[n:]
+	if length > maxPathLen {
+		return nil, errors.Wrapf(ErrInvalidProof, "path of length %d", length)
+	}
+
+	path := make(PathToLeaf, length)
+	height, size, pinVersion := int8(0), int64(1), version
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(bz) == 0 {
+			return nil, errors.Errorf("decoding path node #%d: unexpected end", i)
+		}
+		flags := bz[0]
+		bz = bz[1:]
+		if flags&^(existenceSiblingLeft|existenceHeightTwo) != 0 {
+			return nil, errors.Errorf("decoding path node #%d: invalid flags %b", i, flags)
+		}
+		siblingSize, n, err := amino.DecodeUvarint(bz)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding path node #%d size", i)
+		}
+		bz = bz[n:]
+		if siblingSize == 0 || siblingSize > uint64(math.MaxInt64-size) {
+			return nil, errors.Errorf("decoding path node #%d: invalid sibling size %d", i, siblingSize)
+		}
+		versionDelta, n, err := amino.DecodeUvarint(bz)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding path node #%d version", i)
+		}
+		bz = bz[n:]
+		if versionDelta > uint64(math.MaxInt64-pinVersion) {
+			return nil, errors.Errorf("decoding path node #%d: invalid version difference %d", i, versionDelta)
+		}
+		if len(bz) < tmhash.Size {
+			return nil, errors.Errorf("decoding path node #%d: unexpected end", i)
+		}
+		sibling := append([]byte{}, bz[:tmhash.Size]...)
+		bz = bz[tmhash.Size:]
+
+		pinHeight := int(height) + 1
+		if flags&existenceHeightTwo != 0 {
+			pinHeight++
+		}
+		if pinHeight > math.MaxInt8 {
+			return nil, errors.Errorf("decoding path node #%d: invalid height %d", i, pinHeight)
+		}
+		height = int8(pinHeight)
+		size += int64(siblingSize)
+		pinVersion += int64(versionDelta)
+		path[i] = proofInnerNode{Height: height, Size: size, Version: pinVersion}
+		if flags&existenceSiblingLeft != 0 {
+			path[i].Left = sibling
+		} else {
+			path[i].Right = sibling
+		}
+	}
+
+	*proof = ExistenceProof{Key: key, Value: value, Version: version, Path: path}
+	return bz, nil
+}
+
+// GetWithExistenceProof gets the value under the key along with a proof of its
+// existence. If the key does not exist, ErrKeyDoesNotExist is returned.
+func (t *ImmutableTree) GetWithExistenceProof(key []byte) (value []byte, proof *ExistenceProof, err error) {
+	if err := t.checkProofSupport(); err != nil {
+		return nil, nil, err
+	}
+	if t.root == nil {
+		return nil, nil, errors.Wrap(ErrKeyDoesNotExist, "tree is empty")
+	}
+	t.root.hashWithCount(t.hashFunc()) // Ensure that all hashes are calculated.
+
+	path, leaf, err := t.root.PathToLeaf(t, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf.value, &ExistenceProof{
+		Key:     leaf.key,
+		Value:   leaf.value,
+		Version: leaf.version,
+		Path:    path,
+	}, nil
+}
+
+// GetVersionedWithExistenceProof gets the value under the key at the specified
+// version along with a proof of its existence, which verifies against the root
+// hash of that version rather than of the working tree. It returns an error
+// wrapping ErrVersionDoesNotExist if the version was never saved or has been
+// deleted, and ErrKeyDoesNotExist if the key is not in the version.
+func (tree *MutableTree) GetVersionedWithExistenceProof(key []byte, version int64) (
+	value []byte, proof *ExistenceProof, err error,
+) {
+	if !tree.versions[version] {
+		return nil, nil, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version)
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.GetWithExistenceProof(key)
+}
+
+// GetByIndexWithProof gets the key and value at the specified index along with
+// a proof of their existence, which can also prove their index with
+// ExistenceProof.VerifyIndex. It returns an error if the index is out of
+// bounds.
+func (t *ImmutableTree) GetByIndexWithProof(index int64) (key, value []byte, proof *ExistenceProof, err error) {
+	if index < 0 || index >= t.Size() {
+		return nil, nil, nil, errors.Errorf("index %d out of bounds for tree of size %d", index, t.Size())
+	}
+	key, _, err = t.GetByIndex(index)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	value, proof, err = t.GetWithExistenceProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, value, proof, nil
+}
@@ -0,0 +1,257 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	amino "github.com/tendermint/go-amino"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestExistenceProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set(randBytes(4), randBytes(8))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set(randBytes(4), randBytes(8))
+	}
+	root := tree.WorkingHash()
+
+	tree.Iterate(func(key, value []byte) bool {
+		proofValue, proof, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		require.Equal(t, value, proofValue)
+		require.NoError(t, proof.Verify(root), proof.String())
+		require.Equal(t, root, proof.ComputeRootHash())
+		require.Error(t, proof.Verify(randBytes(len(root))))
+		return false
+	})
+}
+
+func TestExistenceProofBinary(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 200; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%03d", mrand.Intn(500))), randBytes(mrand.Intn(10)))
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	rootHash := tree.Hash()
+
+	var compactSize, verboseSize int
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		_, proof, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		bz, err := proof.MarshalBinary()
+		require.NoError(t, err)
+		compactSize += len(bz)
+		verboseSize += len(cdc.MustMarshalBinaryLengthPrefixed(proof))
+
+		decoded := &ExistenceProof{}
+		require.NoError(t, decoded.UnmarshalBinary(bz))
+		require.Equal(t, proof.Path, decoded.Path)
+		require.Equal(t, proof.ComputeRootHash(), decoded.ComputeRootHash())
+		require.NoError(t, decoded.Verify(rootHash))
+		require.Equal(t, key, []byte(decoded.Key))
+		require.Equal(t, value, []byte(decoded.Value))
+
+		// Every truncation fails to decode.
+		for i := 0; i < len(bz); i++ {
+			require.Error(t, (&ExistenceProof{}).UnmarshalBinary(bz[:i]))
+		}
+		require.Error(t, (&ExistenceProof{}).UnmarshalBinary(append(bz, 0)))
+
+		// A changed byte either fails to decode or to verify.
+		tampered := append([]byte{}, bz...)
+		tampered[mrand.Intn(len(tampered))] ^= 0x01
+		if err := decoded.UnmarshalBinary(tampered); err == nil {
+			require.Error(t, decoded.Verify(rootHash))
+		}
+		return false
+	})
+	require.NoError(t, err)
+	t.Logf("compact proofs are %d bytes, verbose proofs %d bytes", compactSize, verboseSize)
+	require.True(t, compactSize < verboseSize)
+
+	// Proofs which can't come from a tree can't be encoded.
+	_, _, proof, err := tree.GetByIndexWithProof(0)
+	require.NoError(t, err)
+	proof.Path[len(proof.Path)-1].Height += 2
+	_, err = proof.MarshalBinary()
+	require.Equal(t, ErrInvalidProof, errors.Cause(err))
+
+	// A negative leaf version would let the version differences of the path
+	// overflow, whatever they are.
+	for _, delta := range []uint64{0, 1, 1 << 62, 1 << 63, math.MaxUint64} {
+		var buf bytes.Buffer
+		buf.WriteByte(proofFormatExistence)
+		require.NoError(t, amino.EncodeByteSlice(&buf, []byte("key")))
+		require.NoError(t, amino.EncodeByteSlice(&buf, []byte("value")))
+		require.NoError(t, amino.EncodeVarint(&buf, -1))
+		require.NoError(t, amino.EncodeUvarint(&buf, 1))
+		buf.WriteByte(0)
+		require.NoError(t, amino.EncodeUvarint(&buf, 1))
+		require.NoError(t, amino.EncodeUvarint(&buf, delta))
+		buf.Write(make([]byte, tmhash.Size))
+		err := (&ExistenceProof{}).UnmarshalBinary(buf.Bytes())
+		require.Equal(t, ErrInvalidProof, errors.Cause(err), "version difference %d", delta)
+	}
+}
+
+func TestGetVersionedWithExistenceProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("old"))
+	}
+	oldRoot, oldVersion, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-05"), []byte("new"))
+	newRoot, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-05"), []byte("working"))
+
+	// The old value is proven against the root of its version only.
+	value, proof, err := tree.GetVersionedWithExistenceProof([]byte("key-05"), oldVersion)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), value)
+	require.NoError(t, proof.Verify(oldRoot))
+	require.Error(t, proof.Verify(newRoot))
+	require.Error(t, proof.Verify(tree.WorkingHash()))
+
+	_, _, err = tree.GetVersionedWithExistenceProof([]byte("key-20"), oldVersion)
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+
+	// A deleted version can no longer be proven against.
+	require.NoError(t, tree.DeleteVersion(oldVersion))
+	_, _, err = tree.GetVersionedWithExistenceProof([]byte("key-05"), oldVersion)
+	require.Equal(t, ErrVersionDoesNotExist, errors.Cause(err))
+}
+
+func TestExistenceProofTampered(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		tree.Set([]byte(k), []byte("value_"+k))
+	}
+	root := tree.WorkingHash()
+
+	_, proof, err := tree.GetWithExistenceProof([]byte("d"))
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(root))
+	require.NotEmpty(t, proof.Path)
+
+	// Tamper with a sibling hash.
+	pin := proof.Path[0]
+	saved := pin
+	if len(pin.Left) > 0 {
+		pin.Left = randBytes(len(pin.Left))
+	} else {
+		pin.Right = randBytes(len(pin.Right))
+	}
+	proof.Path[0] = pin
+	require.True(t, errors.Cause(proof.Verify(root)) == ErrInvalidProof)
+	proof.Path[0] = saved
+
+	// Tamper with the sizes.
+	proof.Path[0].Size++
+	require.Error(t, proof.Verify(root))
+	proof.Path[0].Size--
+
+	// Set both children.
+	proof.Path[0].Left, proof.Path[0].Right = randBytes(20), randBytes(20)
+	require.Error(t, proof.Verify(root))
+	proof.Path[0] = saved
+
+	// Tamper with the leaf.
+	proof.Value = []byte("other")
+	require.Error(t, proof.Verify(root))
+	proof.Value = []byte("value_d")
+	proof.Version++
+	require.Error(t, proof.Verify(root))
+	proof.Version--
+	require.NoError(t, proof.Verify(root))
+
+	var nilProof *ExistenceProof
+	require.Error(t, nilProof.Verify(root))
+}
+
+func TestExistenceProofAbsentKey(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	_, _, err := tree.GetWithExistenceProof([]byte("a"))
+	require.True(t, errors.Cause(err) == ErrKeyDoesNotExist)
+
+	tree.Set([]byte("a"), []byte("1"))
+	_, proof, err := tree.GetWithExistenceProof([]byte("a"))
+	require.NoError(t, err)
+	require.Empty(t, proof.Path)
+	require.NoError(t, proof.Verify(tree.WorkingHash()))
+
+	_, proof, err = tree.GetWithExistenceProof([]byte("b"))
+	require.True(t, errors.Cause(err) == ErrKeyDoesNotExist)
+	require.Nil(t, proof)
+}
+
+func TestGetByIndexWithProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	_, _, _, err := tree.GetByIndexWithProof(0)
+	require.Error(t, err)
+
+	for i := 0; i < 100; i++ {
+		tree.Set(randBytes(4), randBytes(8))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.WorkingHash()
+
+	var index int64
+	tree.Iterate(func(key, value []byte) bool {
+		proofKey, proofValue, proof, err := tree.GetByIndexWithProof(index)
+		require.NoError(t, err)
+		require.Equal(t, key, proofKey)
+		require.Equal(t, value, proofValue)
+		require.NoError(t, proof.VerifyIndex(root, index))
+
+		// A different index is rejected.
+		require.True(t, errors.Cause(proof.VerifyIndex(root, index+1)) == ErrInvalidProof)
+		require.Error(t, proof.VerifyIndex(root, index-1))
+		index++
+		return false
+	})
+	require.EqualValues(t, 100, index)
+
+	for _, index := range []int64{-1, 100} {
+		_, _, _, err = tree.GetByIndexWithProof(index)
+		require.Error(t, err)
+	}
+}
+
+func TestVerifyIndexTampered(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		tree.Set([]byte(k), []byte("value_"+k))
+	}
+	root := tree.WorkingHash()
+
+	_, _, proof, err := tree.GetByIndexWithProof(4)
+	require.NoError(t, err)
+	require.Equal(t, "e", string(proof.Key))
+	require.NoError(t, proof.VerifyIndex(root, 4))
+
+	// Changing the sizes along the path to claim another index breaks the
+	// hashes.
+	for i := range proof.Path {
+		proof.Path[i].Size--
+		require.NotEqual(t, int64(4), proof.Path.Index())
+		require.Error(t, proof.VerifyIndex(root, proof.Path.Index()))
+		proof.Path[i].Size++
+	}
+}
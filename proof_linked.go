@@ -0,0 +1,184 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LinkedRangeProof proves the pairs of a range of keys, with nothing skipped,
+// as a chain of existence proofs of consecutive leaves. Each proof commits to
+// the index of its leaf through the sizes of the inner nodes on its path, so
+// leaves at consecutive indexes are adjacent: no key exists between them.
+//
+// The chain is bounded by the leaf before the range, unless the range starts
+// at the first leaf, and the leaf after the pairs, unless they end at the last
+// leaf. If the leaf after the pairs is still in the range, the pairs were
+// truncated by a limit, and Next returns the key to continue from.
+type LinkedRangeProof struct {
+	// Before proves the leaf before the first pair, which is before the range.
+	Before *ExistenceProof `json:"before"`
+	// Leaves prove the pairs, in order.
+	Leaves []*ExistenceProof `json:"leaves"`
+	// After proves the leaf after the last pair, which is the key to continue
+	// from if it is still in the range.
+	After *ExistenceProof `json:"after"`
+}
+
+// String returns a string representation of the proof.
+func (proof *LinkedRangeProof) String() string {
+	if proof == nil {
+		return "<nil-LinkedRangeProof>"
+	}
+	return proof.StringIndented("")
+}
+
+func (proof *LinkedRangeProof) StringIndented(indent string) string {
+	leafString := func(leaf *ExistenceProof, indent string) string {
+		if leaf == nil {
+			return "<nil-ExistenceProof>"
+		}
+		return leaf.StringIndented(indent)
+	}
+	leaves := make([]string, len(proof.Leaves))
+	for i, leaf := range proof.Leaves {
+		leaves[i] = fmt.Sprintf("%v:%v", i, leafString(leaf, indent+"    "))
+	}
+	return fmt.Sprintf(`LinkedRangeProof{
+%s  Before: %v
+%s  Leaves:
+%s    %v
+%s  After:  %v
+%s}`,
+		indent, leafString(proof.Before, indent+"  "),
+		indent,
+		indent, strings.Join(leaves, "\n"+indent+"    "),
+		indent, leafString(proof.After, indent+"  "),
+		indent)
+}
+
+// Next returns the key to continue the range from if the pairs were truncated
+// by a limit, or nil if they are complete. It must only be trusted once the
+// proof is verified for the range.
+func (proof *LinkedRangeProof) Next(end []byte) []byte {
+	if proof.After == nil || (end != nil && bytes.Compare(proof.After.Key, end) >= 0) {
+		return nil
+	}
+	return proof.After.Key
+}
+
+// Verify checks that the proof proves the pairs of the range [start, end) of
+// the tree with the given root hash, where nil bounds are unbounded, with no
+// key skipped: from the first key of the range up to the last key or, if they
+// were truncated, the key returned by Next.
+func (proof *LinkedRangeProof) Verify(rootHash []byte, start, end []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	chain := make([]*ExistenceProof, 0, len(proof.Leaves)+2)
+	if proof.Before != nil {
+		chain = append(chain, proof.Before)
+	}
+	chain = append(chain, proof.Leaves...)
+	if proof.After != nil {
+		chain = append(chain, proof.After)
+	}
+	if len(chain) == 0 {
+		// Only an empty tree has no leaf to prove.
+		if len(rootHash) != 0 {
+			return errors.Wrap(ErrInvalidProof, "no leaves proven for a tree which is not empty")
+		}
+		return nil
+	}
+
+	var size, index int64
+	for i, leaf := range chain {
+		if leaf == nil {
+			return errors.Wrapf(ErrInvalidProof, "leaf #%d is nil", i)
+		}
+		if err := leaf.Verify(rootHash); err != nil {
+			return errors.Wrapf(err, "leaf #%d", i)
+		}
+		leafIndex := leaf.Path.Index()
+		if i == 0 {
+			size = leaf.size()
+		} else if leafIndex != index+1 {
+			return errors.Wrapf(ErrInvalidProof, "leaf #%d at index %d does not follow index %d", i, leafIndex, index)
+		}
+		index = leafIndex
+	}
+
+	if proof.Before == nil {
+		if chain[0].Path.Index() != 0 {
+			return errors.Wrap(ErrInvalidProof, "missing leaf before the range")
+		}
+	} else if start == nil || bytes.Compare(proof.Before.Key, start) >= 0 {
+		return errors.Wrapf(ErrInvalidProof, "key %X before the range is in the range", proof.Before.Key)
+	}
+	if len(proof.Leaves) > 0 {
+		first, last := proof.Leaves[0], proof.Leaves[len(proof.Leaves)-1]
+		if start != nil && bytes.Compare(first.Key, start) < 0 {
+			return errors.Wrapf(ErrInvalidProof, "first key %X before the range", first.Key)
+		}
+		if end != nil && bytes.Compare(last.Key, end) >= 0 {
+			return errors.Wrapf(ErrInvalidProof, "last key %X after the range", last.Key)
+		}
+	}
+	if proof.After == nil && index != size-1 {
+		return errors.Wrap(ErrInvalidProof, "missing leaf after the range")
+	}
+	if proof.After != nil && len(proof.Leaves) == 0 && proof.Next(end) != nil {
+		return errors.Wrapf(ErrInvalidProof, "key %X after the range is in the range", proof.After.Key)
+	}
+	return nil
+}
+
+// size returns the number of leaves of the tree the proof is from.
+func (proof *ExistenceProof) size() int64 {
+	if len(proof.Path) == 0 {
+		return 1
+	}
+	return proof.Path[0].Size
+}
+
+// IterateRangeWithProof gets the pairs of the range [start, end), where nil
+// bounds are unbounded, up to limit pairs if limit is positive, along with a
+// proof that no key of the range was skipped. If the pairs were truncated by
+// the limit, the proof's Next returns the start of the rest of the range.
+func (t *ImmutableTree) IterateRangeWithProof(start, end []byte, limit int) (*LinkedRangeProof, error) {
+	if err := t.checkProofSupport(); err != nil {
+		return nil, err
+	}
+	proof := &LinkedRangeProof{}
+	size := t.Size()
+	if size == 0 {
+		return proof, nil
+	}
+
+	var index int64
+	var err error
+	if start != nil {
+		if index, _, err = t.Get(start); err != nil {
+			return nil, err
+		}
+	}
+	if index > 0 {
+		if _, _, proof.Before, err = t.GetByIndexWithProof(index - 1); err != nil {
+			return nil, err
+		}
+	}
+	for ; index < size; index++ {
+		_, _, leaf, err := t.GetByIndexWithProof(index)
+		if err != nil {
+			return nil, err
+		}
+		if (end != nil && bytes.Compare(leaf.Key, end) >= 0) || (limit > 0 && len(proof.Leaves) == limit) {
+			proof.After = leaf
+			break
+		}
+		proof.Leaves = append(proof.Leaves, leaf)
+	}
+	return proof, nil
+}
@@ -0,0 +1,102 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestLinkedRangeProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", 2*i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	ranges := [][2][]byte{
+		{nil, nil},
+		{key(10), key(50)},
+		{key(11), key(51)},
+		{nil, key(7)},
+		{key(150), nil},
+		{key(41), key(42)},
+		{[]byte("a"), []byte("b")},
+		{[]byte("z"), nil},
+	}
+	for _, r := range ranges {
+		start, end := r[0], r[1]
+		var expected [][]byte
+		_, err := tree.IterateRange(start, end, true, func(key, value []byte) bool {
+			expected = append(expected, key)
+			return false
+		})
+		require.NoError(t, err)
+
+		for _, limit := range []int{0, 1, 7} {
+			// Following the continuation keys gets the whole range.
+			var keys [][]byte
+			from := start
+			for {
+				proof, err := tree.IterateRangeWithProof(from, end, limit)
+				require.NoError(t, err)
+				require.NoError(t, proof.Verify(root, from, end), "[%s, %s) limit %d", from, end, limit)
+				if limit > 0 {
+					require.True(t, len(proof.Leaves) <= limit)
+				}
+				for _, leaf := range proof.Leaves {
+					keys = append(keys, leaf.Key)
+				}
+				if from = proof.Next(end); from == nil {
+					break
+				}
+			}
+			require.Equal(t, expected, keys, "[%s, %s) limit %d", start, end, limit)
+		}
+	}
+
+	// A proof with a skipped key, or a missing bound, fails.
+	proof, err := tree.IterateRangeWithProof(key(10), key(50), 0)
+	require.NoError(t, err)
+	require.Len(t, proof.Leaves, 20)
+	verify := func(tampered LinkedRangeProof) error {
+		return tampered.Verify(root, key(10), key(50))
+	}
+	skipped := *proof
+	skipped.Leaves = append(append([]*ExistenceProof{}, proof.Leaves[:5]...), proof.Leaves[6:]...)
+	require.Equal(t, ErrInvalidProof, errors.Cause(verify(skipped)))
+	first := *proof
+	first.Leaves = proof.Leaves[1:]
+	require.Equal(t, ErrInvalidProof, errors.Cause(verify(first)))
+	last := *proof
+	last.Leaves = proof.Leaves[:len(proof.Leaves)-1]
+	require.Equal(t, ErrInvalidProof, errors.Cause(verify(last)))
+	noBefore := *proof
+	noBefore.Before = nil
+	require.Equal(t, ErrInvalidProof, errors.Cause(verify(noBefore)))
+	noAfter := *proof
+	noAfter.After = nil
+	require.Equal(t, ErrInvalidProof, errors.Cause(verify(noAfter)))
+	require.Error(t, proof.Verify(root, key(8), key(50)))
+	require.Error(t, proof.Verify(root, key(10), key(48)))
+	require.Error(t, proof.Verify(randBytes(len(root)), key(10), key(50)))
+
+	// A truncated proof can't pass for a complete one without its last leaf.
+	truncated, err := tree.IterateRangeWithProof(key(10), key(50), 5)
+	require.NoError(t, err)
+	require.Equal(t, key(20), truncated.Next(key(50)))
+	truncated.After = nil
+	require.Error(t, truncated.Verify(root, key(10), key(50)))
+
+	// The empty tree has no leaves.
+	empty := NewMutableTree(db.NewMemDB(), 0)
+	proof, err = empty.IterateRangeWithProof(nil, nil, 0)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(empty.Hash(), nil, nil))
+	require.Error(t, proof.Verify(root, nil, nil))
+}
@@ -0,0 +1,208 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	cmn "github.com/tendermint/iavl/common"
+)
+
+// MultiProof proves that several keys are set to their values in the tree
+// with a given root hash. It holds the part of the tree made of the paths to
+// their leaves, so the inner nodes the paths share, and the sibling hashes
+// along them, appear once instead of once per key as with ExistenceProof.
+type MultiProof struct {
+	// Nodes are the nodes of the part of the tree, in pre-order: an inner
+	// node is followed by its left and then its right subtree.
+	Nodes []multiProofNode `json:"nodes"`
+}
+
+// multiProofNode is one of:
+//   - a subtree without any of the keys, of which only the Hash is known,
+//   - a leaf of one of the keys, with Height 0, the Key and its Version,
+//   - an inner node, with its Height, Size and Version.
+type multiProofNode struct {
+	Height  int8         `json:"height"`
+	Size    int64        `json:"size"`
+	Version int64        `json:"version"`
+	Key     cmn.HexBytes `json:"key"`
+	Hash    cmn.HexBytes `json:"hash"`
+}
+
+func (mpn multiProofNode) String() string {
+	switch {
+	case len(mpn.Hash) > 0:
+		return fmt.Sprintf("Hash %X", mpn.Hash)
+	case mpn.Height == 0:
+		return fmt.Sprintf("Leaf %X@%d", mpn.Key, mpn.Version)
+	default:
+		return fmt.Sprintf("Inner height %d size %d @%d", mpn.Height, mpn.Size, mpn.Version)
+	}
+}
+
+// String returns a string representation of the proof.
+func (proof *MultiProof) String() string {
+	if proof == nil {
+		return "<nil-MultiProof>"
+	}
+	return proof.StringIndented("")
+}
+
+func (proof *MultiProof) StringIndented(indent string) string {
+	strs := make([]string, len(proof.Nodes))
+	for i, node := range proof.Nodes {
+		strs[i] = fmt.Sprintf("%v:%v", i, node)
+	}
+	return fmt.Sprintf(`MultiProof{
+%s  %v
+%s}`,
+		indent, strings.Join(strs, "\n"+indent+"  "),
+		indent)
+}
+
+// Verify checks that the proof proves exactly the given pairs, keyed by the
+// string of their key, in the tree with the given root hash.
+func (proof *MultiProof) Verify(rootHash []byte, kvs map[string][]byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	v := multiProofVerifier{nodes: proof.Nodes, kvs: kvs, proven: make(map[string]bool, len(kvs))}
+	hash, err := v.hash(maxPathLen)
+	if err != nil {
+		return err
+	}
+	if len(v.nodes) > 0 {
+		return errors.Wrapf(ErrInvalidProof, "%d nodes left over", len(v.nodes))
+	}
+	if len(v.proven) != len(kvs) {
+		return errors.Wrapf(ErrInvalidProof, "proves %d of %d keys", len(v.proven), len(kvs))
+	}
+	if !bytes.Equal(rootHash, hash) {
+		return errors.Wrap(ErrInvalidRoot, "root hash doesn't match")
+	}
+	return nil
+}
+
+// multiProofVerifier consumes the nodes of a MultiProof, hashing them back up.
+type multiProofVerifier struct {
+	nodes  []multiProofNode
+	kvs    map[string][]byte
+	proven map[string]bool
+}
+
+// hash consumes the next subtree and returns its hash. Its height must be less
+// than maxHeight, which bounds the recursion for malformed proofs.
+func (v *multiProofVerifier) hash(maxHeight int) ([]byte, error) {
+	if len(v.nodes) == 0 {
+		return nil, errors.Wrap(ErrInvalidProof, "missing nodes")
+	}
+	node := v.nodes[0]
+	v.nodes = v.nodes[1:]
+	if int(node.Height) >= maxHeight || node.Height < 0 {
+		return nil, errors.Wrapf(ErrInvalidProof, "invalid height %d", node.Height)
+	}
+
+	switch {
+	case len(node.Hash) > 0:
+		return node.Hash, nil
+
+	case node.Height == 0:
+		value, ok := v.kvs[string(node.Key)]
+		if !ok {
+			return nil, errors.Wrapf(ErrInvalidProof, "unexpected leaf %X", node.Key)
+		}
+		if v.proven[string(node.Key)] {
+			return nil, errors.Wrapf(ErrInvalidProof, "duplicate leaf %X", node.Key)
+		}
+		v.proven[string(node.Key)] = true
+		return proofLeafNode{
+			Key:       node.Key,
+			ValueHash: valueHash(value),
+			Version:   node.Version,
+		}.Hash(), nil
+
+	default:
+		left, err := v.hash(int(node.Height))
+		if err != nil {
+			return nil, err
+		}
+		right, err := v.hash(int(node.Height))
+		if err != nil {
+			return nil, err
+		}
+		return proofInnerNode{
+			Height:  node.Height,
+			Size:    node.Size,
+			Version: node.Version,
+			Left:    left,
+		}.Hash(right), nil
+	}
+}
+
+// GetWithMultiProof gets the values under the keys, in the same order, along
+// with a single proof of their existence. If one of the keys does not exist,
+// ErrKeyDoesNotExist is returned.
+func (t *ImmutableTree) GetWithMultiProof(keys [][]byte) (values [][]byte, proof *MultiProof, err error) {
+	if err := t.checkProofSupport(); err != nil {
+		return nil, nil, err
+	}
+	if t.root == nil {
+		return nil, nil, errors.Wrap(ErrKeyDoesNotExist, "tree is empty")
+	}
+	t.root.hashWithCount(t.hashFunc()) // Ensure that all hashes are calculated.
+
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	unique := sorted[:0]
+	for i, key := range sorted {
+		if i == 0 || !bytes.Equal(key, sorted[i-1]) {
+			unique = append(unique, key)
+		}
+	}
+
+	proof = &MultiProof{}
+	found := make(map[string][]byte, len(unique))
+	if err := t.root.appendMultiProof(t, unique, &proof.Nodes, found); err != nil {
+		return nil, nil, err
+	}
+	values = make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = found[string(key)]
+	}
+	return values, proof, nil
+}
+
+// appendMultiProof appends the nodes proving the sorted keys in the subtree to
+// nodes, and adds the values of the keys to found.
+func (node *Node) appendMultiProof(t *ImmutableTree, keys [][]byte, nodes *[]multiProofNode, found map[string][]byte) error {
+	if len(keys) == 0 {
+		*nodes = append(*nodes, multiProofNode{Hash: node.hash})
+		return nil
+	}
+	if node.isLeaf() {
+		for _, key := range keys {
+			if !bytes.Equal(key, node.key) {
+				return errors.Wrapf(ErrKeyDoesNotExist, "key %X", key)
+			}
+		}
+		*nodes = append(*nodes, multiProofNode{Key: node.key, Version: node.version})
+		found[string(node.key)] = node.value
+		return nil
+	}
+
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return err
+	}
+	*nodes = append(*nodes, multiProofNode{Height: node.height, Size: node.size, Version: node.version})
+	split := sort.Search(len(keys), func(i int) bool { return bytes.Compare(keys[i], node.key) >= 0 })
+	if err := left.appendMultiProof(t, keys[:split], nodes, found); err != nil {
+		return err
+	}
+	return right.appendMultiProof(t, keys[split:], nodes, found)
+}
@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMultiProof(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%04d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("key-0500"), []byte("working"))
+	root := tree.WorkingHash()
+
+	var keys [][]byte
+	kvs := map[string][]byte{}
+	singleSize := 0
+	for i := 0; i < 1000; i += 50 {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		keys = append(keys, key)
+		value, proof, err := tree.GetWithExistenceProof(key)
+		require.NoError(t, err)
+		kvs[string(key)] = value
+		singleSize += len(cdc.MustMarshalBinaryLengthPrefixed(proof))
+	}
+	// Duplicate keys are proven once.
+	keys = append(keys, keys[0])
+
+	values, proof, err := tree.GetWithMultiProof(keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+	for i, key := range keys {
+		require.Equal(t, kvs[string(key)], values[i])
+	}
+	require.NoError(t, proof.Verify(root, kvs), proof.String())
+
+	// The shared inner nodes and sibling hashes are only in the proof once.
+	multiSize := len(cdc.MustMarshalBinaryLengthPrefixed(proof))
+	require.True(t, multiSize < singleSize, "multiproof of %d bytes, single proofs of %d bytes", multiSize, singleSize)
+
+	// Any difference in the pairs or the root fails.
+	require.Error(t, proof.Verify(randBytes(len(root)), kvs))
+	tampered := map[string][]byte{}
+	for k, v := range kvs {
+		tampered[k] = v
+	}
+	tampered["key-0500"] = []byte("value-500")
+	require.Error(t, proof.Verify(root, tampered))
+	tampered["key-0500"] = []byte("working")
+	tampered["key-0001"] = []byte("value-1")
+	require.Error(t, proof.Verify(root, tampered))
+	delete(tampered, "key-0001")
+	delete(tampered, "key-0000")
+	require.Error(t, proof.Verify(root, tampered))
+
+	// A proof of no keys is the root hash.
+	_, proof, err = tree.GetWithMultiProof(nil)
+	require.NoError(t, err)
+	require.Len(t, proof.Nodes, 1)
+	require.NoError(t, proof.Verify(root, nil))
+
+	_, _, err = tree.GetWithMultiProof([][]byte{[]byte("key-0000"), []byte("key-00005")})
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+}
+
+func TestMultiProofMalformed(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	kvs := map[string][]byte{}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		tree.Set([]byte(k), []byte("value_"+k))
+		kvs[k] = []byte("value_" + k)
+	}
+	root := tree.WorkingHash()
+	keys := [][]byte{[]byte("b"), []byte("e")}
+	_, proof, err := tree.GetWithMultiProof(keys)
+	require.NoError(t, err)
+	proven := map[string][]byte{"b": kvs["b"], "e": kvs["e"]}
+	require.NoError(t, proof.Verify(root, proven))
+
+	nodes := proof.Nodes
+	for name, malformed := range map[string][]multiProofNode{
+		"truncated": nodes[:len(nodes)-1],
+		"extra":     append(append([]multiProofNode{}, nodes...), multiProofNode{Hash: root}),
+		"height":    append([]multiProofNode{{Height: 127, Size: 7}}, nodes[1:]...),
+	} {
+		err := (&MultiProof{Nodes: malformed}).Verify(root, proven)
+		require.Error(t, err, name)
+	}
+	require.Error(t, (*MultiProof)(nil).Verify(root, proven))
+}
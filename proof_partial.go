@@ -0,0 +1,47 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// PartialProof proves that a key is set to a value in a subtree of which the
+// root hash, the anchor, is already trusted, e.g. cached by a client from an
+// earlier proof. Its Path only goes from the parent of the leaf up to the
+// anchor, so it is shorter than a proof up to the root the deeper the anchor.
+type PartialProof struct {
+	ExistenceProof
+}
+
+// Verify checks that the leaf holding the proof's key and value merkle-izes
+// through Path to the given anchor hash. It can't tell where the anchor is in
+// the tree, so the anchor must be trusted on its own.
+func (proof *PartialProof) Verify(anchorHash []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	return proof.ExistenceProof.Verify(anchorHash)
+}
+
+// GetProofFromAnchor gets a proof that the key is set to its value, up to the
+// node with the anchor hash rather than the root. The anchor must be on the
+// path from the root to the leaf of the key, the leaf included, or an error is
+// returned, as it is if the key does not exist.
+func (t *ImmutableTree) GetProofFromAnchor(key []byte, anchorHash []byte) (*PartialProof, error) {
+	_, proof, err := t.GetWithExistenceProof(key)
+	if err != nil {
+		return nil, err
+	}
+	hashes, _, err := t.Path(key)
+	if err != nil {
+		return nil, err
+	}
+	for depth, hash := range hashes {
+		if bytes.Equal(hash, anchorHash) {
+			proof.Path = proof.Path[depth:]
+			return &PartialProof{ExistenceProof: *proof}, nil
+		}
+	}
+	return nil, errors.Errorf("anchor %X is not on the path of key %X", anchorHash, key)
+}
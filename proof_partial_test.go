@@ -0,0 +1,53 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestGetProofFromAnchor(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	for _, i := range []int{0, 123, 250, 499} {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		hashes, found, err := tree.Path(key)
+		require.NoError(t, err)
+		require.True(t, found)
+
+		// Each anchor on the path, from the root down to the leaf, gets a
+		// proof of the remaining path below it.
+		for depth, anchor := range hashes {
+			proof, err := tree.GetProofFromAnchor(key, anchor)
+			require.NoError(t, err)
+			require.Equal(t, key, []byte(proof.Key))
+			require.Equal(t, fmt.Sprintf("value-%d", i), string(proof.Value))
+			require.Len(t, proof.Path, len(hashes)-1-depth)
+			require.NoError(t, proof.Verify(anchor), "%s depth %d", key, depth)
+
+			// A wrong anchor fails.
+			if depth > 0 {
+				require.Equal(t, ErrInvalidProof, errors.Cause(proof.Verify(root)))
+				require.Equal(t, ErrInvalidProof, errors.Cause(proof.Verify(hashes[depth-1])))
+			}
+			require.Equal(t, ErrInvalidProof, errors.Cause(proof.Verify(randBytes(len(root)))))
+		}
+	}
+
+	// An anchor off the path of the key, or a missing key, fail.
+	other, _, err := tree.Path([]byte("key-499"))
+	require.NoError(t, err)
+	_, err = tree.GetProofFromAnchor([]byte("key-000"), other[len(other)-1])
+	require.Error(t, err)
+	_, err = tree.GetProofFromAnchor([]byte("missing"), root)
+	require.Equal(t, ErrKeyDoesNotExist, errors.Cause(err))
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
 )
 
 // pathWithLeaf is a path to a leaf node and the leaf node itself.
@@ -46,8 +47,8 @@ func (pwl pathWithLeaf) computeRootHash() []byte {
 //----------------------------------------
 
 // PathToLeaf represents an inner path to a leaf node.
-// Note that the nodes are ordered such that the last one is closest
-// to the root of the tree.
+// Note that the nodes are ordered such that the first one is the root of the
+// tree, and the last one is the parent of the leaf.
 type PathToLeaf []proofInnerNode
 
 func (pl PathToLeaf) String() string {
@@ -148,7 +149,11 @@ func (pl PathToLeaf) isLeftAdjacentTo(pl2 PathToLeaf) bool {
 	return pl.isRightmost() && pl2.isLeftmost()
 }
 
-// returns -1 if invalid.
+// Index returns the index of the leaf, or -1 if invalid. Each node on the path
+// commits to its own size in its hash, so the size of the left subtree of a
+// node is its size less the size of the next node on the path, and the index
+// can be verified from the hashes alone, without committing to the sizes of
+// both children.
 func (pl PathToLeaf) Index() (idx int64) {
 	for i, node := range pl {
 		if node.Left == nil {
@@ -165,3 +170,39 @@ func (pl PathToLeaf) Index() (idx int64) {
 	}
 	return idx
 }
+
+// encode writes the length of the path, then its nodes from the root down.
+func (pl PathToLeaf) encode(buf *bytes.Buffer) error {
+	if err := amino.EncodeUvarint(buf, uint64(len(pl))); err != nil {
+		return err
+	}
+	for _, pin := range pl {
+		if err := pin.encode(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePathToLeaf decodes a path written by encode, and returns the bytes
+// which follow it.
+func decodePathToLeaf(bz []byte) (pl PathToLeaf, rest []byte, err error) {
+	length, n, err := amino.DecodeUvarint(bz)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "decoding path length")
+	}
+	bz = bz[n:]
+	if length > maxPathLen {
+		return nil, nil, errors.Wrapf(ErrInvalidProof, "path of length %d", length)
+	}
+	if length == 0 {
+		return nil, bz, nil
+	}
+	pl = make(PathToLeaf, length)
+	for i := range pl {
+		if pl[i], bz, err = decodeProofInnerNode(bz); err != nil {
+			return nil, nil, errors.Wrapf(err, "decoding path node #%d", i)
+		}
+	}
+	return pl, bz, nil
+}
@@ -7,8 +7,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
-
-	"github.com/tendermint/tendermint/crypto/tmhash"
+	amino "github.com/tendermint/go-amino"
 )
 
 type RangeProof struct {
@@ -25,6 +24,90 @@ type RangeProof struct {
 
 }
 
+// MarshalBinary encodes the proof for light clients. It holds the format byte
+// proofFormatRange, then the left path, the number of inner paths followed by
+// each of them, and the number of leaves followed by each of them. A path is
+// its length followed by its inner nodes from the root down, each its height,
+// size and version, then its left and right hashes, the one of the child on
+// the path empty. A leaf is its key and value hash, then its version.
+func (proof *RangeProof) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(proofFormatRange)
+	if err := proof.LeftPath.encode(&buf); err != nil {
+		return nil, err
+	}
+	if err := amino.EncodeUvarint(&buf, uint64(len(proof.InnerNodes))); err != nil {
+		return nil, err
+	}
+	for _, path := range proof.InnerNodes {
+		if err := path.encode(&buf); err != nil {
+			return nil, err
+		}
+	}
+	if err := amino.EncodeUvarint(&buf, uint64(len(proof.Leaves))); err != nil {
+		return nil, err
+	}
+	for _, leaf := range proof.Leaves {
+		if err := leaf.encode(&buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a proof encoded by MarshalBinary. The proof has to
+// be verified again.
+func (proof *RangeProof) UnmarshalBinary(bz []byte) error {
+	if err := checkProofFormat(bz, proofFormatRange); err != nil {
+		return err
+	}
+	leftPath, bz, err := decodePathToLeaf(bz[1:])
+	if err != nil {
+		return errors.Wrap(err, "decoding left path")
+	}
+	// Each path and leaf takes at least a byte, which bounds their counts
+	// before anything is allocated for them.
+	count, n, err := amino.DecodeUvarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding inner path count")
+	}
+	bz = bz[n:]
+	if count > uint64(len(bz)) {
+		return errors.Errorf("decoding proof: %d inner paths in %d bytes", count, len(bz))
+	}
+	var innerNodes []PathToLeaf
+	if count > 0 {
+		innerNodes = make([]PathToLeaf, count)
+	}
+	for i := range innerNodes {
+		if innerNodes[i], bz, err = decodePathToLeaf(bz); err != nil {
+			return errors.Wrapf(err, "decoding inner path #%d", i)
+		}
+	}
+	if count, n, err = amino.DecodeUvarint(bz); err != nil {
+		return errors.Wrap(err, "decoding leaf count")
+	}
+	bz = bz[n:]
+	if count > uint64(len(bz)) {
+		return errors.Errorf("decoding proof: %d leaves in %d bytes", count, len(bz))
+	}
+	var leaves []proofLeafNode
+	if count > 0 {
+		leaves = make([]proofLeafNode, count)
+	}
+	for i := range leaves {
+		if leaves[i], bz, err = decodeProofLeafNode(bz); err != nil {
+			return errors.Wrapf(err, "decoding leaf #%d", i)
+		}
+	}
+	if len(bz) > 0 {
+		return errors.Errorf("decoding proof: %d bytes left over", len(bz))
+	}
+
+	*proof = RangeProof{LeftPath: leftPath, InnerNodes: innerNodes, Leaves: leaves}
+	return nil
+}
+
 // Keys returns all the keys in the RangeProof.  NOTE: The keys here may
 // include more keys than provided by tree.GetRangeWithProof or
 // MutableTree.GetVersionedRangeWithProof.  The keys returned there are only
@@ -106,8 +189,7 @@ func (proof *RangeProof) VerifyItem(key, value []byte) error {
 	if i >= len(leaves) || !bytes.Equal(leaves[i].Key, key) {
 		return errors.Wrap(ErrInvalidProof, "leaf key not found in proof")
 	}
-	valueHash := tmhash.Sum(value)
-	if !bytes.Equal(leaves[i].ValueHash, valueHash) {
+	if !bytes.Equal(leaves[i].ValueHash, valueHash(value)) {
 		return errors.Wrap(ErrInvalidProof, "leaf value hash not same")
 	}
 	return nil
@@ -318,17 +400,22 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 	if limit < 0 {
 		panic("limit must be greater or equal to 0 -- 0 means no limit")
 	}
+	if err := t.checkProofSupport(); err != nil {
+		return nil, nil, nil, err
+	}
 	if t.root == nil {
 		return nil, nil, nil, nil
 	}
-	t.root.hashWithCount() // Ensure that all hashes are calculated.
+	t.root.hashWithCount(t.hashFunc()) // Ensure that all hashes are calculated.
 
 	// Get the first key/value pair proof, which provides us with the left key.
 	path, left, err := t.root.PathToLeaf(t, keyStart)
-	if err != nil {
+	if err == ErrKeyDoesNotExist {
 		// Key doesn't exist, but instead we got the prev leaf (or the
 		// first or last leaf), which provides proof of absence).
 		err = nil
+	} else if err != nil {
+		return nil, nil, nil, err
 	}
 	startOK := keyStart == nil || bytes.Compare(keyStart, left.key) <= 0
 	endOK := keyEnd == nil || bytes.Compare(left.key, keyEnd) < 0
@@ -341,7 +428,7 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 	var leaves = []proofLeafNode{
 		{
 			Key:       left.key,
-			ValueHash: tmhash.Sum(left.value),
+			ValueHash: valueHash(left.value),
 			Version:   left.version,
 		},
 	}
@@ -372,7 +459,7 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 	var pathCount = 0
 	// var keys, values [][]byte defined as function outs.
 
-	t.root.traverseInRange(t, afterLeft, nil, true, false, 0,
+	_, err = t.root.traverseInRange(t, afterLeft, nil, true, false, 0,
 		func(node *Node, depth uint8) (stop bool) {
 
 			// Track when we diverge from path, or when we've exhausted path,
@@ -403,7 +490,7 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 				// Append leaf to leaves.
 				leaves = append(leaves, proofLeafNode{
 					Key:       node.key,
-					ValueHash: tmhash.Sum(node.value),
+					ValueHash: valueHash(node.value),
 					Version:   node.version,
 				})
 				leafCount++
@@ -440,6 +527,9 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 			return false
 		},
 	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	return &RangeProof{
 		LeftPath:   path,
@@ -464,6 +554,9 @@ func (t *ImmutableTree) GetWithProof(key []byte) (value []byte, proof *RangeProo
 }
 
 // GetRangeWithProof gets key/value pairs within the specified range and limit.
+// The proof also holds the leaves just outside the range, if any, so that it
+// proves that no key in range was left out. When the limit is reached, the last
+// leaf of the proof is the key to continue from, and is not returned.
 func (t *ImmutableTree) GetRangeWithProof(startKey []byte, endKey []byte, limit int) (keys, values [][]byte, proof *RangeProof, err error) {
 	proof, keys, values, err = t.getRangeProof(startKey, endKey, limit)
 	return
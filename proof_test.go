@@ -3,6 +3,9 @@ package iavl
 
 import (
 	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -113,6 +116,78 @@ func TestTreeKeyExistsProof(t *testing.T) {
 	// TODO: Test with single value in tree.
 }
 
+func TestRangeProofBinary(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(2 * i)}, randBytes(8))
+	}
+	root := tree.WorkingHash()
+
+	for _, r := range [][2][]byte{{nil, nil}, {{10}, {50}}, {{11}, {13}}, {{250}, nil}} {
+		_, _, proof, err := tree.GetRangeWithProof(r[0], r[1], 0)
+		require.NoError(t, err)
+		bz, err := proof.MarshalBinary()
+		require.NoError(t, err)
+		decoded := &RangeProof{}
+		require.NoError(t, decoded.UnmarshalBinary(bz))
+		require.Equal(t, proof.LeftPath, decoded.LeftPath)
+		require.Equal(t, proof.InnerNodes, decoded.InnerNodes)
+		require.Equal(t, proof.Leaves, decoded.Leaves)
+		require.NoError(t, decoded.Verify(root))
+		require.Equal(t, proof.Keys(), decoded.Keys())
+
+		for i := 0; i < len(bz); i++ {
+			require.Error(t, (&RangeProof{}).UnmarshalBinary(bz[:i]))
+		}
+		require.Error(t, (&RangeProof{}).UnmarshalBinary(append(bz, 0)))
+		require.Error(t, (&AbsenceProof{}).UnmarshalBinary(bz))
+	}
+}
+
+// TestProofBinaryGolden pins the binary layouts of proofs, which parsers in
+// other languages depend on. A change to a layout needs a new format byte.
+func TestProofBinaryGolden(t *testing.T) {
+	hash := func(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+	existence := &ExistenceProof{
+		Key:     []byte("key"),
+		Value:   []byte("value"),
+		Version: 3,
+		Path: PathToLeaf{
+			{Height: 2, Size: 4, Version: 5, Left: hash(0xbb)},
+			{Height: 1, Size: 2, Version: 3, Right: hash(0xaa)},
+		},
+	}
+	absence := &AbsenceProof{Right: existence}
+	rng := &RangeProof{
+		LeftPath:   PathToLeaf{{Height: 1, Size: 2, Version: 3, Right: hash(0xaa)}},
+		InnerNodes: []PathToLeaf{{}},
+		Leaves: []proofLeafNode{
+			{Key: []byte("a"), ValueHash: hash(0xcc), Version: 3},
+			{Key: []byte("b"), ValueHash: hash(0xdd), Version: 1},
+		},
+	}
+
+	for _, c := range []struct {
+		proof    interface{ MarshalBinary() ([]byte, error) }
+		expected string
+	}{
+		{existence, "01" + "036b6579" + "0576616c7565" + "06" + "02" +
+			"00" + "01" + "00" + strings.Repeat("aa", 32) +
+			"01" + "02" + "02" + strings.Repeat("bb", 32)},
+		{absence, "02" + "02" + "036b6579" + "0576616c7565" + "06" + "02" +
+			"00" + "01" + "00" + strings.Repeat("aa", 32) +
+			"01" + "02" + "02" + strings.Repeat("bb", 32)},
+		{rng, "03" + "01" + "02" + "04" + "06" + "00" + "20" + strings.Repeat("aa", 32) +
+			"01" + "00" +
+			"02" + "0161" + "20" + strings.Repeat("cc", 32) + "06" +
+			"0162" + "20" + strings.Repeat("dd", 32) + "02"},
+	} {
+		bz, err := c.proof.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, c.expected, hex.EncodeToString(bz), "%T", c.proof)
+	}
+}
+
 func TestTreeKeyInRangeProofs(t *testing.T) {
 	tree := NewMutableTree(db.NewMemDB(), 0)
 	require := require.New(t)
@@ -203,6 +278,69 @@ func TestTreeKeyInRangeProofs(t *testing.T) {
 	}
 }
 
+func TestTreeRangeProofLimit(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		tree.Set(key, key)
+	}
+	root := tree.WorkingHash()
+
+	keys, values, proof, err := tree.GetRangeWithProof([]byte("key-010"), []byte("key-090"), 7)
+	require.NoError(err)
+	// The limit bounds the leaves of the proof, the last of which is the
+	// key to continue from rather than a returned item.
+	require.Len(keys, 6)
+	require.Equal(keys, values)
+	require.Equal([]byte("key-010"), keys[0])
+	require.Equal([]byte("key-015"), keys[5])
+	require.Len(proof.Keys(), 7)
+	require.Equal([]byte("key-016"), proof.Keys()[6])
+	require.EqualValues(10, proof.LeftIndex())
+	require.NoError(proof.Verify(root))
+	for _, key := range proof.Keys() {
+		require.NoError(proof.VerifyItem(key, key))
+	}
+	// Keys past the limit are not proven.
+	require.Error(proof.VerifyItem([]byte("key-017"), []byte("key-017")))
+}
+
+func TestTreeRangeProofDroppedLeaf(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require := require.New(t)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		tree.Set(key, key)
+	}
+	root := tree.WorkingHash()
+
+	keys, _, proof, err := tree.GetRangeWithProof([]byte("key-020"), []byte("key-040"), 0)
+	require.NoError(err)
+	require.Len(keys, 20)
+	require.NoError(proof.Verify(root))
+
+	// Dropping any leaf but the first and the last, along with any one of
+	// the inner paths, must not verify: the leaves left can't account for the
+	// hashes of their ancestors.
+	for i := 1; i < len(proof.Leaves)-1; i++ {
+		for j := range proof.InnerNodes {
+			bad := &RangeProof{
+				LeftPath:   proof.LeftPath,
+				InnerNodes: append(append([]PathToLeaf(nil), proof.InnerNodes[:j]...), proof.InnerNodes[j+1:]...),
+				Leaves:     append(append([]proofLeafNode(nil), proof.Leaves[:i]...), proof.Leaves[i+1:]...),
+			}
+			require.Error(bad.Verify(root), "dropped leaf %d and inner path %d", i, j)
+		}
+	}
+
+	// Nor must swapping two adjacent leaves.
+	leaves := append([]proofLeafNode(nil), proof.Leaves...)
+	leaves[5], leaves[6] = leaves[6], leaves[5]
+	bad := &RangeProof{LeftPath: proof.LeftPath, InnerNodes: proof.InnerNodes, Leaves: leaves}
+	require.Error(bad.Verify(root))
+}
+
 func verifyProof(t *testing.T, proof *RangeProof, root []byte) {
 	// Proof must verify.
 	require.NoError(t, proof.Verify(root))
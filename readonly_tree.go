@@ -0,0 +1,102 @@
+package iavl
+
+// ReadOnlyTree is a snapshot of a tree which only exposes reads, to share a
+// tree without letting callers change it, and to document that intent.
+//
+// It holds the root the tree had when it was taken, so it keeps reading the
+// same keys while the tree it was taken from changes. Its nodes are all
+// hashed when it is taken, so its reads, proofs included, don't modify them
+// and may run concurrently. A snapshot of a saved version, e.g. from
+// MutableTree.GetImmutable, is independent of the MutableTree; one of a
+// working tree must not be read while the MutableTree saves a version, which
+// detaches the saved nodes from their children.
+type ReadOnlyTree struct {
+	tree *ImmutableTree
+}
+
+// ReadOnly returns a read-only snapshot of the tree.
+func (t *ImmutableTree) ReadOnly() *ReadOnlyTree {
+	tree := &ImmutableTree{
+		root:    t.loadRoot(),
+		ndb:     t.ndb,
+		version: t.version,
+	}
+	tree.Hash()
+	return &ReadOnlyTree{tree: tree}
+}
+
+// Size returns the number of leaf nodes in the tree, see ImmutableTree.Size.
+func (rt *ReadOnlyTree) Size() int64 {
+	return rt.tree.Size()
+}
+
+// Height returns the height of the tree, see ImmutableTree.Height.
+func (rt *ReadOnlyTree) Height() int8 {
+	return rt.tree.Height()
+}
+
+// Version returns the version of the tree, see ImmutableTree.Version.
+func (rt *ReadOnlyTree) Version() int64 {
+	return rt.tree.Version()
+}
+
+// Hash returns the root hash of the tree, see ImmutableTree.Hash.
+func (rt *ReadOnlyTree) Hash() []byte {
+	return rt.tree.Hash()
+}
+
+// Has returns whether the key is in the tree, see ImmutableTree.Has.
+func (rt *ReadOnlyTree) Has(key []byte) (bool, error) {
+	return rt.tree.Has(key)
+}
+
+// Get returns the index and value of the key, see ImmutableTree.Get.
+func (rt *ReadOnlyTree) Get(key []byte) (index int64, value []byte, err error) {
+	return rt.tree.Get(key)
+}
+
+// GetSafe returns a copy of the value of the key, see ImmutableTree.GetSafe.
+func (rt *ReadOnlyTree) GetSafe(key []byte) (value []byte, exists bool, err error) {
+	return rt.tree.GetSafe(key)
+}
+
+// Iterate iterates over all keys of the tree, see ImmutableTree.Iterate.
+func (rt *ReadOnlyTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	return rt.tree.Iterate(fn)
+}
+
+// IterateRange iterates over the keys in a range, see
+// ImmutableTree.IterateRange.
+func (rt *ReadOnlyTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	return rt.tree.IterateRange(start, end, ascending, fn)
+}
+
+// Iterator returns an iterator over the keys in a range, see
+// ImmutableTree.Iterator.
+func (rt *ReadOnlyTree) Iterator(start, end []byte, ascending bool) *Iterator {
+	return rt.tree.Iterator(start, end, ascending)
+}
+
+// GetWithProof gets the value of the key with a range proof, see
+// ImmutableTree.GetWithProof.
+func (rt *ReadOnlyTree) GetWithProof(key []byte) (value []byte, proof *RangeProof, err error) {
+	return rt.tree.GetWithProof(key)
+}
+
+// GetRangeWithProof gets the pairs in a range with a proof, see
+// ImmutableTree.GetRangeWithProof.
+func (rt *ReadOnlyTree) GetRangeWithProof(startKey []byte, endKey []byte, limit int) (keys, values [][]byte, proof *RangeProof, err error) {
+	return rt.tree.GetRangeWithProof(startKey, endKey, limit)
+}
+
+// GetWithExistenceProof gets the value of the key with a proof of its
+// existence, see ImmutableTree.GetWithExistenceProof.
+func (rt *ReadOnlyTree) GetWithExistenceProof(key []byte) (value []byte, proof *ExistenceProof, err error) {
+	return rt.tree.GetWithExistenceProof(key)
+}
+
+// GetAbsenceProof returns a proof that the key is not in the tree, see
+// ImmutableTree.GetAbsenceProof.
+func (rt *ReadOnlyTree) GetAbsenceProof(key []byte) (*AbsenceProof, error) {
+	return rt.tree.GetAbsenceProof(key)
+}
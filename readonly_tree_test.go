@@ -0,0 +1,83 @@
+package iavl
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestReadOnlyTree(t *testing.T) {
+	// The read-only tree has no methods to change it.
+	typ := reflect.TypeOf(&ReadOnlyTree{})
+	for _, name := range []string{"Set", "Remove", "SaveVersion", "BatchSet", "RemoveRange"} {
+		_, ok := typ.MethodByName(name)
+		require.False(t, ok, name)
+	}
+
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("saved"))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	saved, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	for i := 0; i < 50; i += 2 {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("working"))
+	}
+
+	// Snapshots of a saved version and of the working tree keep reading the
+	// keys they were taken with while the tree advances.
+	snapshots := map[string]*ReadOnlyTree{
+		"saved":   saved.ReadOnly(),
+		"working": tree.ReadOnly(),
+	}
+	hashes := map[string][]byte{
+		"saved":   saved.Hash(),
+		"working": tree.WorkingHash(),
+	}
+	for i := 0; i < 50; i += 3 {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("later"))
+		tree.Remove([]byte(fmt.Sprintf("key-%02d", i+1)))
+	}
+	tree.Set([]byte("key-50"), []byte("later"))
+	require.NotEqual(t, hashes["working"], tree.WorkingHash())
+
+	for name, snapshot := range snapshots {
+		require.Equal(t, hashes[name], snapshot.Hash(), name)
+		require.EqualValues(t, 50, snapshot.Size(), name)
+		require.EqualValues(t, version, snapshot.Version(), name)
+		has, err := snapshot.Has([]byte("key-50"))
+		require.NoError(t, err)
+		require.False(t, has, name)
+
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			want := "saved"
+			if name == "working" && i%2 == 0 {
+				want = "working"
+			}
+			_, value, err := snapshot.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, want, string(value), "%s %s", name, key)
+
+			_, proof, err := snapshot.GetWithExistenceProof(key)
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(hashes[name]))
+		}
+		absence, err := snapshot.GetAbsenceProof([]byte("key-50"))
+		require.NoError(t, err)
+		require.NoError(t, absence.Verify(hashes[name], []byte("key-50")))
+
+		count := 0
+		_, err = snapshot.Iterate(func(key, value []byte) bool {
+			count++
+			return false
+		})
+		require.NoError(t, err)
+		require.Equal(t, 50, count, name)
+	}
+}
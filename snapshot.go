@@ -0,0 +1,249 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// WriteTo writes a snapshot of the whole tree to w, which can be read back by
+// ReadTree independently of the database the tree is stored in. It returns the
+// number of bytes written.
+//
+// The snapshot starts with the version of the tree and its number of nodes as
+// varints and the root hash prefixed by its length as a uvarint, followed by
+// every node in post-order (left subtree, right subtree, node), each encoded
+// as by writeBytes and prefixed by its length as a uvarint. The hashes of the
+// tree are calculated first, if needed.
+func (t *ImmutableTree) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	root := t.loadRoot()
+
+	var count int64
+	var rootHash []byte
+	if root != nil {
+		rootHash = t.Hash()
+		count = 2*root.size - 1
+	}
+	if err := amino.EncodeVarint(cw, t.version); err != nil {
+		return cw.n, errors.Wrap(err, "writing version")
+	}
+	if err := amino.EncodeVarint(cw, count); err != nil {
+		return cw.n, errors.Wrap(err, "writing node count")
+	}
+	if err := amino.EncodeByteSlice(cw, rootHash); err != nil {
+		return cw.n, errors.Wrap(err, "writing root hash")
+	}
+	if root == nil {
+		return cw.n, nil
+	}
+
+	var buf bytes.Buffer
+	var err error
+	root.traversePost(t, func(node *Node) bool {
+		buf.Reset()
+		if err = node.writeBytes(&buf); err != nil {
+			return true
+		}
+		if err = amino.EncodeByteSlice(cw, buf.Bytes()); err != nil {
+			err = errors.Wrap(err, "writing node")
+			return true
+		}
+		return false
+	})
+	return cw.n, err
+}
+
+// ReadTree reads a snapshot written by ImmutableTree.WriteTo into a new tree,
+// created as by NewImmutableTree. The nodes are kept in memory and are not
+// saved to the database. The tree is validated as by ImmutableTree.Validate,
+// so its hashes are checked against the ones recorded in the snapshot, and its
+// root hash must match the one in the snapshot header.
+func ReadTree(r io.Reader, db dbm.DB, cacheSize int) (*ImmutableTree, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		rb := bufio.NewReader(r)
+		r, br = rb, rb
+	}
+
+	version, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading version")
+	}
+	count, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading node count")
+	}
+	if count < 0 {
+		return nil, errors.Errorf("invalid node count %d", count)
+	}
+	rootHash, err := readByteSlice(r, br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "reading root hash")
+	}
+
+	// Rebuild the tree bottom up: the children of each inner node are the
+	// last two subtrees read.
+	var stack []*Node
+	for i := int64(0); i < count; i++ {
+		length, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading length of node %d", i)
+		}
+		// Don't trust the length to allocate, since it may be corrupted.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+			return nil, errors.Wrapf(err, "reading node %d", i)
+		}
+		node, err := DecodeNode(buf.Bytes())
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding node %d", i)
+		}
+		if !node.isLeaf() {
+			if len(stack) < 2 {
+				return nil, errors.Errorf("missing children of node %d", i)
+			}
+			node.leftNode, node.rightNode = stack[len(stack)-2], stack[len(stack)-1]
+			stack = stack[:len(stack)-2]
+		}
+		stack = append(stack, node)
+	}
+	if len(stack) > 1 {
+		return nil, errors.Errorf("snapshot holds %d trees", len(stack))
+	}
+
+	tree := NewImmutableTree(db, cacheSize)
+	tree.version = version
+	if len(stack) == 1 {
+		tree.storeRoot(stack[0])
+	}
+	if err := tree.Validate(); err != nil {
+		return nil, err
+	}
+	if hash := tree.Hash(); !bytes.Equal(hash, rootHash) {
+		return nil, errors.Errorf("root hash %X does not match snapshot root hash %X", hash, rootHash)
+	}
+	return tree, nil
+}
+
+// kvStreamBatch is the number of pairs LoadKVStream reads before setting them.
+const kvStreamBatch = 1024
+
+// LoadKVStream sets the key/value pairs read from r in the working tree, in
+// order, and returns how many were set. Each pair is a key then a value,
+// each prefixed by its length as a uvarint, as encoded by
+// amino.EncodeByteSlice. The pairs are set in batches: a batch sorted by
+// strictly ascending key is set with BatchSet, which is faster, and any other
+// with Set for each pair.
+//
+// The stream ends cleanly at EOF between two pairs. A truncated pair returns
+// an error wrapping io.ErrUnexpectedEOF, after setting the pairs before it. A
+// pair which can't be set returns the error, and the count includes the pairs
+// set before it: the previous batches, and the pairs before it in its batch
+// unless the batch is sorted.
+func (tree *MutableTree) LoadKVStream(r io.Reader) (count int, err error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		rb := bufio.NewReader(r)
+		r, br = rb, rb
+	}
+
+	kvs := make([]KVPair, 0, kvStreamBatch)
+	for {
+		var kv KVPair
+		kv.Key, err = readByteSlice(r, br)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err == nil {
+			kv.Value, err = readByteSlice(r, br)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil {
+			err = errors.Wrapf(err, "reading pair %d", count+len(kvs))
+			break
+		}
+		kvs = append(kvs, kv)
+		if len(kvs) == kvStreamBatch {
+			set, err := tree.setKVBatch(kvs)
+			count += set
+			if err != nil {
+				return count, err
+			}
+			kvs = kvs[:0]
+		}
+	}
+	set, setErr := tree.setKVBatch(kvs)
+	count += set
+	if setErr != nil {
+		return count, setErr
+	}
+	return count, err
+}
+
+// setKVBatch sets the pairs with BatchSet if they are sorted, or one by one,
+// and returns how many were set: none of a sorted batch if it fails, as with
+// BatchSet, and the pairs before the failed one otherwise.
+func (tree *MutableTree) setKVBatch(kvs []KVPair) (set int, err error) {
+	sorted := true
+	for i := 1; i < len(kvs) && sorted; i++ {
+		sorted = tree.compare(kvs[i-1].Key, kvs[i].Key) < 0
+	}
+	if sorted {
+		if err := tree.BatchSet(kvs); err != nil {
+			return 0, err
+		}
+		return len(kvs), nil
+	}
+	for _, kv := range kvs {
+		if _, err := tree.Set(kv.Key, kv.Value); err != nil {
+			return set, err
+		}
+		set++
+	}
+	return set, nil
+}
+
+// readByteSlice reads a byte slice prefixed by its length as a uvarint. It
+// returns io.EOF only if r ends before the length.
+func readByteSlice(r io.Reader, br io.ByteReader) ([]byte, error) {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	// Don't trust the length to allocate, since it may be corrupted.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if length == 0 {
+		return []byte{}, nil // Empty, not nil, as nil values can't be set.
+	}
+	return buf.Bytes(), nil
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,177 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	amino "github.com/tendermint/go-amino"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree := NewMutableTree(memDB, 0)
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 1000; i += 3 {
+		tree.Remove([]byte(fmt.Sprintf("key-%03d", i)))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Snapshot a saved version, whose nodes are loaded from the database.
+	saved, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	// And the working tree, whose new nodes are in memory.
+	tree.Set([]byte("new"), []byte("value"))
+
+	for _, src := range []*ImmutableTree{saved, tree.ImmutableTree} {
+		var buf bytes.Buffer
+		n, err := src.WriteTo(&buf)
+		require.NoError(t, err)
+		require.EqualValues(t, buf.Len(), n)
+
+		// The snapshot is deterministic.
+		var again bytes.Buffer
+		_, err = src.WriteTo(&again)
+		require.NoError(t, err)
+		require.Equal(t, buf.Bytes(), again.Bytes())
+
+		read, err := ReadTree(&buf, nil, 0)
+		require.NoError(t, err)
+		require.Equal(t, src.Hash(), read.Hash())
+		require.Equal(t, src.Version(), read.Version())
+		require.Equal(t, src.Size(), read.Size())
+		src.Iterate(func(key, value []byte) bool {
+			_, v, _ := read.Get(key)
+			require.Equal(t, value, v)
+			return false
+		})
+	}
+}
+
+func TestSnapshotEmpty(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var buf bytes.Buffer
+	_, err := tree.WriteTo(&buf)
+	require.NoError(t, err)
+
+	read, err := ReadTree(&buf, db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Nil(t, read.Hash())
+	require.EqualValues(t, 0, read.Size())
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	var buf bytes.Buffer
+	_, err := tree.WriteTo(&buf)
+	require.NoError(t, err)
+	snapshot := buf.Bytes()
+
+	// Truncated.
+	for _, n := range []int{0, 1, 2, len(snapshot) / 2, len(snapshot) - 1} {
+		_, err = ReadTree(bytes.NewReader(snapshot[:n]), nil, 0)
+		require.Error(t, err, "truncated to %d bytes", n)
+	}
+
+	// A changed value no longer matches the hashes of its ancestors.
+	corrupted := bytes.Replace(snapshot, []byte("value-3"), []byte("value-X"), 1)
+	require.NotEqual(t, snapshot, corrupted)
+	_, err = ReadTree(bytes.NewReader(corrupted), nil, 0)
+	require.Error(t, err)
+
+	// A changed root version is only caught by the root hash in the header.
+	// The root is the last node, and its version follows its height and size.
+	var root bytes.Buffer
+	require.NoError(t, tree.root.writeBytes(&root))
+	offset := len(snapshot) - root.Len()
+	require.Equal(t, root.Bytes(), snapshot[offset:])
+	corrupted = append([]byte{}, snapshot...)
+	corrupted[offset+2] ^= 0x02
+	_, err = ReadTree(bytes.NewReader(corrupted), nil, 0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "root hash")
+}
+
+func TestLoadKVStream(t *testing.T) {
+	kvs := make([]KVPair, 3000)
+	for i := range kvs {
+		kvs[i] = KVPair{Key: []byte(fmt.Sprintf("key-%04d", i)), Value: []byte(fmt.Sprintf("value-%d", i))}
+	}
+	kvs[10].Value = []byte{}
+	encode := func(kvs []KVPair) []byte {
+		var buf bytes.Buffer
+		for _, kv := range kvs {
+			require.NoError(t, amino.EncodeByteSlice(&buf, kv.Key))
+			require.NoError(t, amino.EncodeByteSlice(&buf, kv.Value))
+		}
+		return buf.Bytes()
+	}
+	expected := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, expected.InitFromSorted(kvs))
+
+	shuffled := make([]KVPair, len(kvs))
+	copy(shuffled, kvs)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+	for name, stream := range map[string][]KVPair{"sorted": kvs, "shuffled": shuffled} {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		count, err := tree.LoadKVStream(bytes.NewReader(encode(stream)))
+		require.NoError(t, err, name)
+		require.Equal(t, len(kvs), count, name)
+		require.Equal(t, expected.Size(), tree.Size(), name)
+		require.NoError(t, tree.Validate(), name)
+		_, err = tree.Iterate(func(key, value []byte) bool {
+			_, expectedValue, err := expected.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, expectedValue, value, name)
+			return false
+		})
+		require.NoError(t, err)
+	}
+
+	// An empty stream sets nothing.
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	count, err := tree.LoadKVStream(bytes.NewReader(nil))
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// A truncated last pair is an error, after setting the pairs before it.
+	encoded := encode(kvs[:5])
+	last := len(encode(kvs[:4]))
+	for i := last + 1; i < len(encoded); i++ {
+		tree := NewMutableTree(db.NewMemDB(), 0)
+		count, err := tree.LoadKVStream(bytes.NewReader(encoded[:i]))
+		require.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err), "truncated to %d bytes", i)
+		require.Equal(t, 4, count)
+		require.EqualValues(t, 4, tree.Size())
+	}
+
+	// A pair which can't be set stops the stream. The pairs set before it in an
+	// unsorted batch are counted, and none of a sorted batch are set.
+	long := append([]KVPair{}, kvs[:10]...)
+	long[6].Value = make([]byte, 100)
+	long[0], long[1] = long[1], long[0]
+	for name, test := range map[string]struct {
+		stream []KVPair
+		count  int
+	}{"sorted": {long[2:], 0}, "unsorted": {long, 6}} {
+		tree := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MaxValueLength: 50})
+		count, err := tree.LoadKVStream(bytes.NewReader(encode(test.stream)))
+		require.Equal(t, ErrValueTooLong, errors.Cause(err), name)
+		require.Equal(t, test.count, count, name)
+		require.EqualValues(t, test.count, tree.Size(), name)
+	}
+}
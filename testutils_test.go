@@ -43,8 +43,12 @@ func N(l, r interface{}) *Node {
 		right = NewNode(i2b(r.(int)), nil, 0)
 	}
 
+	leftmost, err := right.lmd(nil)
+	if err != nil {
+		panic(err)
+	}
 	n := &Node{
-		key:       right.lmd(nil).key,
+		key:       leftmost.key,
 		value:     nil,
 		leftNode:  left,
 		rightNode: right,
@@ -58,7 +62,7 @@ func T(n *Node) *MutableTree {
 	d := db.NewDB("test", db.MemDBBackend, "")
 	t := NewMutableTree(d, 0)
 
-	n.hashWithCount()
+	n.hashWithCount(t.hashFunc())
 	t.root = n
 	return t
 }
@@ -0,0 +1,111 @@
+package iavl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	cmn "github.com/tendermint/iavl/common"
+)
+
+// jsonNode is the JSON representation of a node written by DumpJSON. Leaves
+// have a value, inner nodes their children.
+type jsonNode struct {
+	Key     cmn.HexBytes  `json:"key"`
+	Value   *cmn.HexBytes `json:"value,omitempty"`
+	Height  int8          `json:"height"`
+	Size    int64         `json:"size"`
+	Version int64         `json:"version"`
+	Hash    cmn.HexBytes  `json:"hash"`
+	Left    *jsonNode     `json:"left,omitempty"`
+	Right   *jsonNode     `json:"right,omitempty"`
+}
+
+// DumpJSON writes the structure of the tree as indented JSON, for debugging
+// and for diffing trees in tests and bug reports. Each node has its key, its
+// height, size, version and hash, and either its value or its left and right
+// children nested in it. Byte slices are written in hex. The output is the
+// same for the same tree, and an empty tree is written as null.
+//
+// Like Hash, it computes the hashes of the nodes changed since they were last
+// hashed. The whole tree is loaded in memory.
+func (t *ImmutableTree) DumpJSON(w io.Writer) error {
+	var root *jsonNode
+	if t.root != nil {
+		t.root.hashWithCount(t.hashFunc())
+		var err error
+		if root, err = t.root.toJSON(t); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+// DumpKeys writes the keys of the tree in order, one per line, for quick
+// inspection from the command line. With hexEncode, each key is written in
+// hex. Otherwise, keys which are printable UTF-8 text are written as is, and
+// the others, along with the empty key and keys starting with a double quote,
+// are written quoted as Go strings, which strconv.Unquote reverses, so binary
+// keys never break the lines.
+func (t *ImmutableTree) DumpKeys(w io.Writer, hexEncode bool) error {
+	var err error
+	_, iterErr := t.Iterate(func(key, _ []byte) bool {
+		switch {
+		case hexEncode:
+			_, err = fmt.Fprintf(w, "%X\n", key)
+		case isPrintableKey(key):
+			_, err = fmt.Fprintf(w, "%s\n", key)
+		default:
+			_, err = fmt.Fprintln(w, strconv.Quote(string(key)))
+		}
+		return err != nil
+	})
+	if iterErr != nil {
+		return iterErr
+	}
+	return err
+}
+
+// isPrintableKey returns whether the key can be written as is by DumpKeys.
+func isPrintableKey(key []byte) bool {
+	if len(key) == 0 || key[0] == '"' || !utf8.Valid(key) {
+		return false
+	}
+	for _, r := range string(key) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (node *Node) toJSON(t *ImmutableTree) (*jsonNode, error) {
+	jn := &jsonNode{
+		Key:     node.key,
+		Height:  node.height,
+		Size:    node.size,
+		Version: node.version,
+		Hash:    node.hash,
+	}
+	if node.isLeaf() {
+		value := cmn.HexBytes(node.value)
+		jn.Value = &value
+		return jn, nil
+	}
+	left, right, err := node.getChildren(t)
+	if err != nil {
+		return nil, err
+	}
+	if jn.Left, err = left.toJSON(t); err != nil {
+		return nil, err
+	}
+	if jn.Right, err = right.toJSON(t); err != nil {
+		return nil, err
+	}
+	return jn, nil
+}
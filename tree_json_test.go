@@ -0,0 +1,130 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestDumpJSON(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var buf bytes.Buffer
+	require.NoError(t, tree.DumpJSON(&buf))
+	require.Equal(t, "null\n", buf.String())
+
+	tree.Set([]byte{0x01}, []byte{0xaa})
+	tree.Set([]byte{0x02}, []byte{})
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte{0x03}, []byte{0xcc})
+
+	buf.Reset()
+	require.NoError(t, tree.DumpJSON(&buf))
+	require.Equal(t, `{
+  "key": "02",
+  "height": 2,
+  "size": 3,
+  "version": 2,
+  "hash": "63D3CE9C5E4D0AEFD79473480188551F64C60E8D9156CB033A5AC1E899AE2657",
+  "left": {
+    "key": "01",
+    "value": "AA",
+    "height": 0,
+    "size": 1,
+    "version": 1,
+    "hash": "AFCCE10EC3076F79373EA20AAF49CA16E5545249BA0D6B30F4B8C6C61FACDB93"
+  },
+  "right": {
+    "key": "03",
+    "height": 1,
+    "size": 2,
+    "version": 2,
+    "hash": "071A7223561DE6D59AB0B367D07285DE73E50A2FE676AB36405244FA872A72E2",
+    "left": {
+      "key": "02",
+      "value": "",
+      "height": 0,
+      "size": 1,
+      "version": 1,
+      "hash": "2FE8CE8D1365995EDDAD13914897B186AAAED219A3A5D87EEDD817527263680D"
+    },
+    "right": {
+      "key": "03",
+      "value": "CC",
+      "height": 0,
+      "size": 1,
+      "version": 2,
+      "hash": "FC1B8D66F2674C9E65AC5C39FD81A1BAD40751329D1D594E22ECED5408E3A87F"
+    }
+  }
+}
+`, buf.String())
+
+	// The same tree loaded from the database gives the same output.
+	loaded, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	tree.Rollback()
+	var expected, actual bytes.Buffer
+	require.NoError(t, tree.DumpJSON(&expected))
+	require.NoError(t, loaded.DumpJSON(&actual))
+	require.Equal(t, expected.String(), actual.String())
+}
+
+func TestDumpKeys(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	var buf bytes.Buffer
+	require.NoError(t, tree.DumpKeys(&buf, false))
+	require.Empty(t, buf.String())
+
+	keys := [][]byte{
+		{},
+		{0x00, 0xff},
+		[]byte("\"quoted\""),
+		[]byte("line\nbreak"),
+		[]byte("plain key"),
+		[]byte("ünïcode"),
+		{0xc3, 0x28}, // Invalid UTF-8.
+	}
+	for _, key := range keys {
+		tree.Set(key, []byte{})
+	}
+	var expected [][]byte
+	tree.Iterate(func(key, _ []byte) bool {
+		expected = append(expected, key)
+		return false
+	})
+
+	// Hex keys round-trip.
+	buf.Reset()
+	require.NoError(t, tree.DumpKeys(&buf, true))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, len(keys))
+	for i, line := range lines {
+		key, err := hex.DecodeString(line)
+		require.NoError(t, err)
+		require.Equal(t, expected[i], key)
+	}
+
+	// Printable keys are written as is, and the others quoted, one per line.
+	buf.Reset()
+	require.NoError(t, tree.DumpKeys(&buf, false))
+	lines = strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, len(keys))
+	for i, line := range lines {
+		key := line
+		if strings.HasPrefix(line, `"`) {
+			var err error
+			key, err = strconv.Unquote(line)
+			require.NoError(t, err)
+		}
+		require.Equal(t, string(expected[i]), key)
+	}
+	require.Contains(t, lines, "plain key")
+	require.Contains(t, lines, "ünïcode")
+	require.Contains(t, lines, `"\"quoted\""`)
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	cmn "github.com/tendermint/iavl/common"
@@ -130,7 +131,7 @@ func TestVersionedRandomTreeSmallKeys(t *testing.T) {
 
 	// Try getting random keys.
 	for i := 0; i < keysPerVersion; i++ {
-		_, val := tree.Get([]byte(cmn.RandStr(1)))
+		_, val, _ := tree.Get([]byte(cmn.RandStr(1)))
 		require.NotNil(val)
 		require.NotEmpty(val)
 	}
@@ -171,12 +172,65 @@ func TestVersionedRandomTreeSmallKeysRandomDeletes(t *testing.T) {
 
 	// Try getting random keys.
 	for i := 0; i < keysPerVersion; i++ {
-		_, val := tree.Get([]byte(cmn.RandStr(1)))
+		_, val, _ := tree.Get([]byte(cmn.RandStr(1)))
 		require.NotNil(val)
 		require.NotEmpty(val)
 	}
 }
 
+func TestVersionedTreeDeleteVersionsRetainedLoad(t *testing.T) {
+	require := require.New(t)
+	d := db.NewMemDB()
+	tree := NewMutableTree(d, 0)
+
+	versions := 20
+	expected := map[int64]map[string]string{}
+	for i := 1; i <= versions; i++ {
+		for j := 0; j < 20; j++ {
+			k := cmn.RandStr(1)
+			if j%4 == 3 {
+				tree.Remove([]byte(k))
+			} else {
+				tree.Set([]byte(k), []byte(cmn.RandStr(8)))
+			}
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(err)
+		expected[version] = map[string]string{}
+		tree.Iterate(func(key, value []byte) bool {
+			expected[version][string(key)] = string(value)
+			return false
+		})
+	}
+
+	for _, i := range cmn.RandPerm(versions - 1) {
+		require.NoError(tree.DeleteVersion(int64(i + 1)))
+		delete(expected, int64(i+1))
+
+		// Every retained version must load in full from a fresh tree, and the
+		// stored nodes must be exactly the ones they reference.
+		fresh := NewMutableTree(d, 0)
+		_, err := fresh.Load()
+		require.NoError(err)
+		reachable := map[string]bool{}
+		for version, kvs := range expected {
+			itree, err := fresh.GetImmutable(version)
+			require.NoError(err)
+			actual := map[string]string{}
+			itree.Iterate(func(key, value []byte) bool {
+				actual[string(key)] = string(value)
+				return false
+			})
+			require.Equal(kvs, actual, "version %d", version)
+			itree.root.traverse(itree, true, func(node *Node) bool {
+				reachable[string(node.hash)] = true
+				return false
+			})
+		}
+		require.Len(fresh.ndb.nodes(), len(reachable))
+	}
+}
+
 func TestVersionedTreeSpecial1(t *testing.T) {
 	tree := NewMutableTree(db.NewMemDB(), 100)
 
@@ -358,9 +412,11 @@ func TestVersionedTree(t *testing.T) {
 	// key2 = val2
 	// -----------
 
+	// Besides the leaves, the inner nodes on their paths are orphaned, including
+	// the parent of key1 which is replaced by its sibling.
 	nodes3 := tree.ndb.leafNodes()
 	require.Len(nodes3, 6, "wrong number of nodes")
-	require.Len(tree.ndb.orphans(), 6, "wrong number of orphans")
+	require.Len(tree.ndb.orphans(), 7, "wrong number of orphans")
 
 	hash4, _, _ := tree.SaveVersion()
 	require.EqualValues(hash3, hash4)
@@ -380,42 +436,42 @@ func TestVersionedTree(t *testing.T) {
 	tree.Set([]byte("key1"), []byte("val0"))
 
 	// "key2"
-	_, val := tree.GetVersioned([]byte("key2"), 0)
+	_, val, _ := tree.GetVersioned([]byte("key2"), 0)
 	require.Nil(val)
 
-	_, val = tree.GetVersioned([]byte("key2"), 1)
+	_, val, _ = tree.GetVersioned([]byte("key2"), 1)
 	require.Equal("val0", string(val))
 
-	_, val = tree.GetVersioned([]byte("key2"), 2)
+	_, val, _ = tree.GetVersioned([]byte("key2"), 2)
 	require.Equal("val1", string(val))
 
-	_, val = tree.Get([]byte("key2"))
+	_, val, _ = tree.Get([]byte("key2"))
 	require.Equal("val2", string(val))
 
 	// "key1"
-	_, val = tree.GetVersioned([]byte("key1"), 1)
+	_, val, _ = tree.GetVersioned([]byte("key1"), 1)
 	require.Equal("val0", string(val))
 
-	_, val = tree.GetVersioned([]byte("key1"), 2)
+	_, val, _ = tree.GetVersioned([]byte("key1"), 2)
 	require.Equal("val1", string(val))
 
-	_, val = tree.GetVersioned([]byte("key1"), 3)
+	_, val, _ = tree.GetVersioned([]byte("key1"), 3)
 	require.Nil(val)
 
-	_, val = tree.GetVersioned([]byte("key1"), 4)
+	_, val, _ = tree.GetVersioned([]byte("key1"), 4)
 	require.Nil(val)
 
-	_, val = tree.Get([]byte("key1"))
+	_, val, _ = tree.Get([]byte("key1"))
 	require.Equal("val0", string(val))
 
 	// "key3"
-	_, val = tree.GetVersioned([]byte("key3"), 0)
+	_, val, _ = tree.GetVersioned([]byte("key3"), 0)
 	require.Nil(val)
 
-	_, val = tree.GetVersioned([]byte("key3"), 2)
+	_, val, _ = tree.GetVersioned([]byte("key3"), 2)
 	require.Equal("val1", string(val))
 
-	_, val = tree.GetVersioned([]byte("key3"), 3)
+	_, val, _ = tree.GetVersioned([]byte("key3"), 3)
 	require.Equal("val1", string(val))
 
 	// Delete a version. After this the keys in that version should not be found.
@@ -434,26 +490,26 @@ func TestVersionedTree(t *testing.T) {
 	nodes5 := tree.ndb.leafNodes()
 	require.True(len(nodes5) < len(nodes4), "db should have shrunk after delete %d !< %d", len(nodes5), len(nodes4))
 
-	_, val = tree.GetVersioned([]byte("key2"), 2)
+	_, val, _ = tree.GetVersioned([]byte("key2"), 2)
 	require.Nil(val)
 
-	_, val = tree.GetVersioned([]byte("key3"), 2)
+	_, val, _ = tree.GetVersioned([]byte("key3"), 2)
 	require.Nil(val)
 
 	// But they should still exist in the latest version.
 
-	_, val = tree.Get([]byte("key2"))
+	_, val, _ = tree.Get([]byte("key2"))
 	require.Equal("val2", string(val))
 
-	_, val = tree.Get([]byte("key3"))
+	_, val, _ = tree.Get([]byte("key3"))
 	require.Equal("val1", string(val))
 
 	// Version 1 should still be available.
 
-	_, val = tree.GetVersioned([]byte("key1"), 1)
+	_, val, _ = tree.GetVersioned([]byte("key1"), 1)
 	require.Equal("val0", string(val))
 
-	_, val = tree.GetVersioned([]byte("key2"), 1)
+	_, val, _ = tree.GetVersioned([]byte("key2"), 1)
 	require.Equal("val0", string(val))
 }
 
@@ -522,16 +578,16 @@ func TestVersionedTreeOrphanDeleting(t *testing.T) {
 
 	tree.DeleteVersion(2)
 
-	_, val := tree.Get([]byte("key0"))
+	_, val, _ := tree.Get([]byte("key0"))
 	require.Equal(t, val, []byte("val2"))
 
-	_, val = tree.Get([]byte("key1"))
+	_, val, _ = tree.Get([]byte("key1"))
 	require.Nil(t, val)
 
-	_, val = tree.Get([]byte("key2"))
+	_, val, _ = tree.Get([]byte("key2"))
 	require.Equal(t, val, []byte("val2"))
 
-	_, val = tree.Get([]byte("key3"))
+	_, val, _ = tree.Get([]byte("key3"))
 	require.Equal(t, val, []byte("val1"))
 
 	tree.DeleteVersion(1)
@@ -556,7 +612,7 @@ func TestVersionedTreeSpecialCase(t *testing.T) {
 
 	tree.DeleteVersion(2)
 
-	_, val := tree.GetVersioned([]byte("key2"), 1)
+	_, val, _ := tree.GetVersioned([]byte("key2"), 1)
 	require.Equal("val0", string(val))
 }
 
@@ -583,7 +639,7 @@ func TestVersionedTreeSpecialCase2(t *testing.T) {
 
 	require.NoError(tree.DeleteVersion(2))
 
-	_, val := tree.GetVersioned([]byte("key2"), 1)
+	_, val, _ := tree.GetVersioned([]byte("key2"), 1)
 	require.Equal("val0", string(val))
 }
 
@@ -684,7 +740,7 @@ func TestVersionedTreeErrors(t *testing.T) {
 	require.Error(tree.DeleteVersion(1))
 
 	// Trying to get a key from a version which doesn't exist.
-	_, val := tree.GetVersioned([]byte("key"), 404)
+	_, val, _ := tree.GetVersioned([]byte("key"), 404)
 	require.Nil(val)
 
 	// Same thing with proof. We get an error because a proof couldn't be
@@ -725,7 +781,7 @@ func TestVersionedCheckpoints(t *testing.T) {
 	// Make sure all keys exist at least once.
 	for _, ks := range keys {
 		for _, k := range ks {
-			_, val := tree.Get(k)
+			_, val, _ := tree.Get(k)
 			require.NotEmpty(val)
 		}
 	}
@@ -734,7 +790,7 @@ func TestVersionedCheckpoints(t *testing.T) {
 	for i := 1; i <= versions; i++ {
 		if i%versionsPerCheckpoint != 0 {
 			for _, k := range keys[int64(i)] {
-				_, val := tree.GetVersioned(k, int64(i))
+				_, val, _ := tree.GetVersioned(k, int64(i))
 				require.Nil(val)
 			}
 		}
@@ -744,7 +800,7 @@ func TestVersionedCheckpoints(t *testing.T) {
 	for i := 1; i <= versions; i++ {
 		for _, k := range keys[int64(i)] {
 			if i%versionsPerCheckpoint == 0 {
-				_, val := tree.GetVersioned(k, int64(i))
+				_, val, _ := tree.GetVersioned(k, int64(i))
 				require.NotEmpty(val)
 			}
 		}
@@ -772,7 +828,7 @@ func TestVersionedCheckpointsSpecialCase(t *testing.T) {
 	// checkpoint, which is version 10.
 	tree.DeleteVersion(1)
 
-	_, val := tree.GetVersioned(key, 2)
+	_, val, _ := tree.GetVersioned(key, 2)
 	require.NotEmpty(val)
 	require.Equal([]byte("val1"), val)
 }
@@ -833,19 +889,19 @@ func TestVersionedCheckpointsSpecialCase4(t *testing.T) {
 	tree.Set([]byte("X"), []byte("New"))
 	tree.SaveVersion()
 
-	_, val := tree.GetVersioned([]byte("A"), 2)
+	_, val, _ := tree.GetVersioned([]byte("A"), 2)
 	require.Nil(t, val)
 
-	_, val = tree.GetVersioned([]byte("A"), 1)
+	_, val, _ = tree.GetVersioned([]byte("A"), 1)
 	require.NotEmpty(t, val)
 
 	tree.DeleteVersion(1)
 	tree.DeleteVersion(2)
 
-	_, val = tree.GetVersioned([]byte("A"), 2)
+	_, val, _ = tree.GetVersioned([]byte("A"), 2)
 	require.Nil(t, val)
 
-	_, val = tree.GetVersioned([]byte("A"), 1)
+	_, val, _ = tree.GetVersioned([]byte("A"), 1)
 	require.Nil(t, val)
 }
 
@@ -1107,12 +1163,12 @@ func TestCopyValueSemantics(t *testing.T) {
 	val := []byte("v1")
 
 	tree.Set([]byte("k"), val)
-	_, v := tree.Get([]byte("k"))
+	_, v, _ := tree.Get([]byte("k"))
 	require.Equal([]byte("v1"), v)
 
 	val[1] = '2'
 
-	_, val = tree.Get([]byte("k"))
+	_, val, _ = tree.Get([]byte("k"))
 	require.Equal([]byte("v2"), val)
 }
 
@@ -1135,13 +1191,13 @@ func TestRollback(t *testing.T) {
 
 	require.Equal(int64(2), tree.Size())
 
-	_, val := tree.Get([]byte("r"))
+	_, val, _ := tree.Get([]byte("r"))
 	require.Nil(val)
 
-	_, val = tree.Get([]byte("s"))
+	_, val, _ = tree.Get([]byte("s"))
 	require.Nil(val)
 
-	_, val = tree.Get([]byte("t"))
+	_, val, _ = tree.Get([]byte("t"))
 	require.Equal([]byte("v"), val)
 }
 
@@ -1166,7 +1222,7 @@ func TestLazyLoadVersion(t *testing.T) {
 	require.NoError(t, err, "unexpected error when lazy loading version")
 	require.Equal(t, version, int64(maxVersions))
 
-	_, value := tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions)))
+	_, value, _ := tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions)))
 	require.Equal(t, value, []byte(fmt.Sprintf("value_%d", maxVersions)), "unexpected value")
 
 	// require the ability to lazy load an older version
@@ -1174,7 +1230,7 @@ func TestLazyLoadVersion(t *testing.T) {
 	require.NoError(t, err, "unexpected error when lazy loading version")
 	require.Equal(t, version, int64(maxVersions-1))
 
-	_, value = tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions-1)))
+	_, value, _ = tree.Get([]byte(fmt.Sprintf("key_%d", maxVersions-1)))
 	require.Equal(t, value, []byte(fmt.Sprintf("value_%d", maxVersions-1)), "unexpected value")
 
 	// require the inability to lazy load a non-valid version
@@ -1323,3 +1379,190 @@ func BenchmarkTreeLoadAndDelete(b *testing.B) {
 		}
 	})
 }
+
+func TestValidate(t *testing.T) {
+	tree := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, tree.Validate())
+	for i := 0; i < 200; i++ {
+		tree.Set(randBytes(4), randBytes(8))
+		if i%50 == 0 {
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	// Validate the working tree, with unsaved nodes, then the saved one.
+	require.NoError(t, tree.Validate())
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.Validate())
+
+	// An unbalanced tree is rejected even if it is otherwise consistent.
+	unbalanced := T(N(1, N(2, N(3, 4))))
+	err = unbalanced.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unbalanced")
+}
+
+func TestValidateCorrupted(t *testing.T) {
+	setup := func() (db.DB, *Node) {
+		d := db.NewMemDB()
+		tree := NewMutableTree(d, 0)
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		root, err := tree.ndb.GetNode(tree.root.hash)
+		require.NoError(t, err)
+		return d, root
+	}
+	// rewrite rewrites the persisted node under its hash, then validates a
+	// tree freshly loaded from the database.
+	rewrite := func(d db.DB, node *Node, change func(*Node)) error {
+		tree := NewMutableTree(d, 0)
+		change(node)
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		d.Set(tree.ndb.nodeKey(node.hash), buf.Bytes())
+		_, err := tree.Load()
+		require.NoError(t, err)
+		return tree.Validate()
+	}
+
+	testCases := map[string]struct {
+		change func(d db.DB, root *Node) error
+		err    string
+	}{
+		"leaf value": {func(d db.DB, root *Node) error {
+			tree := NewMutableTree(d, 0)
+			leaf := tree.ndb.leafNodes()[3]
+			return rewrite(d, leaf, func(n *Node) { n.value = []byte("other") })
+		}, "hash mismatch"},
+		"leaf version": {func(d db.DB, root *Node) error {
+			tree := NewMutableTree(d, 0)
+			leaf := tree.ndb.leafNodes()[3]
+			return rewrite(d, leaf, func(n *Node) { n.version++ })
+		}, "hash mismatch"},
+		"height": {func(d db.DB, root *Node) error {
+			return rewrite(d, root, func(n *Node) { n.height++ })
+		}, "height"},
+		"size": {func(d db.DB, root *Node) error {
+			return rewrite(d, root, func(n *Node) { n.size++ })
+		}, "size"},
+		"key": {func(d db.DB, root *Node) error {
+			// A key between the two subtrees, which is not the leftmost.
+			return rewrite(d, root, func(n *Node) {
+				key := append([]byte{}, n.key...)
+				key[len(key)-1]--
+				n.key = append(key, 0xff)
+			})
+		}, "leftmost key"},
+		"swapped children": {func(d db.DB, root *Node) error {
+			return rewrite(d, root, func(n *Node) { n.leftHash, n.rightHash = n.rightHash, n.leftHash })
+		}, "out of order"},
+		"missing node": {func(d db.DB, root *Node) error {
+			tree := NewMutableTree(d, 0)
+			d.Delete(tree.ndb.nodeKey(root.leftHash))
+			_, err := tree.Load()
+			require.NoError(t, err)
+			return tree.Validate()
+		}, ErrNodeMissing.Error()},
+	}
+	for name, tc := range testCases {
+		d, root := setup()
+		err := tc.change(d, root)
+		require.Error(t, err, name)
+		require.Contains(t, err.Error(), tc.err, name)
+	}
+}
+
+func TestMissingNode(t *testing.T) {
+	d := db.NewMemDB()
+	tree := NewMutableTree(d, 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	hash := tree.Hash()
+
+	// Drop the left child of the root, as a pruned or corrupted database
+	// would, and reload the tree so that it isn't cached.
+	root, err := tree.ndb.GetNode(hash)
+	require.NoError(t, err)
+	d.Delete(tree.ndb.nodeKey(root.leftHash))
+	tree = NewMutableTree(d, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	missing := []byte("key-00")
+
+	requireMissing := func(err error) {
+		require.Error(t, err)
+		require.Equal(t, ErrNodeMissing, errors.Cause(err))
+	}
+	_, _, err = tree.Get(missing)
+	requireMissing(err)
+	_, err = tree.Has(missing)
+	requireMissing(err)
+	_, err = tree.Iterate(func(key, value []byte) bool { return false })
+	requireMissing(err)
+	_, err = tree.IterateFast(true, func(key, value []byte) bool { return false })
+	requireMissing(err)
+	_, _, err = tree.GetWithProof(missing)
+	requireMissing(err)
+	iter := tree.Iterator(nil, nil, true)
+	require.False(t, iter.Valid())
+	requireMissing(iter.Error())
+
+	// Failed changes leave the working tree as is.
+	_, err = tree.Set(missing, []byte("new"))
+	requireMissing(err)
+	_, _, err = tree.Remove(missing)
+	requireMissing(err)
+	_, err = tree.RemoveRange(nil, nil)
+	requireMissing(err)
+	require.Equal(t, hash, tree.WorkingHash())
+	require.Empty(t, tree.orphans)
+
+	// The right half of the tree can still be read and changed.
+	_, value, err := tree.Get([]byte("key-19"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	_, err = tree.Set([]byte("key-19"), []byte("new"))
+	require.NoError(t, err)
+}
+
+func TestChild(t *testing.T) {
+	d := db.NewMemDB()
+	tree := NewMutableTree(d, 0)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root, err := tree.ndb.GetNode(tree.Hash())
+	require.NoError(t, err)
+	d.Delete(tree.ndb.nodeKey(root.leftHash))
+
+	// Walk the reloaded tree down its right edge, loading each node.
+	tree = NewMutableTree(d, 0)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	node := tree.Root()
+	require.Equal(t, root.hash, node.Hash())
+	for !node.IsLeaf() {
+		child, err := tree.Child(node, false)
+		require.NoError(t, err)
+		require.True(t, child.Height() < node.Height())
+		node = child
+	}
+	require.Equal(t, []byte("key-19"), node.Key())
+	_, err = tree.Child(node, true)
+	require.Error(t, err)
+
+	// The missing left child of the root is an error, not a panic.
+	_, err = tree.Child(tree.Root(), true)
+	require.Equal(t, ErrNodeMissing, errors.Cause(err))
+
+	require.Nil(t, NewMutableTree(db.NewMemDB(), 0).Root())
+}
@@ -27,11 +27,15 @@ func printNode(ndb *nodeDB, node *Node, indent int) {
 	if node.rightNode != nil {
 		printNode(ndb, node.rightNode, indent+1)
 	} else if node.rightHash != nil {
-		rightNode := ndb.GetNode(node.rightHash)
-		printNode(ndb, rightNode, indent+1)
+		rightNode, err := ndb.GetNode(node.rightHash)
+		if err != nil {
+			fmt.Printf("%s    <error: %v>\n", indentPrefix, err)
+		} else {
+			printNode(ndb, rightNode, indent+1)
+		}
 	}
 
-	hash := node._hash()
+	hash := node._hash(ndb.hashFunc())
 	fmt.Printf("%sh:%X\n", indentPrefix, hash)
 	if node.isLeaf() {
 		fmt.Printf("%s%X:%X (%v)\n", indentPrefix, node.key, node.value, node.height)
@@ -40,8 +44,12 @@ func printNode(ndb *nodeDB, node *Node, indent int) {
 	if node.leftNode != nil {
 		printNode(ndb, node.leftNode, indent+1)
 	} else if node.leftHash != nil {
-		leftNode := ndb.GetNode(node.leftHash)
-		printNode(ndb, leftNode, indent+1)
+		leftNode, err := ndb.GetNode(node.leftHash)
+		if err != nil {
+			fmt.Printf("%s    <error: %v>\n", indentPrefix, err)
+		} else {
+			printNode(ndb, leftNode, indent+1)
+		}
 	}
 
 }
@@ -78,6 +86,19 @@ func cpIncr(bz []byte) (ret []byte) {
 	return []byte{0x00}
 }
 
+// Returns the smallest key greater than all the keys starting with prefix, or
+// nil if there is none, i.e. if prefix is empty or made of 0xFF bytes only.
+func prefixEnd(prefix []byte) []byte {
+	end := cp(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < byte(0xFF) {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
 type byteslices [][]byte
 
 func (bz byteslices) Len() int {
@@ -0,0 +1,170 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+	dbm "github.com/tendermint/tm-db"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// WALWriter is a write-ahead log of the database writes of the tree, see
+// MutableTree.SetWAL. Its changes must be durable once its methods return.
+type WALWriter interface {
+	// Append adds a record to the end of the log. A crash while appending
+	// may leave a partial record, which is detected and ignored.
+	Append(record []byte) error
+	// Records returns the records appended since the log was truncated.
+	Records() ([][]byte, error)
+	// Truncate removes all the records of the log.
+	Truncate() error
+}
+
+// Kinds of the writes of a WAL record.
+const (
+	walSet    byte = 1
+	walDelete byte = 2
+)
+
+// walBatch is a batch which also keeps the writes made to it, to log them
+// before they are written.
+type walBatch struct {
+	dbm.Batch
+	record bytes.Buffer // The writes, each a kind, a key and a value for sets.
+	count  uint64       // The number of writes in record.
+}
+
+var _ dbm.Batch = (*walBatch)(nil)
+
+func (b *walBatch) Set(key, value []byte) {
+	b.Batch.Set(key, value)
+	b.record.WriteByte(walSet)
+	b.writeSlice(key)
+	b.writeSlice(value)
+	b.count++
+}
+
+func (b *walBatch) Delete(key []byte) {
+	b.Batch.Delete(key)
+	b.record.WriteByte(walDelete)
+	b.writeSlice(key)
+	b.count++
+}
+
+func (b *walBatch) writeSlice(bz []byte) {
+	if err := amino.EncodeByteSlice(&b.record, bz); err != nil {
+		panic(err) // A bytes.Buffer never fails.
+	}
+}
+
+// encode returns the WAL record of the writes: their count, the writes, and
+// a checksum of both, which a partial record doesn't match.
+func (b *walBatch) encode() []byte {
+	var buf bytes.Buffer
+	if err := amino.EncodeUvarint(&buf, b.count); err != nil {
+		panic(err)
+	}
+	buf.Write(b.record.Bytes())
+	buf.Write(tmhash.Sum(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// applyWALRecord writes the writes of the record to the batch. It returns an
+// error, and writes nothing, if the record is partial or malformed.
+func applyWALRecord(record []byte, batch dbm.SetDeleter) error {
+	if len(record) < tmhash.Size || !bytes.Equal(tmhash.Sum(record[:len(record)-tmhash.Size]), record[len(record)-tmhash.Size:]) {
+		return errors.New("checksum mismatch")
+	}
+	bz := record[:len(record)-tmhash.Size]
+	count, n, err := amino.DecodeUvarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding count")
+	}
+	bz = bz[n:]
+
+	type write struct {
+		kind       byte
+		key, value []byte
+	}
+	writes := make([]write, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(bz) == 0 {
+			return errors.Errorf("missing write #%d", i)
+		}
+		w := write{kind: bz[0]}
+		if w.kind != walSet && w.kind != walDelete {
+			return errors.Errorf("write #%d has unknown kind %d", i, w.kind)
+		}
+		bz = bz[1:]
+		if w.key, n, err = amino.DecodeByteSlice(bz); err != nil {
+			return errors.Wrapf(err, "decoding key of write #%d", i)
+		}
+		bz = bz[n:]
+		if w.kind == walSet {
+			if w.value, n, err = amino.DecodeByteSlice(bz); err != nil {
+				return errors.Wrapf(err, "decoding value of write #%d", i)
+			}
+			bz = bz[n:]
+		}
+		writes = append(writes, w)
+	}
+	if len(bz) > 0 {
+		return errors.Errorf("%d trailing bytes", len(bz))
+	}
+
+	for _, w := range writes {
+		if w.kind == walSet {
+			batch.Set(w.key, w.value)
+		} else {
+			batch.Delete(w.key)
+		}
+	}
+	return nil
+}
+
+// setWAL recovers the writes logged in the WAL, then logs the following ones
+// to it. A complete record was logged before any of its writes were made,
+// some of which may be missing, so they are all made again. A partial one
+// was being logged when the writes were interrupted, so none of them were
+// made, and it is dropped. A nil WAL stops logging.
+func (ndb *nodeDB) setWAL(wal WALWriter) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if _, ok := ndb.db.(*deferredDB); ok {
+		return errors.New("can't set a write-ahead log while commits are deferred")
+	}
+	b, logging := ndb.batch.(*walBatch)
+	if wal == nil {
+		if logging {
+			ndb.batch = b.Batch
+		}
+		ndb.wal = nil
+		return nil
+	}
+
+	records, err := wal.Records()
+	if err != nil {
+		return errors.Wrap(err, "reading write-ahead log")
+	}
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	for _, record := range records {
+		if err := applyWALRecord(record, batch); err != nil {
+			break
+		}
+	}
+	batch.WriteSync()
+	if err := wal.Truncate(); err != nil {
+		return errors.Wrap(err, "truncating write-ahead log")
+	}
+	ndb.latestVersion = 0 // Recovered versions may be later.
+
+	if !logging {
+		ndb.batch = &walBatch{Batch: ndb.batch}
+	}
+	ndb.wal = wal
+	return nil
+}
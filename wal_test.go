@@ -0,0 +1,206 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+var errCrash = errors.New("crash")
+
+// memWAL is a WALWriter in memory, which simulates crashes while appending.
+type memWAL struct {
+	records [][]byte
+	// crash makes Append fail after appending crash bytes of the record, or
+	// all of them if crash is -1, while 0 doesn't crash.
+	crash int
+}
+
+func (w *memWAL) Append(record []byte) error {
+	if w.crash > 0 {
+		record = record[:w.crash]
+	}
+	w.records = append(w.records, append([]byte{}, record...))
+	if w.crash != 0 {
+		return errCrash
+	}
+	return nil
+}
+
+func (w *memWAL) Records() ([][]byte, error) { return w.records, nil }
+
+func (w *memWAL) Truncate() error {
+	w.records = nil
+	return nil
+}
+
+// unsyncedDB is a database whose batches written without syncing are lost, as
+// in an OS crash or power loss right after the write.
+type unsyncedDB struct {
+	db.DB
+}
+
+func (d unsyncedDB) NewBatch() db.Batch { return unsyncedBatch{d.DB.NewBatch()} }
+
+type unsyncedBatch struct {
+	db.Batch
+}
+
+func (unsyncedBatch) Write() {}
+
+// walWrites collects the writes of WAL records.
+type walWrites struct {
+	keys, values [][]byte
+}
+
+func (w *walWrites) Set(key, value []byte) {
+	w.keys, w.values = append(w.keys, key), append(w.values, value)
+}
+
+func (w *walWrites) Delete(key []byte) {
+	w.keys, w.values = append(w.keys, key), append(w.values, nil)
+}
+
+func TestMutableTree_SetWAL(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		crash     int
+		applyHalf bool
+		recovered bool
+	}{
+		{"crash before writing", -1, false, true},
+		{"crash while writing", -1, true, true},
+		{"crash while logging", 100, false, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			memDB := db.NewMemDB()
+			wal := &memWAL{}
+			tree := NewMutableTree(memDB, 0)
+			require.NoError(t, tree.SetWAL(wal))
+			var hashes [][]byte
+			for v := 0; v < 3; v++ {
+				for i := 0; i < 50; i++ {
+					tree.Set([]byte(fmt.Sprintf("key-%d", (v*20+i)%80)), []byte(fmt.Sprintf("value-%d", v)))
+				}
+				if v == 2 {
+					wal.crash = c.crash
+				}
+				hash, _, err := tree.SaveVersion()
+				if v < 2 {
+					require.NoError(t, err)
+					require.Empty(t, wal.records)
+					if v == 1 {
+						// Deleted versions are logged too.
+						require.NoError(t, tree.DeleteVersion(1))
+						require.Empty(t, wal.records)
+					}
+				} else {
+					require.Equal(t, errCrash, errors.Cause(err))
+					require.Len(t, wal.records, 1)
+					hash = tree.WorkingHash()
+				}
+				hashes = append(hashes, hash)
+			}
+			require.False(t, NewMutableTree(memDB, 0).VersionExists(3))
+
+			if c.applyHalf {
+				writes := &walWrites{}
+				require.NoError(t, applyWALRecord(wal.records[0], writes))
+				for i := 0; i < len(writes.keys)/2; i++ {
+					if writes.values[i] == nil {
+						memDB.Delete(writes.keys[i])
+					} else {
+						memDB.Set(writes.keys[i], writes.values[i])
+					}
+				}
+			}
+
+			// Reopening recovers the logged version, or drops the partial one.
+			recovered := NewMutableTree(memDB, 0)
+			require.NoError(t, recovered.SetWAL(wal))
+			require.Empty(t, wal.records)
+			version, err := recovered.Load()
+			require.NoError(t, err)
+			if c.recovered {
+				require.EqualValues(t, 3, version)
+				require.Equal(t, hashes[2], recovered.Hash())
+			} else {
+				require.EqualValues(t, 2, version)
+				require.Equal(t, hashes[1], recovered.Hash())
+			}
+			require.NoError(t, recovered.Validate())
+			_, err = recovered.IntegrityDigest()
+			require.NoError(t, err)
+
+			// The recovered tree logs its own versions.
+			wal.crash = 0
+			recovered.Set([]byte("new"), []byte{})
+			_, _, err = recovered.SaveVersion()
+			require.NoError(t, err)
+			require.Empty(t, wal.records)
+		})
+	}
+}
+
+func TestMutableTree_SetWALRetry(t *testing.T) {
+	memDB := db.NewMemDB()
+	wal := &memWAL{}
+	tree := NewMutableTree(memDB, 100)
+	require.NoError(t, tree.SetWAL(wal))
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("value"))
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// A failed save leaves the tree and its database as they were, so the
+	// version can be changed further and saved again.
+	for i := 0; i < 50; i += 3 {
+		tree.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte("updated"))
+	}
+	wal.crash = -1
+	_, _, err = tree.SaveVersion()
+	require.Equal(t, errCrash, errors.Cause(err))
+	require.EqualValues(t, 1, tree.Version())
+	require.EqualValues(t, 1, tree.ndb.getLatestVersion())
+
+	wal.crash = 0
+	tree.Set([]byte("new"), []byte{})
+	expected := tree.WorkingHash()
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, expected, hash)
+	require.Empty(t, wal.records)
+
+	reloaded := NewMutableTree(memDB, 0)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, reloaded.Hash())
+	require.NoError(t, reloaded.Validate())
+	_, value, err := reloaded.Get([]byte("key-03"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+}
+
+func TestMutableTree_SetWALSync(t *testing.T) {
+	memDB := db.NewMemDB()
+	wal := &memWAL{}
+	tree := NewMutableTree(unsyncedDB{memDB}, 0)
+	require.NoError(t, tree.SetWAL(wal))
+	tree.Set([]byte("key"), []byte("value"))
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Empty(t, wal.records)
+
+	// The log was truncated, so the version must have been synced.
+	recovered := NewMutableTree(memDB, 0)
+	require.NoError(t, recovered.SetWAL(wal))
+	loaded, err := recovered.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, loaded)
+	require.Equal(t, hash, recovered.Hash())
+}